@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+
+	"oauth2-server/internal/admin"
+	"oauth2-server/internal/store/sqlstore"
+	"oauth2-server/pkg/config"
+)
+
+// adminAction is one subcommand of an admin command group, e.g. "clients create"
+type adminAction struct {
+	usage string
+	// args is the number of positional arguments; optional allows omitting them
+	args     int
+	optional bool
+	// setup registers the action's flags and returns the function that runs it
+	setup func(flags *flag.FlagSet) adminRun
+}
+
+type adminRun func(ctx context.Context, api admin.API, args []string) (interface{}, error)
+
+// adminGroups are the command groups that manage a server
+var adminGroups = map[string]map[string]adminAction{
+	"clients": {
+		"list": {usage: "clients list", setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.ListClients(ctx)
+		})},
+		"show": {usage: "clients show <client-id>", args: 1, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.GetClient(ctx, args[0])
+		})},
+		"create": {usage: "clients create -name name [client flags]", setup: setupCreateClient},
+		"update": {usage: "clients update <client-id> [client flags]", args: 1, setup: setupUpdateClient},
+		"delete": {usage: "clients delete <client-id>", args: 1, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			if err := api.DeleteClient(ctx, args[0]); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"deleted": args[0]}, nil
+		})},
+		"rotate-secret": {usage: "clients rotate-secret <client-id>", args: 1, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.RotateClientSecret(ctx, args[0])
+		})},
+	},
+	"users": {
+		"list": {usage: "users list", setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.ListUsers(ctx)
+		})},
+		"show": {usage: "users show <user>", args: 1, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.GetUser(ctx, args[0])
+		})},
+		"create":       {usage: "users create -username name [-password pw] [user flags]", setup: setupCreateUser},
+		"update":       {usage: "users update <user> [user flags]", args: 1, setup: setupUpdateUser},
+		"disable":      {usage: "users disable <user>", args: 1, setup: noFlags(setUserEnabled(false))},
+		"enable":       {usage: "users enable <user>", args: 1, setup: noFlags(setUserEnabled(true))},
+		"set-password": {usage: "users set-password <user> [-password pw]", args: 1, setup: setupSetUserPassword},
+		"reset-mfa": {usage: "users reset-mfa <user>", args: 1, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			if err := api.ResetUserMFA(ctx, args[0]); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"mfa_reset": args[0]}, nil
+		})},
+		"delete-passkey": {usage: "users delete-passkey <user> <passkey-id>", args: 2, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			if err := api.DeleteUserPasskey(ctx, args[0], args[1]); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"passkey_deleted": args[1]}, nil
+		})},
+		"delete": {usage: "users delete <user>", args: 1, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			if err := api.DeleteUser(ctx, args[0]); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"deleted": args[0]}, nil
+		})},
+	},
+	"tokens": {
+		"introspect": {usage: "tokens introspect <token>", args: 1, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.IntrospectToken(ctx, args[0])
+		})},
+		"revoke": {usage: "tokens revoke [<token>] [-user id] [-client id]", args: 1, optional: true, setup: setupRevokeTokens},
+	},
+	"keys": {
+		"list": {usage: "keys list", setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) { return api.ListKeys(ctx) })},
+		"rotate": {usage: "keys rotate", setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.RotateKey(ctx)
+		})},
+	},
+	"lockouts": {
+		"list": {usage: "lockouts list", setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			return api.ListLockouts(ctx)
+		})},
+		"unlock": {usage: "lockouts unlock account|client|ip|user_code <key>", args: 2, setup: noFlags(func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+			if err := api.Unlock(ctx, args[0], args[1]); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"unlocked": args[0] + " " + args[1]}, nil
+		})},
+	},
+}
+
+// adminOptions select the server or storage to manage and the output format
+type adminOptions struct {
+	server       string
+	token        string
+	clientID     string
+	clientSecret string
+	configPath   string
+	realm        string
+	output       string
+}
+
+// register adds the shared flags; defaults come from the environment
+func (o *adminOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.server, "server", os.Getenv("OAUTH2_ADMIN_URL"), "base URL of a running server; without it the configured storage is used directly")
+	flags.StringVar(&o.token, "token", os.Getenv("OAUTH2_ADMIN_TOKEN"), "access token with the admin scope")
+	flags.StringVar(&o.clientID, "client-id", os.Getenv("OAUTH2_ADMIN_CLIENT_ID"), "client that obtains an admin token with client_credentials")
+	flags.StringVar(&o.clientSecret, "client-secret", os.Getenv("OAUTH2_ADMIN_CLIENT_SECRET"), "secret of -client-id")
+	flags.StringVar(&o.configPath, "config", config.FilePath(), "config file naming the storage to use without -server")
+	flags.StringVar(&o.realm, "realm", os.Getenv("OAUTH2_ADMIN_REALM"), "realm to manage instead of the default realm")
+	flags.StringVar(&o.output, "o", "table", "output format: table or json")
+}
+
+// connect returns the admin API of the server, or of the storage backend when
+// no server is given, and a function that releases it
+func (o *adminOptions) connect(ctx context.Context) (admin.API, func(), error) {
+	if o.server != "" {
+		server := strings.TrimSuffix(o.server, "/")
+		if o.realm != "" {
+			server += config.RealmConfig{Name: o.realm}.PathPrefix()
+		}
+		token := o.token
+		if token == "" {
+			if o.clientID == "" || o.clientSecret == "" {
+				return nil, nil, errors.New("-server requires -token or -client-id and -client-secret")
+			}
+			var err error
+			if token, err = admin.FetchToken(ctx, server, o.clientID, o.clientSecret); err != nil {
+				return nil, nil, err
+			}
+		}
+		return admin.NewRemoteClient(server, token), func() {}, nil
+	}
+
+	loaded, err := config.LoadFile(o.configPath)
+	if err == nil {
+		err = loaded.Validate()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load %s: %w", o.configPath, err)
+	}
+	if o.realm != "" {
+		realmConfig, ok := loaded.Realm(o.realm)
+		if !ok {
+			return nil, nil, fmt.Errorf("realm %s is not defined in %s", o.realm, o.configPath)
+		}
+		loaded = realmConfig
+	}
+
+	driver := loaded.Storage.StorageDriver()
+	if driver == config.StorageDriverMemory {
+		return nil, nil, errors.New("the memory storage driver only exists inside the server process, use -server to manage a running server")
+	}
+	backend, err := sqlstore.Open(driver, loaded.Storage.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	return admin.NewService(backend, nil, nil, loaded), func() { backend.Close() }, nil
+}
+
+// runAdminCommand runs an action of an admin command group
+func runAdminCommand(group string, args []string) int {
+	actions := adminGroups[group]
+	if len(args) == 0 {
+		printAdminUsage(group)
+		return 2
+	}
+	action, ok := actions[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", group+" "+args[0])
+		printAdminUsage(group)
+		return 2
+	}
+
+	flags := flag.NewFlagSet(group+" "+args[0], flag.ContinueOnError)
+	var options adminOptions
+	options.register(flags)
+	run := action.setup(flags)
+	positional, err := parseInterspersed(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	if len(positional) != action.args && !(action.optional && len(positional) == 0) {
+		fmt.Fprintf(os.Stderr, "usage: oauth2-server %s\n", action.usage)
+		return 2
+	}
+	if options.output != "table" && options.output != "json" {
+		fmt.Fprintf(os.Stderr, "❌ invalid output format %q: must be table or json\n", options.output)
+		return 2
+	}
+
+	ctx := context.Background()
+	api, release, err := options.connect(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	defer release()
+
+	ctx = admin.WithActor(ctx, cliActor())
+	result, err := run(ctx, api, positional)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	if err := printResult(os.Stdout, options.output, result); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags that may follow positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// printAdminUsage lists the actions of a command group
+func printAdminUsage(group string) {
+	fmt.Fprintf(os.Stderr, "Usage: oauth2-server %s <command> [flags]\n\nCommands:\n", group)
+	for _, name := range sortedKeys(adminGroups[group]) {
+		fmt.Fprintf(os.Stderr, "  %s\n", adminGroups[group][name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun with -h after a command for its flags.")
+}
+
+// cliActor identifies the operator in the audit log of local changes
+func cliActor() string {
+	if current, err := user.Current(); err == nil {
+		return "cli:" + current.Username
+	}
+	return "cli"
+}
+
+// noFlags adapts a run function for actions without their own flags
+func noFlags(run adminRun) func(*flag.FlagSet) adminRun {
+	return func(*flag.FlagSet) adminRun { return run }
+}
+
+// clientFlags are the flags of clients create and update
+type clientFlags struct {
+	id            string
+	secret        string
+	name          string
+	description   string
+	logoURI       string
+	redirectURIs  listFlag
+	grantTypes    listFlag
+	responseTypes listFlag
+	scopes        listFlag
+	audience      listFlag
+	origins       listFlag
+	public        bool
+	authMethod    string
+}
+
+// register adds the client flags
+func (c *clientFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&c.name, "name", "", "client name")
+	flags.StringVar(&c.description, "description", "", "client description")
+	flags.StringVar(&c.logoURI, "logo-uri", "", "logo URL")
+	flags.Var(&c.redirectURIs, "redirect-uri", "redirect URI; repeat or separate with commas")
+	flags.Var(&c.grantTypes, "grant-type", "grant type; repeat or separate with commas")
+	flags.Var(&c.responseTypes, "response-type", "response type; repeat or separate with commas")
+	flags.Var(&c.scopes, "scope", "allowed scope; repeat or separate with commas")
+	flags.Var(&c.audience, "audience", "audience; repeat or separate with commas")
+	flags.Var(&c.origins, "origin", "browser origin allowed to call the token endpoint; repeat or separate with commas")
+	flags.BoolVar(&c.public, "public", false, "public client without a secret")
+	flags.StringVar(&c.authMethod, "auth-method", "", "token endpoint auth method")
+}
+
+// apply copies the flags that were set onto a client
+func (c *clientFlags) apply(flags *flag.FlagSet, client *admin.Client) {
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			client.Name = c.name
+		case "description":
+			client.Description = c.description
+		case "logo-uri":
+			client.LogoURI = c.logoURI
+		case "redirect-uri":
+			client.RedirectURIs = c.redirectURIs
+		case "grant-type":
+			client.GrantTypes = c.grantTypes
+		case "response-type":
+			client.ResponseTypes = c.responseTypes
+		case "scope":
+			client.Scopes = c.scopes
+		case "audience":
+			client.Audience = c.audience
+		case "origin":
+			client.AllowedOrigins = c.origins
+		case "public":
+			client.Public = c.public
+		case "auth-method":
+			client.TokenEndpointAuthMethod = c.authMethod
+		}
+	})
+}
+
+// setupCreateClient creates a client. Without -grant-type, clients with
+// redirect URIs get the authorization code and refresh token grants and
+// other clients the client credentials grant.
+func setupCreateClient(flags *flag.FlagSet) adminRun {
+	var c clientFlags
+	c.register(flags)
+	flags.StringVar(&c.id, "id", "", "client ID; generated when empty")
+	flags.StringVar(&c.secret, "secret", "", "client secret; generated when empty")
+
+	return func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+		client := admin.Client{ID: c.id, Secret: c.secret}
+		if len(c.redirectURIs) > 0 {
+			client.GrantTypes = []string{"authorization_code", "refresh_token"}
+			client.ResponseTypes = []string{"code"}
+		} else {
+			client.GrantTypes = []string{"client_credentials"}
+		}
+		if c.public {
+			client.TokenEndpointAuthMethod = "none"
+		}
+		c.apply(flags, &client)
+		if client.Name == "" {
+			return nil, errors.New("-name is required")
+		}
+		return api.CreateClient(ctx, client)
+	}
+}
+
+// setupUpdateClient changes the given fields of a client and keeps the others
+func setupUpdateClient(flags *flag.FlagSet) adminRun {
+	var c clientFlags
+	c.register(flags)
+
+	return func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+		client, err := api.GetClient(ctx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.apply(flags, client)
+		return api.UpdateClient(ctx, args[0], *client)
+	}
+}
+
+// userFlags are the flags of users create and update
+type userFlags struct {
+	username   string
+	email      string
+	name       string
+	roles      listFlag
+	scopes     listFlag
+	attributes mapFlag
+}
+
+// register adds the user flags
+func (u *userFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&u.username, "username", "", "username used to log in")
+	flags.StringVar(&u.email, "email", "", "email address")
+	flags.StringVar(&u.name, "name", "", "display name")
+	flags.Var(&u.roles, "role", "role; repeat or separate with commas")
+	flags.Var(&u.scopes, "scope", "scope the user may be granted; repeat or separate with commas")
+	flags.Var(&u.attributes, "attr", "attribute as key=value; repeat, an empty value removes the attribute")
+}
+
+// apply copies the flags that were set onto a user
+func (u *userFlags) apply(flags *flag.FlagSet, user *admin.User) {
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "username":
+			user.Username = u.username
+		case "email":
+			user.Email = u.email
+		case "name":
+			user.Name = u.name
+		case "role":
+			user.Roles = u.roles
+		case "scope":
+			user.Scopes = u.scopes
+		case "attr":
+			if user.Attributes == nil {
+				user.Attributes = make(map[string]string)
+			}
+			for key, value := range u.attributes {
+				if value == "" {
+					delete(user.Attributes, key)
+				} else {
+					user.Attributes[key] = value
+				}
+			}
+		}
+	})
+}
+
+// setupCreateUser creates an enabled user
+func setupCreateUser(flags *flag.FlagSet) adminRun {
+	var u userFlags
+	var id, password string
+	u.register(flags)
+	flags.StringVar(&id, "id", "", "user ID; generated when empty")
+	flags.StringVar(&password, "password", "", "password; without it the user cannot log in until one is set")
+
+	return func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+		user := admin.User{ID: id, Password: password, Enabled: true}
+		u.apply(flags, &user)
+		if user.Username == "" {
+			return nil, errors.New("-username is required")
+		}
+		return api.CreateUser(ctx, user)
+	}
+}
+
+// setupUpdateUser changes the given fields of a user and keeps the others
+func setupUpdateUser(flags *flag.FlagSet) adminRun {
+	var u userFlags
+	u.register(flags)
+
+	return func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+		user, err := api.GetUser(ctx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		u.apply(flags, user)
+		return api.UpdateUser(ctx, user.ID, *user)
+	}
+}
+
+// setUserEnabled enables or disables a user; disabling revokes its tokens
+func setUserEnabled(enabled bool) adminRun {
+	return func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+		user, err := api.GetUser(ctx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		user.Enabled = enabled
+		return api.UpdateUser(ctx, user.ID, *user)
+	}
+}
+
+// setupSetUserPassword sets a password given with -password or read from stdin
+func setupSetUserPassword(flags *flag.FlagSet) adminRun {
+	var password string
+	flags.StringVar(&password, "password", "", "new password; read from stdin when empty")
+
+	return func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+		if password == "" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return nil, fmt.Errorf("failed to read the password from stdin: %w", err)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+		if err := api.SetUserPassword(ctx, args[0], password); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"password_set": args[0]}, nil
+	}
+}
+
+// setupRevokeTokens revokes a token or all tokens of a user and/or client
+func setupRevokeTokens(flags *flag.FlagSet) adminRun {
+	var req admin.RevokeRequest
+	flags.StringVar(&req.UserID, "user", "", "revoke the tokens of this user ID")
+	flags.StringVar(&req.ClientID, "client", "", "revoke the tokens of this client ID")
+
+	return func(ctx context.Context, api admin.API, args []string) (interface{}, error) {
+		if len(args) > 0 {
+			req.Token = args[0]
+		}
+		return api.RevokeTokens(ctx, req)
+	}
+}
+
+// listFlag collects repeated or comma separated values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// mapFlag collects repeated key=value pairs
+type mapFlag map[string]string
+
+func (m *mapFlag) String() string {
+	pairs := make([]string, 0, len(*m))
+	for _, key := range sortedKeys(*m) {
+		pairs = append(pairs, key+"="+(*m)[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *mapFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	if *m == nil {
+		*m = make(mapFlag)
+	}
+	(*m)[strings.TrimSpace(key)] = val
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"reflect"
+	"testing"
+
+	"oauth2-server/internal/admin"
+)
+
+// recordingAPI records the clients, users and revocations the admin commands
+// send; the stored client and user are returned by the lookups of updates
+type recordingAPI struct {
+	admin.API
+	client  *admin.Client
+	user    *admin.User
+	revoked *admin.RevokeRequest
+}
+
+func (a *recordingAPI) GetClient(ctx context.Context, id string) (*admin.Client, error) {
+	copied := *a.client
+	return &copied, nil
+}
+
+func (a *recordingAPI) CreateClient(ctx context.Context, client admin.Client) (*admin.Client, error) {
+	a.client = &client
+	return &client, nil
+}
+
+func (a *recordingAPI) UpdateClient(ctx context.Context, id string, client admin.Client) (*admin.Client, error) {
+	a.client = &client
+	return &client, nil
+}
+
+func (a *recordingAPI) GetUser(ctx context.Context, id string) (*admin.User, error) {
+	copied := *a.user
+	copied.Attributes = make(map[string]string)
+	for key, value := range a.user.Attributes {
+		copied.Attributes[key] = value
+	}
+	return &copied, nil
+}
+
+func (a *recordingAPI) CreateUser(ctx context.Context, user admin.User) (*admin.User, error) {
+	a.user = &user
+	return &user, nil
+}
+
+func (a *recordingAPI) UpdateUser(ctx context.Context, id string, user admin.User) (*admin.User, error) {
+	a.user = &user
+	return &user, nil
+}
+
+func (a *recordingAPI) RevokeTokens(ctx context.Context, req admin.RevokeRequest) (*admin.RevokeResult, error) {
+	a.revoked = &req
+	return &admin.RevokeResult{}, nil
+}
+
+// runAdminAction parses args for an action of a command group and runs it
+// against api, the way runAdminCommand does
+func runAdminAction(t *testing.T, api admin.API, group, action string, args ...string) error {
+	t.Helper()
+	flags := flag.NewFlagSet(group+" "+action, flag.ContinueOnError)
+	run := adminGroups[group][action].setup(flags)
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		t.Fatalf("%s %s %v: %v", group, action, args, err)
+	}
+	_, err = run(context.Background(), api, positional)
+	return err
+}
+
+func TestClientFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		args   []string
+		// existing is the client before an update
+		existing *admin.Client
+		want     admin.Client
+	}{
+		{
+			name:   "web client",
+			action: "create",
+			args: []string{"-name", "Web", "-id", "web", "-redirect-uri", "https://app.example.com/callback",
+				"-scope", "openid, profile", "-scope", "api", "-origin", "https://app.example.com,https://www.example.com"},
+			want: admin.Client{
+				ID: "web", Name: "Web",
+				RedirectURIs:   []string{"https://app.example.com/callback"},
+				GrantTypes:     []string{"authorization_code", "refresh_token"},
+				ResponseTypes:  []string{"code"},
+				Scopes:         []string{"openid", "profile", "api"},
+				AllowedOrigins: []string{"https://app.example.com", "https://www.example.com"},
+			},
+		},
+		{
+			name:   "service client",
+			action: "create",
+			args:   []string{"-name", "Service", "-secret", "s3cret", "-audience", "https://api.example.com", "-description", "Batch jobs"},
+			want: admin.Client{
+				Secret: "s3cret", Name: "Service", Description: "Batch jobs",
+				GrantTypes: []string{"client_credentials"},
+				Audience:   []string{"https://api.example.com"},
+			},
+		},
+		{
+			name:   "public client with explicit grant types",
+			action: "create",
+			args: []string{"-name", "Mobile", "-public", "-redirect-uri", "app://callback",
+				"-grant-type", "authorization_code", "-response-type", "code", "-logo-uri", "https://app.example.com/logo.png"},
+			want: admin.Client{
+				Name: "Mobile", LogoURI: "https://app.example.com/logo.png", Public: true, TokenEndpointAuthMethod: "none",
+				RedirectURIs:  []string{"app://callback"},
+				GrantTypes:    []string{"authorization_code"},
+				ResponseTypes: []string{"code"},
+			},
+		},
+		{
+			name:   "update changes only the given flags",
+			action: "update",
+			args:   []string{"web", "-origin", "https://new.example.com", "-auth-method", "client_secret_post"},
+			existing: &admin.Client{
+				ID: "web", Name: "Web", Scopes: []string{"openid"},
+				AllowedOrigins: []string{"https://app.example.com"},
+			},
+			want: admin.Client{
+				ID: "web", Name: "Web", Scopes: []string{"openid"},
+				AllowedOrigins:          []string{"https://new.example.com"},
+				TokenEndpointAuthMethod: "client_secret_post",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &recordingAPI{client: tt.existing}
+			if err := runAdminAction(t, api, "clients", tt.action, tt.args...); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*api.client, tt.want) {
+				t.Errorf("client = %+v, want %+v", *api.client, tt.want)
+			}
+		})
+	}
+
+	if err := runAdminAction(t, &recordingAPI{}, "clients", "create", "-id", "nameless"); err == nil {
+		t.Error("client without -name was created")
+	}
+}
+
+func TestUserFlags(t *testing.T) {
+	api := &recordingAPI{}
+	err := runAdminAction(t, api, "users", "create", "-username", "alice", "-password", "secret",
+		"-email", "alice@example.com", "-role", "admin,auditor", "-attr", "department=IT", "-attr", "locale=nl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := admin.User{
+		Username: "alice", Password: "secret", Email: "alice@example.com", Enabled: true,
+		Roles:      []string{"admin", "auditor"},
+		Attributes: map[string]string{"department": "IT", "locale": "nl"},
+	}
+	if !reflect.DeepEqual(*api.user, want) {
+		t.Fatalf("created user = %+v, want %+v", *api.user, want)
+	}
+
+	// An empty attribute value removes the attribute; the rest is kept
+	api.user.Password = ""
+	if err := runAdminAction(t, api, "users", "update", "alice", "-name", "Alice", "-attr", "locale=", "-scope", "api"); err != nil {
+		t.Fatal(err)
+	}
+	want.Password, want.Name, want.Scopes = "", "Alice", []string{"api"}
+	want.Attributes = map[string]string{"department": "IT"}
+	if !reflect.DeepEqual(*api.user, want) {
+		t.Errorf("updated user = %+v, want %+v", *api.user, want)
+	}
+
+	if err := runAdminAction(t, &recordingAPI{}, "users", "create", "-email", "nobody@example.com"); err == nil {
+		t.Error("user without -username was created")
+	}
+}
+
+func TestRevokeTokenFlags(t *testing.T) {
+	api := &recordingAPI{}
+	if err := runAdminAction(t, api, "tokens", "revoke", "-user", "alice", "-client", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (admin.RevokeRequest{UserID: "alice", ClientID: "web"}); *api.revoked != want {
+		t.Errorf("revoke request = %+v, want %+v", *api.revoked, want)
+	}
+
+	if err := runAdminAction(t, api, "tokens", "revoke", "some-token"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (admin.RevokeRequest{Token: "some-token"}); *api.revoked != want {
+		t.Errorf("revoke request = %+v, want %+v", *api.revoked, want)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"oauth2-server/internal/mockidp"
+	"oauth2-server/pkg/config"
+)
+
+// command is a CLI subcommand; run returns the process exit code
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+// commands are run instead of the server when named as the first argument
+var commands = map[string]command{
+	"serve": {
+		usage: "serve                            start the server (the default)",
+		run:   func([]string) int { serve(); return 0 },
+	},
+	"config": {
+		usage: "config validate|schema           validate config.yaml or print its JSON Schema",
+		run:   configCommand,
+	},
+	"clients": {
+		usage: "clients list|show|create|update|delete|rotate-secret",
+		run:   func(args []string) int { return runAdminCommand("clients", args) },
+	},
+	"users": {
+		usage: "users list|show|create|update|enable|disable|set-password|reset-mfa|delete-passkey|delete",
+		run:   func(args []string) int { return runAdminCommand("users", args) },
+	},
+	"tokens": {
+		usage: "tokens introspect|revoke",
+		run:   func(args []string) int { return runAdminCommand("tokens", args) },
+	},
+	"keys": {
+		usage: "keys list|rotate",
+		run:   func(args []string) int { return runAdminCommand("keys", args) },
+	},
+	"lockouts": {
+		usage: "lockouts list|unlock",
+		run:   func(args []string) int { return runAdminCommand("lockouts", args) },
+	},
+	"mock-idp": {
+		usage: "mock-idp                         run a mock OIDC identity provider for testing",
+		run:   mockIDPCommand,
+	},
+	// Kept for scripts written against the earlier command names
+	"validate-config": {run: validateConfigCommand},
+	"config-schema":   {run: configSchemaCommand},
+}
+
+// runCommand runs the subcommand named by args[0]
+func runCommand(args []string) int {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+	return cmd.run(args[1:])
+}
+
+// printUsage lists the subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: oauth2-server [command]")
+	fmt.Fprintln(w, "Without a command the server is started.")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range []string{"serve", "config", "clients", "users", "tokens", "keys", "lockouts", "mock-idp"} {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(w, "\nThe clients, users, tokens, keys and lockouts commands manage the server at -server")
+	fmt.Fprintln(w, "(OAUTH2_ADMIN_URL) through its admin API, authenticating with -token or")
+	fmt.Fprintln(w, "-client-id/-client-secret of a client with the admin scope. Without -server")
+	fmt.Fprintln(w, "they work on the storage configured in -config. Use -o json for JSON output.")
+}
+
+// mockIDPCommand serves a mock OpenID Connect provider to test the login
+// through identity_providers without a real IdP
+func mockIDPCommand(args []string) int {
+	flags := flag.NewFlagSet("mock-idp", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:9090", "listen address")
+	issuer := flags.String("issuer", "http://localhost:9090", "issuer URL")
+	clientID := flags.String("client-id", "oauth2-server", "client ID of this server at the mock")
+	clientSecret := flags.String("client-secret", "mock-secret", "client secret, empty for a public client")
+	var identity mockidp.Identity
+	flags.StringVar(&identity.Subject, "sub", "mock-user-1", "default subject")
+	flags.StringVar(&identity.Username, "username", "mock.user", "default preferred_username")
+	flags.StringVar(&identity.Email, "email", "mock.user@example.com", "default email")
+	flags.BoolVar(&identity.EmailVerified, "email-verified", true, "whether the email is verified")
+	flags.StringVar(&identity.Name, "name", "Mock User", "default name")
+	groups := flags.String("groups", "", "default groups, comma separated")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *groups != "" {
+		identity.Groups = strings.Split(*groups, ",")
+	}
+
+	server, err := mockidp.New(*issuer, *clientID, *clientSecret, identity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	fmt.Printf("🧪 Mock identity provider %s for client %s on %s\n", *issuer, *clientID, *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// configCommand runs config validate or config schema
+func configCommand(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "validate":
+			return validateConfigCommand(args[1:])
+		case "schema":
+			return configSchemaCommand(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: oauth2-server config validate [-config path]")
+	fmt.Fprintln(os.Stderr, "       oauth2-server config schema")
+	return 2
+}
+
+// validateConfigCommand loads a config file the way the server does, including
+// environment overrides, and prints every problem with its line number
+func validateConfigCommand(args []string) int {
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	path := flags.String("config", config.FilePath(), "config file to validate")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if _, err := os.Stat(*path); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	loaded, err := config.LoadFile(*path)
+	if err == nil {
+		err = loaded.Validate()
+	}
+
+	var validationErr *config.ValidationError
+	switch {
+	case err == nil:
+		fmt.Printf("✅ %s is valid\n", *path)
+		return 0
+	case errors.As(err, &validationErr):
+		for _, problem := range validationErr.Problems {
+			location := *path
+			if problem.Line > 0 {
+				location = fmt.Sprintf("%s:%d", *path, problem.Line)
+			}
+			if problem.Path != "" {
+				fmt.Fprintf(os.Stderr, "%s: %s: %s\n", location, problem.Path, problem.Message)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", location, problem.Message)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "❌ %d problems found\n", len(validationErr.Problems))
+		return 1
+	default:
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+}
+
+// configSchemaCommand prints the JSON Schema of config.yaml
+func configSchemaCommand(args []string) int {
+	schema, err := config.JSONSchema()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	fmt.Println(string(schema))
+	return 0
+}
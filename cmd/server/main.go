@@ -2,24 +2,37 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
-	"github.com/ory/fosite/storage"
 	"github.com/sirupsen/logrus" // Add this import
 
+	"oauth2-server/internal/admin"
+	"oauth2-server/internal/audit"
 	"oauth2-server/internal/auth"
+	"oauth2-server/internal/certs"
 	"oauth2-server/internal/flows"
 	"oauth2-server/internal/handlers"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/middleware"
+	"oauth2-server/internal/ratelimit"
+	"oauth2-server/internal/reload"
+	"oauth2-server/internal/scheduler"
+	"oauth2-server/internal/scim"
 	"oauth2-server/internal/store"
+	"oauth2-server/internal/store/sqlstore"
 	"oauth2-server/internal/utils"
 	"oauth2-server/pkg/config"
 )
@@ -31,41 +44,31 @@ var (
 	// Application configuration
 	cfg *config.Config
 
-	// OAuth2 provider and stores
-	oauth2Provider fosite.OAuth2Provider
-	clientStore    *store.ClientStore
-	authCodeStore  *store.AuthCodeStore
-	tokenStore     *store.TokenStore
+	// Realms served by this process; the first is the default realm at the root
+	realms []*realm
 
-	// OAuth2 flows
-	authCodeFlow      *flows.AuthorizationCodeFlow
-	clientCredsFlow   *flows.ClientCredentialsFlow
-	refreshTokenFlow  *flows.RefreshTokenFlow
-	tokenExchangeFlow *flows.TokenExchangeFlow
-	deviceCodeFlow    *flows.DeviceCodeFlow
+	// Background jobs (cleanup, snapshots, certificate reload)
+	jobScheduler *scheduler.Scheduler
 
-	// Documentation handler
-	docsHandler *handlers.DocsHandler
+	// Serves the TLS certificate and picks up renewed files
+	certReloader *certs.Reloader
 
-	// Token handlers
-	tokenHandlers *handlers.TokenHandlers
+	// Applies client and user changes of config.yaml without a restart
+	configReloader *reload.Reloader
 
-	// Registration handler
-	registrationHandlers *handlers.RegistrationHandlers
+	// Set while in-flight requests drain so the readiness probe takes the pod out of rotation
+	shuttingDown atomic.Bool
 )
 
-// CompositeStore combines our custom ClientStore with Fosite's MemoryStore
-type CompositeStore struct {
-	*store.ClientStore
-	*storage.MemoryStore
-}
-
-// GetClient implements fosite.ClientManager
-func (c *CompositeStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
-	return c.ClientStore.GetClient(ctx, id)
+func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	serve()
 }
 
-func main() {
+// serve runs the server until SIGINT or SIGTERM
+func serve() {
 	log.Println("🚀 Starting OAuth2 Server...")
 
 	// Load configuration from YAML
@@ -77,6 +80,14 @@ func main() {
 
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
+		// Report each problem on its own line so none is lost in a wrapped message
+		var validationErr *config.ValidationError
+		if errors.As(err, &validationErr) && len(validationErr.Problems) > 1 {
+			for _, problem := range validationErr.Problems {
+				log.Errorf("❌ %s", problem)
+			}
+			log.Fatalf("❌ Invalid configuration: %d problems", len(validationErr.Problems))
+		}
 		log.Fatalf("❌ Invalid configuration: %v", err)
 	}
 
@@ -108,25 +119,17 @@ func main() {
 		})
 	}
 
+	// Security events are written to the audit log when enabled
+	audit.SetEnabled(enableAudit)
+
 	log.Printf("✅ Configuration loaded successfully")
 	log.Printf("🔧 Log Level: %s, Format: %s, Audit: %t", logLevel, logFormat, enableAudit)
 
-	// Initialize stores
-	clientStore = store.NewClientStore()
-	tokenStore = store.NewTokenStore()
-
-	// Load clients from configuration
-	if err := clientStore.LoadClientsFromConfig(cfg.Clients); err != nil {
-		log.Fatalf("❌ Failed to load clients from config: %v", err)
+	// Initialize the default realm and the configured realms
+	if err := initializeRealms(); err != nil {
+		log.Fatalf("❌ Failed to initialize realms: %v", err)
 	}
-
-	// Initialize OAuth2 provider
-	if err := initializeOAuth2Provider(); err != nil {
-		log.Fatalf("❌ Failed to initialize OAuth2 provider: %v", err)
-	}
-
-	// Initialize flows
-	initializeFlows()
+	defer closeRealms()
 
 	// Setup routes
 	setupRoutes()
@@ -139,54 +142,354 @@ func main() {
 	log.Printf("🔧 Client registration: %s/register", cfg.Server.BaseURL)
 	log.Printf("🏥 Health check: %s/health", cfg.Server.BaseURL)
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.Port), nil); err != nil {
-		log.Fatalf("❌ Server failed to start: %v", err)
+	servers := []*http.Server{newHTTPServer(cfg.Server.Port)}
+	if cfg.Server.TLS.Enabled() {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			log.Fatalf("❌ Failed to configure TLS: %v", err)
+		}
+		if cfg.Server.TLS.Port == 0 {
+			servers[0].TLSConfig = tlsConfig
+			log.Printf("🔐 Serving HTTPS on port %d", cfg.Server.Port)
+		} else {
+			tlsServer := newHTTPServer(cfg.Server.TLS.Port)
+			tlsServer.TLSConfig = tlsConfig
+			servers = append(servers, tlsServer)
+			log.Printf("🔐 Serving HTTPS on port %d", cfg.Server.TLS.Port)
+		}
+	}
+	if cfg.Security.RequireHTTPS && !cfg.Server.TLS.Enabled() && len(cfg.Proxy.TrustedProxies) == 0 {
+		log.Printf("⚠️ require_https is set without TLS or trusted proxies, protected endpoints will reject every request")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start background jobs
+	initializeJobs()
+	jobScheduler.Start(ctx)
+	go reloadOnSIGHUP(ctx)
+
+	serverErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				// The certificate comes from TLSConfig.GetCertificate
+				serverErr <- server.ListenAndServeTLS("", "")
+				return
+			}
+			serverErr <- server.ListenAndServe()
+		}(server)
+	}
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			jobScheduler.Stop()
+			log.Fatalf("❌ Server failed to start: %v", err)
+		}
+	case <-ctx.Done():
 	}
+
+	shutdown(servers)
 }
 
-func initializeStores() {
-	clientStore = store.NewClientStore()
-	authCodeStore = store.NewAuthCodeStore()
-	tokenStore = store.NewTokenStore()
+// reloadOnSIGHUP reloads clients and users from the config file on SIGHUP
+func reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("🔄 SIGHUP received, reloading %s", config.FilePath())
+			// Failures are logged and audited by the reloader
+			configReloader.Reload(ctx)
+		}
+	}
 }
 
-func initializeOAuth2Provider() error {
-	// Generate RSA key for JWT signing
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// newHTTPServer creates a server for the port with the configured timeouts
+func newHTTPServer(port int) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		ReadTimeout:       cfg.Server.ReadTimeoutDuration(),
+		ReadHeaderTimeout: cfg.Server.ReadTimeoutDuration(),
+		WriteTimeout:      cfg.Server.WriteTimeoutDuration(),
+		IdleTimeout:       2 * cfg.Server.ReadTimeoutDuration(),
+	}
+}
+
+// newTLSConfig loads the certificate and applies the configured protocol policy
+func newTLSConfig() (*tls.Config, error) {
+	minVersion, err := cfg.Server.TLS.TLSMinVersion()
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := cfg.Server.TLS.CipherSuiteIDs()
 	if err != nil {
-		return fmt.Errorf("failed to generate RSA key: %w", err)
+		return nil, err
 	}
 
-	// Create memory store for non-client data (sessions, codes, etc.)
-	memoryStore := storage.NewMemoryStore()
+	certReloader, err = certs.NewReloader(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: certReloader.GetCertificate,
+	}, nil
+}
 
-	// Create a composite store that uses our clientStore for clients
-	// and memoryStore for everything else
-	compositeStore := &CompositeStore{
-		ClientStore: clientStore,
-		MemoryStore: memoryStore,
+// requireHTTPS rejects plain HTTP on sensitive endpoints of the realm when
+// security.require_https is set
+func (rl *realm) requireHTTPS(handler http.HandlerFunc) http.HandlerFunc {
+	if !rl.cfg.Security.RequireHTTPS {
+		return handler
 	}
+	// Already validated with the configuration
+	trustedProxies, _ := rl.cfg.Proxy.TrustedProxyNetworks()
+	return middleware.RequireHTTPS(trustedProxies)(handler)
+}
+
+// rateLimit throttles a protocol endpoint when rate_limit is enabled
+func (rl *realm) rateLimit(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	if !rl.cfg.RateLimit.Enabled {
+		return handler
+	}
+	// Already validated with the configuration
+	trustedProxies, _ := rl.cfg.Proxy.TrustedProxyNetworks()
+	return middleware.RateLimit(rl.rateLimiter, endpoint, trustedProxies, rl.verifiedClient)(handler)
+}
+
+// verifiedClient returns the client of a request that authenticates with the
+// correct client secret
+func (rl *realm) verifiedClient(r *http.Request) (string, bool) {
+	clientID, secret, err := utils.ExtractClientCredentials(r)
+	if err != nil || !rl.clientStore.VerifySecret(clientID, secret) {
+		return "", false
+	}
+	return clientID, true
+}
+
+// cors lets browsers call an endpoint from the origins allowed by the client
+// of the request
+func (rl *realm) cors(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return middleware.CORS(middleware.CORSPolicy{
+		Methods:    methods,
+		Headers:    []string{"Authorization", "Content-Type"},
+		Registered: rl.clientStore.OriginRegistered,
+		Allowed: func(r *http.Request, origin string) bool {
+			clientID := rl.requestClientID(r)
+			return clientID != "" && rl.clientStore.ClientAllowsOrigin(clientID, origin)
+		},
+	})(handler)
+}
+
+// publicCORS lets browsers read discovery metadata and keys from any origin
+func publicCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return middleware.CORS(middleware.CORSPolicy{
+		Methods: []string{http.MethodGet},
+		Public:  true,
+	})(handler)
+}
+
+// requestClientID returns the client a request is made for: the client of
+// its bearer token, or the client it authenticates as or names
+func (rl *realm) requestClientID(r *http.Request) string {
+	if token := utils.ExtractBearerToken(r); token != "" {
+		clientID, _, err := rl.accessTokenOwner(r.Context(), token)
+		if err != nil {
+			return ""
+		}
+		return clientID
+	}
+	clientID, _, _ := auth.ExtractClientCredentials(r)
+	return clientID
+}
+
+// accessTokenOwner returns the client and user of a valid access token of the
+// realm, whether the token store or fosite issued it
+func (rl *realm) accessTokenOwner(ctx context.Context, token string) (clientID, userID string, err error) {
+	if tokenInfo, err := rl.tokenStore.ValidateAccessToken(token); err == nil {
+		return tokenInfo.ClientID, tokenInfo.UserID, nil
+	}
+
+	// Tokens of the authorization code grant are issued by fosite
+	session := &auth.UserSession{}
+	tokenUse, request, err := rl.oauth2Provider.IntrospectToken(ctx, token, fosite.AccessToken, session)
+	if err != nil {
+		return "", "", err
+	}
+	if tokenUse != fosite.AccessToken {
+		return "", "", fosite.ErrInvalidTokenFormat.WithHint("The token is not an access token.")
+	}
+	return request.GetClient().GetID(), session.UserID, nil
+}
+
+// shutdown drains in-flight requests, stops background jobs and persists state
+func shutdown(servers []*http.Server) {
+	log.Printf("🛑 Shutting down, draining requests for up to %s", cfg.Server.ShutdownTimeoutDuration())
+	shuttingDown.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeoutDuration())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("⚠️ Server shutdown incomplete on %s: %v", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	jobScheduler.Stop()
+
+	// Persist the final in-memory state once no more requests are served
+	for _, rl := range realms {
+		if rl.cfg.Storage.Snapshot.Enabled() {
+			if err := jobScheduler.RunNow(context.Background(), rl.jobName("snapshot")); err != nil {
+				log.Printf("❌ Final snapshot%s failed: %v", rl.label(), err)
+			}
+		}
+	}
+
+	log.Printf("👋 Server stopped")
+}
+
+// initializeStores opens the configured storage backend and creates the stores on top of it
+func (rl *realm) initializeStores() error {
+	switch driver := rl.cfg.Storage.StorageDriver(); driver {
+	case config.StorageDriverMemory:
+		memoryBackend := store.NewMemoryBackend()
+		rl.storageBackend = memoryBackend
+
+		if !rl.cfg.Storage.Snapshot.Enabled() {
+			log.Printf("⚠️ Using in-memory storage: state is lost on restart and not shared between replicas")
+			break
+		}
+
+		stats, err := memoryBackend.LoadSnapshot(rl.cfg.Storage.Snapshot.File, rl.cfg.Storage.Snapshot.Key)
+		if err != nil {
+			return fmt.Errorf("failed to load snapshot: %w", err)
+		}
+		log.Printf("💾 Restored snapshot %s: %d clients, %d users, %d groups, %d tokens, %d device grants, %d expired entries skipped",
+			rl.cfg.Storage.Snapshot.File, stats.Clients, stats.Users, stats.Groups, stats.Tokens+stats.Requests, stats.DeviceGrants, stats.Skipped)
+	default:
+		backend, err := sqlstore.Open(driver, rl.cfg.Storage.DSN)
+		if err != nil {
+			return err
+		}
+		rl.storageBackend = backend
+		log.Printf("🗄️ Using %s storage%s", driver, rl.label())
+	}
+
+	rl.lockouts = lockout.NewTracker(rl.cfg)
+	rl.rateLimiter = ratelimit.NewLimiter(rl.storageBackend, rl.cfg)
+	rl.clientStore = store.NewClientStore(rl.storageBackend.Clients())
+	rl.clientStore.UseLockout(rl.lockouts)
+	rl.userStore = store.NewUserStore(rl.storageBackend.Users())
+	rl.tokenStore = store.NewTokenStore(rl.storageBackend.Tokens())
+	rl.tokenStore.UseIssuer(rl.cfg.Server.BaseURL)
+	return nil
+}
+
+// initializeJobs registers the cleanup and snapshot jobs of every realm and
+// the process-wide reload jobs
+func initializeJobs() {
+	jobScheduler = scheduler.NewScheduler()
+	for _, rl := range realms {
+		rl.registerJobs(jobScheduler)
+	}
+
+	if interval := cfg.Server.ConfigReloadIntervalSeconds; interval > 0 {
+		jobScheduler.Register("config_reload", time.Duration(interval)*time.Second, configReloader.ReloadIfChanged)
+	}
+
+	if certReloader != nil {
+		jobScheduler.Register("tls_reload", cfg.Server.TLS.ReloadInterval(), certReloader.Reload)
+	}
+}
+
+// registerJobs registers the cleanup of every store of the realm, the reload
+// of its signing keys and its snapshot job
+func (rl *realm) registerJobs(jobScheduler *scheduler.Scheduler) {
+	interval := rl.cfg.Server.CleanupInterval()
+
+	jobScheduler.Register(rl.jobName("expired_tokens"), interval, rl.tokenStore.CleanupExpiredTokens)
+	jobScheduler.Register(rl.jobName("expired_requests"), interval, func(ctx context.Context) (int, error) {
+		return rl.storageBackend.Requests().DeleteExpiredRequests(ctx, time.Now())
+	})
+	jobScheduler.Register(rl.jobName("expired_device_codes"), interval, rl.deviceCodeFlow.CleanupExpiredDeviceCodes)
+	jobScheduler.Register(rl.jobName("expired_sessions"), interval, func(ctx context.Context) (int, error) {
+		return rl.storageBackend.Sessions().DeleteExpiredSessions(ctx, time.Now())
+	})
+	jobScheduler.Register(rl.jobName("lockouts"), interval, rl.lockouts.Prune)
+	if rl.cfg.RateLimit.Enabled {
+		jobScheduler.Register(rl.jobName("rate_limits"), interval, rl.rateLimiter.Prune)
+	}
+
+	// Replicas sharing a database pick up the keys rotated by another replica
+	if _, ok := rl.storageBackend.(*store.MemoryBackend); !ok {
+		jobScheduler.Register(rl.jobName("signing_keys"), auth.KeyReloadInterval, rl.keyManager.Reload)
+	}
+
+	if memoryBackend, ok := rl.storageBackend.(*store.MemoryBackend); ok && rl.cfg.Storage.Snapshot.Enabled() {
+		snapshot := rl.cfg.Storage.Snapshot
+		jobScheduler.Register(rl.jobName("snapshot"), snapshot.Interval(), func(ctx context.Context) (int, error) {
+			stats, err := memoryBackend.WriteSnapshot(snapshot.File, snapshot.Key)
+			if err != nil {
+				return 0, err
+			}
+			log.Printf("💾 Snapshot written%s: %d clients, %d users, %d groups, %d tokens, %d device grants",
+				rl.label(), stats.Clients, stats.Users, stats.Groups, stats.Tokens+stats.Requests, stats.DeviceGrants)
+			return 0, nil
+		})
+	}
+}
+
+func (rl *realm) initializeOAuth2Provider() error {
+	// Load the RSA keys for JWT signing, generating the first one on first start
+	var err error
+	rl.keyManager, err = auth.LoadKeyManager(context.Background(), rl.cfg.Server.BaseURL, rl.storageBackend.SigningKeys())
+	if err != nil {
+		return err
+	}
+
+	// Codes and fosite-issued tokens live in the configured storage backend
+	fositeStore := store.NewFositeStore(rl.clientStore, rl.storageBackend.Requests())
 
 	// Configure OAuth2 provider
 	config := &fosite.Config{
-		AccessTokenLifespan:      time.Hour,
-		RefreshTokenLifespan:     time.Hour * 24 * 30,
+		AccessTokenLifespan:      rl.cfg.Security.AccessTokenLifetime(),
+		RefreshTokenLifespan:     rl.cfg.Security.RefreshTokenLifetime(),
 		AuthorizeCodeLifespan:    time.Minute * 10,
-		GlobalSecret:             []byte(cfg.Security.JWTSecret + "-padded-to-32-bytes-for-hmac-security"), // Ensure adequate length
-		AccessTokenIssuer:        cfg.Server.BaseURL,
+		GlobalSecret:             []byte(rl.cfg.Security.JWTSecret + "-padded-to-32-bytes-for-hmac-security"), // Ensure adequate length
+		AccessTokenIssuer:        rl.cfg.Server.BaseURL,
+		IDTokenIssuer:            rl.cfg.Server.BaseURL,
+		ClientSecretsHasher:      store.SecretHasher{},
 		ScopeStrategy:            fosite.HierarchicScopeStrategy,
 		AudienceMatchingStrategy: fosite.DefaultAudienceMatchingStrategy,
 	}
 
 	// Build OAuth2 provider with all grant types
-	oauth2Provider = compose.Compose(
+	rl.oauth2Provider = compose.Compose(
 		config,
-		compositeStore,
+		fositeStore,
 		&compose.CommonStrategy{
 			CoreStrategy: compose.NewOAuth2HMACStrategy(config),
 			OpenIDConnectTokenStrategy: compose.NewOpenIDConnectStrategy(
 				func(ctx context.Context) (interface{}, error) {
-					return privateKey, nil
+					return rl.keyManager.SigningKey(), nil
 				},
 				config,
 			),
@@ -202,91 +505,118 @@ func initializeOAuth2Provider() error {
 	return nil
 }
 
-func initializeFlows() {
+func (rl *realm) initializeFlows() error {
 	// Initialize token handlers
-	tokenHandlers = handlers.NewTokenHandlers(clientStore, tokenStore, cfg)
+	trustedIssuers, err := auth.NewTrustedIssuers(rl.cfg.TokenExchange.TrustedIssuers)
+	if err != nil {
+		return fmt.Errorf("failed to load trusted token exchange issuers: %w", err)
+	}
+	// Shared user authentication with lockout for the login form, device
+	// verification and the password grant
+	authenticators, err := auth.NewAuthenticators(rl.cfg.Authentication, rl.userStore)
+	if err != nil {
+		return fmt.Errorf("failed to set up authentication: %w", err)
+	}
+	rl.userAuth = auth.NewUserAuthenticator(rl.userStore, authenticators, rl.lockouts, rl.storageBackend.Requests(), rl.cfg)
 
-	authCodeFlow = flows.NewAuthorizationCodeFlow(oauth2Provider, cfg)
-	clientCredsFlow = flows.NewClientCredentialsFlow(clientStore, tokenStore, cfg)
-	refreshTokenFlow = flows.NewRefreshTokenFlow(clientStore, tokenStore, cfg)
-	tokenExchangeFlow = flows.NewTokenExchangeFlow(clientStore, tokenStore, cfg)
-	deviceCodeFlow = flows.NewDeviceCodeFlow(clientStore, cfg)
+	rl.tokenHandlers = handlers.NewTokenHandlers(rl.clientStore, rl.tokenStore, rl.userStore, rl.keyManager, trustedIssuers, rl.userAuth, rl.cfg)
 
-	// Start cleanup timer for expired device codes
-	deviceCodeFlow.StartCleanupTimer()
+	// Upstream identity providers offered on the login page
+	upstreamProviders := auth.NewUpstreamProviders(rl.cfg.IdentityProviders)
+	rl.authCodeFlow = flows.NewAuthorizationCodeFlow(rl.oauth2Provider, rl.userAuth, upstreamProviders, rl.userStore, rl.storageBackend.Sessions(), rl.storageBackend.Consents(), rl.cfg)
+	rl.clientCredsFlow = flows.NewClientCredentialsFlow(rl.clientStore, rl.tokenStore, rl.cfg)
+	rl.refreshTokenFlow = flows.NewRefreshTokenFlow(rl.clientStore, rl.tokenStore, rl.cfg)
+	rl.tokenExchangeFlow = flows.NewTokenExchangeFlow(rl.clientStore, rl.tokenStore, rl.cfg)
+	rl.deviceCodeFlow = flows.NewDeviceCodeFlow(rl.clientStore, rl.tokenStore, rl.storageBackend.DeviceGrants(), rl.cfg)
 
 	// Initialize documentation handler
-	docsHandler = handlers.NewDocsHandler(cfg, clientStore)
+	rl.docsHandler = handlers.NewDocsHandler(rl.cfg, rl.clientStore, rl.tokenStore)
 
 	// Initialize registration handlers
-	registrationHandlers = handlers.NewRegistrationHandlers(clientStore, cfg)
+	rl.registrationHandlers = handlers.NewRegistrationHandlers(rl.clientStore, rl.cfg)
 
-	log.Printf("✅ OAuth2 flows initialized")
-}
+	// Initialize device verification handlers
+	rl.deviceHandlers = handlers.NewDeviceHandlers(rl.deviceCodeFlow, rl.clientStore, rl.userStore, rl.userAuth, rl.lockouts, rl.cfg)
 
-func setupDefaultClients() {
-	log.Println("🔧 Setting up clients from configuration...")
+	// Initialize the admin API, used by the CLI, and SCIM provisioning on top of it
+	adminService := admin.NewService(rl.storageBackend, rl.keyManager, rl.lockouts, rl.cfg)
+	rl.adminHandlers = handlers.NewAdminHandlers(adminService, rl.tokenStore)
+	rl.scimHandlers = handlers.NewSCIMHandlers(scim.NewService(rl.storageBackend, adminService, rl.cfg), rl.tokenStore, rl.cfg.Server.BaseURL)
 
-	for _, clientConfig := range cfg.Clients {
-		// Convert ClientConfig to models.ClientInfo
-		clientInfo := clientConfig.ToModelsClientInfo()
-		client := store.CreateDefaultClient(clientInfo)
-		if err := clientStore.StoreClient(client); err != nil {
-			log.Printf("❌ Failed to store client %s: %v", clientConfig.ID, err)
-			continue
+	log.Printf("✅ OAuth2 flows initialized%s", rl.label())
+	return nil
+}
+
+// setupRoutes serves the default realm at the root and every other realm under
+// /realms/{name}/ and, when it has its own issuer, on the issuer's host
+func setupRoutes() {
+	for _, rl := range realms[1:] {
+		mux := http.NewServeMux()
+		rl.registerRoutes(mux)
+		http.Handle(rl.prefix+"/", http.StripPrefix(rl.prefix, mux))
+		if rl.host != "" {
+			http.Handle(rl.host+"/", mux)
 		}
-		log.Printf("✅ Client registered: %s (%s)", clientConfig.ID, clientConfig.Name)
 	}
-
-	log.Printf("🎯 %d clients registered successfully", len(cfg.Clients))
+	realms[0].registerRoutes(http.DefaultServeMux)
 }
 
-func setupRoutes() {
+// registerRoutes registers the endpoints of the realm on mux
+func (rl *realm) registerRoutes(mux *http.ServeMux) {
 	// OAuth2 endpoints with proxy awareness
-	http.HandleFunc("/.well-known/oauth-authorization-server", proxyAwareMiddleware(wellKnownHandler))
-	http.HandleFunc("/.well-known/openid_configuration", proxyAwareMiddleware(wellKnownHandler))
-	http.HandleFunc("/.well-known/jwks.json", proxyAwareMiddleware(jwksHandler))
-	http.HandleFunc("/auth", proxyAwareMiddleware(authHandler))
-	http.HandleFunc("/token", proxyAwareMiddleware(tokenHandler))
-	http.HandleFunc("/userinfo", proxyAwareMiddleware(userInfoHandler))
-	http.HandleFunc("/callback", proxyAwareMiddleware(callbackHandler))
-	http.HandleFunc("/revoke", proxyAwareMiddleware(revokeHandler))
-	http.HandleFunc("/introspect", proxyAwareMiddleware(introspectHandler))
+	mux.HandleFunc("/.well-known/oauth-authorization-server", publicCORS(rl.proxyAwareMiddleware(rl.wellKnownHandler)))
+	mux.HandleFunc("/.well-known/openid_configuration", publicCORS(rl.proxyAwareMiddleware(rl.wellKnownHandler)))
+	mux.HandleFunc("/.well-known/jwks.json", publicCORS(rl.proxyAwareMiddleware(rl.jwksHandler)))
+	mux.HandleFunc("/auth", rl.requireHTTPS(rl.rateLimit(config.RateLimitEndpointAuth, rl.proxyAwareMiddleware(rl.authHandler))))
+	mux.HandleFunc("/login/", rl.requireHTTPS(rl.proxyAwareMiddleware(rl.loginHandler)))
+	mux.HandleFunc("/token", rl.requireHTTPS(rl.cors(rl.rateLimit(config.RateLimitEndpointToken, rl.proxyAwareMiddleware(rl.tokenHandler)), http.MethodPost)))
+	mux.HandleFunc("/userinfo", rl.cors(rl.proxyAwareMiddleware(rl.userInfoHandler), http.MethodGet, http.MethodPost))
+	mux.HandleFunc("/callback", rl.proxyAwareMiddleware(rl.callbackHandler))
+	mux.HandleFunc("/revoke", rl.cors(rl.proxyAwareMiddleware(rl.revokeHandler), http.MethodPost))
+	mux.HandleFunc("/introspect", rl.proxyAwareMiddleware(rl.introspectHandler))
 
 	// Device flow endpoints
-	http.HandleFunc("/device_authorization", proxyAwareMiddleware(deviceAuthHandler))
-	http.HandleFunc("/device", proxyAwareMiddleware(deviceHandler))
+	mux.HandleFunc("/device_authorization", rl.rateLimit(config.RateLimitEndpointDeviceAuthorization, rl.proxyAwareMiddleware(rl.deviceAuthHandler)))
+	mux.HandleFunc("/device", rl.proxyAwareMiddleware(rl.deviceHandler))
 
 	// Registration endpoints
-	http.HandleFunc("/register", proxyAwareMiddleware(registrationHandler))
-	http.HandleFunc("/register/", proxyAwareMiddleware(registrationConfigHandler))
+	mux.HandleFunc("/register", rl.requireHTTPS(rl.rateLimit(config.RateLimitEndpointRegister, rl.proxyAwareMiddleware(rl.registrationHandler))))
+	mux.HandleFunc("/register/", rl.requireHTTPS(rl.proxyAwareMiddleware(rl.registrationConfigHandler)))
 
 	// Testing endpoints
-	http.HandleFunc("/client1/auth", proxyAwareMiddleware(client1AuthHandler))
-	http.HandleFunc("/client1/callback", proxyAwareMiddleware(callbackHandler))
+	mux.HandleFunc("/client1/auth", rl.proxyAwareMiddleware(rl.client1AuthHandler))
+	mux.HandleFunc("/client1/callback", rl.proxyAwareMiddleware(rl.callbackHandler))
 
 	// Health and utility endpoints
-	http.HandleFunc("/health", proxyAwareMiddleware(healthHandler))
-	http.HandleFunc("/", proxyAwareMiddleware(homeHandler))
+	mux.HandleFunc("/health", rl.proxyAwareMiddleware(rl.healthHandler))
+	mux.HandleFunc("/ready", readyHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/", rl.proxyAwareMiddleware(rl.homeHandler))
 
 	// Client management API endpoints (must come before general /api/ route)
-	http.HandleFunc("/api/clients", proxyAwareMiddleware(clientManagementHandler))
-	http.HandleFunc("/api/clients/", proxyAwareMiddleware(clientManagementHandler))
+	mux.HandleFunc("/api/clients", rl.requireHTTPS(rl.proxyAwareMiddleware(rl.clientManagementHandler)))
+	mux.HandleFunc("/api/clients/", rl.requireHTTPS(rl.proxyAwareMiddleware(rl.clientManagementHandler)))
+
+	// Admin API (requires a token with the admin scope)
+	mux.HandleFunc("/admin/", rl.requireHTTPS(rl.proxyAwareMiddleware(rl.adminHandler)))
+
+	// SCIM 2.0 provisioning (admin scope)
+	mux.HandleFunc("/scim/v2/", rl.requireHTTPS(rl.proxyAwareMiddleware(rl.scimHandler)))
 
 	// General API endpoints (protected with authentication)
-	http.HandleFunc("/api/", proxyAwareMiddleware(apiHandler))
+	mux.HandleFunc("/api/", rl.requireHTTPS(rl.proxyAwareMiddleware(rl.apiHandler)))
 
 	// Documentation endpoints
-	http.HandleFunc("/docs", proxyAwareMiddleware(docsWrapperHandler))
-	http.HandleFunc("/docs/", proxyAwareMiddleware(docsWrapperHandler))
+	mux.HandleFunc("/docs", rl.proxyAwareMiddleware(rl.docsWrapperHandler))
+	mux.HandleFunc("/docs/", rl.proxyAwareMiddleware(rl.docsWrapperHandler))
 
 	// Add debug endpoints (only in development)
-	if cfg != nil && cfg.Logging.Level == "debug" {
-		debugHandlers := handlers.NewDebugHandlers(clientStore, cfg)
+	if rl.cfg != nil && rl.cfg.Logging.Level == "debug" {
+		debugHandlers := handlers.NewDebugHandlers(rl.clientStore, rl.cfg)
 		if debugHandlers != nil {
-			http.HandleFunc("/debug/clients", debugHandlers.HandleDebugClients)
-			http.HandleFunc("/debug/client", debugHandlers.HandleDebugClient)
-			http.HandleFunc("/debug/config", debugHandlers.HandleDebugConfig)
+			mux.HandleFunc("/debug/clients", debugHandlers.HandleDebugClients)
+			mux.HandleFunc("/debug/client", debugHandlers.HandleDebugClient)
+			mux.HandleFunc("/debug/config", debugHandlers.HandleDebugConfig)
 			log.Printf("🔧 Debug endpoints enabled at /debug/*")
 		} else {
 			log.Printf("⚠️ Failed to create debug handlers")
@@ -295,43 +625,51 @@ func setupRoutes() {
 }
 
 // Helper wrapper functions for your existing handlers
-func authHandler(w http.ResponseWriter, r *http.Request) {
-	authCodeFlow.HandleAuthorization(w, r)
+func (rl *realm) authHandler(w http.ResponseWriter, r *http.Request) {
+	rl.authCodeFlow.HandleAuthorization(w, r)
+}
+
+func (rl *realm) loginHandler(w http.ResponseWriter, r *http.Request) {
+	rl.authCodeFlow.HandleUpstreamLogin(w, r)
+}
+
+func (rl *realm) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	rl.authCodeFlow.HandleCallback(w, r)
 }
 
-func callbackHandler(w http.ResponseWriter, r *http.Request) {
-	authCodeFlow.HandleCallback(w, r)
+func (rl *realm) deviceAuthHandler(w http.ResponseWriter, r *http.Request) {
+	rl.deviceCodeFlow.HandleAuthorization(w, r)
 }
 
-func deviceAuthHandler(w http.ResponseWriter, r *http.Request) {
-	deviceCodeFlow.HandleAuthorization(w, r)
+func (rl *realm) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	rl.deviceHandlers.HandleDeviceVerification(w, r)
 }
 
-func registrationHandler(w http.ResponseWriter, r *http.Request) {
-	registrationHandlers.HandleRegistration(w, r)
+func (rl *realm) registrationHandler(w http.ResponseWriter, r *http.Request) {
+	rl.registrationHandlers.HandleRegistration(w, r)
 }
 
-func registrationConfigHandler(w http.ResponseWriter, r *http.Request) {
-	registrationHandlers.HandleClientConfiguration(w, r)
+func (rl *realm) registrationConfigHandler(w http.ResponseWriter, r *http.Request) {
+	rl.registrationHandlers.HandleClientConfiguration(w, r)
 }
 
-func docsWrapperHandler(w http.ResponseWriter, r *http.Request) {
-	docsHandler.ServeHTTP(w, r)
+func (rl *realm) docsWrapperHandler(w http.ResponseWriter, r *http.Request) {
+	rl.docsHandler.ServeHTTP(w, r)
 }
 
-func clientManagementHandler(w http.ResponseWriter, r *http.Request) {
+func (rl *realm) clientManagementHandler(w http.ResponseWriter, r *http.Request) {
 	// Route client management API calls to the docs handler
 	if r.URL.Path == "/api/clients" {
-		docsHandler.HandleClientsAPI(w, r)
+		rl.docsHandler.HandleClientsAPI(w, r)
 	} else if len(r.URL.Path) > 13 && r.URL.Path[:13] == "/api/clients/" {
-		docsHandler.HandleClientAPI(w, r)
+		rl.docsHandler.HandleClientAPI(w, r)
 	} else {
 		http.NotFound(w, r)
 	}
 }
 
 // Token handler that routes to appropriate flow
-func tokenHandler(w http.ResponseWriter, r *http.Request) {
+func (rl *realm) tokenHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		utils.WriteInvalidRequestError(w, "Failed to parse request")
 		return
@@ -342,184 +680,57 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch grantType {
 	case "client_credentials":
-		tokenHandlers.HandleClientCredentials(w, r)
+		rl.tokenHandlers.HandleClientCredentials(w, r)
 	case "refresh_token":
-		tokenHandlers.HandleRefreshToken(w, r)
+		rl.tokenHandlers.HandleRefreshToken(w, r)
 	case "urn:ietf:params:oauth:grant-type:token-exchange":
-		tokenHandlers.HandleTokenExchange(w, r)
+		rl.tokenHandlers.HandleTokenExchange(w, r)
+	case handlers.JWTBearerGrantType:
+		rl.tokenHandlers.HandleJWTBearer(w, r)
+	case handlers.PasswordGrantType:
+		rl.tokenHandlers.HandlePassword(w, r)
 	case "urn:ietf:params:oauth:grant-type:device_code":
-		deviceCodeFlow.HandleToken(w, r)
+		rl.deviceCodeFlow.HandleToken(w, r)
 	default:
 		// Handle standard grant types with Fosite
-		handleStandardTokenRequest(w, r)
+		rl.handleStandardTokenRequest(w, r)
 	}
 }
 
-func handleStandardTokenRequest(w http.ResponseWriter, r *http.Request) {
+func (rl *realm) handleStandardTokenRequest(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	accessRequest, err := oauth2Provider.NewAccessRequest(ctx, r, &fosite.DefaultSession{})
-	if err != nil {
-		log.Printf("❌ Error creating access request: %v", err)
-		oauth2Provider.WriteAccessError(ctx, w, accessRequest, err)
-		return
-	}
-
-	response, err := oauth2Provider.NewAccessResponse(ctx, accessRequest)
-	if err != nil {
-		log.Printf("❌ Error creating access response: %v", err)
-		oauth2Provider.WriteAccessError(ctx, w, accessRequest, err)
-		return
-	}
 
-	oauth2Provider.WriteAccessResponse(ctx, w, accessRequest, response)
-}
-
-// Device handler for user verification
-func deviceHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		showDeviceVerificationForm(w, r)
-		return
-	}
-
-	if r.Method == "POST" {
-		handleDeviceVerification(w, r)
+	// Fosite compares the client secret, so the lockout is applied around it
+	clientID, _, _ := auth.ExtractClientCredentials(r)
+	lockoutKeys := []lockout.Key{lockout.Client(clientID), lockout.IP(r.RemoteAddr)}
+	if rl.lockouts.Check(lockoutKeys...) > 0 {
+		rl.oauth2Provider.WriteAccessError(ctx, w, fosite.NewAccessRequest(&auth.UserSession{}), fosite.ErrInvalidClient.WithHint(store.ErrClientLocked.Error()))
 		return
 	}
 
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
-
-func showDeviceVerificationForm(w http.ResponseWriter, r *http.Request) {
-	userCode := r.URL.Query().Get("user_code")
-	errorMsg := r.URL.Query().Get("error")
-
-	html := `<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Device Verification</title>
-    <style>
-        body { font-family: Arial, sans-serif; max-width: 500px; margin: 50px auto; padding: 20px; }
-        .form-group { margin-bottom: 15px; }
-        label { display: block; margin-bottom: 5px; font-weight: bold; }
-        input[type="text"], input[type="password"] { width: 100%; padding: 8px; border: 1px solid #ddd; border-radius: 4px; }
-        button { background-color: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 4px; cursor: pointer; }
-        button:hover { background-color: #0056b3; }
-        .error { color: red; margin-bottom: 15px; }
-        .info { color: #666; margin-bottom: 15px; }
-    </style>
-</head>
-<body>
-    <h2>📱 Device Verification</h2>
-    <div class="info">Please enter the user code displayed on your device and authenticate:</div>`
-
-	if errorMsg != "" {
-		html += fmt.Sprintf(`<div class="error">%s</div>`, errorMsg)
-	}
-
-	html += `
-    <form method="post">
-        <div class="form-group">
-            <label for="user_code">User Code:</label>
-            <input type="text" id="user_code" name="user_code" value="` + userCode + `" placeholder="Enter user code" required>
-        </div>
-        <div class="form-group">
-            <label for="username">Username:</label>
-            <input type="text" id="username" name="username" placeholder="john.doe" required>
-        </div>
-        <div class="form-group">
-            <label for="password">Password:</label>
-            <input type="password" id="password" name="password" placeholder="password123" required>
-        </div>
-        <button type="submit">Authorize Device</button>
-    </form>
-    
-    <p><a href="/">← Back to Home</a></p>
-</body>
-</html>`
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write([]byte(html))
-}
-
-func handleDeviceVerification(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Printf("Failed to parse form: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+	accessRequest, err := rl.oauth2Provider.NewAccessRequest(ctx, r, &auth.UserSession{})
+	if errors.Is(err, fosite.ErrInvalidClient) {
+		rl.lockouts.Fail(lockout.CredentialClientSecret, clientID, r.RemoteAddr, lockoutKeys...)
 	}
-
-	userCode := r.FormValue("user_code")
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-
-	// Normalize user code - trim, uppercase, and ensure consistent formatting
-	userCode = strings.TrimSpace(strings.ToUpper(userCode))
-
-	// Validate user code format
-	if err := utils.ValidateUserCode(userCode); err != nil {
-		http.Redirect(w, r, "/device?error=Invalid user code format", http.StatusFound)
+	if err != nil {
+		log.Printf("❌ Error creating access request: %v", err)
+		rl.oauth2Provider.WriteAccessError(ctx, w, accessRequest, err)
 		return
 	}
+	rl.lockouts.Succeed(lockout.Client(clientID))
 
-	// Ensure user code has the hyphen format for device flow lookup
-	if len(userCode) == 8 && !strings.Contains(userCode, "-") {
-		userCode = fmt.Sprintf("%s-%s", userCode[:4], userCode[4:])
-	}
-
-	// Authenticate user against configured users
-	user := authenticateUserFromConfig(username, password)
-	if user == nil {
-		http.Redirect(w, r, "/device?error=Invalid username or password", http.StatusFound)
+	response, err := rl.oauth2Provider.NewAccessResponse(ctx, accessRequest)
+	if err != nil {
+		log.Printf("❌ Error creating access response: %v", err)
+		rl.oauth2Provider.WriteAccessError(ctx, w, accessRequest, err)
 		return
 	}
 
-	// Authorize the device
-	if deviceCodeFlow.AuthorizeDevice(userCode, user.ID) {
-		showDeviceVerificationSuccess(w, r)
-	} else {
-		http.Redirect(w, r, "/device?error=Invalid or expired user code", http.StatusFound)
-	}
-}
-
-// Add helper function for user authentication
-func authenticateUserFromConfig(username, password string) *config.User {
-	if user, found := cfg.GetUserByUsername(username); found {
-		// In a real implementation, you'd hash and compare passwords properly
-		if user.Password == password {
-			return user
-		}
-	}
-	return nil
-}
-
-func showDeviceVerificationSuccess(w http.ResponseWriter, r *http.Request) {
-	html := `<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>Device Authorized</title>
-    <style>
-        body { font-family: Arial, sans-serif; max-width: 500px; margin: 50px auto; padding: 20px; text-align: center; }
-        .success { color: green; font-size: 24px; margin-bottom: 20px; }
-        .info { color: #666; margin-bottom: 15px; }
-    </style>
-</head>
-<body>
-    <div class="success">✅ Device Successfully Authorized!</div>
-    <div class="info">You can now return to your device. The application should receive the access token shortly.</div>
-    <p><a href="/">← Back to Home</a></p>
-</body>
-</html>`
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write([]byte(html))
+	rl.oauth2Provider.WriteAccessResponse(ctx, w, accessRequest, response)
 }
 
 // Enhanced userinfo handler with proper user lookup
-func userInfoHandler(w http.ResponseWriter, r *http.Request) {
+func (rl *realm) userInfoHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract bearer token
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
@@ -537,30 +748,39 @@ func userInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 	token := parts[1]
 
-	// Validate the access token (simplified version)
-	if err := auth.ValidateAccessToken(token); err != nil {
-		w.Header().Set("WWW-Authenticate", "Bearer")
+	// Validate the access token against the realm's storage, which rejects
+	// tokens issued by other realms
+	_, userID, err := rl.accessTokenOwner(r.Context(), token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 		http.Error(w, "Invalid access token", http.StatusUnauthorized)
 		return
 	}
 
-	// For now, return the first user's info or a default user
-	// In a real implementation, you'd extract user ID from the token
-	var userInfo map[string]interface{}
-	if len(cfg.Users) > 0 {
-		user := cfg.Users[0]
-		userInfo = map[string]interface{}{
-			"sub":      user.ID,
-			"name":     user.Name,
-			"email":    user.Email,
-			"username": user.Username,
-		}
-	} else {
-		// Fallback if no users configured
-		userInfo = map[string]interface{}{
-			"sub":   "default-user",
-			"name":  "Default User",
-			"email": "default@example.com",
+	// Only tokens issued to a user have claims to return; client tokens
+	// such as those of the client credentials grant have none
+	if userID == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", error_description="The access token was not issued to a user"`)
+		http.Error(w, "The access token was not issued to a user", http.StatusForbidden)
+		return
+	}
+
+	user, found := rl.userStore.GetUser(userID)
+	if !found {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "The user of the access token is unknown", http.StatusUnauthorized)
+		return
+	}
+
+	userInfo := map[string]interface{}{
+		"sub":      user.ID,
+		"name":     user.Name,
+		"email":    user.Email,
+		"username": user.Username,
+	}
+	for name, value := range user.Attributes {
+		if _, reserved := userInfo[name]; !reserved {
+			userInfo[name] = value
 		}
 	}
 
@@ -569,12 +789,34 @@ func userInfoHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Well-known handler
-func wellKnownHandler(w http.ResponseWriter, r *http.Request) {
+// supportedGrantTypes lists the grant types for discovery; the opt-in password
+// grant is only advertised while at least one client enables it
+func (rl *realm) supportedGrantTypes() []string {
+	grantTypes := []string{
+		"authorization_code",
+		"client_credentials",
+		"refresh_token",
+		"urn:ietf:params:oauth:grant-type:device_code",
+		"urn:ietf:params:oauth:grant-type:token-exchange",
+		handlers.JWTBearerGrantType,
+	}
+
+	for _, client := range rl.clientStore.ListClients() {
+		if utils.Contains(client.GetGrantTypes(), handlers.PasswordGrantType) {
+			grantTypes = append(grantTypes, handlers.PasswordGrantType)
+			break
+		}
+	}
+
+	return grantTypes
+}
+
+func (rl *realm) wellKnownHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "public, max-age=3600")
 
 	// Get the effective base URL (proxy-aware)
-	baseURL := cfg.GetEffectiveBaseURL(r)
+	baseURL := rl.cfg.GetEffectiveBaseURL(r)
 
 	wellKnown := map[string]interface{}{
 		// OAuth2 Authorization Server Metadata (RFC 8414)
@@ -593,10 +835,7 @@ func wellKnownHandler(w http.ResponseWriter, r *http.Request) {
 		"device_verification_uri_complete": baseURL + "/device?user_code={user_code}",
 
 		// Supported scopes
-		"scopes_supported": []string{
-			"openid", "profile", "email", "offline_access",
-			"api:read", "api:write", "admin",
-		},
+		"scopes_supported": rl.cfg.SupportedScopes(),
 
 		// Supported response types
 		"response_types_supported": []string{
@@ -606,13 +845,7 @@ func wellKnownHandler(w http.ResponseWriter, r *http.Request) {
 		},
 
 		// Supported grant types
-		"grant_types_supported": []string{
-			"authorization_code",
-			"client_credentials",
-			"refresh_token",
-			"urn:ietf:params:oauth:grant-type:device_code",
-			"urn:ietf:params:oauth:grant-type:token-exchange",
-		},
+		"grant_types_supported": rl.supportedGrantTypes(),
 
 		// Token endpoint authentication methods
 		"token_endpoint_auth_methods_supported": []string{
@@ -669,7 +902,7 @@ func wellKnownHandler(w http.ResponseWriter, r *http.Request) {
 			"preferred_username", "profile", "picture", "website",
 			"email", "email_verified", "gender", "birthdate", "zoneinfo",
 			"locale", "phone_number", "phone_number_verified", "address",
-			"updated_at",
+			"updated_at", "acr", "amr",
 		},
 
 		"claims_parameter_supported":            true,
@@ -679,7 +912,7 @@ func wellKnownHandler(w http.ResponseWriter, r *http.Request) {
 		"claims_locales_supported":              []string{"en-US", "en-GB", "de-DE", "fr-FR"},
 		"ui_locales_supported":                  []string{"en-US", "en-GB", "de-DE", "fr-FR"},
 		"display_values_supported":              []string{"page", "popup", "touch", "wap"},
-		"acr_values_supported":                  []string{"0", "1", "2"},
+		"acr_values_supported":                  []string{auth.ACRSingleFactor, auth.ACRMultiFactor},
 		"frontchannel_logout_supported":         true,
 		"frontchannel_logout_session_supported": true,
 		"backchannel_logout_supported":          false,
@@ -709,27 +942,40 @@ func wellKnownHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // JWKS handler
-func jwksHandler(w http.ResponseWriter, r *http.Request) {
-	jwks := map[string]interface{}{
-		"keys": []map[string]interface{}{
-			{
-				"kty": "RSA",
-				"use": "sig",
-				"kid": "oauth2-server-key",
-				"alg": "RS256",
-				"n":   "example-modulus",
-				"e":   "AQAB",
-			},
-		},
-	}
-
+func (rl *realm) jwksHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "public, max-age=3600")
-	json.NewEncoder(w).Encode(jwks)
+	json.NewEncoder(w).Encode(rl.keyManager.JWKS())
 }
 
 // Health handler
-func healthHandler(w http.ResponseWriter, r *http.Request) {
+// metricsHandler exposes background job metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if jobScheduler != nil {
+		jobScheduler.WriteMetrics(w)
+	}
+}
+
+// readyHandler fails while requests drain on shutdown so the pod is taken out of rotation
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status := "ready"
+	if shuttingDown.Load() {
+		status = "shutting_down"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    status,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+func (rl *realm) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
@@ -737,20 +983,21 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		"status":    "healthy",
 		"timestamp": time.Now().Unix(),
 		"version":   "1.0.0",
-		"base_url":  cfg.Server.BaseURL,
-		"clients":   len(clientStore.ListClients()),
+		"base_url":  rl.cfg.Server.BaseURL,
+		"clients":   len(rl.clientStore.ListClients()),
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
 // Home handler
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	// Generate user list from configuration
+func (rl *realm) homeHandler(w http.ResponseWriter, r *http.Request) {
+	// Generate the list of demo users from the configuration; users created
+	// at runtime or provisioned from directories are never shown
 	var userListHTML strings.Builder
-	if len(cfg.Users) > 0 {
+	if len(rl.cfg.Users) > 0 {
 		userListHTML.WriteString("<h3>👥 Available Test Users:</h3><ul>")
-		for _, user := range cfg.Users {
+		for _, user := range rl.cfg.Users {
 			userListHTML.WriteString(fmt.Sprintf(
 				"<li><strong>%s</strong> (%s) - Password: <code>%s</code></li>",
 				user.Username, user.Name, user.Password))
@@ -762,9 +1009,9 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Generate client list from configuration
 	var clientListHTML strings.Builder
-	if len(cfg.Clients) > 0 {
+	if clients := rl.cfg.ListClients(); len(clients) > 0 {
 		clientListHTML.WriteString("<h3>🔑 Configured Clients:</h3><ul>")
-		for _, client := range cfg.Clients {
+		for _, client := range clients {
 			clientListHTML.WriteString(fmt.Sprintf(
 				"<li><strong>%s</strong> - %s<br><small>Grant Types: %s</small></li>",
 				client.ID, client.Name, strings.Join(client.GrantTypes, ", ")))
@@ -815,10 +1062,10 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
         
         <div class="section">
             <h3>🔗 Quick Test Links</h3>
-            <a href="/client1/auth" class="btn">Test Authorization Flow</a>
-            <a href="/device" class="btn">Test Device Flow</a>
-            <a href="/.well-known/oauth-authorization-server" class="btn">Discovery Document</a>
-            <a href="/health" class="btn">Health Check</a>
+            <a href="client1/auth" class="btn">Test Authorization Flow</a>
+            <a href="device" class="btn">Test Device Flow</a>
+            <a href=".well-known/oauth-authorization-server" class="btn">Discovery Document</a>
+            <a href="health" class="btn">Health Check</a>
         </div>
         
         <div class="section">
@@ -835,7 +1082,7 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
         </div>
     </div>
 </body>
-</html>`, cfg.Server.BaseURL, userListHTML.String(), clientListHTML.String())
+</html>`, rl.cfg.Server.BaseURL, userListHTML.String(), clientListHTML.String())
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -843,33 +1090,32 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Client 1 auth handler
-func client1AuthHandler(w http.ResponseWriter, r *http.Request) {
+func (rl *realm) client1AuthHandler(w http.ResponseWriter, r *http.Request) {
 	// Find the first client from configuration or use default
 	var clientID string
 	var redirectURI string
 
-	if len(cfg.Clients) > 0 {
-		client := cfg.Clients[0]
+	if client, found := rl.cfg.GetFirstClient(); found {
 		clientID = client.ID
 		if len(client.RedirectURIs) > 0 {
 			redirectURI = client.RedirectURIs[0]
 		} else {
-			redirectURI = cfg.Server.BaseURL + "/client1/callback"
+			redirectURI = rl.cfg.Server.BaseURL + "/client1/callback"
 		}
 	} else {
 		// Fallback to default values
 		clientID = "frontend-app"
-		redirectURI = cfg.Server.BaseURL + "/client1/callback"
+		redirectURI = rl.cfg.Server.BaseURL + "/client1/callback"
 	}
 
 	authURL := fmt.Sprintf("%s/auth?client_id=%s&redirect_uri=%s&response_type=code&scope=openid+profile+email&state=random-state",
-		cfg.Server.BaseURL, clientID, redirectURI)
+		rl.cfg.Server.BaseURL, clientID, redirectURI)
 
 	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
 // API handler with authentication
-func apiHandler(w http.ResponseWriter, r *http.Request) {
+func (rl *realm) apiHandler(w http.ResponseWriter, r *http.Request) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		w.Header().Set("WWW-Authenticate", "Bearer")
@@ -884,8 +1130,8 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := auth.ValidateAccessToken(token); err != nil {
-		w.Header().Set("WWW-Authenticate", "Bearer")
+	if _, err := rl.tokenStore.ValidateAccessToken(token); err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 		http.Error(w, "Invalid access token", http.StatusUnauthorized)
 		return
 	}
@@ -901,7 +1147,7 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Middleware for proxy awareness
-func proxyAwareMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+func (rl *realm) proxyAwareMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Store original values
 		originalHost := r.Host
@@ -921,18 +1167,10 @@ func proxyAwareMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 			r.URL.Host = host
 		}
 
-		// Handle X-Forwarded-For (original client IP)
-		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-			// Take the first IP in the chain (original client)
-			if ips := strings.Split(xff, ","); len(ips) > 0 {
-				r.RemoteAddr = strings.TrimSpace(ips[0])
-			}
-		}
-
-		// Handle X-Real-IP (alternative to X-Forwarded-For)
-		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-			r.RemoteAddr = realIP
-		}
+		// Take the original client IP from X-Forwarded-For or X-Real-IP, but
+		// only as reported by trusted proxies; lockouts are counted per source IP
+		trustedProxies, _ := rl.cfg.Proxy.TrustedProxyNetworks()
+		r.RemoteAddr = middleware.ClientIP(r, trustedProxies)
 
 		// Handle X-Forwarded-Port
 		if port := r.Header.Get("X-Forwarded-Port"); port != "" {
@@ -943,14 +1181,14 @@ func proxyAwareMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 			}
 		}
 
-		// Update the config's BaseURL for this request if needed
-		if r.URL.Scheme != "" && r.Host != "" {
-			originalBaseURL := cfg.Server.BaseURL
-			cfg.Server.BaseURL = r.URL.Scheme + "://" + r.Host
+		// Update the config's BaseURL for this request if needed; realms keep their issuer
+		if rl.name == "" && r.URL.Scheme != "" && r.Host != "" {
+			originalBaseURL := rl.cfg.Server.BaseURL
+			rl.cfg.Server.BaseURL = r.URL.Scheme + "://" + r.Host
 
 			// Restore original BaseURL after request
 			defer func() {
-				cfg.Server.BaseURL = originalBaseURL
+				rl.cfg.Server.BaseURL = originalBaseURL
 			}()
 		}
 
@@ -977,98 +1215,22 @@ func getRequestBaseURL(r *http.Request) string {
 	return scheme + "://" + host
 }
 
-// Add token revocation handler
-func revokeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		utils.WriteMethodNotAllowedError(w)
-		return
-	}
-
-	if err := r.ParseForm(); err != nil {
-		utils.WriteInvalidRequestError(w, "Failed to parse request")
-		return
-	}
-
-	token := r.FormValue("token")
-	if token == "" {
-		utils.WriteInvalidRequestError(w, "Token parameter is required")
-		return
-	}
-
-	// Extract client credentials
-	clientID, clientSecret, err := auth.ExtractClientCredentials(r)
-	if err != nil {
-		utils.WriteInvalidClientError(w, "Client authentication required")
-		return
-	}
-
-	// Authenticate client
-	if err := clientStore.ValidateClientCredentials(clientID, clientSecret); err != nil {
-		utils.WriteInvalidClientError(w, "Client authentication failed")
-		return
-	}
-
-	// For demo purposes, just return success
-	// In a real implementation, you'd revoke the token from your token store
-	w.WriteHeader(http.StatusOK)
-	log.Printf("✅ Token revoked for client: %s", clientID)
+// Token revocation handler (RFC 7009) backed by the token store
+func (rl *realm) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	rl.tokenHandlers.HandleTokenRevocation(w, r)
 }
 
-// Add token introspection handler
-func introspectHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		utils.WriteMethodNotAllowedError(w)
-		return
-	}
-
-	if err := r.ParseForm(); err != nil {
-		utils.WriteInvalidRequestError(w, "Failed to parse request")
-		return
-	}
-
-	token := r.FormValue("token")
-	if token == "" {
-		utils.WriteInvalidRequestError(w, "Token parameter is required")
-		return
-	}
-
-	// Extract client credentials
-	clientID, clientSecret, err := auth.ExtractClientCredentials(r)
-	if err != nil {
-		utils.WriteInvalidClientError(w, "Client authentication required")
-		return
-	}
-
-	// Authenticate client
-	if err := clientStore.ValidateClientCredentials(clientID, clientSecret); err != nil {
-		utils.WriteInvalidClientError(w, "Client authentication failed")
-		return
-	}
-
-	// Get user information (use first user or default)
-	var userID string
-	if len(cfg.Users) > 0 {
-		userID = cfg.Users[0].ID
-	} else {
-		userID = "default-user"
-	}
+// Token introspection handler (RFC 7662) backed by the token store
+func (rl *realm) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	rl.tokenHandlers.HandleTokenIntrospection(w, r)
+}
 
-	// For demo purposes, return a basic introspection response
-	introspectionResponse := map[string]interface{}{
-		"active":     true,
-		"client_id":  clientID,
-		"token_type": "Bearer",
-		"scope":      "api:read api:write",
-		"exp":        time.Now().Add(time.Hour).Unix(),
-		"iat":        time.Now().Unix(),
-		"sub":        userID,
-		"aud":        []string{"api-service"},
-		"iss":        cfg.Server.BaseURL,
-	}
+func (rl *realm) adminHandler(w http.ResponseWriter, r *http.Request) {
+	rl.adminHandlers.HandleAdmin(w, r)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(introspectionResponse)
-	log.Printf("✅ Token introspected for client: %s", clientID)
+func (rl *realm) scimHandler(w http.ResponseWriter, r *http.Request) {
+	rl.scimHandlers.HandleSCIM(w, r)
 }
 
 // Example placeholder handlers for unimplemented flows
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/handlers"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// discoveredGrantTypes returns grant_types_supported from the discovery document
+func discoveredGrantTypes(t *testing.T, rl *realm) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	rl.wellKnownHandler(w, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+
+	var document struct {
+		GrantTypes []string `json:"grant_types_supported"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatalf("discovery document is not JSON: %s", w.Body.String())
+	}
+	return document.GrantTypes
+}
+
+func TestDiscoveryAdvertisesPasswordGrantOnlyWhenEnabled(t *testing.T) {
+	clients := store.NewClientStore(store.NewMemoryBackend().Clients())
+	rl := &realm{cfg: &config.Config{}, clientStore: clients}
+
+	if err := clients.StoreClient(&store.Client{ID: "app", GrantTypes: []string{"authorization_code"}}); err != nil {
+		t.Fatal(err)
+	}
+	if grantTypes := discoveredGrantTypes(t, rl); slices.Contains(grantTypes, handlers.PasswordGrantType) {
+		t.Errorf("grant_types_supported = %v, want no password grant", grantTypes)
+	}
+
+	if err := clients.StoreClient(&store.Client{ID: "legacy", GrantTypes: []string{handlers.PasswordGrantType}}); err != nil {
+		t.Fatal(err)
+	}
+	if grantTypes := discoveredGrantTypes(t, rl); !slices.Contains(grantTypes, handlers.PasswordGrantType) {
+		t.Errorf("grant_types_supported = %v, want the password grant", grantTypes)
+	}
+}
+
+// authorizationCodeToken returns an access token of the authorization code
+// grant, which fosite issues, for alice and the spa client
+func authorizationCodeToken(t *testing.T, rl *realm) string {
+	t.Helper()
+	ctx := context.Background()
+	authorize := httptest.NewRequest(http.MethodGet, "/authorize?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {"spa"},
+		"redirect_uri":  {"https://spa.example.com/callback"},
+		"scope":         {"profile"},
+		"state":         {"state-of-the-test"},
+	}.Encode(), nil)
+	ar, err := rl.oauth2Provider.NewAuthorizeRequest(ctx, authorize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar.GrantScope("profile")
+	response, err := rl.oauth2Provider.NewAuthorizeResponse(ctx, ar, &auth.UserSession{UserID: "alice", Username: "alice", Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {response.GetCode()},
+		"redirect_uri": {"https://spa.example.com/callback"},
+	}.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("spa", "spa-secret")
+	w := httptest.NewRecorder()
+	rl.tokenHandler(w, request)
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || tokens.AccessToken == "" {
+		t.Fatalf("token response = %d %s, want an access token", w.Code, w.Body.String())
+	}
+	return tokens.AccessToken
+}
+
+func TestUserInfoAcceptsAuthorizationCodeTokensCrossOrigin(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.BaseURL = "http://localhost:8080"
+	cfg.Security.JWTSecret = "test-secret"
+	cfg.Clients = []config.ClientConfig{{
+		ID:            "spa",
+		Secret:        "spa-secret",
+		RedirectURIs:  []string{"https://spa.example.com/callback"},
+		GrantTypes:    []string{"authorization_code"},
+		ResponseTypes: []string{"code"},
+		Scopes:        []string{"profile"},
+	}}
+	cfg.Users = []config.UserConfig{{ID: "alice", Username: "alice", Password: "alice-password", Name: "Alice"}}
+	rl, err := newRealm(cfg, config.RealmConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.storageBackend.Close()
+
+	token := authorizationCodeToken(t, rl)
+	userInfo := rl.cors(rl.userInfoHandler, http.MethodGet, http.MethodPost)
+
+	tests := []struct {
+		name       string
+		origin     string
+		token      string
+		wantStatus int
+		wantOrigin string
+	}{
+		{name: "origin of the client", origin: "https://spa.example.com", token: token, wantStatus: http.StatusOK, wantOrigin: "https://spa.example.com"},
+		{name: "origin of no client", origin: "https://evil.example.com", token: token, wantStatus: http.StatusOK},
+		{name: "unknown token", origin: "https://spa.example.com", token: "unknown-token", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			request.Header.Set("Origin", tt.origin)
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			userInfo(w, request)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body.String(), tt.wantStatus)
+			}
+			if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", origin, tt.wantOrigin)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var claims map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &claims); err != nil || claims["sub"] != "alice" {
+				t.Errorf("userinfo = %s, want the claims of alice", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"oauth2-server/internal/admin"
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/lockout"
+)
+
+// printResult writes the result of an admin command as indented JSON or as a table
+func printResult(w io.Writer, format string, result interface{}) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	switch v := result.(type) {
+	case []admin.Client:
+		fmt.Fprintln(table, "CLIENT ID\tNAME\tSOURCE\tPUBLIC\tGRANT TYPES\tSCOPES")
+		for _, client := range v {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%t\t%s\t%s\n", client.ID, client.Name, client.Source, client.Public,
+				list(client.GrantTypes), list(client.Scopes))
+		}
+	case *admin.Client:
+		rows := [][2]string{
+			{"Client ID", v.ID},
+			{"Name", v.Name},
+			{"Description", v.Description},
+			{"Source", v.Source},
+			{"Public", fmt.Sprint(v.Public)},
+			{"Auth method", v.TokenEndpointAuthMethod},
+			{"Redirect URIs", list(v.RedirectURIs)},
+			{"Grant types", list(v.GrantTypes)},
+			{"Response types", list(v.ResponseTypes)},
+			{"Scopes", list(v.Scopes)},
+			{"Audience", list(v.Audience)},
+			{"Allowed origins", list(v.AllowedOrigins)},
+		}
+		if v.Secret != "" {
+			rows = append(rows, [2]string{"Client secret", v.Secret + "   (shown once, store it now)"})
+		}
+		writeRows(table, rows)
+	case []admin.User:
+		fmt.Fprintln(table, "ID\tUSERNAME\tNAME\tEMAIL\tSOURCE\tENABLED\tROLES")
+		for _, user := range v {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n", user.ID, user.Username, user.Name, user.Email, user.Source, user.Enabled, list(user.Roles))
+		}
+	case *admin.User:
+		rows := [][2]string{
+			{"ID", v.ID},
+			{"Username", v.Username},
+			{"Name", v.Name},
+			{"Email", v.Email},
+			{"Enabled", fmt.Sprint(v.Enabled)},
+			{"Roles", list(v.Roles)},
+			{"Scopes", list(v.Scopes)},
+			{"Source", v.Source},
+			{"Created", timestamp(v.CreatedAt)},
+			{"Updated", timestamp(v.UpdatedAt)},
+		}
+		for _, key := range sortedKeys(v.Attributes) {
+			rows = append(rows, [2]string{"Attribute " + key, v.Attributes[key]})
+		}
+		for _, key := range sortedKeys(v.Identities) {
+			rows = append(rows, [2]string{"Identity " + key, v.Identities[key]})
+		}
+		if v.MFA != nil {
+			rows = append(rows, [2]string{"MFA", fmt.Sprintf("enrolled %s, %d recovery codes left", timestamp(v.MFA.EnrolledAt), v.MFA.RecoveryCodes)})
+		} else {
+			rows = append(rows, [2]string{"MFA", "not enrolled"})
+		}
+		for _, passkey := range v.Passkeys {
+			used := "never used"
+			if !passkey.LastUsedAt.IsZero() {
+				used = "last used " + timestamp(passkey.LastUsedAt)
+			}
+			rows = append(rows, [2]string{"Passkey " + passkey.ID, fmt.Sprintf("%s, created %s, %s", passkey.Name, timestamp(passkey.CreatedAt), used)})
+		}
+		writeRows(table, rows)
+	case *admin.Token:
+		writeRows(table, [][2]string{
+			{"Active", fmt.Sprint(v.Active)},
+			{"Type", v.TokenType},
+			{"Client ID", v.ClientID},
+			{"User ID", v.UserID},
+			{"Scopes", list(v.Scopes)},
+			{"Audience", list(v.Audience)},
+			{"Issued at", timestamp(v.IssuedAt)},
+			{"Expires at", timestamp(v.ExpiresAt)},
+			{"Revoked", fmt.Sprint(v.Revoked)},
+		})
+	case *admin.RevokeResult:
+		fmt.Fprintf(table, "Revoked %d tokens and %d grants\n", v.Revoked, v.Grants)
+	case []auth.KeyInfo:
+		fmt.Fprintln(table, "KEY ID\tALG\tCREATED\tACTIVE")
+		for _, key := range v {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%t\n", key.KeyID, key.Algorithm, timestamp(key.CreatedAt), key.Active)
+		}
+	case *auth.KeyInfo:
+		fmt.Fprintf(table, "New signing key %s (%s), previous keys stay in the JWKS\n", v.KeyID, v.Algorithm)
+	case []lockout.Lock:
+		fmt.Fprintln(table, "KIND\tKEY\tFAILURES\tLAST FAILURE\tLOCKED UNTIL")
+		for _, lock := range v {
+			lockedUntil := ""
+			if lock.LockedUntil != nil {
+				lockedUntil = timestamp(*lock.LockedUntil)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", lock.Kind, lock.Value, lock.Failures, timestamp(lock.LastFailure), lockedUntil)
+		}
+	case map[string]interface{}:
+		rows := make([][2]string, 0, len(v))
+		for _, key := range sortedKeys(v) {
+			rows = append(rows, [2]string{key, fmt.Sprint(v[key])})
+		}
+		writeRows(table, rows)
+	default:
+		return fmt.Errorf("no table format for %T, use -o json", result)
+	}
+	return table.Flush()
+}
+
+// writeRows writes "label: value" rows, skipping empty values
+func writeRows(w io.Writer, rows [][2]string) {
+	for _, row := range rows {
+		if row[1] != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", row[0], row[1])
+		}
+	}
+}
+
+// list joins values for a table cell
+func list(values []string) string {
+	return strings.Join(values, ", ")
+}
+
+// timestamp formats a time for a table cell
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
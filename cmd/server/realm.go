@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/ory/fosite"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/flows"
+	"oauth2-server/internal/handlers"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/ratelimit"
+	"oauth2-server/internal/reload"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// realm holds everything a tenant does not share with other tenants: its
+// configuration, storage, signing keys, flows and handlers. The server itself
+// is the default realm, served at the root.
+type realm struct {
+	// name is empty for the default realm
+	name string
+	// prefix is the path the realm is served under, e.g. /realms/partners
+	prefix string
+	// host is the host of the realm's own issuer, if it has one
+	host string
+	cfg  *config.Config
+
+	// OAuth2 provider and stores
+	oauth2Provider fosite.OAuth2Provider
+	storageBackend store.Backend
+	clientStore    *store.ClientStore
+	userStore      *store.UserStore
+	tokenStore     *store.TokenStore
+
+	// Signing keys for JWTs and the JWKS endpoint
+	keyManager *auth.KeyManager
+
+	// Failed credential checks per account, client and source IP
+	lockouts *lockout.Tracker
+
+	// Token buckets of the protocol endpoints
+	rateLimiter *ratelimit.Limiter
+
+	// Shared user authentication with lockout
+	userAuth *auth.UserAuthenticator
+
+	// OAuth2 flows
+	authCodeFlow      *flows.AuthorizationCodeFlow
+	clientCredsFlow   *flows.ClientCredentialsFlow
+	refreshTokenFlow  *flows.RefreshTokenFlow
+	tokenExchangeFlow *flows.TokenExchangeFlow
+	deviceCodeFlow    *flows.DeviceCodeFlow
+
+	// Documentation handler
+	docsHandler *handlers.DocsHandler
+
+	// Token handlers
+	tokenHandlers *handlers.TokenHandlers
+
+	// Registration handler
+	registrationHandlers *handlers.RegistrationHandlers
+
+	// Device verification handlers
+	deviceHandlers *handlers.DeviceHandlers
+
+	// Admin API handlers
+	adminHandlers *handlers.AdminHandlers
+
+	// SCIM provisioning handlers
+	scimHandlers *handlers.SCIMHandlers
+}
+
+// initializeRealms creates the default realm and one realm per configured
+// tenant, and registers them for config reloads
+func initializeRealms() error {
+	defaultRealm, err := newRealm(cfg, config.RealmConfig{})
+	if err != nil {
+		return err
+	}
+	realms = []*realm{defaultRealm}
+	configReloader = reload.NewReloader(config.FilePath(), cfg, defaultRealm.clientStore, defaultRealm.userStore)
+
+	for _, realmConfig := range cfg.Realms {
+		derived, _ := cfg.Realm(realmConfig.Name)
+		rl, err := newRealm(derived, realmConfig)
+		if err != nil {
+			closeRealms()
+			return fmt.Errorf("realm %s: %w", realmConfig.Name, err)
+		}
+		realms = append(realms, rl)
+		configReloader.AddRealm(rl.name, rl.cfg, rl.clientStore, rl.userStore)
+		log.Printf("🏢 Realm %s: issuer %s", rl.name, rl.cfg.Server.BaseURL)
+	}
+	return nil
+}
+
+// newRealm opens the storage of a realm and creates its provider, flows and handlers
+func newRealm(realmCfg *config.Config, realmConfig config.RealmConfig) (*realm, error) {
+	rl := &realm{name: realmConfig.Name, cfg: realmCfg}
+	if rl.name != "" {
+		rl.prefix = realmConfig.PathPrefix()
+		if realmConfig.Issuer != "" {
+			// Validated with the configuration
+			issuer, _ := url.Parse(realmConfig.Issuer)
+			rl.host = issuer.Hostname()
+		}
+	}
+
+	if err := rl.initializeStores(); err != nil {
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	// Load clients from configuration
+	if err := rl.clientStore.LoadClientsFromConfig(rl.cfg.Clients); err != nil {
+		rl.storageBackend.Close()
+		return nil, fmt.Errorf("failed to load clients from config: %w", err)
+	}
+
+	// Load users from configuration
+	if err := rl.userStore.LoadUsersFromConfig(rl.cfg.Users); err != nil {
+		rl.storageBackend.Close()
+		return nil, fmt.Errorf("failed to load users from config: %w", err)
+	}
+
+	// Initialize OAuth2 provider
+	if err := rl.initializeOAuth2Provider(); err != nil {
+		rl.storageBackend.Close()
+		return nil, fmt.Errorf("failed to initialize OAuth2 provider: %w", err)
+	}
+
+	// Initialize flows
+	if err := rl.initializeFlows(); err != nil {
+		rl.storageBackend.Close()
+		return nil, err
+	}
+	return rl, nil
+}
+
+// closeRealms closes the storage of every realm
+func closeRealms() {
+	for _, rl := range realms {
+		if err := rl.storageBackend.Close(); err != nil {
+			log.Printf("⚠️ Failed to close storage%s: %v", rl.label(), err)
+		}
+	}
+}
+
+// jobName prefixes a background job with the realm name so every realm has its own job
+func (rl *realm) jobName(job string) string {
+	if rl.name == "" {
+		return job
+	}
+	return rl.name + ":" + job
+}
+
+// label names the realm in log messages
+func (rl *realm) label() string {
+	if rl.name == "" {
+		return ""
+	}
+	return " (realm " + rl.name + ")"
+}
@@ -0,0 +1,244 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/pkg/config"
+)
+
+// Scope must be granted to a token to call the admin API
+const Scope = "admin"
+
+// Client and user sources
+const (
+	SourceConfig  = "config"
+	SourceRuntime = "runtime"
+)
+
+var (
+	// ErrNotFound is returned for unknown clients, users and tokens
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a change is not allowed in the current state
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidRequest is returned for incomplete or contradicting input
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrKeysUnavailable is returned when signing keys are managed outside the
+	// current process; they only exist in the memory of a running server
+	ErrKeysUnavailable = errors.New("signing keys are only available through a running server")
+	// ErrLockoutsUnavailable is returned outside the server; failed attempts
+	// are only counted in the memory of a running server
+	ErrLockoutsUnavailable = errors.New("lockouts are only available through a running server")
+)
+
+// API is implemented by Service, which works on the storage backend directly,
+// and by RemoteClient, which calls the admin API of a running server
+type API interface {
+	ListClients(ctx context.Context) ([]Client, error)
+	GetClient(ctx context.Context, id string) (*Client, error)
+	CreateClient(ctx context.Context, client Client) (*Client, error)
+	UpdateClient(ctx context.Context, id string, client Client) (*Client, error)
+	DeleteClient(ctx context.Context, id string) error
+	RotateClientSecret(ctx context.Context, id string) (*Client, error)
+
+	ListUsers(ctx context.Context) ([]User, error)
+	GetUser(ctx context.Context, id string) (*User, error)
+	CreateUser(ctx context.Context, user User) (*User, error)
+	UpdateUser(ctx context.Context, id string, user User) (*User, error)
+	DeleteUser(ctx context.Context, id string) error
+	SetUserPassword(ctx context.Context, id, password string) error
+	ResetUserMFA(ctx context.Context, id string) error
+	DeleteUserPasskey(ctx context.Context, id, passkeyID string) error
+
+	IntrospectToken(ctx context.Context, token string) (*Token, error)
+	RevokeTokens(ctx context.Context, req RevokeRequest) (*RevokeResult, error)
+
+	ListKeys(ctx context.Context) ([]auth.KeyInfo, error)
+	RotateKey(ctx context.Context) (*auth.KeyInfo, error)
+
+	ListLockouts(ctx context.Context) ([]lockout.Lock, error)
+	Unlock(ctx context.Context, kind, key string) error
+}
+
+var (
+	_ API = (*Service)(nil)
+	_ API = (*RemoteClient)(nil)
+)
+
+// Client is an OAuth2 client as shown and edited by administrators. The
+// secret is only returned when it is generated.
+type Client struct {
+	ID                      string   `json:"client_id"`
+	Secret                  string   `json:"client_secret,omitempty"`
+	Name                    string   `json:"name"`
+	Description             string   `json:"description,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	Scopes                  []string `json:"scopes"`
+	Audience                []string `json:"audience,omitempty"`
+	Public                  bool     `json:"public"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	// AllowedOrigins may call the token, revocation and userinfo endpoints
+	// from a browser; empty allows the origins of the redirect URIs
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// Source is "config" for clients defined in config.yaml, which can only be
+	// changed there, and "runtime" for all others
+	Source string `json:"source,omitempty"`
+}
+
+// User is a user account as shown and edited by administrators. The password
+// is only accepted when a user is created and never returned.
+type User struct {
+	ID         string            `json:"id"`
+	Username   string            `json:"username"`
+	Password   string            `json:"password,omitempty"`
+	Email      string            `json:"email,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Enabled    bool              `json:"enabled"`
+	Roles      []string          `json:"roles,omitempty"`
+	Scopes     []string          `json:"scopes,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	CreatedAt  time.Time         `json:"created_at,omitempty"`
+	UpdatedAt  time.Time         `json:"updated_at,omitempty"`
+	// Source is "config" for users defined in config.yaml, which can only be
+	// changed there, the name of the htpasswd or LDAP backend or the ID of the
+	// upstream identity provider for users created on their first login, and
+	// "runtime" for all others
+	Source string `json:"source,omitempty"`
+	// Identities are the linked subjects at upstream identity providers; read-only
+	Identities map[string]string `json:"identities,omitempty"`
+	// MFA is the enrolled second factor; read-only, removed with ResetUserMFA
+	MFA *UserMFA `json:"mfa,omitempty"`
+	// Passkeys are the registered WebAuthn credentials; read-only, removed
+	// with DeleteUserPasskey
+	Passkeys []UserPasskey `json:"passkeys,omitempty"`
+}
+
+// UserMFA describes the enrolled authenticator app of a user without its secrets
+type UserMFA struct {
+	EnrolledAt    time.Time `json:"enrolled_at"`
+	RecoveryCodes int       `json:"recovery_codes"`
+}
+
+// UserPasskey describes a registered passkey without its public key
+type UserPasskey struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// Token describes a stored access or refresh token
+type Token struct {
+	Active    bool      `json:"active"`
+	TokenType string    `json:"token_type"`
+	ClientID  string    `json:"client_id"`
+	UserID    string    `json:"user_id,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	Audience  []string  `json:"aud,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Revoked   bool      `json:"revoked"`
+}
+
+// RevokeRequest selects the tokens to revoke: a single token, or every token
+// of a user, a client or a user at one client
+type RevokeRequest struct {
+	Token    string `json:"token,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// RevokeResult reports how many tokens were revoked
+type RevokeResult struct {
+	Revoked int `json:"revoked"`
+	// Grants is the number of authorization code grants whose codes and
+	// tokens were revoked; only set when revoking by user or client
+	Grants int `json:"grants,omitempty"`
+}
+
+// APIError is the JSON error body of the admin API
+type APIError struct {
+	Status      int      `json:"-"`
+	Code        string   `json:"error"`
+	Description string   `json:"error_description"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+// Error formats the error with its problems, one per line
+func (e *APIError) Error() string {
+	message := e.Description
+	if message == "" {
+		message = e.Code
+	}
+	if len(e.Problems) > 0 {
+		message += ":\n  " + strings.Join(e.Problems, "\n  ")
+	}
+	return message
+}
+
+// ToAPIError maps a service error to its HTTP status and error code
+func ToAPIError(err error) *APIError {
+	var apiErr *APIError
+	var validationErr *config.ValidationError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &validationErr):
+		problems := make([]string, 0, len(validationErr.Problems))
+		for _, problem := range validationErr.Problems {
+			problems = append(problems, problem.String())
+		}
+		return &APIError{Status: http.StatusBadRequest, Code: "invalid_client_metadata", Description: "invalid client", Problems: problems}
+	case errors.Is(err, ErrNotFound):
+		return &APIError{Status: http.StatusNotFound, Code: "not_found", Description: err.Error()}
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrKeysUnavailable), errors.Is(err, ErrLockoutsUnavailable):
+		return &APIError{Status: http.StatusConflict, Code: "conflict", Description: err.Error()}
+	case errors.Is(err, ErrInvalidRequest):
+		return &APIError{Status: http.StatusBadRequest, Code: "invalid_request", Description: err.Error()}
+	default:
+		return &APIError{Status: http.StatusInternalServerError, Code: "server_error", Description: err.Error()}
+	}
+}
+
+type actorKey struct{}
+
+// WithActor records who performs the admin operations in ctx; it appears in the audit log
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor recorded in ctx
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	return "unknown"
+}
+
+// kindError carries a message and the sentinel error that classifies it
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string { return e.message }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// errorf formats an error that matches kind with errors.Is
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, message: fmt.Sprintf(format, args...)}
+}
+
+// notFound reports a missing client, user or token
+func notFound(kind, id string) error {
+	return errorf(ErrNotFound, "%s %s not found", kind, id)
+}
@@ -0,0 +1,216 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/lockout"
+)
+
+// RemoteClient calls the admin API of a running server
+type RemoteClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewRemoteClient creates a client for the server at baseURL using an access
+// token with the admin scope
+func NewRemoteClient(baseURL, token string) *RemoteClient {
+	return &RemoteClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// FetchToken obtains an admin access token with the client credentials grant
+func FetchToken(ctx context.Context, baseURL, clientID, clientSecret string) (string, error) {
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {Scope}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientSecret)
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request an admin token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to read token response (HTTP %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("failed to obtain an admin token: %s %s", body.Error, body.ErrorDescription)
+	}
+	return body.AccessToken, nil
+}
+
+// ListClients returns all clients
+func (c *RemoteClient) ListClients(ctx context.Context) ([]Client, error) {
+	var clients []Client
+	return clients, c.do(ctx, http.MethodGet, "/admin/clients", nil, &clients)
+}
+
+// GetClient returns one client
+func (c *RemoteClient) GetClient(ctx context.Context, id string) (*Client, error) {
+	var client Client
+	return &client, c.do(ctx, http.MethodGet, "/admin/clients/"+url.PathEscape(id), nil, &client)
+}
+
+// CreateClient creates a client
+func (c *RemoteClient) CreateClient(ctx context.Context, client Client) (*Client, error) {
+	var created Client
+	return &created, c.do(ctx, http.MethodPost, "/admin/clients", client, &created)
+}
+
+// UpdateClient replaces the editable fields of a client
+func (c *RemoteClient) UpdateClient(ctx context.Context, id string, client Client) (*Client, error) {
+	var updated Client
+	return &updated, c.do(ctx, http.MethodPut, "/admin/clients/"+url.PathEscape(id), client, &updated)
+}
+
+// DeleteClient removes a client
+func (c *RemoteClient) DeleteClient(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/clients/"+url.PathEscape(id), nil, nil)
+}
+
+// RotateClientSecret replaces the secret of a client
+func (c *RemoteClient) RotateClientSecret(ctx context.Context, id string) (*Client, error) {
+	var client Client
+	return &client, c.do(ctx, http.MethodPost, "/admin/clients/"+url.PathEscape(id)+"/rotate-secret", nil, &client)
+}
+
+// ListUsers returns the users
+func (c *RemoteClient) ListUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	return users, c.do(ctx, http.MethodGet, "/admin/users", nil, &users)
+}
+
+// GetUser returns one user by ID or username
+func (c *RemoteClient) GetUser(ctx context.Context, id string) (*User, error) {
+	var user User
+	return &user, c.do(ctx, http.MethodGet, "/admin/users/"+url.PathEscape(id), nil, &user)
+}
+
+// CreateUser creates a user
+func (c *RemoteClient) CreateUser(ctx context.Context, user User) (*User, error) {
+	var created User
+	return &created, c.do(ctx, http.MethodPost, "/admin/users", user, &created)
+}
+
+// UpdateUser replaces the editable fields of a user
+func (c *RemoteClient) UpdateUser(ctx context.Context, id string, user User) (*User, error) {
+	var updated User
+	return &updated, c.do(ctx, http.MethodPut, "/admin/users/"+url.PathEscape(id), user, &updated)
+}
+
+// DeleteUser removes a user
+func (c *RemoteClient) DeleteUser(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/users/"+url.PathEscape(id), nil, nil)
+}
+
+// SetUserPassword replaces the password of a user
+func (c *RemoteClient) SetUserPassword(ctx context.Context, id, password string) error {
+	return c.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(id)+"/password", map[string]string{"password": password}, nil)
+}
+
+// ResetUserMFA removes the second factor of a user
+func (c *RemoteClient) ResetUserMFA(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/users/"+url.PathEscape(id)+"/mfa", nil, nil)
+}
+
+// DeleteUserPasskey removes a passkey of a user
+func (c *RemoteClient) DeleteUserPasskey(ctx context.Context, id, passkeyID string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/users/"+url.PathEscape(id)+"/passkeys/"+url.PathEscape(passkeyID), nil, nil)
+}
+
+// IntrospectToken returns the stored state of a token
+func (c *RemoteClient) IntrospectToken(ctx context.Context, token string) (*Token, error) {
+	var info Token
+	return &info, c.do(ctx, http.MethodPost, "/admin/tokens/introspect", map[string]string{"token": token}, &info)
+}
+
+// RevokeTokens revokes one token or all tokens of a user and/or client
+func (c *RemoteClient) RevokeTokens(ctx context.Context, req RevokeRequest) (*RevokeResult, error) {
+	var result RevokeResult
+	return &result, c.do(ctx, http.MethodPost, "/admin/tokens/revoke", req, &result)
+}
+
+// ListKeys returns the signing keys
+func (c *RemoteClient) ListKeys(ctx context.Context) ([]auth.KeyInfo, error) {
+	var keys []auth.KeyInfo
+	return keys, c.do(ctx, http.MethodGet, "/admin/keys", nil, &keys)
+}
+
+// RotateKey replaces the signing key
+func (c *RemoteClient) RotateKey(ctx context.Context) (*auth.KeyInfo, error) {
+	var key auth.KeyInfo
+	return &key, c.do(ctx, http.MethodPost, "/admin/keys/rotate", nil, &key)
+}
+
+// ListLockouts returns the accounts, clients and source IPs with failed attempts
+func (c *RemoteClient) ListLockouts(ctx context.Context) ([]lockout.Lock, error) {
+	var locks []lockout.Lock
+	return locks, c.do(ctx, http.MethodGet, "/admin/lockouts", nil, &locks)
+}
+
+// Unlock forgets the failed attempts of an account, client, source IP or user codes
+func (c *RemoteClient) Unlock(ctx context.Context, kind, key string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/lockouts/"+url.PathEscape(kind)+"/"+url.PathEscape(key), nil, nil)
+}
+
+// do sends a JSON request and decodes the JSON response into out
+func (c *RemoteClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &APIError{Status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+			return fmt.Errorf("admin API returned HTTP %d", resp.StatusCode)
+		}
+		return apiErr
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,709 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/store"
+	"oauth2-server/internal/utils"
+	"oauth2-server/pkg/config"
+)
+
+// Service implements the admin operations on a storage backend. The server
+// uses it behind the admin API; the CLI uses it directly when no server URL
+// is given.
+type Service struct {
+	backend  store.Backend
+	clients  *store.ClientStore
+	users    *store.UserStore
+	tokens   *store.TokenStore
+	keys     *auth.KeyManager
+	lockouts *lockout.Tracker
+	config   *config.Config
+}
+
+// NewService creates the admin service; keys and lockouts are nil outside the
+// server
+func NewService(backend store.Backend, keys *auth.KeyManager, lockouts *lockout.Tracker, cfg *config.Config) *Service {
+	return &Service{
+		backend:  backend,
+		clients:  store.NewClientStore(backend.Clients()),
+		users:    store.NewUserStore(backend.Users()),
+		tokens:   store.NewTokenStore(backend.Tokens()),
+		keys:     keys,
+		lockouts: lockouts,
+		config:   cfg,
+	}
+}
+
+// ListClients returns all clients ordered by ID
+func (s *Service) ListClients(ctx context.Context) ([]Client, error) {
+	stored, err := s.backend.Clients().ListClients(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+
+	clients := make([]Client, 0, len(stored))
+	for _, client := range stored {
+		clients = append(clients, s.toClient(client))
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients, nil
+}
+
+// GetClient returns one client
+func (s *Service) GetClient(ctx context.Context, id string) (*Client, error) {
+	stored, err := s.getClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	client := s.toClient(stored)
+	return &client, nil
+}
+
+// CreateClient validates and stores a new client. The ID and, for
+// confidential clients authenticating with a secret, the secret are generated
+// when empty; the secret is only returned here.
+func (s *Service) CreateClient(ctx context.Context, client Client) (*Client, error) {
+	if client.ID == "" {
+		client.ID = utils.GenerateClientID()
+	}
+	if s.clients.ClientExists(client.ID) {
+		return nil, errorf(ErrConflict, "client %s already exists", client.ID)
+	}
+	if client.Secret == "" && !client.Public && client.TokenEndpointAuthMethod != "private_key_jwt" {
+		client.Secret = utils.GenerateClientSecret()
+	}
+
+	clientConfig := config.ClientConfig{}
+	applyClient(&clientConfig, client)
+	clientConfig.ID = client.ID
+	clientConfig.Secret = client.Secret
+	if err := s.saveClient(clientConfig); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ Admin created client %s (%s)", client.ID, client.Name)
+	s.audit(ctx, "admin_client_created", client.ID)
+
+	created, err := s.GetClient(ctx, client.ID)
+	if err != nil {
+		return nil, err
+	}
+	created.Secret = client.Secret
+	return created, nil
+}
+
+// UpdateClient replaces the editable fields of a client; the secret and
+// settings that are not part of Client are kept
+func (s *Service) UpdateClient(ctx context.Context, id string, client Client) (*Client, error) {
+	stored, err := s.getRuntimeClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := toClientConfig(stored)
+	applyClient(&clientConfig, client)
+	if err := s.saveClient(clientConfig); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ Admin updated client %s", id)
+	s.audit(ctx, "admin_client_updated", id)
+	return s.GetClient(ctx, id)
+}
+
+// DeleteClient removes a client
+func (s *Service) DeleteClient(ctx context.Context, id string) error {
+	if _, err := s.getRuntimeClient(ctx, id); err != nil {
+		return err
+	}
+	if err := s.backend.Clients().DeleteClient(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete client %s: %w", id, err)
+	}
+
+	log.Printf("🗑️ Admin deleted client %s", id)
+	s.audit(ctx, "admin_client_deleted", id)
+	return nil
+}
+
+// RotateClientSecret replaces the secret of a confidential client and returns
+// the client with the new secret
+func (s *Service) RotateClientSecret(ctx context.Context, id string) (*Client, error) {
+	stored, err := s.getRuntimeClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Public {
+		return nil, errorf(ErrConflict, "client %s is public and has no secret", id)
+	}
+
+	clientConfig := toClientConfig(stored)
+	clientConfig.Secret = utils.GenerateClientSecret()
+	if err := s.saveClient(clientConfig); err != nil {
+		return nil, err
+	}
+
+	log.Printf("🔑 Admin rotated the secret of client %s", id)
+	s.audit(ctx, "admin_client_secret_rotated", id)
+
+	client := s.toClient(stored)
+	client.Secret = clientConfig.Secret
+	return &client, nil
+}
+
+// ListUsers returns the users ordered by username
+func (s *Service) ListUsers(ctx context.Context) ([]User, error) {
+	stored, err := s.backend.Users().ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	users := make([]User, 0, len(stored))
+	for _, user := range stored {
+		users = append(users, s.toUser(user))
+	}
+	return users, nil
+}
+
+// GetUser returns one user by ID or username
+func (s *Service) GetUser(ctx context.Context, id string) (*User, error) {
+	stored, err := s.getUser(id)
+	if err != nil {
+		return nil, err
+	}
+	user := s.toUser(stored)
+	return &user, nil
+}
+
+// CreateUser stores a new user. The ID is generated when empty; without a
+// password the user cannot log in until one is set.
+func (s *Service) CreateUser(ctx context.Context, user User) (*User, error) {
+	if user.ID == "" {
+		user.ID = utils.GenerateUserID()
+	}
+	if _, found := s.users.GetUser(user.ID); found {
+		return nil, errorf(ErrConflict, "user %s already exists", user.ID)
+	}
+
+	stored := &store.User{ID: user.ID}
+	if err := applyUser(stored, user); err != nil {
+		return nil, err
+	}
+	if user.Password != "" {
+		if err := stored.SetPassword(user.Password); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.saveUser(stored); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ Admin created user %s (%s)", stored.Username, stored.ID)
+	s.auditUser(ctx, "admin_user_created", stored.ID)
+	return s.GetUser(ctx, stored.ID)
+}
+
+// UpdateUser replaces the editable fields of a user; the password is kept.
+// Disabling a user revokes its tokens.
+func (s *Service) UpdateUser(ctx context.Context, id string, user User) (*User, error) {
+	stored, err := s.getRuntimeUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if user.Password != "" {
+		return nil, errorf(ErrInvalidRequest, "passwords are set through the password endpoint")
+	}
+
+	wasEnabled := stored.Enabled
+	if err := applyUser(stored, user); err != nil {
+		return nil, err
+	}
+	if err := s.saveUser(stored); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ Admin updated user %s", stored.Username)
+	s.auditUser(ctx, "admin_user_updated", stored.ID)
+	if wasEnabled && !stored.Enabled {
+		if err := s.revokeUserTokens(ctx, stored.ID); err != nil {
+			return nil, err
+		}
+	}
+	return s.GetUser(ctx, stored.ID)
+}
+
+// DeleteUser removes a user and revokes its tokens
+func (s *Service) DeleteUser(ctx context.Context, id string) error {
+	stored, err := s.getRuntimeUser(id)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Users().DeleteUser(ctx, stored.ID); err != nil {
+		return fmt.Errorf("failed to delete user %s: %w", stored.ID, err)
+	}
+
+	log.Printf("🗑️ Admin deleted user %s", stored.Username)
+	s.auditUser(ctx, "admin_user_deleted", stored.ID)
+	return s.revokeUserTokens(ctx, stored.ID)
+}
+
+// SetUserPassword replaces the password of a user
+func (s *Service) SetUserPassword(ctx context.Context, id, password string) error {
+	stored, err := s.getRuntimeUser(id)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return errorf(ErrInvalidRequest, "password is required")
+	}
+	if stored.Authenticator != "" {
+		return errorf(ErrConflict, "the password of user %s is managed by authentication backend %s", stored.Username, stored.Authenticator)
+	}
+	if err := stored.SetPassword(password); err != nil {
+		return err
+	}
+	if err := s.saveUser(stored); err != nil {
+		return err
+	}
+
+	log.Printf("🔑 Admin set the password of user %s", stored.Username)
+	s.auditUser(ctx, "admin_user_password_set", stored.ID)
+	return nil
+}
+
+// ResetUserMFA removes the authenticator app and recovery codes of a user, who
+// has to enrol again on the next login if a second factor is required. Users
+// from config.yaml can be reset as well, since their second factor is not
+// part of the configuration.
+func (s *Service) ResetUserMFA(ctx context.Context, id string) error {
+	stored, err := s.getUser(id)
+	if err != nil {
+		return err
+	}
+	if stored.MFA == nil {
+		return errorf(ErrConflict, "user %s has no second factor", stored.Username)
+	}
+	stored.MFA = nil
+	if err := s.users.SaveUser(stored); err != nil {
+		return fmt.Errorf("failed to reset the second factor of user %s: %w", stored.Username, err)
+	}
+
+	log.Printf("📱 Admin reset the second factor of user %s", stored.Username)
+	s.auditUser(ctx, "admin_user_mfa_reset", stored.ID)
+	return nil
+}
+
+// DeleteUserPasskey removes a passkey of a user, e.g. of a lost device
+func (s *Service) DeleteUserPasskey(ctx context.Context, id, passkeyID string) error {
+	stored, err := s.getUser(id)
+	if err != nil {
+		return err
+	}
+	remaining := make([]store.Passkey, 0, len(stored.Passkeys))
+	for _, passkey := range stored.Passkeys {
+		if passkey.ID != passkeyID {
+			remaining = append(remaining, passkey)
+		}
+	}
+	if len(remaining) == len(stored.Passkeys) {
+		return notFound("passkey", passkeyID)
+	}
+	stored.Passkeys = remaining
+	if err := s.users.SaveUser(stored); err != nil {
+		return fmt.Errorf("failed to delete passkey of user %s: %w", stored.Username, err)
+	}
+
+	log.Printf("🔑 Admin deleted passkey %s of user %s", passkeyID, stored.Username)
+	s.auditUser(ctx, "admin_user_passkey_deleted", stored.ID)
+	return nil
+}
+
+// IntrospectToken returns the stored state of a token, including revoked and
+// expired tokens
+func (s *Service) IntrospectToken(ctx context.Context, token string) (*Token, error) {
+	if token == "" {
+		return nil, errorf(ErrInvalidRequest, "token is required")
+	}
+
+	stored, err := s.backend.Tokens().GetToken(ctx, token)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, errorf(ErrNotFound, "token not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %w", err)
+	}
+
+	info := &Token{
+		Active:    !stored.Revoked && time.Now().Before(stored.ExpiresAt),
+		TokenType: stored.TokenType,
+		ClientID:  stored.ClientID,
+		UserID:    stored.UserID,
+		Scopes:    stored.Scopes,
+		Audience:  stored.Audience,
+		IssuedAt:  stored.CreatedAt,
+		ExpiresAt: stored.ExpiresAt,
+		Revoked:   stored.Revoked,
+	}
+	return info, nil
+}
+
+// RevokeTokens revokes one token or all unrevoked tokens of a user and/or client
+func (s *Service) RevokeTokens(ctx context.Context, req RevokeRequest) (*RevokeResult, error) {
+	if req.Token != "" {
+		if req.UserID != "" || req.ClientID != "" {
+			return nil, errorf(ErrInvalidRequest, "token cannot be combined with user_id or client_id")
+		}
+		if _, err := s.IntrospectToken(ctx, req.Token); err != nil {
+			return nil, err
+		}
+		if err := s.tokens.RevokeToken(req.Token); err != nil {
+			return nil, fmt.Errorf("failed to revoke token: %w", err)
+		}
+		s.auditTokens(ctx, req, 1, 0)
+		return &RevokeResult{Revoked: 1}, nil
+	}
+
+	if req.UserID == "" && req.ClientID == "" {
+		return nil, errorf(ErrInvalidRequest, "token, user_id or client_id is required")
+	}
+
+	tokens, err := s.backend.Tokens().ListTokens(ctx, req.UserID, req.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	revoked := 0
+	for _, token := range tokens {
+		if token.Revoked {
+			continue
+		}
+		token.Revoked = true
+		if err := s.tokens.StoreToken(token); err != nil {
+			return nil, fmt.Errorf("failed to revoke token: %w", err)
+		}
+		revoked++
+	}
+
+	// Codes and tokens issued through the authorization code flow are kept
+	// as request records under the user's subject
+	grants, err := s.backend.Requests().DeactivateRequestsOf(ctx, req.UserID, req.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke grants: %w", err)
+	}
+
+	log.Printf("🚫 Admin revoked %d tokens and %d grants (user %q, client %q)", revoked, grants, req.UserID, req.ClientID)
+	s.auditTokens(ctx, req, revoked, grants)
+	return &RevokeResult{Revoked: revoked, Grants: grants}, nil
+}
+
+// ListKeys returns the signing keys, current key first
+func (s *Service) ListKeys(ctx context.Context) ([]auth.KeyInfo, error) {
+	if s.keys == nil {
+		return nil, ErrKeysUnavailable
+	}
+	return s.keys.Keys(), nil
+}
+
+// RotateKey replaces the signing key; the previous key stays in the JWKS
+func (s *Service) RotateKey(ctx context.Context) (*auth.KeyInfo, error) {
+	if s.keys == nil {
+		return nil, ErrKeysUnavailable
+	}
+
+	key, err := s.keys.Rotate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("🔑 Admin rotated the signing key, new key %s", key.KeyID)
+	audit.Log(audit.Event{
+		Type:    "admin_key_rotated",
+		Outcome: audit.OutcomeSuccess,
+		Details: map[string]interface{}{"actor": ActorFrom(ctx), "kid": key.KeyID},
+	})
+	return &key, nil
+}
+
+// ListLockouts returns the accounts, clients and source IPs with failed
+// attempts, locked ones first
+func (s *Service) ListLockouts(ctx context.Context) ([]lockout.Lock, error) {
+	if s.lockouts == nil {
+		return nil, ErrLockoutsUnavailable
+	}
+	return s.lockouts.List(), nil
+}
+
+// Unlock forgets the failed attempts of an account (by username), client,
+// source IP or the user codes of an account, lifting its lockout
+func (s *Service) Unlock(ctx context.Context, kind, key string) error {
+	if s.lockouts == nil {
+		return ErrLockoutsUnavailable
+	}
+	switch lockout.Kind(kind) {
+	case lockout.KindAccount, lockout.KindClient, lockout.KindIP, lockout.KindUserCode:
+	default:
+		return errorf(ErrInvalidRequest, "unknown lockout kind %q, use account, client, ip or user_code", kind)
+	}
+	if !s.lockouts.Unlock(lockout.Key{Kind: lockout.Kind(kind), Value: key}) {
+		return notFound(kind, key)
+	}
+
+	log.Printf("🔓 Admin unlocked %s %s", kind, key)
+	audit.Log(audit.Event{
+		Type:    "admin_lockout_cleared",
+		Outcome: audit.OutcomeSuccess,
+		Details: map[string]interface{}{"actor": ActorFrom(ctx), "kind": kind, "key": key},
+	})
+	return nil
+}
+
+// getClient loads a client from storage
+func (s *Service) getClient(ctx context.Context, id string) (*store.Client, error) {
+	client, err := s.backend.Clients().GetClient(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, notFound("client", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client %s: %w", id, err)
+	}
+	return client, nil
+}
+
+// getRuntimeClient loads a client that may be changed through the admin API;
+// clients from config.yaml would be overwritten by the next reload
+func (s *Service) getRuntimeClient(ctx context.Context, id string) (*store.Client, error) {
+	client, err := s.getClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.fromConfig(id) {
+		return nil, errorf(ErrConflict, "client %s is defined in config.yaml and must be changed there", id)
+	}
+	return client, nil
+}
+
+// fromConfig reports whether a client is defined in the configuration
+func (s *Service) fromConfig(id string) bool {
+	_, ok := s.config.GetClientByID(id)
+	return ok
+}
+
+// saveClient validates and stores a client
+func (s *Service) saveClient(clientConfig config.ClientConfig) error {
+	if err := config.ValidateClient(clientConfig); err != nil {
+		return err
+	}
+	return s.clients.StoreConfigClient(clientConfig)
+}
+
+// getUser loads a user by ID or username
+func (s *Service) getUser(id string) (*store.User, error) {
+	user, found := s.users.FindUser(id)
+	if !found {
+		return nil, notFound("user", id)
+	}
+	return user, nil
+}
+
+// getRuntimeUser loads a user that may be changed through the admin API;
+// users from config.yaml would be overwritten by the next reload
+func (s *Service) getRuntimeUser(id string) (*store.User, error) {
+	user, err := s.getUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.userFromConfig(user.Username) {
+		return nil, errorf(ErrConflict, "user %s is defined in config.yaml and must be changed there", user.Username)
+	}
+	return user, nil
+}
+
+// userFromConfig reports whether a user is defined in the configuration
+func (s *Service) userFromConfig(username string) bool {
+	_, ok := s.config.GetUserByUsername(username)
+	return ok
+}
+
+// saveUser stores a user whose username must be unique and not reserved by config.yaml
+func (s *Service) saveUser(user *store.User) error {
+	if s.userFromConfig(user.Username) {
+		return errorf(ErrConflict, "username %s is defined in config.yaml", user.Username)
+	}
+	err := s.users.SaveUser(user)
+	if errors.Is(err, store.ErrUsernameTaken) {
+		return errorf(ErrConflict, "username %s is already taken", user.Username)
+	}
+	return err
+}
+
+// revokeUserTokens revokes the tokens of a deleted or disabled user
+func (s *Service) revokeUserTokens(ctx context.Context, userID string) error {
+	_, err := s.RevokeTokens(ctx, RevokeRequest{UserID: userID})
+	return err
+}
+
+// audit records a client change
+func (s *Service) audit(ctx context.Context, eventType, clientID string) {
+	audit.Log(audit.Event{
+		Type:     eventType,
+		Outcome:  audit.OutcomeSuccess,
+		ClientID: clientID,
+		Details:  map[string]interface{}{"actor": ActorFrom(ctx)},
+	})
+}
+
+// auditUser records a user change
+func (s *Service) auditUser(ctx context.Context, eventType, userID string) {
+	audit.Log(audit.Event{
+		Type:    eventType,
+		Outcome: audit.OutcomeSuccess,
+		Subject: userID,
+		Details: map[string]interface{}{"actor": ActorFrom(ctx)},
+	})
+}
+
+// auditTokens records a revocation
+func (s *Service) auditTokens(ctx context.Context, req RevokeRequest, revoked, grants int) {
+	audit.Log(audit.Event{
+		Type:     "admin_tokens_revoked",
+		Outcome:  audit.OutcomeSuccess,
+		ClientID: req.ClientID,
+		Subject:  req.UserID,
+		Details:  map[string]interface{}{"actor": ActorFrom(ctx), "revoked": revoked, "grants": grants},
+	})
+}
+
+// toClient converts a stored client without its secret
+func (s *Service) toClient(client *store.Client) Client {
+	source := SourceRuntime
+	if s.fromConfig(client.ID) {
+		source = SourceConfig
+	}
+	return Client{
+		ID:                      client.ID,
+		Name:                    client.Name,
+		Description:             client.Description,
+		LogoURI:                 client.LogoURI,
+		RedirectURIs:            client.RedirectURIs,
+		GrantTypes:              client.GrantTypes,
+		ResponseTypes:           client.ResponseTypes,
+		Scopes:                  client.Scopes,
+		Audience:                client.Audience,
+		Public:                  client.Public,
+		TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+		AllowedOrigins:          client.AllowedOrigins,
+		Source:                  source,
+	}
+}
+
+// toClientConfig converts a stored client including the settings Client does not expose
+func toClientConfig(client *store.Client) config.ClientConfig {
+	return config.ClientConfig{
+		ID:                      client.ID,
+		Secret:                  string(client.Secret),
+		Name:                    client.Name,
+		Description:             client.Description,
+		LogoURI:                 client.LogoURI,
+		RedirectURIs:            client.RedirectURIs,
+		GrantTypes:              client.GrantTypes,
+		ResponseTypes:           client.ResponseTypes,
+		Scopes:                  client.Scopes,
+		Audience:                client.Audience,
+		TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+		Public:                  client.Public,
+		EnabledFlows:            client.EnabledFlows,
+		DevicePollInterval:      client.DevicePollInterval,
+		AllowImpersonation:      client.AllowImpersonation,
+		MayAct:                  client.MayAct,
+		JWKSURI:                 client.JWKSURI,
+		JWKS:                    client.JWKS,
+		JWTBearerSubjects:       client.JWTBearerSubjects,
+		AllowedOrigins:          client.AllowedOrigins,
+		TokenExchangePolicy:     client.TokenExchangePolicy,
+	}
+}
+
+// applyClient copies the editable fields onto a client configuration
+func applyClient(clientConfig *config.ClientConfig, client Client) {
+	clientConfig.Name = client.Name
+	clientConfig.Description = client.Description
+	clientConfig.LogoURI = client.LogoURI
+	clientConfig.RedirectURIs = client.RedirectURIs
+	clientConfig.GrantTypes = client.GrantTypes
+	clientConfig.ResponseTypes = client.ResponseTypes
+	clientConfig.Scopes = client.Scopes
+	clientConfig.Audience = client.Audience
+	clientConfig.Public = client.Public
+	clientConfig.TokenEndpointAuthMethod = client.TokenEndpointAuthMethod
+	clientConfig.AllowedOrigins = client.AllowedOrigins
+}
+
+// toUser converts a stored user without its password hash
+func (s *Service) toUser(user *store.User) User {
+	source := SourceRuntime
+	switch {
+	case s.userFromConfig(user.Username):
+		source = SourceConfig
+	case user.Authenticator != "":
+		source = user.Authenticator
+	}
+	converted := User{
+		ID:         user.ID,
+		Username:   user.Username,
+		Email:      user.Email,
+		Name:       user.Name,
+		Enabled:    user.Enabled,
+		Roles:      user.Roles,
+		Scopes:     user.Scopes,
+		Attributes: user.Attributes,
+		CreatedAt:  user.CreatedAt,
+		UpdatedAt:  user.UpdatedAt,
+		Source:     source,
+		Identities: user.Identities,
+	}
+	if user.MFA != nil {
+		converted.MFA = &UserMFA{
+			EnrolledAt:    user.MFA.EnrolledAt,
+			RecoveryCodes: len(user.MFA.RecoveryCodes),
+		}
+	}
+	for _, passkey := range user.Passkeys {
+		converted.Passkeys = append(converted.Passkeys, UserPasskey{
+			ID:         passkey.ID,
+			Name:       passkey.Name,
+			CreatedAt:  passkey.CreatedAt,
+			LastUsedAt: passkey.LastUsedAt,
+		})
+	}
+	return converted
+}
+
+// applyUser copies the editable fields onto a stored user
+func applyUser(stored *store.User, user User) error {
+	username := strings.TrimSpace(user.Username)
+	if username == "" || strings.ContainsAny(username, " \t\r\n") {
+		return errorf(ErrInvalidRequest, "username is required and must not contain whitespace")
+	}
+	for _, role := range user.Roles {
+		if strings.TrimSpace(role) == "" {
+			return errorf(ErrInvalidRequest, "roles must not be empty")
+		}
+	}
+	stored.Username = username
+	stored.Email = user.Email
+	stored.Name = user.Name
+	stored.Enabled = user.Enabled
+	stored.Roles = user.Roles
+	stored.Scopes = user.Scopes
+	stored.Attributes = user.Attributes
+	return nil
+}
@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// Event is a security relevant action recorded in the audit log
+type Event struct {
+	Time     time.Time              `json:"time"`
+	Type     string                 `json:"type"`
+	Outcome  string                 `json:"outcome"`
+	ClientID string                 `json:"client_id,omitempty"`
+	Subject  string                 `json:"subject,omitempty"`
+	Reason   string                 `json:"reason,omitempty"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+}
+
+// Logger writes audit events as JSON lines
+type Logger struct {
+	out     *log.Logger
+	enabled bool
+	mutex   sync.RWMutex
+}
+
+// NewLogger creates an audit logger writing to w
+func NewLogger(w io.Writer, enabled bool) *Logger {
+	return &Logger{
+		out:     log.New(w, "", 0),
+		enabled: enabled,
+	}
+}
+
+// SetEnabled turns audit logging on or off
+func (l *Logger) SetEnabled(enabled bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.enabled = enabled
+}
+
+// Log records an event, stamping the time when unset
+func (l *Logger) Log(event Event) {
+	l.mutex.RLock()
+	enabled := l.enabled
+	l.mutex.RUnlock()
+
+	if !enabled {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(struct {
+		Audit bool `json:"audit"`
+		Event
+	}{Audit: true, Event: event})
+	if err != nil {
+		log.Printf("❌ Failed to encode audit event %s: %v", event.Type, err)
+		return
+	}
+	l.out.Println(string(data))
+}
+
+// defaultLogger is the process wide audit log, enabled by logging.enable_audit
+var defaultLogger = NewLogger(os.Stdout, false)
+
+// SetEnabled turns the process wide audit log on or off
+func SetEnabled(enabled bool) {
+	defaultLogger.SetEnabled(enabled)
+}
+
+// Log records an event in the process wide audit log
+func Log(event Event) {
+	defaultLogger.Log(event)
+}
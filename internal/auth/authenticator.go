@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// ErrUnknownUser is returned by an Authenticator that does not know the username
+var ErrUnknownUser = errors.New("unknown user")
+
+// Authenticator checks a username and password against one source of accounts
+type Authenticator interface {
+	// Name identifies the backend in logs and the audit log
+	Name() string
+	// Authenticate returns the account when the password is correct,
+	// ErrUnknownUser when the username is unknown to the backend and
+	// ErrInvalidCredentials when the password is wrong. Backends other than
+	// the user store return the profile of the account without an ID; it is
+	// stored as a user owned by the backend on first login.
+	Authenticate(ctx context.Context, username, password string) (*store.User, error)
+}
+
+// NewAuthenticators creates the backends of the authentication section in order
+func NewAuthenticators(authentication config.AuthenticationConfig, users *store.UserStore) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	for _, backend := range authentication.AuthenticatorBackends() {
+		var (
+			authenticator Authenticator
+			err           error
+		)
+		switch backend.Type {
+		case config.AuthenticatorConfigUsers:
+			authenticator = NewStoreAuthenticator(backend.BackendName(), users)
+		case config.AuthenticatorHtpasswd:
+			authenticator, err = NewHtpasswdAuthenticator(backend)
+		case config.AuthenticatorLDAP:
+			authenticator, err = NewLDAPAuthenticator(backend)
+		default:
+			err = fmt.Errorf("unknown authenticator type %q", backend.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("authenticator %s: %w", backend.BackendName(), err)
+		}
+
+		log.Printf("🔐 Authentication backend: %s (%s)", backend.BackendName(), backend.Type)
+		authenticators = append(authenticators, authenticator)
+	}
+	return authenticators, nil
+}
+
+// StoreAuthenticator checks the bcrypt password hashes of the user store: the
+// users from config.yaml and those created through the admin API or SCIM
+type StoreAuthenticator struct {
+	name  string
+	users *store.UserStore
+}
+
+// NewStoreAuthenticator creates an authenticator for the users of the store
+func NewStoreAuthenticator(name string, users *store.UserStore) *StoreAuthenticator {
+	return &StoreAuthenticator{name: name, users: users}
+}
+
+// Name returns the name of the backend
+func (a *StoreAuthenticator) Name() string {
+	return a.name
+}
+
+// Authenticate checks the password against the stored hash. Accounts owned by
+// another backend have no hash and count as unknown.
+func (a *StoreAuthenticator) Authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	user, ok := a.users.Authenticate(username, password)
+	switch {
+	case user == nil || user.Authenticator != "":
+		return nil, ErrUnknownUser
+	case !ok:
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// mergeRoles appends the roles that are not in roles yet
+func mergeRoles(roles []string, more ...string) []string {
+	for _, role := range more {
+		if !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
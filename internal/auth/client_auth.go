@@ -11,9 +11,11 @@ import (
 	"oauth2-server/internal/store"
 )
 
-// AuthenticateClient authenticates a client using client credentials
-func AuthenticateClient(clientID, clientSecret string, clientStore *store.ClientStore) (fosite.Client, error) {
-	if clientID == "" || clientSecret == "" {
+// AuthenticateClient authenticates a client using client credentials sent
+// from remoteAddr.
+// Public clients (such as device flow CLIs) authenticate with client_id only.
+func AuthenticateClient(clientID, clientSecret, remoteAddr string, clientStore *store.ClientStore) (fosite.Client, error) {
+	if clientID == "" {
 		return nil, errors.New("client credentials are required")
 	}
 
@@ -25,7 +27,7 @@ func AuthenticateClient(clientID, clientSecret string, clientStore *store.Client
 	}
 
 	// Validate client credentials
-	if err := clientStore.ValidateClientCredentials(clientID, clientSecret); err != nil {
+	if err := clientStore.ValidateClientCredentials(clientID, clientSecret, remoteAddr); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"oauth2-server/pkg/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrUntrustedIssuer is returned for JWTs whose issuer is not configured as trusted
+var ErrUntrustedIssuer = errors.New("token issuer is not trusted")
+
+// FederatedIdentity is the local identity mapped from a verified external JWT
+type FederatedIdentity struct {
+	Issuer  string
+	Subject string
+	// Mapped is set when the subject prefix or the subject of a mapping rule
+	// chose the local subject; otherwise Subject is the issuer's own subject
+	Mapped bool
+	Scopes []string
+	Claims jwt.MapClaims
+}
+
+// TrustedIssuer verifies JWTs from one external issuer against its JWKS
+type TrustedIssuer struct {
+	config config.TrustedIssuerConfig
+	keys   *KeySet
+}
+
+// TrustedIssuers is the set of external issuers accepted by token exchange
+type TrustedIssuers struct {
+	issuers map[string]*TrustedIssuer
+}
+
+// NewTrustedIssuers creates the trusted issuer set, loading file based key sets up front
+func NewTrustedIssuers(configs []config.TrustedIssuerConfig) (*TrustedIssuers, error) {
+	issuers := make(map[string]*TrustedIssuer)
+
+	for _, issuerConfig := range configs {
+		if issuerConfig.SubjectClaim == "" {
+			issuerConfig.SubjectClaim = "sub"
+		}
+
+		issuer := &TrustedIssuer{config: issuerConfig}
+
+		if issuerConfig.JWKSFile != "" {
+			keys, err := NewFileKeySet("trusted issuer "+issuerConfig.Issuer, issuerConfig.JWKSFile)
+			if err != nil {
+				return nil, fmt.Errorf("trusted issuer %s: %w", issuerConfig.Issuer, err)
+			}
+			issuer.keys = keys
+		} else {
+			issuer.keys = NewRemoteKeySet("trusted issuer "+issuerConfig.Issuer, issuerConfig.JWKSURL)
+		}
+
+		issuers[issuerConfig.Issuer] = issuer
+		log.Printf("🤝 Trusted token exchange issuer: %s", issuerConfig.Issuer)
+	}
+
+	return &TrustedIssuers{issuers: issuers}, nil
+}
+
+// PeekIssuer returns the unverified iss claim of a JWT
+func PeekIssuer(tokenString string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return "", err
+	}
+	return claims.GetIssuer()
+}
+
+// IsTrusted reports whether JWTs from the issuer are accepted
+func (t *TrustedIssuers) IsTrusted(issuer string) bool {
+	if t == nil {
+		return false
+	}
+	_, ok := t.issuers[issuer]
+	return ok
+}
+
+// AllowsJWTBearer reports whether assertions of the issuer are accepted by the
+// JWT bearer grant
+func (t *TrustedIssuers) AllowsJWTBearer(issuer string) bool {
+	if !t.IsTrusted(issuer) {
+		return false
+	}
+	return t.issuers[issuer].config.AllowJWTBearer
+}
+
+// Verify validates an external JWT and maps it to a local identity
+func (t *TrustedIssuers) Verify(tokenString string) (*FederatedIdentity, error) {
+	issuerName, err := PeekIssuer(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.IsTrusted(issuerName) {
+		return nil, ErrUntrustedIssuer
+	}
+
+	return t.issuers[issuerName].verify(tokenString)
+}
+
+// verify checks signature, issuer, expiry and audience, then applies the mapping rules
+func (i *TrustedIssuer) verify(tokenString string) (*FederatedIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, i.keys.KeyFunc,
+		jwt.WithValidMethods(externalSigningMethods),
+		jwt.WithIssuer(i.config.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	audiences, err := claims.GetAudience()
+	if err != nil {
+		return nil, err
+	}
+	if !containsAny(audiences, i.config.Audiences) {
+		return nil, fmt.Errorf("token audience %v is not accepted for issuer %s", []string(audiences), i.config.Issuer)
+	}
+
+	return i.mapIdentity(claims)
+}
+
+// mapIdentity maps the claims to a local subject and scopes
+func (i *TrustedIssuer) mapIdentity(claims jwt.MapClaims) (*FederatedIdentity, error) {
+	identity := &FederatedIdentity{
+		Issuer: i.config.Issuer,
+		Claims: claims,
+	}
+
+	if len(i.config.Rules) == 0 {
+		subject := claimString(claims, i.config.SubjectClaim)
+		if subject == "" {
+			return nil, fmt.Errorf("token has no %s claim", i.config.SubjectClaim)
+		}
+		identity.Subject = i.config.SubjectPrefix + subject
+		identity.Mapped = i.config.SubjectPrefix != ""
+		identity.Scopes = i.config.Scopes
+		return identity, nil
+	}
+
+	for _, rule := range i.config.Rules {
+		if !ruleMatches(rule, claims) {
+			continue
+		}
+
+		subject := claimString(claims, i.config.SubjectClaim)
+		if rule.Subject != "" {
+			subject = expandClaims(rule.Subject, claims)
+		}
+		if subject == "" {
+			return nil, fmt.Errorf("token has no %s claim", i.config.SubjectClaim)
+		}
+
+		identity.Subject = i.config.SubjectPrefix + subject
+		identity.Mapped = i.config.SubjectPrefix != "" || rule.Subject != ""
+		identity.Scopes = rule.Scopes
+		return identity, nil
+	}
+
+	return nil, fmt.Errorf("token claims match no mapping rule of issuer %s", i.config.Issuer)
+}
+
+// ruleMatches reports whether all claim patterns of the rule match
+func ruleMatches(rule config.ClaimMappingRule, claims jwt.MapClaims) bool {
+	for claim, pattern := range rule.Claims {
+		value := claimString(claims, claim)
+		matched, err := path.Match(pattern, value)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// expandClaims replaces {claim} placeholders in the template with claim values
+func expandClaims(template string, claims jwt.MapClaims) string {
+	var result strings.Builder
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			break
+		}
+		result.WriteString(template[:start])
+		result.WriteString(claimString(claims, template[start+1:start+end]))
+		template = template[start+end+1:]
+	}
+	result.WriteString(template)
+	return result.String()
+}
+
+// claimString returns a string or numeric claim as string
+func claimString(claims jwt.MapClaims, name string) string {
+	switch value := claims[name].(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprintf("%v", value)
+	case bool:
+		return fmt.Sprintf("%t", value)
+	}
+	return ""
+}
+
+// containsAny reports whether any of the values is in the allowed list
+func containsAny(values, allowed []string) bool {
+	for _, value := range values {
+		for _, a := range allowed {
+			if value == a {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// HtpasswdAuthenticator checks passwords against an Apache htpasswd file with
+// bcrypt, MD5 ($apr1$) or SHA-1 ({SHA}) hashes. The file is re-read when its
+// modification time or size changes.
+type HtpasswdAuthenticator struct {
+	name   string
+	file   string
+	roles  []string
+	scopes []string
+
+	mutex   sync.Mutex
+	hashes  map[string]string
+	modTime time.Time
+	size    int64
+}
+
+// NewHtpasswdAuthenticator creates the backend and loads its file
+func NewHtpasswdAuthenticator(backend config.AuthenticatorConfig) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{
+		name:   backend.BackendName(),
+		file:   backend.File,
+		roles:  backend.Roles,
+		scopes: backend.Scopes,
+	}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Name returns the name of the backend
+func (a *HtpasswdAuthenticator) Name() string {
+	return a.name
+}
+
+// Authenticate checks the password against the entry of the username
+func (a *HtpasswdAuthenticator) Authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	if err := a.reload(); err != nil {
+		// Keep serving the entries that were loaded last
+		log.Printf("❌ Failed to reload htpasswd file %s: %v", a.file, err)
+	}
+
+	a.mutex.Lock()
+	hash, ok := a.hashes[username]
+	a.mutex.Unlock()
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	if !checkHtpasswd(hash, password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &store.User{
+		Username: username,
+		Enabled:  true,
+		Roles:    a.roles,
+		Scopes:   a.scopes,
+	}, nil
+}
+
+// reload reads the file when it changed since the last load
+func (a *HtpasswdAuthenticator) reload() error {
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.hashes != nil && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.file)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	hashes, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.file, err)
+	}
+
+	if a.hashes != nil {
+		log.Printf("🔄 Reloaded htpasswd file %s: %d users", a.file, len(hashes))
+	}
+	a.hashes, a.modTime, a.size = hashes, info.ModTime(), info.Size()
+	return nil
+}
+
+// parseHtpasswd reads "username:hash" lines; entries with unsupported hashes
+// are skipped with a warning
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(entry, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", line)
+		}
+		if !supportedHtpasswdHash(hash) {
+			log.Printf("⚠️  htpasswd line %d: unsupported hash for user %s, use bcrypt (htpasswd -B)", line, username)
+			continue
+		}
+		hashes[username] = hash
+	}
+	return hashes, scanner.Err()
+}
+
+func supportedHtpasswdHash(hash string) bool {
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$", "$apr1$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHtpasswd compares a password with an htpasswd hash
+func checkHtpasswd(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.Index(salt, "$"); i >= 0 {
+			salt = salt[:i]
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+// apr1 computes Apache's MD5-based crypt of a password
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	alternateSum := alternate.Sum(nil)
+
+	digest := md5.New()
+	digest.Write(pw)
+	digest.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		digest.Write(alternateSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write(pw[:1])
+		}
+	}
+	final := digest.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var encoded strings.Builder
+	encode := func(value uint32, n int) {
+		for ; n > 0; n-- {
+			encoded.WriteByte(itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return magic + salt + "$" + encoded.String()
+}
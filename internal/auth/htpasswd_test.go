@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"oauth2-server/pkg/config"
+)
+
+func writeHtpasswd(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	// The apr1 and SHA hashes of "password" were made with openssl
+	writeHtpasswd(t, file, "# users\n"+
+		"bcrypt:"+string(hash)+"\n"+
+		"apr1:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n"+
+		"sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"+
+		"crypt:rl.3StKT.4T8M\n")
+
+	authenticator, err := NewHtpasswdAuthenticator(config.AuthenticatorConfig{
+		Type:   config.AuthenticatorHtpasswd,
+		File:   file,
+		Roles:  []string{"staff"},
+		Scopes: []string{"openid"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		want     error
+	}{
+		{"bcrypt", "bcrypt-secret", nil},
+		{"bcrypt", "wrong", ErrInvalidCredentials},
+		{"apr1", "password", nil},
+		{"apr1", "Password", ErrInvalidCredentials},
+		{"sha", "password", nil},
+		{"sha", "wrong", ErrInvalidCredentials},
+		// DES crypt is not supported, so the entry is skipped
+		{"crypt", "password", ErrUnknownUser},
+		{"nobody", "password", ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		user, err := authenticator.Authenticate(context.Background(), tt.username, tt.password)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.username, tt.password, err, tt.want)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if user.ID != "" || user.Username != tt.username || !user.Enabled ||
+			!reflect.DeepEqual(user.Roles, []string{"staff"}) || !reflect.DeepEqual(user.Scopes, []string{"openid"}) {
+			t.Errorf("Authenticate(%q) = %+v, want an enabled profile with the backend roles and scopes", tt.username, user)
+		}
+	}
+}
+
+func TestHtpasswdReloadsChangedFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, file, "sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+
+	authenticator, err := NewHtpasswdAuthenticator(config.AuthenticatorConfig{Type: config.AuthenticatorHtpasswd, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticator.Authenticate(context.Background(), "apr1", "password"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("Authenticate before the change = %v, want %v", err, ErrUnknownUser)
+	}
+
+	writeHtpasswd(t, file, "apr1:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n")
+	// Make sure the change is visible even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := authenticator.Authenticate(context.Background(), "apr1", "password"); err != nil {
+		t.Fatalf("Authenticate after the change: %v", err)
+	}
+	if _, err := authenticator.Authenticate(context.Background(), "sha", "password"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("Authenticate of a removed user = %v, want %v", err, ErrUnknownUser)
+	}
+
+	// A file that cannot be read keeps the last entries
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticator.Authenticate(context.Background(), "apr1", "password"); err != nil {
+		t.Fatalf("Authenticate after the file was removed: %v", err)
+	}
+}
+
+func TestNewHtpasswdAuthenticatorRejectsMalformedFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, file, "no-hash-here\n")
+
+	if _, err := NewHtpasswdAuthenticator(config.AuthenticatorConfig{Type: config.AuthenticatorHtpasswd, File: file}); err == nil {
+		t.Fatal("NewHtpasswdAuthenticator accepted a line without a hash")
+	}
+}
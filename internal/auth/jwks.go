@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksCacheTTL is how long keys fetched from a JWKS URL are trusted
+	jwksCacheTTL = time.Hour
+	// jwksRefreshInterval limits refetches triggered by unknown key IDs
+	jwksRefreshInterval = time.Minute
+	// jwksMinBackoff and jwksMaxBackoff bound the wait after failed fetches,
+	// which doubles with every failure in a row
+	jwksMinBackoff = 5 * time.Second
+	jwksMaxBackoff = 5 * time.Minute
+)
+
+// externalSigningMethods are the algorithms accepted for JWTs signed by other parties
+var externalSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// KeySet resolves JWT verification keys from a static or remote JSON Web Key Set
+type KeySet struct {
+	name       string
+	url        string
+	httpClient *http.Client
+	keys       *jose.JSONWebKeySet
+	fetchedAt  time.Time
+	// fetching is closed when the fetch in flight completes; nil when idle
+	fetching chan struct{}
+	// fetchErr is the error of the last failed fetch, retried after retryAt
+	fetchErr error
+	backoff  time.Duration
+	retryAt  time.Time
+	mutex    sync.Mutex
+}
+
+// NewStaticKeySet creates a key set from a JWKS document
+func NewStaticKeySet(name string, data []byte) (*KeySet, error) {
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{name: name, keys: keys, fetchedAt: time.Now()}, nil
+}
+
+// NewFileKeySet creates a key set from a JWKS file
+func NewFileKeySet(name, filename string) (*KeySet, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	return NewStaticKeySet(name, data)
+}
+
+// NewRemoteKeySet creates a key set fetched lazily from a JWKS URL
+func NewRemoteKeySet(name, url string) *KeySet {
+	return &KeySet{
+		name:       name,
+		url:        url,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// KeyFunc resolves the verification key by key ID, refreshing remote key sets as needed
+func (s *KeySet) KeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	if s.url != "" {
+		if err := s.refresh(kid); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.keys == nil {
+		return nil, errors.New("no keys available")
+	}
+
+	keys := lookupKeys(s.keys, kid)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return keys[0].Public().Key, nil
+}
+
+// refresh fetches the remote key set when it is stale or lacks kid. Only one
+// fetch runs at a time and the mutex is not held during it; callers without
+// any keys wait for the fetch in flight, the others keep the previous keys.
+func (s *KeySet) refresh(kid string) error {
+	s.mutex.Lock()
+	stale := s.keys == nil || time.Since(s.fetchedAt) > jwksCacheTTL
+	unknownKey := s.keys != nil && len(lookupKeys(s.keys, kid)) == 0 && time.Since(s.fetchedAt) > jwksRefreshInterval
+	if !stale && !unknownKey {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	if s.fetching != nil {
+		fetching, hasKeys := s.fetching, s.keys != nil
+		s.mutex.Unlock()
+		if !hasKeys {
+			<-fetching
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.keys == nil {
+				return s.fetchErr
+			}
+		}
+		return nil
+	}
+
+	if time.Now().Before(s.retryAt) {
+		defer s.mutex.Unlock()
+		if s.keys == nil {
+			return s.fetchErr
+		}
+		return nil
+	}
+
+	fetching := make(chan struct{})
+	s.fetching = fetching
+	s.mutex.Unlock()
+
+	keys, err := s.fetchKeys()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fetching = nil
+	close(fetching)
+
+	if err != nil {
+		s.fetchErr = err
+		s.backoff = min(max(2*s.backoff, jwksMinBackoff), jwksMaxBackoff)
+		s.retryAt = time.Now().Add(s.backoff)
+		// Keep serving from the previous key set if a refetch fails
+		if s.keys == nil {
+			return err
+		}
+		log.Printf("⚠️ Failed to refresh JWKS for %s, retrying in %s: %v", s.name, s.backoff, err)
+		return nil
+	}
+
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	s.fetchErr = nil
+	s.backoff = 0
+	s.retryAt = time.Time{}
+	log.Printf("🔑 Fetched %d keys for %s", len(keys.Keys), s.name)
+	return nil
+}
+
+// fetchKeys downloads and parses the JWKS
+func (s *KeySet) fetchKeys() (*jose.JSONWebKeySet, error) {
+	resp, err := s.httpClient.Get(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS: %w", err)
+	}
+
+	return parseJWKS(data)
+}
+
+// parseJWKS decodes a JWKS document
+func parseJWKS(data []byte) (*jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	if len(keys.Keys) == 0 {
+		return nil, errors.New("JWKS contains no keys")
+	}
+	return &keys, nil
+}
+
+// lookupKeys finds keys by ID; tokens without a kid may use a single-key set
+func lookupKeys(keys *jose.JSONWebKeySet, kid string) []jose.JSONWebKey {
+	if kid == "" {
+		if len(keys.Keys) == 1 {
+			return keys.Keys
+		}
+		return nil
+	}
+	return keys.Key(kid)
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testJWKS(t *testing.T, kid string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRemoteKeySetFetchesOnceForConcurrentCallers(t *testing.T) {
+	jwks := testJWKS(t, "k1")
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	keys := NewRemoteKeySet("test", server.URL)
+	token := &jwt.Token{Header: map[string]interface{}{"kid": "k1"}}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.KeyFunc(token)
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("KeyFunc: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+}
+
+func TestRemoteKeySetBacksOffAfterFailure(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	keys := NewRemoteKeySet("test", server.URL)
+	token := &jwt.Token{Header: map[string]interface{}{"kid": "k1"}}
+
+	for i := 0; i < 3; i++ {
+		if _, err := keys.KeyFunc(token); err == nil {
+			t.Fatal("KeyFunc succeeded without keys")
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("JWKS fetched %d times during the backoff, want 1", n)
+	}
+}
+
+func TestRemoteKeySetKeepsKeysWhenRefreshFails(t *testing.T) {
+	jwks := testJWKS(t, "k1")
+	var fail atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	keys := NewRemoteKeySet("test", server.URL)
+	if _, err := keys.KeyFunc(&jwt.Token{Header: map[string]interface{}{"kid": "k1"}}); err != nil {
+		t.Fatalf("KeyFunc: %v", err)
+	}
+
+	fail.Store(true)
+	keys.fetchedAt = time.Now().Add(-2 * jwksCacheTTL)
+	if _, err := keys.KeyFunc(&jwt.Token{Header: map[string]interface{}{"kid": "k1"}}); err != nil {
+		t.Fatalf("KeyFunc with stale keys: %v", err)
+	}
+}
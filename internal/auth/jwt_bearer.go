@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"oauth2-server/internal/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// maxAssertionLifetime bounds how far in the future an assertion may expire
+const maxAssertionLifetime = time.Hour
+
+// ErrAssertionReplayed is returned for assertions whose jti was already used
+var ErrAssertionReplayed = errors.New("assertion has already been used")
+
+// BearerAssertion is a verified JWT authorization grant (RFC 7523 Section 2.1)
+type BearerAssertion struct {
+	Issuer  string
+	Subject string
+	// Federated is set when the assertion was issued by a trusted external issuer
+	Federated bool
+	// Scopes granted by the issuer's mapping rules; only set for federated assertions
+	Scopes []string
+	Claims jwt.MapClaims
+}
+
+// FederatedSubject namespaces the subject of a federated assertion by its issuer,
+// so it cannot be mistaken for the ID of a local user
+func FederatedSubject(issuer, subject string) string {
+	return "federated:" + issuer + "#" + subject
+}
+
+// clientKeySet caches the key set built from a client's registered keys
+type clientKeySet struct {
+	source string
+	keys   *KeySet
+}
+
+// JWTBearerVerifier verifies JWT bearer assertions signed with the client's own
+// registered keys or by a trusted issuer that allows the grant
+type JWTBearerVerifier struct {
+	audiences      []string
+	trustedIssuers *TrustedIssuers
+	clientKeys     map[string]*clientKeySet
+	usedJTIs       map[string]time.Time
+	mutex          sync.Mutex
+}
+
+// NewJWTBearerVerifier creates a verifier accepting assertions addressed to one of the audiences
+func NewJWTBearerVerifier(audiences []string, trustedIssuers *TrustedIssuers) *JWTBearerVerifier {
+	return &JWTBearerVerifier{
+		audiences:      audiences,
+		trustedIssuers: trustedIssuers,
+		clientKeys:     make(map[string]*clientKeySet),
+		usedJTIs:       make(map[string]time.Time),
+	}
+}
+
+// Verify validates an assertion presented by the client. Assertions issued by the
+// client itself are checked against its jwks or jwks_uri; all others must come
+// from a trusted issuer with allow_jwt_bearer set.
+func (v *JWTBearerVerifier) Verify(assertion string, client *store.Client) (*BearerAssertion, error) {
+	issuer, err := PeekIssuer(assertion)
+	if err != nil {
+		return nil, err
+	}
+	if issuer == "" {
+		return nil, errors.New("assertion has no iss claim")
+	}
+
+	var result *BearerAssertion
+	if issuer == client.ID {
+		result, err = v.verifyClientAssertion(assertion, client)
+	} else if v.trustedIssuers.AllowsJWTBearer(issuer) {
+		result, err = v.verifyFederatedAssertion(assertion)
+	} else {
+		return nil, ErrUntrustedIssuer
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v.checkLifetimeAndReplay(issuer, result.Claims); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// verifyClientAssertion verifies an assertion signed with the client's registered keys
+func (v *JWTBearerVerifier) verifyClientAssertion(assertion string, client *store.Client) (*BearerAssertion, error) {
+	keys, err := v.keysForClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(assertion, claims, keys.KeyFunc,
+		jwt.WithValidMethods(externalSigningMethods),
+		jwt.WithIssuer(client.ID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	audiences, err := claims.GetAudience()
+	if err != nil {
+		return nil, err
+	}
+	if !containsAny(audiences, v.audiences) {
+		return nil, fmt.Errorf("assertion audience %v does not identify this server", []string(audiences))
+	}
+
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, errors.New("assertion has no sub claim")
+	}
+
+	return &BearerAssertion{
+		Issuer:  client.ID,
+		Subject: subject,
+		Claims:  claims,
+	}, nil
+}
+
+// verifyFederatedAssertion verifies an assertion of a trusted issuer and applies its mapping
+func (v *JWTBearerVerifier) verifyFederatedAssertion(assertion string) (*BearerAssertion, error) {
+	identity, err := v.trustedIssuers.Verify(assertion)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BearerAssertion{
+		Issuer:    identity.Issuer,
+		Subject:   identity.Subject,
+		Federated: true,
+		Scopes:    identity.Scopes,
+		Claims:    identity.Claims,
+	}, nil
+}
+
+// keysForClient returns the cached key set of the client, rebuilding it when
+// the registered keys changed
+func (v *JWTBearerVerifier) keysForClient(client *store.Client) (*KeySet, error) {
+	if client.JWKS == "" && client.JWKSURI == "" {
+		return nil, fmt.Errorf("client %s has no registered keys", client.ID)
+	}
+
+	source := client.JWKSURI + "\n" + client.JWKS
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if cached, ok := v.clientKeys[client.ID]; ok && cached.source == source {
+		return cached.keys, nil
+	}
+
+	var keys *KeySet
+	if client.JWKS != "" {
+		var err error
+		keys, err = NewStaticKeySet("client "+client.ID, []byte(client.JWKS))
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %w", client.ID, err)
+		}
+	} else {
+		keys = NewRemoteKeySet("client "+client.ID, client.JWKSURI)
+	}
+
+	v.clientKeys[client.ID] = &clientKeySet{source: source, keys: keys}
+	return keys, nil
+}
+
+// checkLifetimeAndReplay rejects long-lived assertions and reused jti values
+func (v *JWTBearerVerifier) checkLifetimeAndReplay(issuer string, claims jwt.MapClaims) error {
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return errors.New("assertion has no exp claim")
+	}
+	if time.Until(exp.Time) > maxAssertionLifetime {
+		return fmt.Errorf("assertion expires more than %s in the future", maxAssertionLifetime)
+	}
+
+	jti := claimString(claims, "jti")
+	if jti == "" {
+		return nil
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := time.Now()
+	for key, expiresAt := range v.usedJTIs {
+		if now.After(expiresAt) {
+			delete(v.usedJTIs, key)
+		}
+	}
+
+	key := issuer + "\n" + jti
+	if _, used := v.usedJTIs[key]; used {
+		return ErrAssertionReplayed
+	}
+	// Keep the jti past expiry for the leeway granted during validation
+	v.usedJTIs[key] = exp.Time.Add(30 * time.Second)
+	return nil
+}
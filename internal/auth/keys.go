@@ -0,0 +1,441 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/golang-jwt/jwt/v5"
+
+	"oauth2-server/internal/store"
+)
+
+// maxPreviousKeys is how many rotated-out keys stay in the JWKS so tokens
+// signed before a rotation can still be verified
+const maxPreviousKeys = 2
+
+// KeyReloadInterval is how often replicas look for keys rotated by another
+// replica; a token with an unknown key ID triggers a reload sooner, at most
+// once per minKeyReloadInterval
+const (
+	KeyReloadInterval    = 30 * time.Second
+	minKeyReloadInterval = 5 * time.Second
+)
+
+// signingKey is one RSA key with its key ID
+type signingKey struct {
+	privateKey *rsa.PrivateKey
+	keyID      string
+	createdAt  time.Time
+}
+
+// KeyInfo describes a signing key without exposing it
+type KeyInfo struct {
+	KeyID     string    `json:"kid"`
+	Algorithm string    `json:"alg"`
+	CreatedAt time.Time `json:"created_at"`
+	Active    bool      `json:"active"`
+}
+
+// KeyManager holds the RSA keys used to sign JWTs issued by this server. New
+// tokens are signed with the current key; keys replaced by Rotate remain
+// valid for verification. A manager created by LoadKeyManager keeps its keys
+// in the storage backend, so they survive restarts.
+type KeyManager struct {
+	mutex    sync.RWMutex
+	current  *signingKey
+	previous []*signingKey
+	issuer   string
+	// storage is nil for keys that only live in this process
+	storage store.SigningKeyStorage
+
+	reloadMutex sync.Mutex
+	lastReload  time.Time
+}
+
+// NewKeyManager generates a new RSA signing key for the given issuer that is
+// not persisted
+func NewKeyManager(issuer string) (*KeyManager, error) {
+	key, err := generateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyManager{
+		current: key,
+		issuer:  issuer,
+	}, nil
+}
+
+// LoadKeyManager loads the signing keys of the issuer from storage, and
+// generates and stores the first key when there is none yet
+func LoadKeyManager(ctx context.Context, issuer string, storage store.SigningKeyStorage) (*KeyManager, error) {
+	k := &KeyManager{issuer: issuer, storage: storage}
+
+	stored, err := storage.ListSigningKeys(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	if len(stored) == 0 {
+		key, err := generateSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := k.saveKey(ctx, key); err != nil {
+			return nil, err
+		}
+		log.Printf("🔑 Generated signing key %s for %s", key.keyID, issuer)
+
+		// Replicas that started together may each have stored a key; all of
+		// them sign with the newest
+		if stored, err = storage.ListSigningKeys(ctx, issuer); err != nil {
+			return nil, fmt.Errorf("failed to load signing keys: %w", err)
+		}
+	}
+
+	if err := k.setKeys(stored); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// setKeys makes the newest of the stored keys current and keeps up to
+// maxPreviousKeys older ones for verification
+func (k *KeyManager) setKeys(stored []*store.SigningKey) error {
+	if len(stored) == 0 {
+		return errors.New("no signing keys stored")
+	}
+	if len(stored) > maxPreviousKeys+1 {
+		stored = stored[:maxPreviousKeys+1]
+	}
+
+	keys := make([]*signingKey, 0, len(stored))
+	for _, record := range stored {
+		key, err := decodeSigningKey(record)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.current = keys[0]
+	k.previous = keys[1:]
+	return nil
+}
+
+// saveKey stores a key of the issuer
+func (k *KeyManager) saveKey(ctx context.Context, key *signingKey) error {
+	encoded, err := x509.MarshalPKCS8PrivateKey(key.privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode signing key: %w", err)
+	}
+	if err := k.storage.SaveSigningKey(ctx, &store.SigningKey{
+		ID:         key.keyID,
+		Issuer:     k.issuer,
+		PrivateKey: encoded,
+		CreatedAt:  key.createdAt,
+	}); err != nil {
+		return fmt.Errorf("failed to store signing key: %w", err)
+	}
+	return nil
+}
+
+// decodeSigningKey parses a stored key
+func decodeSigningKey(record *store.SigningKey) (*signingKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(record.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signing key %s: %w", record.ID, err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an RSA key", record.ID)
+	}
+	return &signingKey{
+		privateKey: privateKey,
+		keyID:      record.ID,
+		createdAt:  record.CreatedAt,
+	}, nil
+}
+
+// generateSigningKey creates an RSA key with a key ID derived from the public modulus
+func generateSigningKey() (*signingKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+	}
+
+	sum := sha256.Sum256(privateKey.PublicKey.N.Bytes())
+
+	return &signingKey{
+		privateKey: privateKey,
+		keyID:      base64.RawURLEncoding.EncodeToString(sum[:8]),
+		createdAt:  time.Now(),
+	}, nil
+}
+
+// PrivateKey returns the current RSA signing key
+func (k *KeyManager) PrivateKey() *rsa.PrivateKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.current.privateKey
+}
+
+// KeyID returns the key ID of the current key, advertised in JWT headers
+func (k *KeyManager) KeyID() string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.current.keyID
+}
+
+// SigningKey returns the current key as a JWK, so tokens signed by fosite
+// (such as ID tokens) carry its key ID
+func (k *KeyManager) SigningKey() *jose.JSONWebKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return &jose.JSONWebKey{
+		Key:       k.current.privateKey,
+		KeyID:     k.current.keyID,
+		Algorithm: "RS256",
+		Use:       "sig",
+	}
+}
+
+// Issuer returns the issuer set on signed tokens
+func (k *KeyManager) Issuer() string {
+	return k.issuer
+}
+
+// Rotate replaces the signing key with a new one. The replaced key stays in
+// the JWKS and is accepted for verification until it is one of more than
+// maxPreviousKeys older keys; stored keys older than that are deleted.
+func (k *KeyManager) Rotate(ctx context.Context) (KeyInfo, error) {
+	key, err := generateSigningKey()
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	// Stored keys are shared with the other replicas, which pick the new key
+	// up with Reload; the key set is taken from the storage so a concurrent
+	// reload or rotation elsewhere cannot list a key twice
+	if k.storage != nil {
+		if err := k.saveKey(ctx, key); err != nil {
+			return KeyInfo{}, err
+		}
+		k.deleteRetiredKeys(ctx)
+		if _, err := k.Reload(ctx); err != nil {
+			return KeyInfo{}, err
+		}
+		return key.info(true), nil
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.previous = append([]*signingKey{k.current}, k.previous...)
+	if len(k.previous) > maxPreviousKeys {
+		k.previous = k.previous[:maxPreviousKeys]
+	}
+	k.current = key
+
+	return key.info(true), nil
+}
+
+// Reload picks up the keys stored by other replicas, so a rotation on one
+// replica reaches all of them. It returns how many keys were new.
+func (k *KeyManager) Reload(ctx context.Context) (int, error) {
+	if k.storage == nil {
+		return 0, nil
+	}
+	k.reloadMutex.Lock()
+	defer k.reloadMutex.Unlock()
+	k.lastReload = time.Now()
+
+	stored, err := k.storage.ListSigningKeys(ctx, k.issuer)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	if len(stored) > maxPreviousKeys+1 {
+		stored = stored[:maxPreviousKeys+1]
+	}
+
+	k.mutex.RLock()
+	known := make(map[string]bool, 1+len(k.previous))
+	for _, key := range append([]*signingKey{k.current}, k.previous...) {
+		known[key.keyID] = true
+	}
+	current := k.current.keyID
+	k.mutex.RUnlock()
+
+	added := 0
+	for _, key := range stored {
+		if !known[key.ID] {
+			added++
+		}
+	}
+	// An empty storage keeps the loaded keys
+	if len(stored) == 0 || (added == 0 && len(stored) == len(known) && stored[0].ID == current) {
+		return 0, nil
+	}
+
+	if err := k.setKeys(stored); err != nil {
+		return 0, err
+	}
+	log.Printf("🔑 Reloaded signing keys of %s, current key %s", k.issuer, stored[0].ID)
+	return added, nil
+}
+
+// reloadForUnknownKey reloads the keys when a token names a key ID that may
+// have been created by another replica since the last reload
+func (k *KeyManager) reloadForUnknownKey() bool {
+	if k.storage == nil {
+		return false
+	}
+	k.reloadMutex.Lock()
+	recent := time.Since(k.lastReload) < minKeyReloadInterval
+	k.reloadMutex.Unlock()
+	if recent {
+		return false
+	}
+
+	added, err := k.Reload(context.Background())
+	if err != nil {
+		log.Printf("⚠️ Failed to reload signing keys: %v", err)
+	}
+	return added > 0
+}
+
+// deleteRetiredKeys removes the stored keys that are no longer accepted for
+// verification; failures only leave unused keys behind
+func (k *KeyManager) deleteRetiredKeys(ctx context.Context) {
+	stored, err := k.storage.ListSigningKeys(ctx, k.issuer)
+	if err != nil {
+		log.Printf("⚠️ Failed to list signing keys: %v", err)
+		return
+	}
+	for i := maxPreviousKeys + 1; i < len(stored); i++ {
+		if err := k.storage.DeleteSigningKey(ctx, stored[i].ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Printf("⚠️ Failed to delete retired signing key %s: %v", stored[i].ID, err)
+		}
+	}
+}
+
+// Keys lists the current key first, followed by the keys still accepted for verification
+func (k *KeyManager) Keys() []KeyInfo {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	keys := []KeyInfo{k.current.info(true)}
+	for _, key := range k.previous {
+		keys = append(keys, key.info(false))
+	}
+	return keys
+}
+
+// info describes the key
+func (s *signingKey) info(active bool) KeyInfo {
+	return KeyInfo{
+		KeyID:     s.keyID,
+		Algorithm: jwt.SigningMethodRS256.Alg(),
+		CreatedAt: s.createdAt,
+		Active:    active,
+	}
+}
+
+// verificationKey returns the public key for a key ID; tokens without a kid
+// are verified with the current key
+func (k *KeyManager) verificationKey(kid string) (*rsa.PublicKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if kid == "" || kid == k.current.keyID {
+		return &k.current.privateKey.PublicKey, true
+	}
+	for _, key := range k.previous {
+		if key.keyID == kid {
+			return &key.privateKey.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// SignClaims signs the claims as an RS256 JWT, filling in iss and iat when missing
+func (k *KeyManager) SignClaims(claims jwt.MapClaims) (string, error) {
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = k.issuer
+	}
+	if _, ok := claims["iat"]; !ok {
+		claims["iat"] = time.Now().Unix()
+	}
+
+	k.mutex.RLock()
+	key := k.current
+	k.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.keyID
+	return token.SignedString(key.privateKey)
+}
+
+// ParseToken verifies a JWT signed by this server and returns its claims
+func (k *KeyManager) ParseToken(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		publicKey, ok := k.verificationKey(kid)
+		if !ok && k.reloadForUnknownKey() {
+			publicKey, ok = k.verificationKey(kid)
+		}
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		return publicKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(k.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// JWKS returns the public keys as a JSON Web Key Set, current key first
+func (k *KeyManager) JWKS() map[string]interface{} {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	keys := make([]map[string]interface{}, 0, 1+len(k.previous))
+	for _, key := range append([]*signingKey{k.current}, k.previous...) {
+		publicKey := key.privateKey.PublicKey
+		keys = append(keys, map[string]interface{}{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": key.keyID,
+			"alg": jwt.SigningMethodRS256.Alg(),
+			"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		})
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
+
+// IsJWT reports whether a token looks like a compact serialized JWT
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/internal/store/sqlstore"
+)
+
+const keysTestIssuer = "https://auth.example.org"
+
+func TestLoadKeyManagerKeepsKeysAcrossRestarts(t *testing.T) {
+	sqlite, err := sqlstore.Open(sqlstore.DriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+
+	backends := map[string]store.Backend{
+		"memory": store.NewMemoryBackend(),
+		"sqlite": sqlite,
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			keys, err := LoadKeyManager(ctx, keysTestIssuer, backend.SigningKeys())
+			if err != nil {
+				t.Fatalf("LoadKeyManager: %v", err)
+			}
+			token, err := keys.SignClaims(jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A restart loads the same key, so tokens stay valid
+			restarted, err := LoadKeyManager(ctx, keysTestIssuer, backend.SigningKeys())
+			if err != nil {
+				t.Fatalf("LoadKeyManager after a restart: %v", err)
+			}
+			if restarted.KeyID() != keys.KeyID() {
+				t.Fatalf("key ID after a restart = %s, want %s", restarted.KeyID(), keys.KeyID())
+			}
+			if _, err := restarted.ParseToken(token); err != nil {
+				t.Fatalf("token signed before the restart: %v", err)
+			}
+
+			// Other issuers, such as other realms sharing the database, have their own keys
+			other, err := LoadKeyManager(ctx, keysTestIssuer+"/realms/partners", backend.SigningKeys())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other.KeyID() == keys.KeyID() {
+				t.Error("another issuer got the same signing key")
+			}
+
+			// Rotations are stored, and only the keys still in the JWKS are kept
+			var rotated KeyInfo
+			for i := 0; i < maxPreviousKeys+2; i++ {
+				if rotated, err = keys.Rotate(ctx); err != nil {
+					t.Fatalf("Rotate: %v", err)
+				}
+			}
+			restarted, err = LoadKeyManager(ctx, keysTestIssuer, backend.SigningKeys())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restarted.KeyID() != rotated.KeyID {
+				t.Errorf("key ID after rotating = %s, want %s", restarted.KeyID(), rotated.KeyID)
+			}
+			stored, err := backend.SigningKeys().ListSigningKeys(ctx, keysTestIssuer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) != maxPreviousKeys+1 {
+				t.Errorf("%d keys stored, want %d", len(stored), maxPreviousKeys+1)
+			}
+		})
+	}
+}
+
+func TestReplicasPickUpRotatedKeys(t *testing.T) {
+	sqlite, err := sqlstore.Open(sqlstore.DriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+
+	ctx := context.Background()
+	first, err := LoadKeyManager(ctx, keysTestIssuer, sqlite.SigningKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadKeyManager(ctx, keysTestIssuer, sqlite.SigningKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := first.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	token, err := first.SignClaims(jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token with the new key makes the other replica reload its keys
+	if _, err := second.ParseToken(token); err != nil {
+		t.Fatalf("token signed with the rotated key on another replica: %v", err)
+	}
+	if second.KeyID() != rotated.KeyID {
+		t.Errorf("key ID of the other replica = %s, want %s", second.KeyID(), rotated.KeyID)
+	}
+	if added, err := second.Reload(ctx); err != nil || added != 0 {
+		t.Errorf("Reload without changes = %d, %v, want 0", added, err)
+	}
+
+	if _, err := second.Rotate(ctx); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if added, err := first.Reload(ctx); err != nil || added != 1 {
+		t.Fatalf("Reload after a rotation elsewhere = %d, %v, want 1", added, err)
+	}
+	if first.KeyID() != second.KeyID() || len(first.Keys()) != len(second.Keys()) {
+		t.Errorf("replicas disagree: %v and %v", first.Keys(), second.Keys())
+	}
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// LDAPAuthenticator finds users with a service account and checks their
+// password by binding with the user's DN. Profile claims come from the user's
+// attributes and roles from the groups the user is a member of.
+type LDAPAuthenticator struct {
+	name      string
+	config    config.LDAPConfig
+	roles     []string
+	scopes    []string
+	mapping   map[string]string
+	tlsConfig *tls.Config
+}
+
+// NewLDAPAuthenticator creates the backend; connections are opened per login
+func NewLDAPAuthenticator(backend config.AuthenticatorConfig) (*LDAPAuthenticator, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: backend.LDAP.InsecureSkipVerify,
+	}
+	if backend.LDAP.CAFile != "" {
+		pem, err := os.ReadFile(backend.LDAP.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ldap ca_file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ldap ca_file %s contains no certificates", backend.LDAP.CAFile)
+		}
+	}
+	if _, err := backend.LDAP.Password(); err != nil {
+		return nil, err
+	}
+
+	return &LDAPAuthenticator{
+		name:      backend.BackendName(),
+		config:    backend.LDAP,
+		roles:     backend.Roles,
+		scopes:    backend.Scopes,
+		mapping:   backend.LDAP.AttributeMapping(),
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+// Name returns the name of the backend
+func (a *LDAPAuthenticator) Name() string {
+	return a.name
+}
+
+// Authenticate looks up the user, binds as the user and reads the groups
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := a.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+
+	attributes := make([]string, 0, len(a.mapping))
+	for _, attribute := range a.mapping {
+		attributes = append(attributes, attribute)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.config.Timeout().Seconds()), false,
+		strings.ReplaceAll(a.config.UserFilterTemplate(), "{username}", ldap.EscapeFilter(username)),
+		attributes, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap user search failed: %w", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+	default:
+		return nil, fmt.Errorf("ldap user search for %q matched more than one entry", username)
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind as %s failed: %w", entry.DN, err)
+	}
+
+	user := &store.User{
+		Username: username,
+		Enabled:  true,
+		Roles:    mergeRoles(nil, a.roles...),
+		Scopes:   a.scopes,
+	}
+	for claim, attribute := range a.mapping {
+		value := entry.GetAttributeValue(attribute)
+		switch {
+		case value == "":
+		case claim == "email":
+			user.Email = value
+		case claim == "name":
+			user.Name = value
+		default:
+			if user.Attributes == nil {
+				user.Attributes = make(map[string]string)
+			}
+			user.Attributes[claim] = value
+		}
+	}
+
+	if a.config.GroupBaseDN != "" {
+		// Search groups with the service account, the user may not be allowed to
+		if err := a.bindServiceAccount(conn); err != nil {
+			return nil, err
+		}
+		groups, err := a.groups(conn, entry.DN, username)
+		if err != nil {
+			return nil, err
+		}
+		user.Roles = mergeRoles(user.Roles, a.groupRoles(groups)...)
+	}
+	return user, nil
+}
+
+// connect dials the server and upgrades the connection with StartTLS if configured
+func (a *LDAPAuthenticator) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout()}),
+		ldap.DialWithTLSConfig(a.tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ldap server: %w", err)
+	}
+	conn.SetTimeout(a.config.Timeout())
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// bindServiceAccount binds with the configured service account, if any
+func (a *LDAPAuthenticator) bindServiceAccount(conn *ldap.Conn) error {
+	if a.config.BindDN == "" {
+		return nil
+	}
+	// Read per bind so a rotated password file is picked up
+	password, err := a.config.Password()
+	if err != nil {
+		return err
+	}
+	if err := conn.Bind(a.config.BindDN, password); err != nil {
+		return fmt.Errorf("ldap service account bind failed: %w", err)
+	}
+	return nil
+}
+
+// groups returns the names of the groups the user is a member of
+func (a *LDAPAuthenticator) groups(conn *ldap.Conn, dn, username string) ([]string, error) {
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(dn),
+		"{username}", ldap.EscapeFilter(username),
+	).Replace(a.config.GroupFilterTemplate())
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.config.Timeout().Seconds()), false,
+		filter, []string{a.config.GroupName()}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap group search failed: %w", err)
+	}
+
+	var groups []string
+	for _, entry := range result.Entries {
+		if name := entry.GetAttributeValue(a.config.GroupName()); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// groupRoles maps group names to roles; without group_roles every group is a role
+func (a *LDAPAuthenticator) groupRoles(groups []string) []string {
+	if len(a.config.GroupRoles) == 0 {
+		return groups
+	}
+	var roles []string
+	for _, group := range groups {
+		if role, ok := a.config.GroupRoles[group]; ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,358 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"oauth2-server/pkg/config"
+)
+
+// LDAP protocol operations answered by the test server
+const (
+	ldapBindRequest       ber.Tag = 0
+	ldapBindResponse      ber.Tag = 1
+	ldapUnbindRequest     ber.Tag = 2
+	ldapSearchRequest     ber.Tag = 3
+	ldapSearchResultEntry ber.Tag = 4
+	ldapSearchResultDone  ber.Tag = 5
+)
+
+const (
+	ldapServiceDN       = "cn=svc,dc=example,dc=org"
+	ldapServicePassword = "svc-secret"
+	ldapAliceDN         = "uid=alice,ou=people,dc=example,dc=org"
+	ldapAlicePassword   = "wonderland"
+	ldapBobDN           = "uid=bob,ou=people,dc=example,dc=org"
+)
+
+type ldapEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapTestServer is a minimal LDAP server for simple binds and searches with
+// and, or, not, equality and presence filters. It records the search filters
+// it receives and only lets the service account search.
+type ldapTestServer struct {
+	listener net.Listener
+	entries  []ldapEntry
+
+	mutex   sync.Mutex
+	filters []string
+}
+
+func newLDAPTestServer(t *testing.T) *ldapTestServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapTestServer{
+		listener: listener,
+		entries: []ldapEntry{
+			{dn: ldapServiceDN, password: ldapServicePassword},
+			{dn: ldapAliceDN, password: ldapAlicePassword, attributes: map[string][]string{
+				"uid":              {"alice"},
+				"cn":               {"Alice Liddell"},
+				"mail":             {"alice@example.org"},
+				"departmentNumber": {"research"},
+			}},
+			{dn: ldapBobDN, password: "builder", attributes: map[string][]string{
+				"uid": {"bob"},
+				"cn":  {"Bob"},
+			}},
+			{dn: "cn=admins,ou=groups,dc=example,dc=org", attributes: map[string][]string{
+				"cn":     {"admins"},
+				"member": {ldapAliceDN},
+			}},
+			{dn: "cn=staff,ou=groups,dc=example,dc=org", attributes: map[string][]string{
+				"cn":           {"staff"},
+				"uniqueMember": {ldapAliceDN, ldapBobDN},
+			}},
+		},
+	}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *ldapTestServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapTestServer) receivedFilters() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.filters...)
+}
+
+func (s *ldapTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ldapTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+	var boundDN string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldapBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if entry := s.find(dn); entry != nil && entry.password != "" && entry.password == password {
+				code = ldap.LDAPResultSuccess
+				boundDN = entry.dn
+			}
+			conn.Write(ldapMessage(messageID, ldapResult(ldapBindResponse, code)).Bytes())
+		case ldapSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			s.mutex.Lock()
+			s.filters = append(s.filters, filter)
+			s.mutex.Unlock()
+
+			if boundDN != ldapServiceDN {
+				conn.Write(ldapMessage(messageID, ldapResult(ldapSearchResultDone, ldap.LDAPResultInsufficientAccessRights)).Bytes())
+				continue
+			}
+			base := strings.ToLower(op.Children[0].Value.(string))
+			var requested []string
+			for _, attribute := range op.Children[7].Children {
+				requested = append(requested, attribute.Value.(string))
+			}
+			for _, entry := range s.entries {
+				if strings.HasSuffix(strings.ToLower(entry.dn), ","+base) && ldapMatch(op.Children[6], entry) {
+					conn.Write(ldapMessage(messageID, ldapSearchEntry(entry, requested)).Bytes())
+				}
+			}
+			conn.Write(ldapMessage(messageID, ldapResult(ldapSearchResultDone, ldap.LDAPResultSuccess)).Bytes())
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *ldapTestServer) find(dn string) *ldapEntry {
+	for i := range s.entries {
+		if strings.EqualFold(s.entries[i].dn, dn) {
+			return &s.entries[i]
+		}
+	}
+	return nil
+}
+
+// ldapMatch evaluates a search filter against an entry; values compare case-insensitively
+func ldapMatch(filter *ber.Packet, entry ldapEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !ldapMatch(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if ldapMatch(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !ldapMatch(filter.Children[0], entry)
+	case ldap.FilterEqualityMatch:
+		want := filter.Children[1].Data.String()
+		for _, value := range ldapValues(entry, filter.Children[0].Data.String()) {
+			if strings.EqualFold(value, want) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(ldapValues(entry, filter.Data.String())) > 0
+	default:
+		return false
+	}
+}
+
+func ldapValues(entry ldapEntry, attribute string) []string {
+	for name, values := range entry.attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+func ldapMessage(messageID interface{}, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return op
+}
+
+func ldapSearchEntry(entry ldapEntry, requested []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, name := range requested {
+		values := ldapValues(entry, name)
+		if len(values) == 0 {
+			continue
+		}
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return op
+}
+
+func newTestLDAPAuthenticator(t *testing.T, server *ldapTestServer, configure func(*config.LDAPConfig)) *LDAPAuthenticator {
+	t.Helper()
+	backend := config.AuthenticatorConfig{
+		Type:  config.AuthenticatorLDAP,
+		Roles: []string{"employee"},
+		LDAP: config.LDAPConfig{
+			URL:            server.url(),
+			BindDN:         ldapServiceDN,
+			BindPassword:   ldapServicePassword,
+			UserBaseDN:     "ou=people,dc=example,dc=org",
+			GroupBaseDN:    "ou=groups,dc=example,dc=org",
+			Attributes:     map[string]string{"department": "departmentNumber"},
+			TimeoutSeconds: 5,
+		},
+	}
+	if configure != nil {
+		configure(&backend.LDAP)
+	}
+	authenticator, err := NewLDAPAuthenticator(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	server := newLDAPTestServer(t)
+	authenticator := newTestLDAPAuthenticator(t, server, func(l *config.LDAPConfig) {
+		l.GroupRoles = map[string]string{"admins": "admin"}
+	})
+
+	user, err := authenticator.Authenticate(context.Background(), "alice", ldapAlicePassword)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if user.ID != "" || user.Username != "alice" || !user.Enabled {
+		t.Errorf("user = %+v, want an enabled profile of alice without ID", user)
+	}
+	if user.Email != "alice@example.org" || user.Name != "Alice Liddell" {
+		t.Errorf("email, name = %q, %q, want the mail and cn attributes", user.Email, user.Name)
+	}
+	if want := map[string]string{"department": "research"}; !reflect.DeepEqual(user.Attributes, want) {
+		t.Errorf("attributes = %v, want %v", user.Attributes, want)
+	}
+	// staff is not in group_roles
+	if want := []string{"employee", "admin"}; !reflect.DeepEqual(user.Roles, want) {
+		t.Errorf("roles = %v, want %v", user.Roles, want)
+	}
+}
+
+func TestLDAPAuthenticateGroupsWithoutRoleMapping(t *testing.T) {
+	server := newLDAPTestServer(t)
+	authenticator := newTestLDAPAuthenticator(t, server, nil)
+
+	user, err := authenticator.Authenticate(context.Background(), "alice", ldapAlicePassword)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if want := []string{"employee", "admins", "staff"}; !reflect.DeepEqual(user.Roles, want) {
+		t.Errorf("roles = %v, want %v", user.Roles, want)
+	}
+}
+
+func TestLDAPAuthenticateRejectsCredentials(t *testing.T) {
+	server := newLDAPTestServer(t)
+	authenticator := newTestLDAPAuthenticator(t, server, nil)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     error
+	}{
+		{"wrong password", "alice", "queen-of-hearts", ErrInvalidCredentials},
+		{"empty password", "alice", "", ErrInvalidCredentials},
+		{"unknown user", "carol", "anything", ErrUnknownUser},
+		{"wildcard username", "*", ldapAlicePassword, ErrUnknownUser},
+		{"filter injection", "alice)(|(uid=*", ldapAlicePassword, ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := authenticator.Authenticate(context.Background(), tt.username, tt.password); !errors.Is(err, tt.want) {
+				t.Fatalf("Authenticate(%q) = %v, want %v", tt.username, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticateEscapesFilters(t *testing.T) {
+	server := newLDAPTestServer(t)
+	authenticator := newTestLDAPAuthenticator(t, server, func(l *config.LDAPConfig) {
+		l.UserFilter = "(&(objectClass=*)(uid={username}))"
+	})
+
+	if _, err := authenticator.Authenticate(context.Background(), "a*)(uid=*", "secret"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("Authenticate = %v, want %v", err, ErrUnknownUser)
+	}
+	want := []string{`(&(objectClass=*)(uid=a\2a\29\28uid=\2a))`}
+	if got := server.receivedFilters(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("filters = %q, want %q", got, want)
+	}
+}
+
+func TestLDAPAuthenticateServiceAccountFailure(t *testing.T) {
+	server := newLDAPTestServer(t)
+	authenticator := newTestLDAPAuthenticator(t, server, func(l *config.LDAPConfig) {
+		l.BindPassword = "wrong"
+	})
+
+	_, err := authenticator.Authenticate(context.Background(), "alice", ldapAlicePassword)
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("Authenticate = %v, want a backend error", err)
+	}
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/store"
+)
+
+// Authentication method references (RFC 8176) and authentication context
+// classes recorded in login sessions and ID tokens
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRMFA      = "mfa"
+
+	ACRSingleFactor = "1"
+	ACRMultiFactor  = "2"
+)
+
+// Second factors recorded in the audit log
+const (
+	FactorTOTP         = "totp"
+	FactorRecoveryCode = "recovery_code"
+)
+
+var (
+	// ErrMFARequired is returned where a second factor cannot be asked for,
+	// such as the password grant
+	ErrMFARequired = errors.New("multi-factor authentication is required")
+	// ErrMFANotEnrolled is returned when verifying a user without a second factor
+	ErrMFANotEnrolled = errors.New("multi-factor authentication is not set up")
+	// ErrInvalidMFACode is returned for wrong, reused and expired codes
+	ErrInvalidMFACode = errors.New("invalid authentication code")
+	// ErrMFAAlreadyEnrolled is returned when enrolling a second factor for a
+	// user who has one, without proving it in the same login
+	ErrMFAAlreadyEnrolled = errors.New("a second factor is already set up")
+)
+
+// PasswordAMR returns the authentication methods of a password login,
+// optionally confirmed with a one-time code
+func PasswordAMR(withOTP bool) []string {
+	if withOTP {
+		return []string{AMRPassword, AMROTP, AMRMFA}
+	}
+	return []string{AMRPassword}
+}
+
+// ACR returns the authentication context class of the authentication methods
+func ACR(amr []string) string {
+	for _, method := range amr {
+		if method == AMRMFA {
+			return ACRMultiFactor
+		}
+	}
+	return ACRSingleFactor
+}
+
+// MFARequired reports whether the password login of the user needs a second
+// factor: always once enrolled, and for users and roles listed in the mfa
+// section, who have to enrol first
+func (a *UserAuthenticator) MFARequired(user *store.User) bool {
+	return user.MFA != nil || a.config.MFA.Required(user.Username, user.Roles)
+}
+
+// mayEnroll reports whether a second factor may be added to the user: when
+// the user has none yet, or when the login proved one of them (amr lists the
+// authentication methods of the login), so a login with only the password
+// cannot replace or add to the factors of an account
+func mayEnroll(user *store.User, amr []string) bool {
+	if user.MFA == nil && len(user.Passkeys) == 0 {
+		return true
+	}
+	for _, method := range amr {
+		if method == AMRMFA {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPIssuer returns the issuer shown in authenticator apps
+func (a *UserAuthenticator) TOTPIssuer() string {
+	if a.config.MFA.Issuer != "" {
+		return a.config.MFA.Issuer
+	}
+	if parsed, err := url.Parse(a.config.Server.BaseURL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return "oauth2-server"
+}
+
+// VerifyMFA checks the one-time code or an unused recovery code of an enrolled
+// user after the password was verified. Wrong codes count towards the lockout
+// of the account like wrong passwords.
+func (a *UserAuthenticator) VerifyMFA(attempt LoginAttempt, userID, code string) (*store.User, error) {
+	a.mfaMutex.Lock()
+	defer a.mfaMutex.Unlock()
+
+	// Reload the user so a code accepted meanwhile is not accepted again
+	user, found := a.users.GetUser(userID)
+	if !found || user.MFA == nil {
+		return nil, ErrMFANotEnrolled
+	}
+	attempt.Username = user.Username
+
+	if a.isLocked(attempt) {
+		a.auditMFA("user_mfa", attempt, "", audit.OutcomeDenied, ErrAccountLocked.Error())
+		return nil, ErrAccountLocked
+	}
+
+	factor := ""
+	if step, ok := verifyTOTP(user.MFA.TOTPSecret, code, time.Now(), user.MFA.LastStep); ok {
+		user.MFA.LastStep = step
+		factor = FactorTOTP
+	} else if remaining, ok := useRecoveryCode(user.MFA.RecoveryCodes, code); ok {
+		user.MFA.RecoveryCodes = remaining
+		factor = FactorRecoveryCode
+	}
+
+	if factor == "" {
+		a.recordFailure(attempt, lockout.CredentialMFACode)
+		a.auditMFA("user_mfa", attempt, "", audit.OutcomeDenied, ErrInvalidMFACode.Error())
+		return nil, ErrInvalidMFACode
+	}
+
+	if err := a.users.SaveUser(user); err != nil {
+		return nil, fmt.Errorf("failed to store authentication code use: %w", err)
+	}
+	a.lockouts.Succeed(lockout.Account(attempt.Username))
+
+	if factor == FactorRecoveryCode {
+		log.Printf("🔑 User %s used a recovery code, %d left", user.Username, len(user.MFA.RecoveryCodes))
+	}
+	a.auditMFA("user_mfa", attempt, factor, audit.OutcomeSuccess, "")
+	return user, nil
+}
+
+// EnrollTOTP stores the authenticator secret of a user once a code generated
+// from it was entered, and returns the new recovery codes. They are only kept
+// hashed, so they must be shown to the user now. A user who has a second
+// factor must have proved it in the login with the methods amr.
+func (a *UserAuthenticator) EnrollTOTP(attempt LoginAttempt, userID, secret, code string, amr []string) ([]string, error) {
+	a.mfaMutex.Lock()
+	defer a.mfaMutex.Unlock()
+
+	user, found := a.users.GetUser(userID)
+	if !found {
+		return nil, ErrInvalidCredentials
+	}
+	attempt.Username = user.Username
+
+	if a.isLocked(attempt) {
+		a.auditMFA("user_mfa_enrolled", attempt, FactorTOTP, audit.OutcomeDenied, ErrAccountLocked.Error())
+		return nil, ErrAccountLocked
+	}
+	if !mayEnroll(user, amr) {
+		a.auditMFA("user_mfa_enrolled", attempt, FactorTOTP, audit.OutcomeDenied, ErrMFAAlreadyEnrolled.Error())
+		return nil, ErrMFAAlreadyEnrolled
+	}
+
+	step, ok := verifyTOTP(secret, code, time.Now(), 0)
+	if !ok {
+		a.recordFailure(attempt, lockout.CredentialMFACode)
+		a.auditMFA("user_mfa_enrolled", attempt, FactorTOTP, audit.OutcomeDenied, ErrInvalidMFACode.Error())
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := generateRecoveryCodes(a.config.MFA.RecoveryCodeCount())
+	if err != nil {
+		return nil, err
+	}
+	user.MFA = &store.MFA{
+		TOTPSecret:    secret,
+		EnrolledAt:    time.Now(),
+		LastStep:      step,
+		RecoveryCodes: hashes,
+	}
+	if err := a.users.SaveUser(user); err != nil {
+		return nil, fmt.Errorf("failed to store authenticator: %w", err)
+	}
+
+	log.Printf("📱 User %s enrolled an authenticator app", user.Username)
+	a.auditMFA("user_mfa_enrolled", attempt, FactorTOTP, audit.OutcomeSuccess, "")
+	return codes, nil
+}
+
+// useRecoveryCode returns the remaining hashes when code is one of them
+func useRecoveryCode(hashes []string, code string) ([]string, bool) {
+	if normalizeCode(code) == "" {
+		return hashes, false
+	}
+	hash := hashRecoveryCode(code)
+	for i, candidate := range hashes {
+		if candidate == hash {
+			remaining := append([]string{}, hashes[:i]...)
+			return append(remaining, hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
+
+// auditMFA records the outcome of verifying or enrolling a second factor
+func (a *UserAuthenticator) auditMFA(eventType string, attempt LoginAttempt, factor, outcome, reason string) {
+	details := map[string]interface{}{"method": attempt.Method}
+	if factor != "" {
+		details["factor"] = factor
+	}
+	if attempt.RemoteAddr != "" {
+		details["remote_addr"] = attempt.RemoteAddr
+	}
+
+	audit.Log(audit.Event{
+		Type:     eventType,
+		Outcome:  outcome,
+		ClientID: attempt.ClientID,
+		Subject:  attempt.Username,
+		Reason:   reason,
+		Details:  details,
+	})
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"oauth2-server/internal/softauthn"
+)
+
+// currentTOTPCode returns the code of secret for the current time step
+func currentTOTPCode(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/int64(totpPeriod.Seconds()))
+}
+
+func TestEnrollmentNeedsExistingFactor(t *testing.T) {
+	authenticator, users := newTestUserAuthenticator(t, "")
+	authenticator.config.WebAuthn.Enabled = true
+	registerTestPasskey(t, authenticator, users)
+	attempt := LoginAttempt{Method: LoginMethodForm, RemoteAddr: "192.0.2.1"}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticator.EnrollTOTP(attempt, "user-alice", secret, currentTOTPCode(t, secret), PasswordAMR(false)); !errors.Is(err, ErrMFAAlreadyEnrolled) {
+		t.Fatalf("EnrollTOTP after a password = %v, want %v", err, ErrMFAAlreadyEnrolled)
+	}
+	if user, _ := users.GetUser("user-alice"); user.MFA != nil {
+		t.Fatal("authenticator app was stored without proving the passkey")
+	}
+
+	// A second passkey needs the first one as well
+	user, _ := users.GetUser("user-alice")
+	register := func(amr []string) error {
+		creation, session, err := authenticator.BeginPasskeyRegistration(passkeyTestBaseURL, user)
+		if err != nil {
+			t.Fatalf("BeginPasskeyRegistration: %v", err)
+		}
+		options, _ := json.Marshal(creation)
+		response, err := softauthn.New(passkeyTestBaseURL).Create(options)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		_, err = authenticator.RegisterPasskey(attempt, passkeyTestBaseURL, *session, string(response), "phone", amr)
+		return err
+	}
+	if err := register(PasswordAMR(false)); !errors.Is(err, ErrMFAAlreadyEnrolled) {
+		t.Fatalf("RegisterPasskey after a password = %v, want %v", err, ErrMFAAlreadyEnrolled)
+	}
+	if err := register(PasskeyAMR(false)); err != nil {
+		t.Fatalf("RegisterPasskey after a passkey login: %v", err)
+	}
+
+	codes, err := authenticator.EnrollTOTP(attempt, "user-alice", secret, currentTOTPCode(t, secret), PasskeyAMR(true))
+	if err != nil {
+		t.Fatalf("EnrollTOTP after a passkey: %v", err)
+	}
+	if len(codes) == 0 {
+		t.Error("no recovery codes returned")
+	}
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/store"
+)
+
+// AMRHardwareKey is the authentication method reference (RFC 8176) of a
+// passkey, a proof of possession of a key held by an authenticator
+const AMRHardwareKey = "hwk"
+
+// LoginMethodPasskey is the audit log method of a passwordless passkey login
+const LoginMethodPasskey = "passkey"
+
+// FactorPasskey is a passkey used as second factor in the audit log
+const FactorPasskey = "passkey"
+
+// passkeyTimeout is how long the browser may take for a ceremony
+const passkeyTimeout = 5 * time.Minute
+
+// maxUserHandleLength is the WebAuthn limit of user handles, which are user IDs
+const maxUserHandleLength = 64
+
+// requestKindPasskeyChallenge records answered passkey challenges
+const requestKindPasskeyChallenge = "passkey_challenge"
+
+// ErrInvalidPasskey is returned when a passkey response does not verify
+var ErrInvalidPasskey = errors.New("passkey verification failed")
+
+// PasskeyAMR returns the authentication methods of a passkey login. On its
+// own the passkey verified the user with a PIN or biometrics, so both it and
+// a passkey confirming a password are multi-factor.
+func PasskeyAMR(afterPassword bool) []string {
+	if afterPassword {
+		return []string{AMRPassword, AMRHardwareKey, AMRMFA}
+	}
+	return []string{AMRHardwareKey, AMRMFA}
+}
+
+// webauthnUser adapts a user to the WebAuthn library. The user handle is the
+// user ID, so a passwordless login finds the user without a username.
+type webauthnUser struct {
+	user *store.User
+}
+
+func (u webauthnUser) WebAuthnID() []byte {
+	return []byte(u.user.ID)
+}
+
+func (u webauthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u webauthnUser) WebAuthnDisplayName() string {
+	if u.user.Name != "" {
+		return u.user.Name
+	}
+	return u.user.Username
+}
+
+func (u webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.user.Passkeys))
+	for _, passkey := range u.user.Passkeys {
+		id, err := base64.RawURLEncoding.DecodeString(passkey.ID)
+		if err != nil {
+			continue
+		}
+		transports := make([]protocol.AuthenticatorTransport, 0, len(passkey.Transports))
+		for _, transport := range passkey.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:        id,
+			PublicKey: passkey.PublicKey,
+			Transport: transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: passkey.BackupEligible,
+				BackupState:    passkey.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    passkey.AAGUID,
+				SignCount: passkey.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+// PasskeysEnabled reports whether passkeys are offered on the login page
+func (a *UserAuthenticator) PasskeysEnabled() bool {
+	return a.config.WebAuthn.Enabled
+}
+
+// relyingParty configures WebAuthn for a login page served at baseURL
+func (a *UserAuthenticator) relyingParty(baseURL string) (*webauthn.WebAuthn, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q", baseURL)
+	}
+
+	settings := a.config.WebAuthn
+	rpID := settings.RPID
+	if rpID == "" {
+		rpID = parsed.Hostname()
+	}
+	origins := settings.Origins
+	if len(origins) == 0 {
+		origins = []string{parsed.Scheme + "://" + parsed.Host}
+	}
+	name := settings.RPName
+	if name == "" {
+		name = a.config.MFA.Issuer
+	}
+	if name == "" {
+		name = rpID
+	}
+
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyTimeout, TimeoutUVD: passkeyTimeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:                  rpID,
+		RPDisplayName:         name,
+		RPOrigins:             origins,
+		AttestationPreference: protocol.PreferNoAttestation,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+}
+
+// BeginPasskeyLogin starts a login with a passkey of the user, or with any
+// passkey the authenticator holds for this site when user is nil. A
+// passwordless login requires user verification; the session must be kept
+// until FinishPasskeyLogin.
+func (a *UserAuthenticator) BeginPasskeyLogin(baseURL string, user *store.User) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	rp, err := a.relyingParty(baseURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		return rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+	return rp.BeginLogin(webauthnUser{user}, webauthn.WithUserVerification(protocol.VerificationPreferred))
+}
+
+// FinishPasskeyLogin verifies the assertion of a passkey login started with
+// BeginPasskeyLogin and returns the user. Failures of a known user count
+// towards the lockout of the account like wrong passwords.
+func (a *UserAuthenticator) FinishPasskeyLogin(attempt LoginAttempt, baseURL string, session webauthn.SessionData, response string) (*store.User, error) {
+	a.mfaMutex.Lock()
+	defer a.mfaMutex.Unlock()
+
+	secondFactor := session.UserID != nil
+	fail := func(reason string) {
+		if secondFactor {
+			a.auditMFA("user_mfa", attempt, FactorPasskey, audit.OutcomeDenied, reason)
+		} else {
+			a.audit(attempt, "", audit.OutcomeDenied, reason)
+		}
+	}
+
+	if err := a.answerChallenge(session); err != nil {
+		fail(err.Error())
+		return nil, ErrInvalidPasskey
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes([]byte(response))
+	if err != nil {
+		fail(ErrInvalidPasskey.Error())
+		return nil, ErrInvalidPasskey
+	}
+
+	// The user handle names the user of a passwordless login
+	userID := string(session.UserID)
+	if !secondFactor {
+		userID = string(parsed.Response.UserHandle)
+	}
+	user, found := a.users.GetUser(userID)
+	if !found {
+		a.lockouts.Fail(lockout.CredentialPasskey, attempt.ClientID, attempt.RemoteAddr, lockout.IP(attempt.RemoteAddr))
+		fail("unknown passkey")
+		return nil, ErrInvalidPasskey
+	}
+	attempt.Username = user.Username
+
+	if a.isLocked(attempt) {
+		fail(ErrAccountLocked.Error())
+		return nil, ErrAccountLocked
+	}
+
+	rp, err := a.relyingParty(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	var credential *webauthn.Credential
+	if secondFactor {
+		credential, err = rp.ValidateLogin(webauthnUser{user}, session, parsed)
+	} else {
+		credential, err = rp.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			return webauthnUser{user}, nil
+		}, session, parsed)
+	}
+	if err == nil && credential.Authenticator.CloneWarning {
+		err = errors.New("signature counter did not increase, the passkey may be cloned")
+	}
+	if err != nil {
+		log.Printf("⚠️ Passkey login of user %s failed: %v", user.Username, err)
+		a.recordFailure(attempt, lockout.CredentialPasskey)
+		fail(ErrInvalidPasskey.Error())
+		return nil, ErrInvalidPasskey
+	}
+
+	if !secondFactor && !user.Enabled {
+		fail("account disabled")
+		return nil, ErrInvalidCredentials
+	}
+
+	for i := range user.Passkeys {
+		if id, _ := base64.RawURLEncoding.DecodeString(user.Passkeys[i].ID); bytes.Equal(id, credential.ID) {
+			user.Passkeys[i].SignCount = credential.Authenticator.SignCount
+			user.Passkeys[i].BackupState = credential.Flags.BackupState
+			user.Passkeys[i].LastUsedAt = time.Now()
+		}
+	}
+	if err := a.users.SaveUser(user); err != nil {
+		return nil, fmt.Errorf("failed to store passkey use: %w", err)
+	}
+	a.lockouts.Succeed(lockout.Account(attempt.Username))
+
+	if secondFactor {
+		a.auditMFA("user_mfa", attempt, FactorPasskey, audit.OutcomeSuccess, "")
+	} else {
+		a.audit(attempt, "", audit.OutcomeSuccess, "")
+	}
+	return user, nil
+}
+
+// answerChallenge records the challenge of a ceremony as answered, so a
+// ceremony and its response are accepted once even though the ceremony is
+// kept by the browser. Every answer counts, valid or not; callers hold
+// mfaMutex.
+func (a *UserAuthenticator) answerChallenge(session webauthn.SessionData) error {
+	ctx := context.Background()
+	_, err := a.challenges.GetRequest(ctx, requestKindPasskeyChallenge, session.Challenge)
+	switch {
+	case err == nil:
+		return errors.New("passkey challenge was already answered")
+	case !errors.Is(err, store.ErrNotFound):
+		return fmt.Errorf("failed to check passkey challenge: %w", err)
+	}
+
+	// The challenge is refused by the WebAuthn library once the session
+	// expired, so it only needs to be kept until then
+	expiresAt := session.Expires
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(passkeyTimeout)
+	}
+	if err := a.challenges.SaveRequest(ctx, &store.RequestRecord{
+		Kind:      requestKindPasskeyChallenge,
+		Signature: session.Challenge,
+		Subject:   string(session.UserID),
+		ExpiresAt: expiresAt,
+	}); err != nil {
+		return fmt.Errorf("failed to record passkey challenge: %w", err)
+	}
+	return nil
+}
+
+// BeginPasskeyRegistration starts registering a passkey for the user. The
+// authenticator is asked for a discoverable credential, so the passkey also
+// works without a username.
+func (a *UserAuthenticator) BeginPasskeyRegistration(baseURL string, user *store.User) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	if len(user.ID) > maxUserHandleLength {
+		return nil, nil, fmt.Errorf("user ID of %s is longer than %d bytes", user.Username, maxUserHandleLength)
+	}
+	rp, err := a.relyingParty(baseURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Authenticators that hold a passkey of the user already refuse to
+	// create another one
+	var existing []protocol.CredentialDescriptor
+	for _, credential := range (webauthnUser{user}).WebAuthnCredentials() {
+		existing = append(existing, credential.Descriptor())
+	}
+	return rp.BeginRegistration(webauthnUser{user},
+		webauthn.WithExclusions(existing),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationPreferred,
+		}))
+}
+
+// RegisterPasskey verifies the response of a registration started with
+// BeginPasskeyRegistration and stores the passkey under name. A user who has
+// a second factor must have proved it in the login with the methods amr.
+func (a *UserAuthenticator) RegisterPasskey(attempt LoginAttempt, baseURL string, session webauthn.SessionData, response, name string, amr []string) (*store.Passkey, error) {
+	a.mfaMutex.Lock()
+	defer a.mfaMutex.Unlock()
+
+	user, found := a.users.GetUser(string(session.UserID))
+	if !found {
+		return nil, ErrInvalidCredentials
+	}
+	attempt.Username = user.Username
+
+	if err := a.answerChallenge(session); err != nil {
+		a.auditMFA("user_passkey_registered", attempt, FactorPasskey, audit.OutcomeDenied, err.Error())
+		return nil, ErrInvalidPasskey
+	}
+	if !mayEnroll(user, amr) {
+		a.auditMFA("user_passkey_registered", attempt, FactorPasskey, audit.OutcomeDenied, ErrMFAAlreadyEnrolled.Error())
+		return nil, ErrMFAAlreadyEnrolled
+	}
+
+	rp, err := a.relyingParty(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBytes([]byte(response))
+	if err == nil {
+		var credential *webauthn.Credential
+		if credential, err = rp.CreateCredential(webauthnUser{user}, session, parsed); err == nil {
+			return a.savePasskey(attempt, user, credential, name)
+		}
+	}
+
+	log.Printf("⚠️ Passkey registration of user %s failed: %v", user.Username, err)
+	a.auditMFA("user_passkey_registered", attempt, FactorPasskey, audit.OutcomeDenied, ErrInvalidPasskey.Error())
+	return nil, ErrInvalidPasskey
+}
+
+// savePasskey adds a verified credential to the passkeys of the user
+func (a *UserAuthenticator) savePasskey(attempt LoginAttempt, user *store.User, credential *webauthn.Credential, name string) (*store.Passkey, error) {
+	now := time.Now()
+	if name == "" {
+		name = "Passkey of " + now.Format("2006-01-02")
+	}
+	passkey := store.Passkey{
+		ID:             base64.RawURLEncoding.EncodeToString(credential.ID),
+		Name:           name,
+		PublicKey:      credential.PublicKey,
+		AAGUID:         credential.Authenticator.AAGUID,
+		SignCount:      credential.Authenticator.SignCount,
+		BackupEligible: credential.Flags.BackupEligible,
+		BackupState:    credential.Flags.BackupState,
+		CreatedAt:      now,
+	}
+	for _, transport := range credential.Transport {
+		passkey.Transports = append(passkey.Transports, string(transport))
+	}
+
+	for _, registered := range user.Passkeys {
+		if registered.ID == passkey.ID {
+			return nil, ErrInvalidPasskey
+		}
+	}
+	user.Passkeys = append(user.Passkeys, passkey)
+	if err := a.users.SaveUser(user); err != nil {
+		return nil, fmt.Errorf("failed to store passkey: %w", err)
+	}
+
+	log.Printf("🔑 User %s registered passkey %q", user.Username, passkey.Name)
+	a.auditMFA("user_passkey_registered", attempt, FactorPasskey, audit.OutcomeSuccess, "")
+	return &passkey, nil
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"oauth2-server/internal/softauthn"
+	"oauth2-server/internal/store"
+)
+
+const passkeyTestBaseURL = "http://localhost:8080"
+
+// registerTestPasskey creates a user with a passkey held by a software
+// authenticator
+func registerTestPasskey(t *testing.T, authenticator *UserAuthenticator, users *store.UserStore) *softauthn.Authenticator {
+	t.Helper()
+	user := &store.User{ID: "user-alice", Username: "alice", Enabled: true}
+	if err := users.SaveUser(user); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	creation, session, err := authenticator.BeginPasskeyRegistration(passkeyTestBaseURL, user)
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %v", err)
+	}
+	options, _ := json.Marshal(creation)
+	passkeys := softauthn.New(passkeyTestBaseURL)
+	response, err := passkeys.Create(options)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := authenticator.RegisterPasskey(LoginAttempt{}, passkeyTestBaseURL, *session, string(response), "laptop", nil); err != nil {
+		t.Fatalf("RegisterPasskey: %v", err)
+	}
+	return passkeys
+}
+
+func TestPasskeyChallengeAnsweredOnce(t *testing.T) {
+	authenticator, users := newTestUserAuthenticator(t, "")
+	authenticator.config.WebAuthn.Enabled = true
+	passkeys := registerTestPasskey(t, authenticator, users)
+	attempt := LoginAttempt{Method: LoginMethodPasskey, RemoteAddr: "192.0.2.1"}
+
+	assertion, session, err := authenticator.BeginPasskeyLogin(passkeyTestBaseURL, nil)
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+	options, _ := json.Marshal(assertion)
+	response, err := passkeys.Get(options)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	// A rejected answer uses up the challenge as well
+	if _, err := authenticator.FinishPasskeyLogin(attempt, passkeyTestBaseURL, *session, "{}"); !errors.Is(err, ErrInvalidPasskey) {
+		t.Fatalf("FinishPasskeyLogin with a malformed response = %v, want %v", err, ErrInvalidPasskey)
+	}
+	if _, err := authenticator.FinishPasskeyLogin(attempt, passkeyTestBaseURL, *session, string(response)); !errors.Is(err, ErrInvalidPasskey) {
+		t.Fatalf("FinishPasskeyLogin after a rejected answer = %v, want %v", err, ErrInvalidPasskey)
+	}
+
+	assertion, session, err = authenticator.BeginPasskeyLogin(passkeyTestBaseURL, nil)
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+	options, _ = json.Marshal(assertion)
+	if response, err = passkeys.Get(options); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	user, err := authenticator.FinishPasskeyLogin(attempt, passkeyTestBaseURL, *session, string(response))
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin: %v", err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("user = %q, want alice", user.Username)
+	}
+	if _, err := authenticator.FinishPasskeyLogin(attempt, passkeyTestBaseURL, *session, string(response)); !errors.Is(err, ErrInvalidPasskey) {
+		t.Errorf("replayed FinishPasskeyLogin = %v, want %v", err, ErrInvalidPasskey)
+	}
+}
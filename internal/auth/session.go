@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/ory/fosite"
+	fositejwt "github.com/ory/fosite/token/jwt"
 )
 
 // UserSession represents a user session for OAuth2 flows and implements fosite.Session
@@ -13,6 +14,10 @@ type UserSession struct {
 	Subject   string                 `json:"subject"`
 	Extra     map[string]interface{} `json:"extra"`
 	ExpiresAt map[string]time.Time   `json:"expires_at"`
+	// IDToken and Headers are the ID token claims of OpenID Connect requests;
+	// fosite fills in the standard claims
+	IDToken *fositejwt.IDTokenClaims `json:"id_token_claims,omitempty"`
+	Headers *fositejwt.Headers       `json:"headers,omitempty"`
 }
 
 // GetSubject returns the subject (user ID) for the session - required by fosite.Session
@@ -67,9 +72,49 @@ func (s *UserSession) Clone() fosite.Session {
 		}
 	}
 
+	if s.IDToken != nil {
+		claims := *s.IDToken
+		claims.Audience = append([]string(nil), s.IDToken.Audience...)
+		claims.AuthenticationMethodsReferences = append([]string(nil), s.IDToken.AuthenticationMethodsReferences...)
+		claims.Extra = copyMap(s.IDToken.Extra)
+		clone.IDToken = &claims
+	}
+
+	if s.Headers != nil {
+		clone.Headers = &fositejwt.Headers{Extra: copyMap(s.Headers.Extra)}
+	}
+
 	return clone
 }
 
+// IDTokenClaims returns the claims of the ID token - required by openid.Session
+func (s *UserSession) IDTokenClaims() *fositejwt.IDTokenClaims {
+	if s.IDToken == nil {
+		s.IDToken = &fositejwt.IDTokenClaims{}
+	}
+	return s.IDToken
+}
+
+// IDTokenHeaders returns the headers of the ID token - required by openid.Session
+func (s *UserSession) IDTokenHeaders() *fositejwt.Headers {
+	if s.Headers == nil {
+		s.Headers = fositejwt.NewHeaders()
+	}
+	return s.Headers
+}
+
+// copyMap returns a shallow copy of a claims map
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
 // GetExtra returns extra information stored in the session - sometimes required by fosite
 func (s *UserSession) GetExtra(key string) interface{} {
 	if s.Extra == nil {
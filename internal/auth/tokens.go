@@ -107,61 +107,6 @@ func GenerateUserCode() (string, error) {
 	return fmt.Sprintf("%s-%s", code[:4], code[4:]), nil
 }
 
-// TokenInfo represents information about a token
-type TokenInfo struct {
-	TokenType string    `json:"token_type"`
-	ExpiresAt time.Time `json:"expires_at"`
-	Scope     string    `json:"scope"`
-	ClientID  string    `json:"client_id"`
-	UserID    string    `json:"user_id"`
-	Active    bool      `json:"active"`
-	IssuedAt  time.Time `json:"iat"`
-	Issuer    string    `json:"iss"`
-	Audience  []string  `json:"aud"`
-}
-
-// ValidateToken validates a token and returns token information
-func ValidateToken(token string) (*TokenInfo, error) {
-	// Basic validation
-	if token == "" {
-		return nil, fmt.Errorf("empty token")
-	}
-
-	// In a real implementation, you would:
-	// 1. Parse and validate JWT
-	// 2. Check signature
-	// 3. Verify expiration
-	// 4. Check against revocation list
-
-	// For demo purposes, accept any non-empty token
-	if len(token) < 10 {
-		return nil, fmt.Errorf("invalid token format")
-	}
-
-	// Extract token type from prefix
-	var tokenType string
-	if strings.HasPrefix(token, "at_") {
-		tokenType = "access_token"
-	} else if strings.HasPrefix(token, "rt_") {
-		tokenType = "refresh_token"
-	} else {
-		return nil, fmt.Errorf("unknown token type")
-	}
-
-	// Return basic token info (in real implementation, extract from JWT claims)
-	return &TokenInfo{
-		TokenType: tokenType,
-		ExpiresAt: time.Now().Add(time.Hour), // Default 1 hour expiration
-		Scope:     "openid profile",
-		ClientID:  "unknown",
-		UserID:    "unknown",
-		Active:    true,
-		IssuedAt:  time.Now().Add(-time.Minute), // Issued 1 minute ago
-		Issuer:    "oauth2-server",
-		Audience:  []string{"api"},
-	}, nil
-}
-
 // ValidateAccessToken validates an access token (simplified implementation)
 func ValidateAccessToken(token string) error {
 	if token == "" {
@@ -227,31 +172,6 @@ func ExtractBearerToken(authHeader string) (string, error) {
 	return parts[1], nil
 }
 
-// IntrospectToken performs token introspection (RFC 7662)
-func IntrospectToken(token string) (map[string]interface{}, error) {
-	tokenInfo, err := ValidateToken(token)
-	if err != nil {
-		return map[string]interface{}{
-			"active": false,
-		}, nil
-	}
-
-	// Return introspection response
-	response := map[string]interface{}{
-		"active":     tokenInfo.Active,
-		"token_type": tokenInfo.TokenType,
-		"scope":      tokenInfo.Scope,
-		"client_id":  tokenInfo.ClientID,
-		"username":   tokenInfo.UserID,
-		"exp":        tokenInfo.ExpiresAt.Unix(),
-		"iat":        tokenInfo.IssuedAt.Unix(),
-		"iss":        tokenInfo.Issuer,
-		"aud":        tokenInfo.Audience,
-	}
-
-	return response, nil
-}
-
 // RevokeToken revokes a token
 func RevokeToken(token string) error {
 	// In a real implementation, you would:
@@ -0,0 +1,508 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"oauth2-server/internal/utils"
+	"oauth2-server/pkg/config"
+)
+
+// discoveryCacheTTL is how long discovered endpoints of a provider are reused
+const discoveryCacheTTL = time.Hour
+
+// UpstreamIdentity is the profile of a user authenticated by an upstream
+// identity provider, mapped with the claims configuration of the provider
+type UpstreamIdentity struct {
+	Provider      string
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Roles         []string
+	Scopes        []string
+	Attributes    map[string]string
+	// AMR are the authentication methods reported by the provider
+	AMR []string
+}
+
+// UpstreamProvider logs users in at an upstream OpenID Connect or OAuth2
+// provider with the authorization code flow and PKCE
+type UpstreamProvider struct {
+	config     config.IdentityProviderConfig
+	claims     config.IdentityClaimsConfig
+	httpClient *http.Client
+
+	mutex        sync.Mutex
+	endpoints    upstreamEndpoints
+	discoveredAt time.Time
+	keys         *KeySet
+}
+
+// upstreamEndpoints are the endpoints of a provider, as in its discovery document
+type upstreamEndpoints struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// upstreamTokenResponse is the token endpoint response of a provider
+type upstreamTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// UpstreamProviders are the identity providers offered on the login page
+type UpstreamProviders struct {
+	providers []*UpstreamProvider
+}
+
+// NewUpstreamProviders creates the configured providers; OIDC endpoints are
+// discovered on first use
+func NewUpstreamProviders(configs []config.IdentityProviderConfig) *UpstreamProviders {
+	providers := &UpstreamProviders{}
+	for _, providerConfig := range configs {
+		providers.providers = append(providers.providers, NewUpstreamProvider(providerConfig))
+		log.Printf("🌐 Identity provider: %s (%s)", providerConfig.ID, providerConfig.ProviderType())
+	}
+	return providers
+}
+
+// NewUpstreamProvider creates a provider from its configuration
+func NewUpstreamProvider(providerConfig config.IdentityProviderConfig) *UpstreamProvider {
+	return &UpstreamProvider{
+		config:     providerConfig,
+		claims:     providerConfig.ClaimNames(),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// All returns the providers in configuration order
+func (p *UpstreamProviders) All() []*UpstreamProvider {
+	if p == nil {
+		return nil
+	}
+	return p.providers
+}
+
+// Get returns the provider with the ID
+func (p *UpstreamProviders) Get(id string) (*UpstreamProvider, bool) {
+	for _, provider := range p.All() {
+		if provider.ID() == id {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
+// ID returns the ID of the provider used in its login and callback URLs
+func (p *UpstreamProvider) ID() string {
+	return p.config.ID
+}
+
+// Name returns the label of the login button
+func (p *UpstreamProvider) Name() string {
+	return p.config.DisplayName()
+}
+
+// CreateUsers reports whether unknown identities get a new user
+func (p *UpstreamProvider) CreateUsers() bool {
+	return p.config.CreateUsers
+}
+
+// LinkBy returns how unknown identities are linked to existing users, if at all
+func (p *UpstreamProvider) LinkBy() string {
+	return p.config.LinkBy
+}
+
+// AuthCodeURL returns the URL that starts the login at the provider
+func (p *UpstreamProvider) AuthCodeURL(redirectURI, state, nonce, codeVerifier, prompt string) (string, error) {
+	endpoints, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {redirectURI},
+		"state":                 {state},
+		"code_challenge":        {utils.GenerateCodeChallenge(codeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if scopes := p.config.RequestedScopes(); len(scopes) > 0 {
+		params.Set("scope", strings.Join(scopes, " "))
+	}
+	if p.config.ProviderType() == config.IdentityProviderOIDC {
+		params.Set("nonce", nonce)
+	}
+	if prompt != "" {
+		params.Set("prompt", prompt)
+	}
+
+	separator := "?"
+	if strings.Contains(endpoints.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return endpoints.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange redeems the authorization code and returns the mapped identity.
+// OIDC providers are trusted through their verified ID token, OAuth2 providers
+// through their userinfo endpoint.
+func (p *UpstreamProvider) Exchange(ctx context.Context, code, redirectURI, codeVerifier, nonce string) (*UpstreamIdentity, error) {
+	endpoints, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := p.redeem(ctx, endpoints.TokenEndpoint, code, redirectURI, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if p.config.ProviderType() == config.IdentityProviderOIDC {
+		if tokens.IDToken == "" {
+			return nil, errors.New("token response contains no id_token")
+		}
+		claims, err = p.verifyIDToken(tokens.IDToken, nonce)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id_token: %w", err)
+		}
+	}
+
+	if endpoints.UserInfoEndpoint != "" && tokens.AccessToken != "" {
+		userInfo, err := p.userInfo(ctx, endpoints.UserInfoEndpoint, tokens.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		if claims == nil {
+			claims = userInfo
+		} else if claimValue(userInfo, "sub") != claimValue(claims, "sub") {
+			return nil, errors.New("userinfo subject does not match the id_token")
+		} else {
+			// Claims of the signed ID token take precedence
+			for name, value := range userInfo {
+				if _, ok := claims[name]; !ok {
+					claims[name] = value
+				}
+			}
+		}
+	}
+	if claims == nil {
+		return nil, errors.New("provider returned no claims")
+	}
+
+	return p.mapClaims(claims)
+}
+
+// discover returns the endpoints, fetching the discovery document of OIDC
+// providers when endpoints are not configured. Configured endpoints win.
+func (p *UpstreamProvider) discover() (upstreamEndpoints, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	configured := upstreamEndpoints{
+		Issuer:                p.config.Issuer,
+		AuthorizationEndpoint: p.config.AuthorizationURL,
+		TokenEndpoint:         p.config.TokenURL,
+		UserInfoEndpoint:      p.config.UserInfoURL,
+		JWKSURI:               p.config.JWKSURL,
+	}
+	complete := configured.AuthorizationEndpoint != "" && configured.TokenEndpoint != "" &&
+		(configured.JWKSURI != "" || p.config.ProviderType() != config.IdentityProviderOIDC)
+	if complete || p.config.Issuer == "" {
+		p.setKeys(configured.JWKSURI)
+		return configured, nil
+	}
+
+	if p.discoveredAt.IsZero() || time.Since(p.discoveredAt) > discoveryCacheTTL {
+		discovered, err := p.fetchDiscovery()
+		if err != nil {
+			// Keep using the previous document if a refetch fails
+			if p.discoveredAt.IsZero() {
+				return upstreamEndpoints{}, err
+			}
+			log.Printf("⚠️ Failed to refresh discovery document of %s: %v", p.config.ID, err)
+		} else {
+			p.endpoints = discovered
+			p.discoveredAt = time.Now()
+		}
+	}
+
+	endpoints := p.endpoints
+	if configured.AuthorizationEndpoint != "" {
+		endpoints.AuthorizationEndpoint = configured.AuthorizationEndpoint
+	}
+	if configured.TokenEndpoint != "" {
+		endpoints.TokenEndpoint = configured.TokenEndpoint
+	}
+	if configured.UserInfoEndpoint != "" {
+		endpoints.UserInfoEndpoint = configured.UserInfoEndpoint
+	}
+	if configured.JWKSURI != "" {
+		endpoints.JWKSURI = configured.JWKSURI
+	}
+	p.setKeys(endpoints.JWKSURI)
+	return endpoints, nil
+}
+
+// setKeys creates the key set of the JWKS URL; callers hold the mutex
+func (p *UpstreamProvider) setKeys(jwksURL string) {
+	if jwksURL != "" && (p.keys == nil || p.keys.url != jwksURL) {
+		p.keys = NewRemoteKeySet("identity provider "+p.config.ID, jwksURL)
+	}
+}
+
+// fetchDiscovery downloads {issuer}/.well-known/openid-configuration
+func (p *UpstreamProvider) fetchDiscovery() (upstreamEndpoints, error) {
+	discoveryURL := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := p.httpClient.Get(discoveryURL)
+	if err != nil {
+		return upstreamEndpoints{}, fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return upstreamEndpoints{}, fmt.Errorf("failed to fetch discovery document: status %d", resp.StatusCode)
+	}
+
+	var endpoints upstreamEndpoints
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&endpoints); err != nil {
+		return upstreamEndpoints{}, fmt.Errorf("invalid discovery document: %w", err)
+	}
+	if endpoints.Issuer != p.config.Issuer {
+		return upstreamEndpoints{}, fmt.Errorf("discovery document is for issuer %q, expected %q", endpoints.Issuer, p.config.Issuer)
+	}
+
+	log.Printf("🌐 Discovered endpoints of identity provider %s", p.config.ID)
+	return endpoints, nil
+}
+
+// redeem exchanges the code at the token endpoint
+func (p *UpstreamProvider) redeem(ctx context.Context, tokenURL, code, redirectURI, codeVerifier string) (*upstreamTokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	basicAuth := p.config.ClientSecret != "" && p.config.TokenEndpointAuthMethod != "client_secret_post"
+	if !basicAuth {
+		form.Set("client_id", p.config.ClientID)
+		if p.config.ClientSecret != "" {
+			form.Set("client_secret", p.config.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basicAuth {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens upstreamTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token request failed with status %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	return &tokens, nil
+}
+
+// verifyIDToken checks signature, issuer, audience, expiry and nonce
+func (p *UpstreamProvider) verifyIDToken(idToken, nonce string) (map[string]interface{}, error) {
+	p.mutex.Lock()
+	keys := p.keys
+	p.mutex.Unlock()
+	if keys == nil {
+		return nil, errors.New("provider has no jwks_uri")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, keys.KeyFunc,
+		jwt.WithValidMethods(externalSigningMethods),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	audiences, err := claims.GetAudience()
+	if err != nil {
+		return nil, err
+	}
+	if azp := claimValue(claims, "azp"); (len(audiences) > 1 || azp != "") && azp != p.config.ClientID {
+		return nil, fmt.Errorf("token was issued to %q", azp)
+	}
+	if claimValue(claims, "nonce") != nonce {
+		return nil, errors.New("nonce does not match")
+	}
+	return claims, nil
+}
+
+// userInfo fetches the claims of the access token from the userinfo endpoint
+func (p *UpstreamProvider) userInfo(ctx context.Context, userInfoURL, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("userinfo request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo request failed with status %d", resp.StatusCode)
+	}
+
+	// Numbers are kept as written so large numeric IDs stay exact
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("invalid userinfo response: %w", err)
+	}
+	return claims, nil
+}
+
+// mapClaims maps the upstream claims to the local profile
+func (p *UpstreamProvider) mapClaims(claims map[string]interface{}) (*UpstreamIdentity, error) {
+	identity := &UpstreamIdentity{
+		Provider: p.config.ID,
+		Subject:  claimValue(claims, p.claims.Subject),
+		Username: claimValue(claims, p.claims.Username),
+		Email:    claimValue(claims, p.claims.Email),
+		Name:     claimValue(claims, p.claims.Name),
+		Scopes:   p.config.UserScopes,
+		AMR:      claimValues(claims, "amr"),
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("claims contain no %s", p.claims.Subject)
+	}
+	identity.EmailVerified = claimValue(claims, "email_verified") == "true"
+	if identity.Username == "" {
+		identity.Username = identity.Email
+	}
+	if identity.Username == "" {
+		identity.Username = p.config.ID + "-" + identity.Subject
+	}
+
+	identity.Roles = mergeRoles(nil, p.groupRoles(claimValues(claims, p.claims.Groups))...)
+	identity.Roles = mergeRoles(identity.Roles, p.config.Roles...)
+
+	for attribute, claim := range p.claims.Attributes {
+		if value := claimValue(claims, claim); value != "" {
+			if identity.Attributes == nil {
+				identity.Attributes = make(map[string]string)
+			}
+			identity.Attributes[attribute] = value
+		}
+	}
+	return identity, nil
+}
+
+// groupRoles maps group names to roles; without group_roles every group is a role
+func (p *UpstreamProvider) groupRoles(groups []string) []string {
+	if len(p.config.GroupRoles) == 0 {
+		return groups
+	}
+	var roles []string
+	for _, group := range groups {
+		if role, ok := p.config.GroupRoles[group]; ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// lookupClaim returns a claim by name; names with dots such as
+// realm_access.roles address nested objects
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if name == "" {
+		return nil, false
+	}
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+	head, rest, nested := strings.Cut(name, ".")
+	if !nested {
+		return nil, false
+	}
+	object, ok := claims[head].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookupClaim(object, rest)
+}
+
+// claimValue returns a string, number or boolean claim as a string
+func claimValue(claims map[string]interface{}, name string) string {
+	value, _ := lookupClaim(claims, name)
+	switch value := value.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	return ""
+}
+
+// claimValues returns a list claim, or a single string claim, as strings
+func claimValues(claims map[string]interface{}, name string) []string {
+	value, _ := lookupClaim(claims, name)
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/store"
+	"oauth2-server/internal/utils"
+	"oauth2-server/pkg/config"
+)
+
+// Login methods recorded in the audit log
+const (
+	LoginMethodForm          = "login_form"
+	LoginMethodDevice        = "device_verification"
+	LoginMethodPasswordGrant = "password_grant"
+	LoginMethodUpstream      = "identity_provider"
+)
+
+var (
+	// ErrInvalidCredentials is returned for unknown users and wrong passwords
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrAccountLocked is returned while an account is locked after repeated failures
+	ErrAccountLocked = errors.New("account is temporarily locked")
+	// ErrAuthenticationUnavailable is returned when no backend could check the
+	// password because of errors, e.g. an unreachable LDAP server
+	ErrAuthenticationUnavailable = errors.New("authentication is temporarily unavailable")
+)
+
+// LoginAttempt describes one attempt to authenticate a user
+type LoginAttempt struct {
+	Username   string
+	Password   string
+	Method     string
+	ClientID   string
+	RemoteAddr string
+}
+
+// UserAuthenticator verifies user credentials for every login path (login form,
+// device verification and the password grant) against a chain of backends,
+// locking accounts and source IPs after repeated failures and recording each
+// attempt in the audit log
+type UserAuthenticator struct {
+	users          *store.UserStore
+	authenticators []Authenticator
+	lockouts       *lockout.Tracker
+	// challenges records answered passkey challenges
+	challenges store.RequestStorage
+	config     *config.Config
+	// mfaMutex serializes code checks, so a code is accepted only once
+	mfaMutex sync.Mutex
+}
+
+// NewUserAuthenticator creates an authenticator that tries the backends in
+// order; accounts of htpasswd and LDAP backends are kept in the user store
+// and answered passkey challenges in requests
+func NewUserAuthenticator(users *store.UserStore, authenticators []Authenticator, lockouts *lockout.Tracker, requests store.RequestStorage, cfg *config.Config) *UserAuthenticator {
+	return &UserAuthenticator{
+		users:          users,
+		authenticators: authenticators,
+		lockouts:       lockouts,
+		challenges:     requests,
+		config:         cfg,
+	}
+}
+
+// Authenticate checks the credentials of the attempt and returns the user
+func (a *UserAuthenticator) Authenticate(attempt LoginAttempt) (*store.User, error) {
+	if a.isLocked(attempt) {
+		a.audit(attempt, "", audit.OutcomeDenied, ErrAccountLocked.Error())
+		return nil, ErrAccountLocked
+	}
+
+	user, backend, err := a.check(attempt)
+	if errors.Is(err, ErrAuthenticationUnavailable) {
+		a.audit(attempt, "", audit.OutcomeFailure, err.Error())
+		return nil, err
+	}
+	if err != nil {
+		a.recordFailure(attempt, lockout.CredentialPassword)
+		a.audit(attempt, "", audit.OutcomeDenied, ErrInvalidCredentials.Error())
+		return nil, ErrInvalidCredentials
+	}
+
+	// Accounts of external backends are stored on first login and updated on
+	// every login, so tokens and userinfo can refer to them
+	if user.ID == "" {
+		user, err = a.provision(backend, user)
+		if err != nil {
+			a.audit(attempt, backend, audit.OutcomeDenied, err.Error())
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	a.lockouts.Succeed(lockout.Account(attempt.Username))
+
+	// Disabled accounts get the same answer as wrong credentials
+	if !user.Enabled {
+		a.audit(attempt, backend, audit.OutcomeDenied, "account disabled")
+		return nil, ErrInvalidCredentials
+	}
+
+	// The password grant has no way to ask for a second factor
+	if attempt.Method == LoginMethodPasswordGrant && a.MFARequired(user) {
+		a.audit(attempt, backend, audit.OutcomeDenied, ErrMFARequired.Error())
+		return nil, ErrMFARequired
+	}
+
+	a.audit(attempt, backend, audit.OutcomeSuccess, "")
+	return user, nil
+}
+
+// check runs the chain of backends. A backend that does not know the user
+// passes to the next one; a wrong password does so only in first_success mode.
+func (a *UserAuthenticator) check(attempt LoginAttempt) (*store.User, string, error) {
+	var rejected bool
+	var failure error
+	for _, authenticator := range a.authenticators {
+		user, err := authenticator.Authenticate(context.Background(), attempt.Username, attempt.Password)
+		switch {
+		case err == nil:
+			return user, authenticator.Name(), nil
+		case errors.Is(err, ErrUnknownUser):
+			continue
+		case errors.Is(err, ErrInvalidCredentials):
+			rejected = true
+			if a.config.Authentication.ChainMode() == config.ChainFirstMatch {
+				return nil, "", ErrInvalidCredentials
+			}
+		default:
+			log.Printf("❌ Authentication backend %s failed for %s: %v", authenticator.Name(), attempt.Username, err)
+			failure = err
+		}
+	}
+
+	// Backend errors only matter when no backend gave an answer
+	if failure != nil && !rejected {
+		return nil, "", ErrAuthenticationUnavailable
+	}
+	return nil, "", ErrInvalidCredentials
+}
+
+// provision creates or updates the stored account of an external backend.
+// Usernames of local accounts or of other backends are not taken over.
+func (a *UserAuthenticator) provision(backend string, profile *store.User) (*store.User, error) {
+	existing, found := a.users.GetUserByUsername(profile.Username)
+	if found && existing.Authenticator != backend {
+		return nil, fmt.Errorf("username %s belongs to another account", profile.Username)
+	}
+
+	user := &store.User{
+		ID:            utils.GenerateUserID(),
+		Username:      profile.Username,
+		Email:         profile.Email,
+		Name:          profile.Name,
+		Enabled:       true,
+		Roles:         profile.Roles,
+		Scopes:        profile.Scopes,
+		Attributes:    profile.Attributes,
+		Authenticator: backend,
+	}
+	if found {
+		// The account may have been disabled through the admin API or SCIM
+		user.ID = existing.ID
+		user.Enabled = existing.Enabled
+		user.ExternalID = existing.ExternalID
+		user.Identities = existing.Identities
+		user.MFA = existing.MFA
+		user.Passkeys = existing.Passkeys
+		user.CreatedAt = existing.CreatedAt
+		user.UpdatedAt = existing.UpdatedAt
+		if reflect.DeepEqual(user, existing) {
+			return existing, nil
+		}
+	}
+
+	if err := a.users.SaveUser(user); err != nil {
+		return nil, fmt.Errorf("failed to store account: %w", err)
+	}
+	if !found {
+		log.Printf("👤 Created user %s for authentication backend %s", user.Username, backend)
+	}
+	return user, nil
+}
+
+// AuthenticateUpstream returns the user of an identity authenticated by an
+// upstream provider. The identity is looked up by its link, then linked to an
+// existing user by email or username if the provider allows it, and finally
+// created as a user owned by the provider if it allows that. Users owned by the
+// provider get their profile updated on every login.
+func (a *UserAuthenticator) AuthenticateUpstream(provider *UpstreamProvider, identity *UpstreamIdentity, clientID, remoteAddr string) (*store.User, error) {
+	attempt := LoginAttempt{
+		Username:   identity.Username,
+		Method:     LoginMethodUpstream,
+		ClientID:   clientID,
+		RemoteAddr: remoteAddr,
+	}
+
+	user, err := a.upstreamUser(provider, identity)
+	if err != nil {
+		a.audit(attempt, provider.ID(), audit.OutcomeDenied, err.Error())
+		return nil, err
+	}
+
+	attempt.Username = user.Username
+	if !user.Enabled {
+		a.audit(attempt, provider.ID(), audit.OutcomeDenied, "account disabled")
+		return nil, ErrInvalidCredentials
+	}
+
+	a.audit(attempt, provider.ID(), audit.OutcomeSuccess, "")
+	return user, nil
+}
+
+// upstreamUser finds, links or creates the user of an upstream identity
+func (a *UserAuthenticator) upstreamUser(provider *UpstreamProvider, identity *UpstreamIdentity) (*store.User, error) {
+	if user, found := a.users.FindUserByIdentity(provider.ID(), identity.Subject); found {
+		if user.Authenticator != provider.ID() {
+			return user, nil
+		}
+		return a.saveUpstreamUser(provider, identity, user)
+	}
+
+	var linked *store.User
+	switch provider.LinkBy() {
+	case config.LinkByEmail:
+		// An unverified address could be anyone's
+		if identity.Email != "" && identity.EmailVerified {
+			linked, _ = a.users.FindUserByEmail(identity.Email)
+		}
+	case config.LinkByUsername:
+		linked, _ = a.users.GetUserByUsername(identity.Username)
+	}
+	if linked != nil {
+		if _, ok := linked.Identities[provider.ID()]; ok {
+			return nil, fmt.Errorf("user %s is linked to another %s identity", linked.Username, provider.ID())
+		}
+		if linked.Identities == nil {
+			linked.Identities = make(map[string]string)
+		}
+		linked.Identities[provider.ID()] = identity.Subject
+		if err := a.users.SaveUser(linked); err != nil {
+			return nil, fmt.Errorf("failed to link identity: %w", err)
+		}
+		log.Printf("🔗 Linked %s identity %s to user %s", provider.ID(), identity.Subject, linked.Username)
+		return linked, nil
+	}
+
+	if !provider.CreateUsers() {
+		return nil, fmt.Errorf("no user is linked to %s identity %s", provider.ID(), identity.Subject)
+	}
+	if _, found := a.users.GetUserByUsername(identity.Username); found {
+		return nil, fmt.Errorf("username %s belongs to another account", identity.Username)
+	}
+	return a.saveUpstreamUser(provider, identity, nil)
+}
+
+// saveUpstreamUser creates or updates a user owned by an upstream provider
+func (a *UserAuthenticator) saveUpstreamUser(provider *UpstreamProvider, identity *UpstreamIdentity, existing *store.User) (*store.User, error) {
+	user := &store.User{
+		ID:            utils.GenerateUserID(),
+		Username:      identity.Username,
+		Email:         identity.Email,
+		Name:          identity.Name,
+		Enabled:       true,
+		Roles:         identity.Roles,
+		Scopes:        identity.Scopes,
+		Attributes:    identity.Attributes,
+		Authenticator: provider.ID(),
+		Identities:    map[string]string{provider.ID(): identity.Subject},
+	}
+	if existing != nil {
+		// Keep the username when the new one is taken by someone else
+		if other, found := a.users.GetUserByUsername(user.Username); found && other.ID != existing.ID {
+			user.Username = existing.Username
+		}
+		user.ID = existing.ID
+		user.Enabled = existing.Enabled
+		user.ExternalID = existing.ExternalID
+		user.Identities = existing.Identities
+		user.MFA = existing.MFA
+		user.Passkeys = existing.Passkeys
+		user.CreatedAt = existing.CreatedAt
+		user.UpdatedAt = existing.UpdatedAt
+		if reflect.DeepEqual(user, existing) {
+			return existing, nil
+		}
+	}
+
+	if err := a.users.SaveUser(user); err != nil {
+		return nil, fmt.Errorf("failed to store account: %w", err)
+	}
+	if existing == nil {
+		log.Printf("👤 Created user %s for identity provider %s", user.Username, provider.ID())
+	}
+	return user, nil
+}
+
+// isLocked reports whether the account or the source IP of the attempt has
+// to wait before it may be tried again
+func (a *UserAuthenticator) isLocked(attempt LoginAttempt) bool {
+	return a.lockouts.Check(lockout.Account(attempt.Username), lockout.IP(attempt.RemoteAddr)) > 0
+}
+
+// recordFailure counts a failed check of credential against the account and
+// the source IP of the attempt
+func (a *UserAuthenticator) recordFailure(attempt LoginAttempt, credential string) {
+	a.lockouts.Fail(credential, attempt.ClientID, attempt.RemoteAddr, lockout.Account(attempt.Username), lockout.IP(attempt.RemoteAddr))
+}
+
+// audit records the outcome of a login attempt and the backend that checked it
+func (a *UserAuthenticator) audit(attempt LoginAttempt, backend, outcome, reason string) {
+	details := map[string]interface{}{"method": attempt.Method}
+	if backend != "" {
+		details["authenticator"] = backend
+	}
+	if attempt.RemoteAddr != "" {
+		details["remote_addr"] = attempt.RemoteAddr
+	}
+
+	audit.Log(audit.Event{
+		Type:     "user_login",
+		Outcome:  outcome,
+		ClientID: attempt.ClientID,
+		Subject:  attempt.Username,
+		Reason:   reason,
+		Details:  details,
+	})
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// stubAuthenticator answers every login with the same profile or error
+type stubAuthenticator struct {
+	name  string
+	user  *store.User
+	err   error
+	calls int
+}
+
+func (s *stubAuthenticator) Name() string {
+	return s.name
+}
+
+func (s *stubAuthenticator) Authenticate(ctx context.Context, username, password string) (*store.User, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	user := *s.user
+	user.Username = username
+	return &user, nil
+}
+
+func newTestUserAuthenticator(t *testing.T, chain string, authenticators ...Authenticator) (*UserAuthenticator, *store.UserStore) {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Authentication.Chain = chain
+	backend := store.NewMemoryBackend()
+	users := store.NewUserStore(backend.Users())
+	return NewUserAuthenticator(users, authenticators, lockout.NewTracker(cfg), backend.Requests(), cfg), users
+}
+
+func TestUserAuthenticatorChainModes(t *testing.T) {
+	profile := &store.User{Enabled: true, Email: "alice@example.org"}
+	tests := []struct {
+		name       string
+		chain      string
+		first      error
+		second     error
+		want       error
+		wantCalled bool
+	}{
+		{"unknown user passes on", config.ChainFirstMatch, ErrUnknownUser, nil, nil, true},
+		{"first_success tries the next backend", config.ChainFirstSuccess, ErrInvalidCredentials, nil, nil, true},
+		{"first_match stops at a wrong password", config.ChainFirstMatch, ErrInvalidCredentials, nil, ErrInvalidCredentials, false},
+		{"errors pass on", config.ChainFirstMatch, errors.New("ldap server down"), nil, nil, true},
+		{"errors without an answer", config.ChainFirstSuccess, errors.New("ldap server down"), ErrUnknownUser, ErrAuthenticationUnavailable, true},
+		{"errors with a rejection", config.ChainFirstSuccess, errors.New("ldap server down"), ErrInvalidCredentials, ErrInvalidCredentials, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := &stubAuthenticator{name: "first", user: profile, err: tt.first}
+			second := &stubAuthenticator{name: "second", user: profile, err: tt.second}
+			authenticator, _ := newTestUserAuthenticator(t, tt.chain, first, second)
+
+			user, err := authenticator.Authenticate(LoginAttempt{Username: "alice", Password: "secret", Method: LoginMethodForm})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Authenticate = %v, want %v", err, tt.want)
+			}
+			if called := second.calls > 0; called != tt.wantCalled {
+				t.Errorf("second backend called = %v, want %v", called, tt.wantCalled)
+			}
+			if tt.want == nil && user.Authenticator != "second" {
+				t.Errorf("user authenticator = %q, want second", user.Authenticator)
+			}
+		})
+	}
+}
+
+func TestUserAuthenticatorProvisionsExternalUsers(t *testing.T) {
+	ldap := &stubAuthenticator{name: "ldap", user: &store.User{Enabled: true, Name: "Alice", Roles: []string{"staff"}}}
+	authenticator, users := newTestUserAuthenticator(t, "", ldap)
+
+	first, err := authenticator.Authenticate(LoginAttempt{Username: "alice", Password: "secret", Method: LoginMethodForm})
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if first.ID == "" || first.Authenticator != "ldap" {
+		t.Fatalf("user = %+v, want a stored user of the ldap backend", first)
+	}
+
+	// The stored account follows the backend and keeps a disabled state
+	ldap.user = &store.User{Enabled: true, Name: "Alice Liddell", Roles: []string{"staff"}}
+	first.Enabled = false
+	if err := users.SaveUser(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticator.Authenticate(LoginAttempt{Username: "alice", Password: "secret", Method: LoginMethodForm}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Authenticate of a disabled account = %v, want %v", err, ErrInvalidCredentials)
+	}
+	stored, _ := users.GetUserByUsername("alice")
+	if stored.ID != first.ID || stored.Name != "Alice Liddell" || stored.Enabled {
+		t.Errorf("stored user = %+v, want the updated, still disabled account %s", stored, first.ID)
+	}
+}
+
+func TestUserAuthenticatorDoesNotTakeOverUsernames(t *testing.T) {
+	ldap := &stubAuthenticator{name: "ldap", user: &store.User{Enabled: true}}
+	authenticator, users := newTestUserAuthenticator(t, "", ldap)
+
+	local := &store.User{ID: "user-1", Username: "alice", Enabled: true}
+	if err := local.SetPassword("local-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SaveUser(local); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := authenticator.Authenticate(LoginAttempt{Username: "alice", Password: "ldap-secret", Method: LoginMethodForm}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Authenticate = %v, want %v", err, ErrInvalidCredentials)
+	}
+	stored, _ := users.GetUserByUsername("alice")
+	if stored.ID != "user-1" || stored.Authenticator != "" {
+		t.Errorf("stored user = %+v, want the local account", stored)
+	}
+}
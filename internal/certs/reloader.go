@@ -0,0 +1,100 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate key pair from disk and swaps it when the files
+// change, so renewed certificates are picked up without a restart
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	certStat fileStat
+	keyStat  fileStat
+}
+
+// fileStat identifies a version of a file
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader loads the key pair and fails if it cannot be used
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// Reload loads the key pair again if either file changed and returns 1 when the
+// certificate was replaced. A broken key pair keeps the current certificate.
+func (r *Reloader) Reload(ctx context.Context) (int, error) {
+	certStat, err := statFile(r.certFile)
+	if err != nil {
+		return 0, err
+	}
+	keyStat, err := statFile(r.keyFile)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mutex.RLock()
+	unchanged := r.cert != nil && certStat == r.certStat && keyStat == r.keyStat
+	r.mutex.RUnlock()
+	if unchanged {
+		return 0, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load tls key pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse tls certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.certStat = certStat
+	r.keyStat = keyStat
+	r.mutex.Unlock()
+
+	log.Printf("🔐 TLS certificate loaded: %s, expires %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	if time.Until(leaf.NotAfter) < 7*24*time.Hour {
+		log.Printf("⚠️ TLS certificate expires in less than 7 days")
+	}
+	return 1, nil
+}
+
+// statFile returns the modification time and size of a file
+func statFile(path string) (fileStat, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStat{}, fmt.Errorf("failed to read tls file: %w", err)
+	}
+	return fileStat{modTime: info.ModTime(), size: info.Size()}, nil
+}
@@ -2,28 +2,49 @@ package flows
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"oauth2-server/internal/auth"
+	"oauth2-server/internal/store"
 	"oauth2-server/internal/utils"
 	"oauth2-server/pkg/config"
 
 	"github.com/ory/fosite"
 )
 
+// Login sessions let users approve further authorization requests without
+// entering their password again
+const (
+	sessionCookieName    = "oauth2_session"
+	loginSessionLifetime = 8 * time.Hour
+)
+
 // AuthorizationCodeFlow handles the OAuth2 authorization code flow
 type AuthorizationCodeFlow struct {
 	oauth2Provider fosite.OAuth2Provider
+	userAuth       *auth.UserAuthenticator
+	providers      *auth.UpstreamProviders
+	users          *store.UserStore
+	sessions       store.SessionStorage
+	consents       store.ConsentStorage
 	config         *config.Config
 }
 
 // NewAuthorizationCodeFlow creates a new authorization code flow handler
-func NewAuthorizationCodeFlow(oauth2Provider fosite.OAuth2Provider, config *config.Config) *AuthorizationCodeFlow {
+func NewAuthorizationCodeFlow(oauth2Provider fosite.OAuth2Provider, userAuth *auth.UserAuthenticator, providers *auth.UpstreamProviders, users *store.UserStore, sessions store.SessionStorage, consents store.ConsentStorage, config *config.Config) *AuthorizationCodeFlow {
 	return &AuthorizationCodeFlow{
 		oauth2Provider: oauth2Provider,
+		userAuth:       userAuth,
+		providers:      providers,
+		users:          users,
+		sessions:       sessions,
+		consents:       consents,
 		config:         config,
 	}
 }
@@ -45,36 +66,156 @@ func (f *AuthorizationCodeFlow) HandleAuthorization(w http.ResponseWriter, r *ht
 
 	log.Printf("✅ Authorization request created successfully for client: %s", ar.GetClient().GetID())
 
-	// Check if this is a login form submission
-	if r.Method == "POST" && r.FormValue("action") == "login" {
-		f.handleLogin(w, r, ar)
-		return
+	// Check if this is a login form submission or a later step of a login
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "login":
+			f.handleLogin(w, r, ar)
+			return
+		case "passkey_login":
+			f.handlePasskeyLogin(w, r, ar)
+			return
+		case "passkey_register":
+			f.handlePasskeyRegister(w, r, ar)
+			return
+		case "mfa":
+			f.handleMFA(w, r, ar)
+			return
+		case "mfa_enroll":
+			f.handleMFAEnroll(w, r, ar)
+			return
+		case "mfa_passkey":
+			f.handleMFAPasskey(w, r, ar)
+			return
+		case "mfa_passkey_enroll":
+			f.handleMFAPasskeyEnroll(w, r, ar)
+			return
+		}
 	}
 
 	// Check if user is already authenticated via session or basic auth
-	var userID string
+	var login *store.Session
 
-	// Try to get authenticated user from basic auth (for testing)
+	// Try to get authenticated user from basic auth (for testing); users who
+	// need a second factor have to use the login form
 	if username, password, ok := r.BasicAuth(); ok {
-		if user := f.authenticateUser(username, password); user != nil {
-			userID = user.ID
+		if user, err := f.authenticateUser(r, ar, username, password); err == nil && !f.userAuth.MFARequired(user) {
+			login = newLogin(user.ID, auth.PasswordAMR(false))
 		}
 	}
 
+	// Fall back to the login session unless the client asks for a fresh login
+	if login == nil && !hasPrompt(ar, "login") {
+		login = f.loginSession(r)
+	}
+
 	// If no user authenticated, show login form
-	if userID == "" {
+	if login == nil {
 		f.showLoginForm(w, r, ar)
 		return
 	}
 
 	// Check if this is a consent form submission
 	if r.Method == "POST" && r.FormValue("action") == "consent" {
-		f.handleConsent(w, r, ar, userID)
+		f.handleConsent(w, r, ar, login)
 		return
 	}
 
-	// Show consent form
-	f.showConsentForm(w, r, ar, userID)
+	f.continueAuthorization(w, r, ar, login)
+}
+
+// continueAuthorization skips the consent form when the user already approved
+// the requested scopes and shows it otherwise
+func (f *AuthorizationCodeFlow) continueAuthorization(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester, login *store.Session) {
+	if f.hasConsent(r.Context(), ar, login.UserID) {
+		f.issueAuthorizeResponse(r.Context(), w, ar, login)
+		return
+	}
+
+	f.showConsentForm(w, r, ar, login.UserID)
+}
+
+// hasPrompt reports whether the OpenID Connect prompt parameter contains value
+func hasPrompt(ar fosite.AuthorizeRequester, value string) bool {
+	for _, prompt := range strings.Fields(ar.GetRequestForm().Get("prompt")) {
+		if prompt == value {
+			return true
+		}
+	}
+	return false
+}
+
+// loginSession returns the login session of the cookie, if still valid
+func (f *AuthorizationCodeFlow) loginSession(r *http.Request) *store.Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	session, err := f.sessions.GetSession(r.Context(), cookie.Value)
+	if err != nil || time.Now().After(session.ExpiresAt) {
+		return nil
+	}
+
+	return session
+}
+
+// newLogin describes a login of the user that happened now with the given
+// authentication methods
+func newLogin(userID string, amr []string) *store.Session {
+	now := time.Now()
+	return &store.Session{
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(loginSessionLifetime),
+		AMR:       amr,
+		ACR:       auth.ACR(amr),
+	}
+}
+
+// startSession creates a login session for the user and sets its cookie. The
+// login is returned even when it could not be stored, so the current request
+// can complete.
+func (f *AuthorizationCodeFlow) startSession(w http.ResponseWriter, r *http.Request, userID string, amr []string) *store.Session {
+	session := newLogin(userID, amr)
+
+	sessionID, err := utils.GenerateRandomString(32)
+	if err != nil {
+		log.Printf("⚠️ Failed to generate session ID: %v", err)
+		return session
+	}
+
+	session.ID = sessionID
+	if err := f.sessions.SaveSession(r.Context(), session); err != nil {
+		log.Printf("⚠️ Failed to store login session: %v", err)
+		return session
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(utils.GetRequestBaseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session
+}
+
+// hasConsent reports whether the user already granted every requested scope to
+// the client; prompt=consent always asks again
+func (f *AuthorizationCodeFlow) hasConsent(ctx context.Context, ar fosite.AuthorizeRequester, userID string) bool {
+	if hasPrompt(ar, "consent") {
+		return false
+	}
+
+	consent, err := f.consents.GetConsent(ctx, userID, ar.GetClient().GetID())
+	if err != nil {
+		return false
+	}
+
+	return len(utils.FilterScopes(ar.GetRequestedScopes(), consent.Scopes)) == len(ar.GetRequestedScopes())
 }
 
 // handleLogin processes the login form submission
@@ -83,15 +224,41 @@ func (f *AuthorizationCodeFlow) handleLogin(w http.ResponseWriter, r *http.Reque
 	password := r.FormValue("password")
 
 	// Authenticate the user
-	user := f.authenticateUser(username, password)
-	if user == nil {
+	user, err := f.authenticateUser(r, ar, username, password)
+	if errors.Is(err, auth.ErrAccountLocked) {
+		f.showLoginFormWithError(w, r, ar, "Too many failed login attempts, please try again later")
+		return
+	}
+	if errors.Is(err, auth.ErrAuthenticationUnavailable) {
+		f.showLoginFormWithError(w, r, ar, "Authentication is temporarily unavailable, please try again later")
+		return
+	}
+	if err != nil {
 		// Authentication failed - show login form with error
 		f.showLoginFormWithError(w, r, ar, "Invalid username or password")
 		return
 	}
 
-	// Authentication successful - show consent form
-	f.showConsentForm(w, r, ar, user.ID)
+	// The password is correct, but the login needs a second factor
+	if f.userAuth.MFARequired(user) {
+		f.startMFA(w, r, ar, user)
+		return
+	}
+
+	// Authentication successful - remember the login for later requests
+	f.completeLogin(w, r, ar, user, auth.PasswordAMR(false), r.FormValue("add_passkey") != "")
+}
+
+// completeLogin starts the login session of an authenticated user and
+// continues the authorization request, after offering to create a passkey
+// when the user asked for it
+func (f *AuthorizationCodeFlow) completeLogin(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester, user *store.User, amr []string, offerPasskey bool) {
+	login := f.startSession(w, r, user.ID, amr)
+	if offerPasskey && f.userAuth.PasskeysEnabled() {
+		f.showPasskeyOffer(w, r, user, "")
+		return
+	}
+	f.continueAuthorization(w, r, ar, login)
 }
 
 // showLoginFormWithError displays the login form with an error message
@@ -104,7 +271,7 @@ func (f *AuthorizationCodeFlow) showLoginFormWithError(w http.ResponseWriter, r
 
 	errorHTML := ""
 	if errorMsg != "" {
-		errorHTML = fmt.Sprintf(`<div class="error">❌ %s</div>`, errorMsg)
+		errorHTML = fmt.Sprintf(`<div class="error">❌ %s</div>`, html.EscapeString(errorMsg))
 	}
 
 	loginHTML := `<!DOCTYPE html>
@@ -123,6 +290,9 @@ func (f *AuthorizationCodeFlow) showLoginFormWithError(w http.ResponseWriter, r
         .btn:hover { background-color: #0056b3; }
         .info { background-color: #e7f3ff; padding: 15px; border-radius: 4px; margin-bottom: 20px; }
         .error { background-color: #f8d7da; color: #721c24; padding: 15px; border-radius: 4px; margin-bottom: 20px; border: 1px solid #f5c6cb; }
+        .checkbox { font-weight: normal; }
+        .providers { margin-top: 20px; text-align: center; color: #6c757d; }
+        .providers .provider { display: block; margin-top: 10px; background-color: #6c757d; text-decoration: none; box-sizing: border-box; }
         .test-users { margin-top: 20px; padding: 15px; background-color: #f8f9fa; border-radius: 4px; }
         .test-users h4 { margin: 0 0 10px 0; color: #6c757d; }
         .test-users ul { margin: 0; padding-left: 20px; }
@@ -134,12 +304,12 @@ func (f *AuthorizationCodeFlow) showLoginFormWithError(w http.ResponseWriter, r
         <h2>🔐 OAuth2 Login</h2>
         ` + errorHTML + `
         <div class="info">
-            <strong>Client:</strong> ` + ar.GetClient().GetID() + `<br>
-            <strong>Scopes:</strong> ` + strings.Join(ar.GetRequestedScopes(), ", ") + `<br>
-            <strong>Redirect URI:</strong> ` + ar.GetRedirectURI().String() + `
+            <strong>Client:</strong> ` + html.EscapeString(ar.GetClient().GetID()) + `<br>
+            <strong>Scopes:</strong> ` + html.EscapeString(strings.Join(ar.GetRequestedScopes(), ", ")) + `<br>
+            <strong>Redirect URI:</strong> ` + html.EscapeString(ar.GetRedirectURI().String()) + `
         </div>
         
-        <form method="post" action="/auth` + query + `">
+        <form method="post" action="auth` + html.EscapeString(query) + `">
             <input type="hidden" name="action" value="login">
             <div class="form-group">
                 <label for="username">Username:</label>
@@ -149,8 +319,11 @@ func (f *AuthorizationCodeFlow) showLoginFormWithError(w http.ResponseWriter, r
                 <label for="password">Password:</label>
                 <input type="password" id="password" name="password" required>
             </div>
+            ` + f.passkeyOfferCheckbox() + `
             <button type="submit" class="btn">Login</button>
         </form>
+        ` + f.passkeyLoginButton(w, r) + `
+        ` + f.generateProviderButtons(query) + `
 
         <div class="test-users">
             <h4>Available Test Users:</h4>
@@ -165,16 +338,15 @@ func (f *AuthorizationCodeFlow) showLoginFormWithError(w http.ResponseWriter, r
 	w.Write([]byte(loginHTML))
 }
 
-// authenticateUser validates user credentials against the configured users
-func (f *AuthorizationCodeFlow) authenticateUser(username, password string) *config.User {
-	// Look up user in the configuration
-	if user, found := f.config.GetUserByUsername(username); found {
-		// In a real implementation, you'd hash and compare passwords properly
-		if user.Password == password {
-			return user
-		}
-	}
-	return nil
+// authenticateUser validates user credentials against the user store
+func (f *AuthorizationCodeFlow) authenticateUser(r *http.Request, ar fosite.AuthorizeRequester, username, password string) (*store.User, error) {
+	return f.userAuth.Authenticate(auth.LoginAttempt{
+		Username:   username,
+		Password:   password,
+		Method:     auth.LoginMethodForm,
+		ClientID:   ar.GetClient().GetID(),
+		RemoteAddr: r.RemoteAddr,
+	})
 }
 
 // showLoginForm displays the login form
@@ -182,16 +354,17 @@ func (f *AuthorizationCodeFlow) showLoginForm(w http.ResponseWriter, r *http.Req
 	f.showLoginFormWithError(w, r, ar, "")
 }
 
-// generateTestUsersList creates an HTML list of available test users
+// generateTestUsersList creates an HTML list of the test users of the config
+// file; stored users are not listed on this public page
 func (f *AuthorizationCodeFlow) generateTestUsersList() string {
 	var usersList strings.Builder
 
-	for _, user := range f.config.Users {
+	for _, user := range f.config.ListUsers() {
 		usersList.WriteString(fmt.Sprintf(
 			"<li><strong>%s</strong> / %s (%s)</li>",
-			user.Username,
-			user.Password,
-			user.Name,
+			html.EscapeString(user.Username),
+			html.EscapeString(user.Password),
+			html.EscapeString(user.Name),
 		))
 	}
 
@@ -212,7 +385,7 @@ func (f *AuthorizationCodeFlow) showConsentForm(w http.ResponseWriter, r *http.R
 
 	// Get user information
 	var userName string
-	if user, found := f.config.GetUserByUsername(userID); found {
+	if user, found := f.users.GetUser(userID); found {
 		userName = user.Name
 	} else {
 		userName = userID
@@ -254,7 +427,7 @@ func (f *AuthorizationCodeFlow) showConsentForm(w http.ResponseWriter, r *http.R
             </ul>
         </div>
         
-        <form method="post" action="/auth%s">
+        <form method="post" action="auth%s">
             <input type="hidden" name="action" value="consent">
             <input type="hidden" name="user_id" value="%s">
             <button type="submit" name="consent" value="allow" class="btn btn-primary">Allow</button>
@@ -263,11 +436,11 @@ func (f *AuthorizationCodeFlow) showConsentForm(w http.ResponseWriter, r *http.R
     </div>
 </body>
 </html>`,
-		userName,
-		ar.GetClient().GetID(),
+		html.EscapeString(userName),
+		html.EscapeString(ar.GetClient().GetID()),
 		f.generateScopesList(ar.GetRequestedScopes()),
-		query,
-		userID,
+		html.EscapeString(query),
+		html.EscapeString(userID),
 	)
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -277,30 +450,16 @@ func (f *AuthorizationCodeFlow) showConsentForm(w http.ResponseWriter, r *http.R
 
 // generateScopesList creates an HTML list of requested scopes
 func (f *AuthorizationCodeFlow) generateScopesList(scopes []string) string {
-	scopeDescriptions := map[string]string{
-		"openid":    "Verify your identity",
-		"profile":   "Access your basic profile information",
-		"email":     "Access your email address",
-		"api:read":  "Read access to API resources",
-		"api:write": "Write access to API resources",
-		"api:admin": "Administrative access to API resources",
-		"offline":   "Access your data when you're not actively using the app",
-	}
-
 	var scopesList strings.Builder
 	for _, scope := range scopes {
-		description := scopeDescriptions[scope]
-		if description == "" {
-			description = fmt.Sprintf("Access to %s", scope)
-		}
-		scopesList.WriteString(fmt.Sprintf("<li><strong>%s:</strong> %s</li>", scope, description))
+		scopesList.WriteString(fmt.Sprintf("<li><strong>%s:</strong> %s</li>", html.EscapeString(scope), html.EscapeString(utils.DescribeScope(scope))))
 	}
 
 	return scopesList.String()
 }
 
 // handleConsent processes the consent form submission
-func (f *AuthorizationCodeFlow) handleConsent(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester, userID string) {
+func (f *AuthorizationCodeFlow) handleConsent(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester, login *store.Session) {
 	ctx := context.Background()
 
 	// Check if user consented
@@ -312,20 +471,54 @@ func (f *AuthorizationCodeFlow) handleConsent(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// Remember the decision so the user is not asked again for these scopes
+	err := f.consents.SaveConsent(ctx, &store.Consent{
+		UserID:    login.UserID,
+		ClientID:  ar.GetClient().GetID(),
+		Scopes:    ar.GetRequestedScopes(),
+		GrantedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("⚠️ Failed to store consent: %v", err)
+	}
+
+	f.issueAuthorizeResponse(ctx, w, ar, login)
+}
+
+// issueAuthorizeResponse issues the authorization code and redirects to the client
+func (f *AuthorizationCodeFlow) issueAuthorizeResponse(ctx context.Context, w http.ResponseWriter, ar fosite.AuthorizeRequester, login *store.Session) {
+	userID := login.UserID
+
 	// Get the username for the session
 	var username string
-	if user, found := f.config.GetUserByUsername(userID); found {
+	if user, found := f.users.GetUser(userID); found {
 		username = user.Username
 	} else {
 		username = userID
 	}
 
-	// Create a new session that implements fosite.Session
+	// Grant what the user approved; fosite only issues ID tokens for a
+	// granted openid scope
+	for _, scope := range ar.GetRequestedScopes() {
+		ar.GrantScope(scope)
+	}
+	for _, audience := range ar.GetRequestedAudience() {
+		ar.GrantAudience(audience)
+	}
+
+	// Create a new session that implements fosite.Session, with the ID token
+	// claims describing the login
 	mySessionData := &auth.UserSession{
 		UserID:   userID,
 		Username: username,
 		Subject:  userID,
 	}
+	claims := mySessionData.IDTokenClaims()
+	claims.Subject = userID
+	claims.AuthTime = login.CreatedAt.UTC()
+	claims.RequestedAt = ar.GetRequestedAt().UTC()
+	claims.AuthenticationMethodsReferences = login.AMR
+	claims.AuthenticationContextClassReference = login.ACR
 
 	// Generate the authorization code response
 	response, err := f.oauth2Provider.NewAuthorizeResponse(ctx, ar, mySessionData)
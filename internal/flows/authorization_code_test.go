@@ -0,0 +1,36 @@
+package flows
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ory/fosite"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+func TestLoginPageListsOnlyEscapedConfigUsers(t *testing.T) {
+	f, users := newUpstreamTestFlow(t, nil)
+	f.config.Users = []config.UserConfig{{Username: "bob", Password: "secret", Name: "<b>Bob</b>"}}
+	if err := users.SaveUser(&store.User{ID: "user-mallory", Username: "mallory", Name: "<script>alert(1)</script>", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ar := fosite.NewAuthorizeRequest()
+	ar.Client = &fosite.DefaultClient{ID: "app"}
+	ar.RedirectURI, _ = url.Parse("http://localhost/callback")
+	w := httptest.NewRecorder()
+	f.showLoginForm(w, httptest.NewRequest(http.MethodGet, "/auth?client_id=app", nil), ar)
+
+	page := w.Body.String()
+	if !strings.Contains(page, "&lt;b&gt;Bob&lt;/b&gt;") {
+		t.Error("config user is not listed escaped")
+	}
+	if strings.Contains(page, "mallory") || strings.Contains(page, "<script>alert") {
+		t.Error("stored user is listed on the login page")
+	}
+}
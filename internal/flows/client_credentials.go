@@ -68,7 +68,7 @@ func (f *ClientCredentialsFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate client credentials
-	if err := f.clientStore.ValidateClientCredentials(clientID, clientSecret); err != nil {
+	if err := f.clientStore.ValidateClientCredentials(clientID, clientSecret, r.RemoteAddr); err != nil {
 		log.Printf("❌ Client authentication failed for %s: %v", clientID, err)
 		utils.WriteErrorResponse(w, "invalid_client", "Client authentication failed")
 		return
@@ -116,7 +116,8 @@ func (f *ClientCredentialsFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Store access token with proper parameters
-	expiresAt := time.Now().Add(time.Hour)
+	accessTokenLifetime := f.config.Security.AccessTokenLifetime()
+	expiresAt := time.Now().Add(accessTokenLifetime)
 	err = f.tokenStore.StoreAccessToken(accessToken, clientID, "", requestedScopes, expiresAt)
 	if err != nil {
 		log.Printf("❌ Error storing access token: %v", err)
@@ -128,7 +129,7 @@ func (f *ClientCredentialsFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"access_token": accessToken,
 		"token_type":   "Bearer",
-		"expires_in":   3600, // 1 hour
+		"expires_in":   int(accessTokenLifetime.Seconds()),
 		"scope":        utils.JoinScopes(requestedScopes),
 	}
 
@@ -3,12 +3,13 @@ package flows
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
-	"sync"
 	"time"
 
 	"oauth2-server/internal/auth"
@@ -16,24 +17,35 @@ import (
 	"oauth2-server/internal/store"
 	"oauth2-server/internal/utils"
 	"oauth2-server/pkg/config"
+
+	"github.com/ory/fosite"
 )
 
 // DeviceCodeFlow handles the device authorization flow (RFC 8628)
 type DeviceCodeFlow struct {
-	clientStore      *store.ClientStore
-	config           *config.Config
-	deviceAuths      map[string]*models.DeviceAuthorization
-	userCodeToDevice map[string]string
-	mutex            sync.RWMutex
+	clientStore  *store.ClientStore
+	tokenStore   *store.TokenStore
+	deviceGrants store.DeviceGrantStorage
+	config       *config.Config
 }
 
+// Outcomes of a device token poll that do not issue tokens
+var (
+	errDeviceClientMismatch = errors.New("device code was not issued to this client")
+	errDeviceExpired        = errors.New("device code expired")
+	errDeviceDenied         = errors.New("device authorization denied")
+	errDeviceUsed           = errors.New("device code already used")
+	errDeviceSlowDown       = errors.New("device polling too fast")
+	errDevicePending        = errors.New("device authorization pending")
+)
+
 // NewDeviceCodeFlow creates a new device code flow handler
-func NewDeviceCodeFlow(clientStore *store.ClientStore, config *config.Config) *DeviceCodeFlow {
+func NewDeviceCodeFlow(clientStore *store.ClientStore, tokenStore *store.TokenStore, deviceGrants store.DeviceGrantStorage, config *config.Config) *DeviceCodeFlow {
 	return &DeviceCodeFlow{
-		clientStore:      clientStore,
-		config:           config,
-		deviceAuths:      make(map[string]*models.DeviceAuthorization),
-		userCodeToDevice: make(map[string]string),
+		clientStore:  clientStore,
+		tokenStore:   tokenStore,
+		deviceGrants: deviceGrants,
+		config:       config,
 	}
 }
 
@@ -94,22 +106,26 @@ func (f *DeviceCodeFlow) HandleAuthorization(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Store device authorization
-	expiresAt := time.Now().Add(time.Duration(f.config.Security.DeviceCodeExpirySeconds) * time.Second)
+	expiresIn := f.deviceCodeLifetime()
+	interval := f.pollInterval(client)
+	now := time.Now()
 	deviceAuth := &models.DeviceAuthorization{
 		DeviceCode: deviceCode,
 		UserCode:   userCode,
 		ClientID:   clientID,
 		Scopes:     requestedScopes,
-		ExpiresAt:  expiresAt,
-		IssuedAt:   time.Now(),
+		ExpiresAt:  now.Add(time.Duration(expiresIn) * time.Second),
+		IssuedAt:   now,
+		Interval:   interval,
 		Authorized: false,
 		Used:       false,
 	}
 
-	f.mutex.Lock()
-	f.deviceAuths[deviceCode] = deviceAuth
-	f.userCodeToDevice[userCode] = deviceCode
-	f.mutex.Unlock()
+	if err := f.deviceGrants.SaveDeviceGrant(ctx, deviceAuth); err != nil {
+		log.Printf("❌ Error storing device authorization: %v", err)
+		utils.WriteServerError(w, "Failed to store device authorization")
+		return
+	}
 
 	// Create response with verification_uri_complete
 	baseURL := f.config.BaseURL
@@ -120,13 +136,13 @@ func (f *DeviceCodeFlow) HandleAuthorization(w http.ResponseWriter, r *http.Requ
 	verificationURI := fmt.Sprintf("%s/device", baseURL)
 	verificationURIComplete := fmt.Sprintf("%s/device?user_code=%s", baseURL, userCode)
 
-	response := map[string]interface{}{
-		"device_code":               deviceCode,
-		"user_code":                 userCode,
-		"verification_uri":          verificationURI,
-		"verification_uri_complete": verificationURIComplete,
-		"expires_in":                expiresAt,
-		"interval":                  5, // Polling interval in seconds
+	response := models.DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURIComplete,
+		ExpiresIn:               int64(expiresIn),
+		Interval:                int64(interval),
 	}
 
 	log.Printf("✅ Device authorization created for client: %s, user code: %s", clientID, userCode)
@@ -169,47 +185,82 @@ func (f *DeviceCodeFlow) HandleToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate client with context
-	ctx := context.Background()
+	// Validate client
+	ctx := r.Context()
 	_, err := f.clientStore.GetClient(ctx, clientID)
 	if err != nil {
 		utils.WriteInvalidClientError(w, "Invalid client")
 		return
 	}
 
-	// Get device authorization
-	f.mutex.RLock()
-	deviceAuth, exists := f.deviceAuths[deviceCode]
-	f.mutex.RUnlock()
+	// Resolve the polling state of the device code in a single atomic update so
+	// that concurrent polls for the same device code cannot both observe a stale
+	// last-poll timestamp or both redeem an approved grant
+	var outcome error
+	deviceAuth, err := f.deviceGrants.UpdateDeviceGrant(ctx, deviceCode, func(grant *models.DeviceAuthorization) error {
+		if grant.ClientID != clientID {
+			return errDeviceClientMismatch
+		}
+		if grant.IsExpired() {
+			return errDeviceExpired
+		}
+		if grant.IsDenied() {
+			return errDeviceDenied
+		}
+
+		// RFC 8628 Section 3.5: a client polling faster than the interval gets
+		// slow_down and must add 5 seconds to its interval for all later requests
+		now := time.Now()
+		if grant.PollingTooFast(now) {
+			grant.Interval += models.SlowDownIncrement
+			grant.LastPolledAt = now
+			outcome = errDeviceSlowDown
+			return nil
+		}
+		grant.LastPolledAt = now
+
+		if grant.IsPending() {
+			outcome = errDevicePending
+			return nil
+		}
 
-	if !exists {
+		if !grant.CanIssueToken() {
+			return errDeviceUsed
+		}
+
+		// Claim the grant in the same update so it is redeemed exactly once
+		grant.Used = true
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, store.ErrNotFound):
 		utils.WriteInvalidGrantError(w, "Invalid device code")
 		return
-	}
-
-	// Check if device code has expired
-	if time.Now().After(deviceAuth.ExpiresAt.Add(time.Duration(f.config.Security.DeviceCodeExpirySeconds) * time.Second)) {
-		f.mutex.Lock()
-		delete(f.deviceAuths, deviceCode)
-		delete(f.userCodeToDevice, deviceAuth.UserCode)
-		f.mutex.Unlock()
-		utils.WriteInvalidGrantError(w, "Device code has expired")
+	case errors.Is(err, errDeviceClientMismatch):
+		utils.WriteInvalidGrantError(w, "Device code was not issued to this client")
 		return
-	}
-
-	// Check device status
-	if deviceAuth.IsPending() {
-		// Return authorization_pending error per RFC 8628
-		utils.WriteErrorResponse(w, "authorization_pending", "User has not yet authorized the device")
+	case errors.Is(err, errDeviceExpired):
+		f.deleteDeviceGrant(ctx, deviceCode)
+		utils.WriteErrorResponse(w, "expired_token", "The device code has expired")
 		return
-	}
-
-	if !deviceAuth.CanIssueToken() {
-		if deviceAuth.Used {
-			utils.WriteInvalidGrantError(w, "Device code already used")
-		} else {
-			utils.WriteInvalidGrantError(w, "Device not authorized")
-		}
+	case errors.Is(err, errDeviceDenied):
+		f.deleteDeviceGrant(ctx, deviceCode)
+		utils.WriteErrorResponse(w, "access_denied", "The user denied the authorization request")
+		return
+	case errors.Is(err, errDeviceUsed):
+		utils.WriteInvalidGrantError(w, "Device code already used")
+		return
+	case err != nil:
+		log.Printf("❌ Error updating device authorization: %v", err)
+		utils.WriteServerError(w, "Failed to process device code")
+		return
+	case outcome == errDeviceSlowDown:
+		log.Printf("🐢 Device %s polling too fast, interval raised to %ds", deviceAuth.UserCode, deviceAuth.Interval)
+		utils.WriteErrorResponse(w, "slow_down", fmt.Sprintf("Polling too frequently, wait at least %d seconds between requests", deviceAuth.Interval))
+		return
+	case outcome == errDevicePending:
+		utils.WriteErrorResponse(w, "authorization_pending", "User has not yet authorized the device")
 		return
 	}
 
@@ -229,23 +280,45 @@ func (f *DeviceCodeFlow) HandleToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Persist the tokens with the same lifetime policy as the other grants so
+	// the refresh token can be redeemed and the access token introspected
+	accessTokenLifetime := f.config.Security.AccessTokenLifetime()
+	accessTokenExpiry := time.Now().Add(accessTokenLifetime)
+	refreshTokenExpiry := time.Now().Add(f.config.Security.RefreshTokenLifetime())
+
+	err = f.tokenStore.StoreAccessToken(accessToken, deviceAuth.ClientID, deviceAuth.UserID, deviceAuth.Scopes, accessTokenExpiry)
+	if err != nil {
+		log.Printf("❌ Error storing access token: %v", err)
+		utils.WriteServerError(w, "Failed to store access token")
+		return
+	}
+
+	err = f.tokenStore.StoreRefreshToken(refreshToken, deviceAuth.ClientID, deviceAuth.UserID, deviceAuth.Scopes, refreshTokenExpiry)
+	if err != nil {
+		log.Printf("❌ Error storing refresh token: %v", err)
+		utils.WriteServerError(w, "Failed to store refresh token")
+		return
+	}
+
 	// Create token response
-	expiresAt := time.Now().Add(time.Duration(f.config.Security.TokenExpirySeconds) * time.Second)
-	tokenResponse := map[string]interface{}{
-		"access_token":  accessToken,
-		"token_type":    "Bearer",
-		"expires_in":    expiresAt,
-		"refresh_token": refreshToken,
-		"scope":         utils.JoinScopes(deviceAuth.Scopes),
-	}
-
-	// Mark device as used
-	f.mutex.Lock()
-	deviceAuth.Used = true
-	deviceAuth.AccessToken = accessToken
-	deviceAuth.RefreshToken = refreshToken
-	deviceAuth.TokenType = "Bearer"
-	f.mutex.Unlock()
+	tokenResponse := models.TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        utils.JoinScopes(deviceAuth.Scopes),
+	}
+
+	// Record the issued tokens on the device authorization
+	_, err = f.deviceGrants.UpdateDeviceGrant(ctx, deviceCode, func(grant *models.DeviceAuthorization) error {
+		grant.AccessToken = accessToken
+		grant.RefreshToken = refreshToken
+		grant.TokenType = "Bearer"
+		return nil
+	})
+	if err != nil {
+		log.Printf("⚠️ Failed to record tokens on device authorization %s: %v", deviceAuth.UserCode, err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-store")
@@ -255,36 +328,138 @@ func (f *DeviceCodeFlow) HandleToken(w http.ResponseWriter, r *http.Request) {
 	log.Printf("✅ Access token issued for device: %s, user: %s", deviceCode, deviceAuth.UserID)
 }
 
-// AuthorizeDevice authorizes a device with user code
-func (f *DeviceCodeFlow) AuthorizeDevice(userCode, userID string) bool {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
+// ErrInvalidUserCode is returned when a user code is unknown, expired or already decided
+var ErrInvalidUserCode = errors.New("invalid or expired device code")
+
+// BeginConsent binds an authenticated user to a pending device authorization and
+// returns a copy of the authorization together with a one-time consent token
+// that the consent form has to post back
+func (f *DeviceCodeFlow) BeginConsent(userCode, userID string) (*models.DeviceAuthorization, string, error) {
+	ctx := context.Background()
+
+	deviceAuth, err := f.deviceGrants.GetDeviceGrantByUserCode(ctx, userCode)
+	if err != nil {
+		return nil, "", ErrInvalidUserCode
+	}
+
+	consentToken, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate consent token: %w", err)
+	}
+
+	snapshot, err := f.deviceGrants.UpdateDeviceGrant(ctx, deviceAuth.DeviceCode, func(grant *models.DeviceAuthorization) error {
+		if !grant.IsPending() {
+			return ErrInvalidUserCode
+		}
+		grant.ConsentUser = userID
+		grant.ConsentToken = consentToken
+		return nil
+	})
+	if errors.Is(err, ErrInvalidUserCode) || errors.Is(err, store.ErrNotFound) {
+		return nil, "", ErrInvalidUserCode
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to start consent: %w", err)
+	}
+
+	return snapshot, consentToken, nil
+}
+
+// ConsentUser returns the user that started consent for a user code, provided
+// the consent token matches the one handed out by BeginConsent
+func (f *DeviceCodeFlow) ConsentUser(userCode, consentToken string) (string, bool) {
+	deviceAuth, err := f.deviceGrants.GetDeviceGrantByUserCode(context.Background(), userCode)
+	if err != nil || deviceAuth.ConsentToken == "" || !deviceAuth.IsPending() {
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(deviceAuth.ConsentToken), []byte(consentToken)) != 1 {
+		return "", false
+	}
+
+	return deviceAuth.ConsentUser, true
+}
+
+// AuthorizeDevice authorizes a device with user code, granting the subset of the
+// requested scopes that the user approved
+func (f *DeviceCodeFlow) AuthorizeDevice(userCode, userID string, grantedScopes []string) bool {
+	ctx := context.Background()
 
-	deviceCode, exists := f.userCodeToDevice[userCode]
-	if !exists {
+	deviceAuth, err := f.deviceGrants.GetDeviceGrantByUserCode(ctx, userCode)
+	if err != nil {
 		return false
 	}
 
-	deviceAuth, exists := f.deviceAuths[deviceCode]
-	if !exists {
+	var scopes []string
+	_, err = f.deviceGrants.UpdateDeviceGrant(ctx, deviceAuth.DeviceCode, func(grant *models.DeviceAuthorization) error {
+		if grant.IsExpired() {
+			return errDeviceExpired
+		}
+
+		// A decision has already been made for this device
+		if grant.Authorized || grant.Denied {
+			return ErrInvalidUserCode
+		}
+
+		// Only scopes that were part of the original request can be granted
+		scopes = utils.FilterScopes(grantedScopes, grant.Scopes)
+		if len(scopes) == 0 {
+			return ErrInvalidUserCode
+		}
+
+		// Authorize the device
+		grant.Authorized = true
+		grant.UserID = userID
+		grant.Scopes = scopes
+		grant.ConsentToken = ""
+		return nil
+	})
+	if errors.Is(err, errDeviceExpired) {
+		f.deleteDeviceGrant(ctx, deviceAuth.DeviceCode)
 		return false
 	}
+	if err != nil {
+		return false
+	}
+
+	log.Printf("✅ Device authorized: code=%s, user=%s, scopes=%v", userCode, userID, scopes)
+	return true
+}
+
+// DenyDevice records that the user rejected the device authorization request,
+// so the next poll for the device code receives access_denied
+func (f *DeviceCodeFlow) DenyDevice(userCode, userID string) bool {
+	ctx := context.Background()
 
-	// Check if expired
-	if deviceAuth.IsExpired() {
-		delete(f.deviceAuths, deviceCode)
-		delete(f.userCodeToDevice, userCode)
+	deviceAuth, err := f.deviceGrants.GetDeviceGrantByUserCode(ctx, userCode)
+	if err != nil {
 		return false
 	}
 
-	// Authorize the device
-	deviceAuth.Authorized = true
-	deviceAuth.UserID = userID
+	_, err = f.deviceGrants.UpdateDeviceGrant(ctx, deviceAuth.DeviceCode, func(grant *models.DeviceAuthorization) error {
+		if grant.IsExpired() || grant.Authorized || grant.Denied {
+			return ErrInvalidUserCode
+		}
+		grant.Denied = true
+		grant.UserID = userID
+		grant.ConsentToken = ""
+		return nil
+	})
+	if err != nil {
+		return false
+	}
 
-	log.Printf("✅ Device authorized: code=%s, user=%s", userCode, userID)
+	log.Printf("🚫 Device authorization denied: code=%s, user=%s", userCode, userID)
 	return true
 }
 
+// deleteDeviceGrant removes a device authorization that can no longer be used
+func (f *DeviceCodeFlow) deleteDeviceGrant(ctx context.Context, deviceCode string) {
+	if err := f.deviceGrants.DeleteDeviceGrant(ctx, deviceCode); err != nil {
+		log.Printf("⚠️ Failed to delete device authorization: %v", err)
+	}
+}
+
 // clientSupportsDeviceFlow checks if a client supports device flow
 func (f *DeviceCodeFlow) clientSupportsDeviceFlow(client interface{}) bool {
 	// You would implement this based on your client model
@@ -292,6 +467,26 @@ func (f *DeviceCodeFlow) clientSupportsDeviceFlow(client interface{}) bool {
 	return client != nil
 }
 
+// deviceCodeLifetime returns the configured device code lifetime in seconds
+func (f *DeviceCodeFlow) deviceCodeLifetime() int {
+	if f.config.Security.DeviceCodeExpirySeconds > 0 {
+		return f.config.Security.DeviceCodeExpirySeconds
+	}
+	return 600
+}
+
+// pollInterval returns the minimum polling interval in seconds for a client,
+// falling back to the server-wide setting and then to the RFC 8628 default
+func (f *DeviceCodeFlow) pollInterval(client fosite.Client) int {
+	if c, ok := client.(*store.Client); ok && c.DevicePollInterval > 0 {
+		return c.DevicePollInterval
+	}
+	if f.config.Security.DevicePollIntervalSeconds > 0 {
+		return f.config.Security.DevicePollIntervalSeconds
+	}
+	return models.DefaultDevicePollInterval
+}
+
 // generateDeviceCode generates a unique device code
 func (f *DeviceCodeFlow) generateDeviceCode() (string, error) {
 	// Generate a random device code (longer and more secure)
@@ -332,79 +527,38 @@ func (f *DeviceCodeFlow) generateUserCode() (string, error) {
 
 // GetDeviceAuthByUserCode retrieves device authorization by user code
 func (f *DeviceCodeFlow) GetDeviceAuthByUserCode(userCode string) (*models.DeviceAuthorization, bool) {
-	f.mutex.RLock()
-	defer f.mutex.RUnlock()
-
-	deviceCode, exists := f.userCodeToDevice[userCode]
-	if !exists {
-		return nil, false
-	}
-
-	deviceAuth, exists := f.deviceAuths[deviceCode]
-	return deviceAuth, exists
+	deviceAuth, err := f.deviceGrants.GetDeviceGrantByUserCode(context.Background(), userCode)
+	return deviceAuth, err == nil
 }
 
 // GetDeviceAuthByDeviceCode retrieves device authorization by device code
 func (f *DeviceCodeFlow) GetDeviceAuthByDeviceCode(deviceCode string) (*models.DeviceAuthorization, bool) {
-	f.mutex.RLock()
-	defer f.mutex.RUnlock()
-
-	deviceAuth, exists := f.deviceAuths[deviceCode]
-	return deviceAuth, exists
+	deviceAuth, err := f.deviceGrants.GetDeviceGrant(context.Background(), deviceCode)
+	return deviceAuth, err == nil
 }
 
-// CleanupExpiredDeviceCodes removes expired device codes
-func (f *DeviceCodeFlow) CleanupExpiredDeviceCodes() {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-
-	now := time.Now()
-	var expiredCodes []string
-
-	for deviceCode, deviceAuth := range f.deviceAuths {
-		if now.After(deviceAuth.ExpiresAt) {
-			expiredCodes = append(expiredCodes, deviceCode)
-		}
-	}
-
-	for _, deviceCode := range expiredCodes {
-		deviceAuth := f.deviceAuths[deviceCode]
-		delete(f.deviceAuths, deviceCode)
-		delete(f.userCodeToDevice, deviceAuth.UserCode)
-		log.Printf("🗑️ Cleaned up expired device code: %s", deviceAuth.UserCode)
-	}
-
-	if len(expiredCodes) > 0 {
-		log.Printf("🗑️ Cleaned up %d expired device codes", len(expiredCodes))
-	}
-}
-
-// StartCleanupTimer starts a background cleanup timer for expired device codes
-func (f *DeviceCodeFlow) StartCleanupTimer() {
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute) // Clean up every 5 minutes
-		defer ticker.Stop()
-
-		for range ticker.C {
-			f.CleanupExpiredDeviceCodes()
-		}
-	}()
-	log.Printf("🗑️ Device code cleanup timer started")
+// CleanupExpiredDeviceCodes removes expired device codes and returns how many were deleted
+func (f *DeviceCodeFlow) CleanupExpiredDeviceCodes(ctx context.Context) (int, error) {
+	return f.deviceGrants.DeleteExpiredDeviceGrants(ctx, time.Now())
 }
 
 // GetDeviceStats returns statistics about device authorizations
 func (f *DeviceCodeFlow) GetDeviceStats() map[string]interface{} {
-	f.mutex.RLock()
-	defer f.mutex.RUnlock()
+	deviceAuths, err := f.deviceGrants.ListDeviceGrants(context.Background())
+	if err != nil {
+		log.Printf("❌ Failed to list device authorizations: %v", err)
+	}
 
-	var pending, authorized, used, expired int
+	var pending, authorized, denied, used, expired int
 	now := time.Now()
 
-	for _, deviceAuth := range f.deviceAuths {
+	for _, deviceAuth := range deviceAuths {
 		if now.After(deviceAuth.ExpiresAt) {
 			expired++
 		} else if deviceAuth.Used {
 			used++
+		} else if deviceAuth.Denied {
+			denied++
 		} else if deviceAuth.Authorized {
 			authorized++
 		} else {
@@ -413,9 +567,10 @@ func (f *DeviceCodeFlow) GetDeviceStats() map[string]interface{} {
 	}
 
 	return map[string]interface{}{
-		"total":      len(f.deviceAuths),
+		"total":      len(deviceAuths),
 		"pending":    pending,
 		"authorized": authorized,
+		"denied":     denied,
 		"used":       used,
 		"expired":    expired,
 	}
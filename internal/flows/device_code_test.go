@@ -0,0 +1,185 @@
+package flows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"oauth2-server/internal/models"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// newDeviceTestFlow returns a device flow on the memory backend for the
+// client "tv" together with its device grant storage
+func newDeviceTestFlow(t *testing.T) (*DeviceCodeFlow, store.DeviceGrantStorage) {
+	t.Helper()
+	backend := store.NewMemoryBackend()
+	clients := store.NewClientStore(backend.Clients())
+	if err := clients.StoreClient(&store.Client{ID: "tv", Public: true, GrantTypes: []string{"urn:ietf:params:oauth:grant-type:device_code"}}); err != nil {
+		t.Fatal(err)
+	}
+	return NewDeviceCodeFlow(clients, store.NewTokenStore(backend.Tokens()), backend.DeviceGrants(), &config.Config{}), backend.DeviceGrants()
+}
+
+// saveDeviceGrant stores a pending grant for the scopes openid and profile,
+// changed by change
+func saveDeviceGrant(t *testing.T, grants store.DeviceGrantStorage, change func(*models.DeviceAuthorization)) {
+	t.Helper()
+	now := time.Now()
+	grant := &models.DeviceAuthorization{
+		DeviceCode: "device-code",
+		UserCode:   "ABCD-EFGH",
+		ClientID:   "tv",
+		Scopes:     []string{"openid", "profile"},
+		ExpiresAt:  now.Add(10 * time.Minute),
+		IssuedAt:   now,
+		Interval:   models.DefaultDevicePollInterval,
+	}
+	if change != nil {
+		change(grant)
+	}
+	if err := grants.SaveDeviceGrant(context.Background(), grant); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pollDevice posts the device code to the token endpoint and returns the
+// error code, empty when tokens were issued, and the decoded response
+func pollDevice(t *testing.T, f *DeviceCodeFlow) (string, map[string]interface{}) {
+	t.Helper()
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:device_code"}, "device_code": {"device-code"}, "client_id": {"tv"}}
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	f.HandleToken(w, r)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response is not JSON: %s", w.Body.String())
+	}
+	if w.Code == http.StatusOK {
+		return "", response
+	}
+	code, _ := response["error"].(string)
+	return code, response
+}
+
+func TestDeviceTokenPolling(t *testing.T) {
+	tests := []struct {
+		name  string
+		grant func(*models.DeviceAuthorization)
+		// polls lists the error of each successive poll; empty issues tokens
+		polls []string
+		// interval is the stored polling interval afterwards, if set
+		interval int
+		removed  bool
+	}{
+		{
+			name:     "first poll is pending",
+			polls:    []string{"authorization_pending"},
+			interval: 5,
+		},
+		{
+			name:     "polling within the interval slows down by 5s each time",
+			grant:    func(g *models.DeviceAuthorization) { g.LastPolledAt = time.Now().Add(-time.Second) },
+			polls:    []string{"slow_down", "slow_down"},
+			interval: 15,
+		},
+		{
+			name:     "polling after the interval is pending",
+			grant:    func(g *models.DeviceAuthorization) { g.LastPolledAt = time.Now().Add(-6 * time.Second) },
+			polls:    []string{"authorization_pending", "slow_down"},
+			interval: 10,
+		},
+		{
+			name:    "expired device code is removed",
+			grant:   func(g *models.DeviceAuthorization) { g.ExpiresAt = time.Now().Add(-time.Second) },
+			polls:   []string{"expired_token", "invalid_grant"},
+			removed: true,
+		},
+		{
+			// Without an interval the second poll reaches the used check
+			// instead of slow_down
+			name: "approved device code is redeemed once",
+			grant: func(g *models.DeviceAuthorization) {
+				g.Authorized = true
+				g.UserID = "alice"
+				g.Interval = 0
+			},
+			polls: []string{"", "invalid_grant"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, grants := newDeviceTestFlow(t)
+			saveDeviceGrant(t, grants, tt.grant)
+
+			for i, want := range tt.polls {
+				if got, response := pollDevice(t, f); got != want {
+					t.Fatalf("poll %d = %q (%v), want %q", i+1, got, response, want)
+				}
+			}
+
+			grant, err := grants.GetDeviceGrant(context.Background(), "device-code")
+			if tt.removed {
+				if !errors.Is(err, store.ErrNotFound) {
+					t.Errorf("grant is still stored: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.interval != 0 && grant.Interval != tt.interval {
+				t.Errorf("interval = %d, want %d", grant.Interval, tt.interval)
+			}
+		})
+	}
+}
+
+func TestDeniedDeviceReceivesAccessDenied(t *testing.T) {
+	f, grants := newDeviceTestFlow(t)
+	saveDeviceGrant(t, grants, nil)
+
+	if !f.DenyDevice("ABCD-EFGH", "alice") {
+		t.Fatal("pending grant could not be denied")
+	}
+	if f.AuthorizeDevice("ABCD-EFGH", "alice", []string{"openid"}) {
+		t.Error("denied grant was authorized afterwards")
+	}
+	if got, _ := pollDevice(t, f); got != "access_denied" {
+		t.Fatalf("poll after denial = %q, want access_denied", got)
+	}
+	if _, err := grants.GetDeviceGrant(context.Background(), "device-code"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("denied grant is still stored: %v", err)
+	}
+}
+
+func TestAuthorizeDeviceGrantsConsentedScopes(t *testing.T) {
+	f, grants := newDeviceTestFlow(t)
+	saveDeviceGrant(t, grants, nil)
+
+	// Scopes the device did not request cannot be granted
+	if f.AuthorizeDevice("ABCD-EFGH", "alice", []string{"admin"}) {
+		t.Fatal("grant was authorized without any requested scope")
+	}
+	if !f.AuthorizeDevice("ABCD-EFGH", "alice", []string{"openid", "admin"}) {
+		t.Fatal("grant for a subset of the requested scopes failed")
+	}
+
+	got, response := pollDevice(t, f)
+	if got != "" {
+		t.Fatalf("poll after consent = %q, want tokens", got)
+	}
+	if response["scope"] != "openid" {
+		t.Errorf("scope = %v, want openid", response["scope"])
+	}
+}
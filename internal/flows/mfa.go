@@ -0,0 +1,304 @@
+package flows
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/skip2/go-qrcode"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/store"
+)
+
+// Between the password and the second factor, the user is kept in a sealed
+// cookie scoped to the authorization endpoint
+const (
+	mfaCookieName = "oauth2_mfa"
+	mfaPurpose    = "mfa"
+	mfaLifetime   = 10 * time.Minute
+)
+
+// pendingMFA is a login whose password was verified. Secret is set while the
+// user enrols an authenticator app; AddPasskey when the user asked to create
+// a passkey after the login.
+type pendingMFA struct {
+	UserID     string    `json:"user_id"`
+	Secret     string    `json:"secret,omitempty"`
+	AddPasskey bool      `json:"add_passkey,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// startMFA asks a user whose password was verified for a one-time code or a
+// passkey, or to enrol an authenticator app or a passkey first
+func (f *AuthorizationCodeFlow) startMFA(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester, user *store.User) {
+	pending := pendingMFA{
+		UserID:     user.ID,
+		AddPasskey: r.FormValue("add_passkey") != "",
+		ExpiresAt:  time.Now().Add(mfaLifetime),
+	}
+	if user.MFA == nil && !f.hasPasskeys(user) {
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			log.Printf("❌ Failed to generate TOTP secret: %v", err)
+			f.showLoginFormWithError(w, r, ar, "The login could not be completed, please try again")
+			return
+		}
+		pending.Secret = secret
+	}
+
+	sealed, err := f.sealState(mfaPurpose, pending)
+	if err != nil {
+		log.Printf("❌ Failed to seal pending login: %v", err)
+		f.showLoginFormWithError(w, r, ar, "The login could not be completed, please try again")
+		return
+	}
+	f.setStateCookie(w, r, mfaCookieName, "/auth", sealed, pending.ExpiresAt)
+
+	if pending.Secret != "" {
+		f.showEnrollForm(w, r, user, pending.Secret, "")
+		return
+	}
+	f.showMFAForm(w, r, user, "")
+}
+
+// hasPasskeys reports whether the user can confirm a login with a passkey
+func (f *AuthorizationCodeFlow) hasPasskeys(user *store.User) bool {
+	return f.userAuth.PasskeysEnabled() && len(user.Passkeys) > 0
+}
+
+// pendingLogin returns the unexpired login of the MFA cookie
+func (f *AuthorizationCodeFlow) pendingLogin(r *http.Request) *pendingMFA {
+	cookie, err := r.Cookie(mfaCookieName)
+	if err != nil {
+		return nil
+	}
+	var pending pendingMFA
+	if err := f.openState(mfaPurpose, cookie.Value, &pending); err != nil || time.Now().After(pending.ExpiresAt) {
+		return nil
+	}
+	return &pending
+}
+
+// clearPendingLogin removes the MFA cookie
+func (f *AuthorizationCodeFlow) clearPendingLogin(w http.ResponseWriter, r *http.Request) {
+	f.setStateCookie(w, r, mfaCookieName, "/auth", "", time.Unix(0, 0))
+}
+
+// handleMFA verifies the one-time or recovery code of an enrolled user
+func (f *AuthorizationCodeFlow) handleMFA(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester) {
+	pending := f.pendingLogin(r)
+	if pending == nil || pending.Secret != "" {
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+
+	user, err := f.userAuth.VerifyMFA(f.mfaAttempt(r, ar), pending.UserID, r.FormValue("code"))
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		if user, found := f.users.GetUser(pending.UserID); found {
+			f.showMFAForm(w, r, user, "Invalid authentication code")
+			return
+		}
+	}
+	f.clearPendingLogin(w, r)
+	if errors.Is(err, auth.ErrAccountLocked) {
+		f.showLoginFormWithError(w, r, ar, "Too many failed login attempts, please try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Second factor of user %s failed: %v", pending.UserID, err)
+		f.showLoginFormWithError(w, r, ar, "The login could not be completed, please try again")
+		return
+	}
+
+	f.completeLogin(w, r, ar, user, auth.PasswordAMR(true), pending.AddPasskey)
+}
+
+// handleMFAEnroll stores the authenticator app once the user entered a code
+// from it, then shows the recovery codes
+func (f *AuthorizationCodeFlow) handleMFAEnroll(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester) {
+	pending := f.pendingLogin(r)
+	if pending == nil || pending.Secret == "" {
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+	user, found := f.users.GetUser(pending.UserID)
+	if !found {
+		f.clearPendingLogin(w, r)
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+
+	codes, err := f.userAuth.EnrollTOTP(f.mfaAttempt(r, ar), user.ID, pending.Secret, r.FormValue("code"), auth.PasswordAMR(false))
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		f.showEnrollForm(w, r, user, pending.Secret, "Invalid authentication code, check that the clock of your device is correct")
+		return
+	}
+	f.clearPendingLogin(w, r)
+	if errors.Is(err, auth.ErrAccountLocked) {
+		f.showLoginFormWithError(w, r, ar, "Too many failed login attempts, please try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Enrolment of user %s failed: %v", user.Username, err)
+		f.showLoginFormWithError(w, r, ar, "The login could not be completed, please try again")
+		return
+	}
+
+	f.startSession(w, r, user.ID, auth.PasswordAMR(true))
+	f.showRecoveryCodes(w, r, codes)
+}
+
+// mfaAttempt describes the second step of a login form login
+func (f *AuthorizationCodeFlow) mfaAttempt(r *http.Request, ar fosite.AuthorizeRequester) auth.LoginAttempt {
+	return auth.LoginAttempt{
+		Method:     auth.LoginMethodForm,
+		ClientID:   ar.GetClient().GetID(),
+		RemoteAddr: r.RemoteAddr,
+	}
+}
+
+// showMFAForm asks for a code from the authenticator app or a recovery code,
+// and for a passkey of users who registered one
+func (f *AuthorizationCodeFlow) showMFAForm(w http.ResponseWriter, r *http.Request, user *store.User, errorMsg string) {
+	content := ""
+	if user.MFA != nil {
+		content = `<p>Enter the 6-digit code shown by your authenticator app, or one of your recovery codes.</p>
+        <form method="post" action="auth` + html.EscapeString(queryString(r)) + `">
+            <input type="hidden" name="action" value="mfa">
+            <div class="form-group">
+                <label for="code">Authentication code:</label>
+                <input type="text" id="code" name="code" autocomplete="one-time-code" required autofocus>
+            </div>
+            <button type="submit" class="btn">Verify</button>
+        </form>`
+	}
+	if f.hasPasskeys(user) {
+		if content == "" {
+			content = `<p>Confirm your login with your passkey.</p>`
+		} else {
+			content += `<div class="providers"><p>or</p></div>`
+		}
+		content += passkeyForm(r, "mfa_passkey", "get", "🔑 Use a passkey", f.beginPasskeyLogin(w, r, user))
+	}
+	writeMFAPage(w, "🔐 Two-Factor Authentication", errorMsg, content)
+}
+
+// showEnrollForm shows the QR code of a new TOTP secret and asks for a code
+// generated from it
+func (f *AuthorizationCodeFlow) showEnrollForm(w http.ResponseWriter, r *http.Request, user *store.User, secret, errorMsg string) {
+	uri := auth.TOTPURI(f.userAuth.TOTPIssuer(), user.Username, secret)
+	qr := ""
+	if png, err := qrcode.Encode(uri, qrcode.Medium, 220); err == nil {
+		qr = `<img class="qr" alt="QR code of the authenticator secret" src="data:image/png;base64,` + base64.StdEncoding.EncodeToString(png) + `">`
+	} else {
+		log.Printf("⚠️ Failed to render QR code: %v", err)
+	}
+
+	content := `<p>Your account requires two-factor authentication. Scan the QR code with an authenticator app, or enter the key manually, then enter the code the app shows.</p>
+        ` + qr + `
+        <p class="secret">` + html.EscapeString(groupSecret(secret)) + `</p>
+        <form method="post" action="auth` + html.EscapeString(queryString(r)) + `">
+            <input type="hidden" name="action" value="mfa_enroll">
+            <div class="form-group">
+                <label for="code">Authentication code:</label>
+                <input type="text" id="code" name="code" autocomplete="one-time-code" inputmode="numeric" required autofocus>
+            </div>
+            <button type="submit" class="btn">Enable</button>
+        </form>`
+	if f.userAuth.PasskeysEnabled() {
+		content += `
+        <div class="providers"><p>or</p>` + passkeyForm(r, "mfa_passkey_enroll", "create", "🔑 Use a passkey instead", f.beginPasskeyRegistration(w, r, user)) + `</div>`
+	}
+	writeMFAPage(w, "📱 Set Up Two-Factor Authentication", errorMsg, content)
+}
+
+// showRecoveryCodes shows the recovery codes of a new enrolment once and
+// continues the authorization request
+func (f *AuthorizationCodeFlow) showRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	var list strings.Builder
+	for _, code := range codes {
+		list.WriteString("<li>" + html.EscapeString(code) + "</li>")
+	}
+
+	// The user just logged in, so a requested fresh login is satisfied
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	next := "auth?" + withoutLoginPrompt(query).Encode()
+
+	content := `<div class="success">✅ Two-factor authentication is enabled.</div>
+        <p>Keep these recovery codes in a safe place. Each of them can be used once instead of a code from your app, for example when you lose your device. They are not shown again.</p>
+        <ul class="codes">` + list.String() + `</ul>
+        <a class="btn" href="` + html.EscapeString(next) + `">Continue</a>`
+	writeMFAPage(w, "🔑 Recovery Codes", "", content)
+}
+
+// queryString returns the query of the request with its leading question mark
+func queryString(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return ""
+	}
+	return "?" + r.URL.RawQuery
+}
+
+// groupSecret splits a base32 secret into groups of four for manual entry
+func groupSecret(secret string) string {
+	var groups []string
+	for len(secret) > 4 {
+		groups = append(groups, secret[:4])
+		secret = secret[4:]
+	}
+	return strings.Join(append(groups, secret), " ")
+}
+
+// writeMFAPage renders a step of the login in the style of the login form
+func writeMFAPage(w http.ResponseWriter, title, errorMsg, content string) {
+	errorHTML := ""
+	if errorMsg != "" {
+		errorHTML = fmt.Sprintf(`<div class="error">❌ %s</div>`, html.EscapeString(errorMsg))
+	}
+
+	page := `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>OAuth2 Login</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 50px; background-color: #f5f5f5; }
+        .container { max-width: 400px; margin: 0 auto; background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); }
+        .form-group { margin-bottom: 20px; }
+        label { display: block; margin-bottom: 5px; font-weight: bold; }
+        input[type="text"] { width: 100%; padding: 10px; border: 1px solid #ddd; border-radius: 4px; box-sizing: border-box; font-size: 18px; letter-spacing: 2px; }
+        .btn { display: block; background-color: #007bff; color: white; padding: 10px 20px; border: none; border-radius: 4px; cursor: pointer; width: 100%; text-align: center; text-decoration: none; box-sizing: border-box; }
+        .btn:hover { background-color: #0056b3; }
+        .error { background-color: #f8d7da; color: #721c24; padding: 15px; border-radius: 4px; margin-bottom: 20px; border: 1px solid #f5c6cb; }
+        .success { background-color: #d4edda; color: #155724; padding: 15px; border-radius: 4px; margin-bottom: 20px; border: 1px solid #c3e6cb; }
+        .qr { display: block; margin: 0 auto; }
+        .secret, .codes { font-family: monospace; font-size: 16px; text-align: center; }
+        .codes { list-style: none; padding: 0; columns: 2; }
+        .providers { margin-top: 20px; text-align: center; color: #6c757d; }
+        .providers .provider, .provider { background-color: #6c757d; }
+        .skip { text-align: center; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h2>` + title + `</h2>
+        ` + errorHTML + `
+        ` + content + `
+    </div>
+</body>
+</html>`
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(page))
+}
@@ -0,0 +1,295 @@
+package flows
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ory/fosite"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/store"
+)
+
+// The challenge of a passkey ceremony is kept in a sealed cookie between the
+// page that starts it and the form post that completes it
+const (
+	passkeyCookieName = "oauth2_passkey"
+	passkeyPurpose    = "passkey"
+	passkeyLifetime   = 5 * time.Minute
+)
+
+// beginPasskeyLogin starts a passkey login, of any user when user is nil,
+// and returns the options for navigator.credentials.get() as JSON; empty
+// when it failed
+func (f *AuthorizationCodeFlow) beginPasskeyLogin(w http.ResponseWriter, r *http.Request, user *store.User) string {
+	options, session, err := f.userAuth.BeginPasskeyLogin(f.config.GetEffectiveBaseURL(r), user)
+	if err != nil {
+		log.Printf("❌ Failed to start passkey login: %v", err)
+		return ""
+	}
+	return f.startCeremony(w, r, options, session)
+}
+
+// beginPasskeyRegistration starts registering a passkey for the user and
+// returns the options for navigator.credentials.create() as JSON; empty when
+// it failed
+func (f *AuthorizationCodeFlow) beginPasskeyRegistration(w http.ResponseWriter, r *http.Request, user *store.User) string {
+	options, session, err := f.userAuth.BeginPasskeyRegistration(f.config.GetEffectiveBaseURL(r), user)
+	if err != nil {
+		log.Printf("❌ Failed to start passkey registration: %v", err)
+		return ""
+	}
+	return f.startCeremony(w, r, options, session)
+}
+
+// startCeremony keeps the session of a ceremony in the passkey cookie and
+// returns its options as JSON
+func (f *AuthorizationCodeFlow) startCeremony(w http.ResponseWriter, r *http.Request, options interface{}, session *webauthn.SessionData) string {
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		log.Printf("❌ Failed to encode passkey options: %v", err)
+		return ""
+	}
+	sealed, err := f.sealState(passkeyPurpose, session)
+	if err != nil {
+		log.Printf("❌ Failed to seal passkey challenge: %v", err)
+		return ""
+	}
+	f.setStateCookie(w, r, passkeyCookieName, "/auth", sealed, time.Now().Add(passkeyLifetime))
+	return string(encoded)
+}
+
+// passkeyCeremony returns the session of the ceremony in the passkey cookie
+// and removes the cookie, so a challenge is answered only once
+func (f *AuthorizationCodeFlow) passkeyCeremony(w http.ResponseWriter, r *http.Request) *webauthn.SessionData {
+	cookie, err := r.Cookie(passkeyCookieName)
+	if err != nil {
+		return nil
+	}
+	f.setStateCookie(w, r, passkeyCookieName, "/auth", "", time.Unix(0, 0))
+
+	var session webauthn.SessionData
+	if err := f.openState(passkeyPurpose, cookie.Value, &session); err != nil {
+		return nil
+	}
+	return &session
+}
+
+// handlePasskeyLogin logs in the user of the passkey the browser returned for
+// the challenge of the login page
+func (f *AuthorizationCodeFlow) handlePasskeyLogin(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester) {
+	session := f.passkeyCeremony(w, r)
+	if session == nil || session.UserID != nil {
+		f.showLoginFormWithError(w, r, ar, "Your passkey login expired, please try again")
+		return
+	}
+
+	user, err := f.userAuth.FinishPasskeyLogin(auth.LoginAttempt{
+		Method:     auth.LoginMethodPasskey,
+		ClientID:   ar.GetClient().GetID(),
+		RemoteAddr: r.RemoteAddr,
+	}, f.config.GetEffectiveBaseURL(r), *session, r.FormValue("credential"))
+	if errors.Is(err, auth.ErrAccountLocked) {
+		f.showLoginFormWithError(w, r, ar, "Too many failed login attempts, please try again later")
+		return
+	}
+	if err != nil {
+		f.showLoginFormWithError(w, r, ar, "The passkey was not accepted")
+		return
+	}
+
+	login := f.startSession(w, r, user.ID, auth.PasskeyAMR(false))
+	f.continueAuthorization(w, r, ar, login)
+}
+
+// handlePasskeyRegister stores the passkey created after a login on the
+// offer page and continues the authorization request
+func (f *AuthorizationCodeFlow) handlePasskeyRegister(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester) {
+	login := f.loginSession(r)
+	session := f.passkeyCeremony(w, r)
+	if login == nil || session == nil || string(session.UserID) != login.UserID {
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+
+	_, err := f.userAuth.RegisterPasskey(f.mfaAttempt(r, ar), f.config.GetEffectiveBaseURL(r), *session, r.FormValue("credential"), r.FormValue("name"), login.AMR)
+	if err != nil {
+		if user, found := f.users.GetUser(login.UserID); found {
+			f.showPasskeyOffer(w, r, user, "The passkey could not be registered")
+			return
+		}
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+
+	f.continueAuthorization(w, r, ar, login)
+}
+
+// handleMFAPasskey confirms the password of a pending login with a passkey
+func (f *AuthorizationCodeFlow) handleMFAPasskey(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester) {
+	pending := f.pendingLogin(r)
+	session := f.passkeyCeremony(w, r)
+	if pending == nil || pending.Secret != "" || session == nil || string(session.UserID) != pending.UserID {
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+
+	user, err := f.userAuth.FinishPasskeyLogin(f.mfaAttempt(r, ar), f.config.GetEffectiveBaseURL(r), *session, r.FormValue("credential"))
+	if errors.Is(err, auth.ErrInvalidPasskey) {
+		if user, found := f.users.GetUser(pending.UserID); found {
+			f.showMFAForm(w, r, user, "The passkey was not accepted")
+			return
+		}
+	}
+	f.clearPendingLogin(w, r)
+	if errors.Is(err, auth.ErrAccountLocked) {
+		f.showLoginFormWithError(w, r, ar, "Too many failed login attempts, please try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Passkey of user %s failed: %v", pending.UserID, err)
+		f.showLoginFormWithError(w, r, ar, "The login could not be completed, please try again")
+		return
+	}
+
+	f.completeLogin(w, r, ar, user, auth.PasskeyAMR(true), pending.AddPasskey)
+}
+
+// handleMFAPasskeyEnroll registers a passkey as the second factor of a user
+// who has to enrol one, instead of an authenticator app
+func (f *AuthorizationCodeFlow) handleMFAPasskeyEnroll(w http.ResponseWriter, r *http.Request, ar fosite.AuthorizeRequester) {
+	pending := f.pendingLogin(r)
+	session := f.passkeyCeremony(w, r)
+	if pending == nil || pending.Secret == "" || session == nil || string(session.UserID) != pending.UserID {
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+
+	_, err := f.userAuth.RegisterPasskey(f.mfaAttempt(r, ar), f.config.GetEffectiveBaseURL(r), *session, r.FormValue("credential"), r.FormValue("name"), auth.PasswordAMR(false))
+	user, found := f.users.GetUser(pending.UserID)
+	if !found {
+		f.clearPendingLogin(w, r)
+		f.showLoginFormWithError(w, r, ar, "Your login expired, please log in again")
+		return
+	}
+	if err != nil {
+		f.showEnrollForm(w, r, user, pending.Secret, "The passkey could not be registered")
+		return
+	}
+
+	f.clearPendingLogin(w, r)
+	login := f.startSession(w, r, user.ID, auth.PasskeyAMR(true))
+	f.continueAuthorization(w, r, ar, login)
+}
+
+// showPasskeyOffer asks a user who just logged in to create a passkey, which
+// can be skipped
+func (f *AuthorizationCodeFlow) showPasskeyOffer(w http.ResponseWriter, r *http.Request, user *store.User, errorMsg string) {
+	// The user just logged in, so a requested fresh login is satisfied
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	next := "auth?" + withoutLoginPrompt(query).Encode()
+
+	content := `<p>With a passkey you sign in with the fingerprint, face or PIN of your device instead of your password.</p>
+        ` + passkeyForm(r, "passkey_register", "create", "🔑 Create a passkey", f.beginPasskeyRegistration(w, r, user)) + `
+        <p class="skip"><a href="` + html.EscapeString(next) + `">Not now</a></p>`
+	writeMFAPage(w, "🔑 Create a Passkey", errorMsg, content)
+}
+
+// passkeyLoginButton returns the passkey button of the login page
+func (f *AuthorizationCodeFlow) passkeyLoginButton(w http.ResponseWriter, r *http.Request) string {
+	if !f.userAuth.PasskeysEnabled() {
+		return ""
+	}
+	return `<div class="providers"><p>or</p>` + passkeyForm(r, "passkey_login", "get", "🔑 Sign in with a passkey", f.beginPasskeyLogin(w, r, nil)) + `</div>`
+}
+
+// passkeyOfferCheckbox lets users ask for the passkey offer after the login
+func (f *AuthorizationCodeFlow) passkeyOfferCheckbox() string {
+	if !f.userAuth.PasskeysEnabled() {
+		return ""
+	}
+	return `<div class="form-group"><label class="checkbox"><input type="checkbox" name="add_passkey" value="1"> Create a passkey after signing in</label></div>`
+}
+
+// passkeyForm renders a button that runs a passkey ceremony in the browser
+// and posts its result with the action. ceremony is "get" or "create"; the
+// options are embedded as JSON in a script element with the ID
+// passkey-options. Without options the button is left out.
+func passkeyForm(r *http.Request, action, ceremony, label, options string) string {
+	if options == "" {
+		return ""
+	}
+	return `<form method="post" action="auth` + html.EscapeString(queryString(r)) + `" id="passkey-form">
+            <input type="hidden" name="action" value="` + action + `">
+            <input type="hidden" name="credential">
+            <div class="error" id="passkey-error" hidden></div>
+            <button type="button" class="btn provider" onclick="passkey('` + ceremony + `')">` + label + `</button>
+        </form>
+        <script type="application/json" id="passkey-options">` + options + `</script>
+        <script>` + passkeyScript + `</script>`
+}
+
+// passkeyScript converts between the JSON options and responses and the
+// binary WebAuthn browser API
+const passkeyScript = `
+function fromBase64URL(value) {
+    value = value.replace(/-/g, '+').replace(/_/g, '/');
+    while (value.length % 4) { value += '='; }
+    return Uint8Array.from(atob(value), c => c.charCodeAt(0)).buffer;
+}
+function toBase64URL(buffer) {
+    return btoa(String.fromCharCode(...new Uint8Array(buffer))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+async function passkey(ceremony) {
+    const form = document.getElementById('passkey-form');
+    const error = document.getElementById('passkey-error');
+    const options = JSON.parse(document.getElementById('passkey-options').textContent).publicKey;
+    options.challenge = fromBase64URL(options.challenge);
+    for (const credential of (options.allowCredentials || []).concat(options.excludeCredentials || [])) {
+        credential.id = fromBase64URL(credential.id);
+    }
+    try {
+        let response;
+        if (ceremony === 'create') {
+            options.user.id = fromBase64URL(options.user.id);
+            const credential = await navigator.credentials.create({publicKey: options});
+            response = {
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                attestationObject: toBase64URL(credential.response.attestationObject),
+                transports: credential.response.getTransports ? credential.response.getTransports() : []
+            };
+            form.credential.value = JSON.stringify(Object.assign(describe(credential), {response: response}));
+        } else {
+            const credential = await navigator.credentials.get({publicKey: options});
+            response = {
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                authenticatorData: toBase64URL(credential.response.authenticatorData),
+                signature: toBase64URL(credential.response.signature)
+            };
+            if (credential.response.userHandle) {
+                response.userHandle = toBase64URL(credential.response.userHandle);
+            }
+            form.credential.value = JSON.stringify(Object.assign(describe(credential), {response: response}));
+        }
+        form.submit();
+    } catch (e) {
+        error.textContent = '❌ The passkey could not be used: ' + e.message;
+        error.hidden = false;
+    }
+}
+function describe(credential) {
+    return {
+        id: credential.id,
+        rawId: toBase64URL(credential.rawId),
+        type: credential.type,
+        authenticatorAttachment: credential.authenticatorAttachment || undefined,
+        clientExtensionResults: credential.getClientExtensionResults()
+    };
+}
+`
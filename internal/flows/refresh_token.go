@@ -67,7 +67,7 @@ func (f *RefreshTokenFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authenticate client
-	client, err := auth.AuthenticateClient(clientID, clientSecret, f.clientStore)
+	client, err := auth.AuthenticateClient(clientID, clientSecret, r.RemoteAddr, f.clientStore)
 	if err != nil {
 		log.Printf("❌ Client authentication failed for %s: %v", clientID, err)
 		utils.WriteErrorResponse(w, "invalid_client", "Client authentication failed")
@@ -81,20 +81,20 @@ func (f *RefreshTokenFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate refresh token
-	tokenInfo, valid := f.validateRefreshToken(refreshToken)
+	previous, valid := f.validateRefreshToken(refreshToken)
 	if !valid {
 		utils.WriteErrorResponse(w, "invalid_grant", "Invalid or expired refresh token")
 		return
 	}
 
 	// Verify token belongs to the client
-	if tokenInfo.ClientID != clientID {
+	if previous.ClientID != clientID {
 		utils.WriteErrorResponse(w, "invalid_grant", "Refresh token does not belong to client")
 		return
 	}
 
 	// Handle scope parameter - convert scopes to string for comparison
-	originalScopeString := strings.Join(tokenInfo.Scopes, " ")
+	originalScopeString := strings.Join(previous.Scopes, " ")
 	var newScope string
 	var newScopeSlice []string
 
@@ -108,36 +108,39 @@ func (f *RefreshTokenFlow) Handle(w http.ResponseWriter, r *http.Request) {
 		newScopeSlice = strings.Fields(scope)
 	} else {
 		newScope = originalScopeString
-		newScopeSlice = tokenInfo.Scopes
+		newScopeSlice = previous.Scopes
 	}
 
 	// Generate new tokens
-	newAccessToken, err := auth.GenerateAccessToken(tokenInfo.UserID, clientID, newScopeSlice)
+	newAccessToken, err := auth.GenerateAccessToken(previous.UserID, clientID, newScopeSlice)
 	if err != nil {
 		log.Printf("❌ Error generating access token: %v", err)
 		utils.WriteServerError(w, "Failed to generate access token")
 		return
 	}
 
-	newRefreshToken, err := auth.GenerateRefreshToken(tokenInfo.UserID, clientID)
+	newRefreshToken, err := auth.GenerateRefreshToken(previous.UserID, clientID)
 	if err != nil {
 		log.Printf("❌ Error generating refresh token: %v", err)
 		utils.WriteServerError(w, "Failed to generate refresh token")
 		return
 	}
 
-	// Store new tokens with proper time.Time values
-	accessTokenExpiry := time.Now().Add(time.Hour)
-	refreshTokenExpiry := time.Now().Add(24 * time.Hour)
+	// The new tokens keep the audience and delegation chain of the refresh token
+	now := time.Now()
+	accessTokenLifetime, refreshTokenLifetime := previous.RefreshLifetimes(now,
+		f.config.Security.AccessTokenLifetime(), f.config.Security.RefreshTokenLifetime())
+	accessTokenExpiry := now.Add(accessTokenLifetime)
+	refreshTokenExpiry := now.Add(refreshTokenLifetime)
 
-	err = f.tokenStore.StoreAccessToken(newAccessToken, clientID, tokenInfo.UserID, newScopeSlice, accessTokenExpiry)
+	err = f.tokenStore.StoreToken(previous.Successor(newAccessToken, "access", newScopeSlice, accessTokenExpiry))
 	if err != nil {
 		log.Printf("❌ Error storing access token: %v", err)
 		utils.WriteServerError(w, "Failed to store access token")
 		return
 	}
 
-	err = f.tokenStore.StoreRefreshToken(newRefreshToken, clientID, tokenInfo.UserID, newScopeSlice, refreshTokenExpiry)
+	err = f.tokenStore.StoreToken(previous.Successor(newRefreshToken, "refresh", newScopeSlice, refreshTokenExpiry))
 	if err != nil {
 		log.Printf("❌ Error storing refresh token: %v", err)
 		utils.WriteServerError(w, "Failed to store refresh token")
@@ -155,7 +158,7 @@ func (f *RefreshTokenFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	response := models.TokenResponse{
 		AccessToken:  newAccessToken,
 		TokenType:    "Bearer",
-		ExpiresIn:    3600, // 1 hour
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
 		RefreshToken: newRefreshToken,
 		Scope:        newScope,
 	}
@@ -168,18 +171,17 @@ func (f *RefreshTokenFlow) Handle(w http.ResponseWriter, r *http.Request) {
 }
 
 // validateRefreshToken validates a refresh token
-func (f *RefreshTokenFlow) validateRefreshToken(token string) (*store.TokenInfo, bool) {
+func (f *RefreshTokenFlow) validateRefreshToken(token string) (*store.Token, bool) {
 	if f.tokenStore == nil {
 		return nil, false
 	}
 
-	// Use ValidateRefreshToken method
-	tokenInfo, err := f.tokenStore.ValidateRefreshToken(token)
+	refreshToken, err := f.tokenStore.ValidRefreshToken(token)
 	if err != nil {
 		return nil, false
 	}
 
-	return tokenInfo, true
+	return refreshToken, true
 }
 
 // isScopeSubset checks if requestedScope is a subset of originalScope
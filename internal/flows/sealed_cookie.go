@@ -0,0 +1,120 @@
+package flows
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/utils"
+)
+
+// Login steps that span several requests keep their state in cookies sealed
+// with AES-256-GCM, so it can neither be read nor changed by the browser.
+// Realms share the signing secret, so the key, the additional data and the
+// state itself are bound to the issuer of the realm: a cookie of one realm is
+// refused by every other.
+
+// sealedState is the plaintext of a state cookie
+type sealedState struct {
+	Issuer string          `json:"iss"`
+	State  json.RawMessage `json:"state"`
+}
+
+// stateCipher derives a cipher from the signing secret and the issuer;
+// purpose separates the keys of different cookies
+func (f *AuthorizationCodeFlow) stateCipher(purpose string) (cipher.AEAD, error) {
+	derived := sha256.Sum256([]byte(purpose + "\x00" + f.issuer() + "\x00" + f.config.Security.JWTSecret))
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// issuer returns the issuer of the realm of the flow
+func (f *AuthorizationCodeFlow) issuer() string {
+	return strings.TrimSuffix(f.config.Server.BaseURL, "/")
+}
+
+// stateAdditionalData authenticates the purpose and issuer of a cookie
+func (f *AuthorizationCodeFlow) stateAdditionalData(purpose string) []byte {
+	return []byte(purpose + "\x00" + f.issuer())
+}
+
+// sealState encrypts state for a cookie
+func (f *AuthorizationCodeFlow) sealState(purpose string, state interface{}) (string, error) {
+	aead, err := f.stateCipher(purpose)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(sealedState{Issuer: f.issuer(), State: encoded})
+	if err != nil {
+		return "", err
+	}
+	nonce, err := utils.GenerateRandomBytes(aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, f.stateAdditionalData(purpose))), nil
+}
+
+// openState decrypts the state of a cookie into state
+func (f *AuthorizationCodeFlow) openState(purpose, value string, state interface{}) error {
+	aead, err := f.stateCipher(purpose)
+	if err != nil {
+		return err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return errors.New("sealed state is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], f.stateAdditionalData(purpose))
+	if err != nil {
+		return err
+	}
+	var envelope sealedState
+	if err := json.Unmarshal(plaintext, &envelope); err != nil {
+		return err
+	}
+	if envelope.Issuer != f.issuer() {
+		return errors.New("sealed state belongs to another issuer")
+	}
+	return json.Unmarshal(envelope.State, state)
+}
+
+// setStateCookie sets a sealed state cookie scoped to path below the base
+// URL; an empty value removes it
+func (f *AuthorizationCodeFlow) setStateCookie(w http.ResponseWriter, r *http.Request, name, path, value string, expires time.Time) {
+	baseURL := f.config.GetEffectiveBaseURL(r)
+	if parsed, err := url.Parse(baseURL); err == nil {
+		path = strings.TrimSuffix(parsed.Path, "/") + path
+	}
+
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,38 @@
+package flows
+
+import (
+	"testing"
+	"time"
+
+	"oauth2-server/pkg/config"
+)
+
+// newRealmFlow returns a flow of the realm with the issuer; all realms share
+// the signing secret
+func newRealmFlow(issuer string) *AuthorizationCodeFlow {
+	cfg := &config.Config{}
+	cfg.Security.JWTSecret = "shared-secret"
+	cfg.Server.BaseURL = issuer
+	return &AuthorizationCodeFlow{config: cfg}
+}
+
+func TestSealedStateIsBoundToTheRealm(t *testing.T) {
+	partners := newRealmFlow("https://auth.example.org/realms/partners")
+	staff := newRealmFlow("https://auth.example.org/realms/staff")
+
+	sealed, err := partners.sealState(mfaPurpose, pendingMFA{UserID: "user-alice", ExpiresAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pending pendingMFA
+	if err := partners.openState(mfaPurpose, sealed, &pending); err != nil || pending.UserID != "user-alice" {
+		t.Fatalf("openState in the same realm = %+v, %v", pending, err)
+	}
+	if err := staff.openState(mfaPurpose, sealed, &pendingMFA{}); err == nil {
+		t.Error("state of one realm was accepted by another")
+	}
+	if err := partners.openState(passkeyPurpose, sealed, &pendingMFA{}); err == nil {
+		t.Error("state was accepted for another purpose")
+	}
+}
@@ -73,7 +73,7 @@ func (f *TokenExchangeFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authenticate client
-	client, err := auth.AuthenticateClient(clientID, clientSecret, f.clientStore)
+	client, err := auth.AuthenticateClient(clientID, clientSecret, r.RemoteAddr, f.clientStore)
 	if err != nil {
 		log.Printf("❌ Client authentication failed for %s: %v", clientID, err)
 		f.writeError(w, "invalid_client", "Client authentication failed")
@@ -105,7 +105,7 @@ func (f *TokenExchangeFlow) Handle(w http.ResponseWriter, r *http.Request) {
 	response := models.TokenResponse{
 		AccessToken: newAccessToken,
 		TokenType:   "Bearer",
-		ExpiresIn:   3600, // 1 hour
+		ExpiresIn:   int(f.config.Security.AccessTokenLifetime().Seconds()),
 		Scope:       scope,
 	}
 
@@ -0,0 +1,200 @@
+package flows
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/utils"
+)
+
+// The pending upstream login travels in a sealed cookie between the redirect
+// to the identity provider and its callback
+const (
+	upstreamLoginCookieName = "oauth2_upstream_login"
+	upstreamLoginPurpose    = "upstream-login"
+	upstreamLoginLifetime   = 10 * time.Minute
+)
+
+// upstreamLogin is the state of a login at an upstream identity provider
+type upstreamLogin struct {
+	Provider     string    `json:"provider"`
+	State        string    `json:"state"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"code_verifier"`
+	Query        string    `json:"query"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// HandleUpstreamLogin serves /login/{id}, which sends the user to an upstream
+// identity provider with the authorization request in its query, and
+// /login/{id}/callback, which completes the login and resumes the request
+func (f *AuthorizationCodeFlow) HandleUpstreamLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		utils.WriteErrorHTML(w, http.StatusMethodNotAllowed, "Method Not Allowed", "Use GET.")
+		return
+	}
+
+	id, callback := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/login/"), "/callback")
+	provider, ok := f.providers.Get(id)
+	if !ok {
+		utils.WriteErrorHTML(w, http.StatusNotFound, "Unknown Identity Provider", "No identity provider with this ID is configured.")
+		return
+	}
+
+	if callback {
+		f.finishUpstreamLogin(w, r, provider)
+		return
+	}
+	f.startUpstreamLogin(w, r, provider)
+}
+
+// startUpstreamLogin validates the authorization request and redirects to the provider
+func (f *AuthorizationCodeFlow) startUpstreamLogin(w http.ResponseWriter, r *http.Request, provider *auth.UpstreamProvider) {
+	ar, err := f.oauth2Provider.NewAuthorizeRequest(r.Context(), r)
+	if err != nil {
+		log.Printf("❌ Error creating authorization request: %v", err)
+		f.oauth2Provider.WriteAuthorizeError(r.Context(), w, ar, err)
+		return
+	}
+
+	pending := upstreamLogin{
+		Provider:     provider.ID(),
+		State:        utils.GenerateState(),
+		Nonce:        utils.GenerateNonce(),
+		CodeVerifier: utils.GenerateCodeVerifier(),
+		Query:        r.URL.RawQuery,
+		ExpiresAt:    time.Now().Add(upstreamLoginLifetime),
+	}
+
+	// A fresh login requested by the client is passed on to the provider
+	prompt := ""
+	if hasPrompt(ar, "login") {
+		prompt = "login"
+	}
+	authURL, err := provider.AuthCodeURL(f.upstreamCallbackURL(r, provider), pending.State, pending.Nonce, pending.CodeVerifier, prompt)
+	if err != nil {
+		log.Printf("❌ Identity provider %s is unavailable: %v", provider.ID(), err)
+		utils.WriteErrorHTML(w, http.StatusBadGateway, "Identity Provider Unavailable",
+			fmt.Sprintf("%s cannot be reached, please try again later.", html.EscapeString(provider.Name())))
+		return
+	}
+
+	sealed, err := f.sealState(upstreamLoginPurpose, pending)
+	if err != nil {
+		log.Printf("❌ Failed to seal upstream login state: %v", err)
+		utils.WriteErrorHTML(w, http.StatusInternalServerError, "Login Failed", "The login could not be started.")
+		return
+	}
+	f.setStateCookie(w, r, upstreamLoginCookieName, "/login/", sealed, pending.ExpiresAt)
+
+	log.Printf("🌐 Redirecting to identity provider %s for client %s", provider.ID(), ar.GetClient().GetID())
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// finishUpstreamLogin redeems the code, logs the user in and resumes the
+// authorization request
+func (f *AuthorizationCodeFlow) finishUpstreamLogin(w http.ResponseWriter, r *http.Request, provider *auth.UpstreamProvider) {
+	cookie, err := r.Cookie(upstreamLoginCookieName)
+	if err != nil {
+		utils.WriteErrorHTML(w, http.StatusBadRequest, "Login Expired", "The login was not started from this browser or took too long.")
+		return
+	}
+	f.setStateCookie(w, r, upstreamLoginCookieName, "/login/", "", time.Unix(0, 0))
+
+	var pending upstreamLogin
+	err = f.openState(upstreamLoginPurpose, cookie.Value, &pending)
+	if err != nil || pending.Provider != provider.ID() || time.Now().After(pending.ExpiresAt) {
+		utils.WriteErrorHTML(w, http.StatusBadRequest, "Login Expired", "The login was not started from this browser or took too long.")
+		return
+	}
+	if r.URL.Query().Get("state") != pending.State {
+		log.Printf("⚠️ State mismatch in callback of identity provider %s", provider.ID())
+		utils.WriteErrorHTML(w, http.StatusBadRequest, "Login Failed", "The response of the identity provider does not belong to this login.")
+		return
+	}
+
+	authorizeURL := f.config.GetEffectiveBaseURL(r) + "/auth?" + pending.Query
+	tryAgain := fmt.Sprintf(`<a href="%s">Back to the login page</a>`, html.EscapeString(authorizeURL))
+
+	if upstreamError := r.URL.Query().Get("error"); upstreamError != "" {
+		log.Printf("❌ Identity provider %s returned %s: %s", provider.ID(), upstreamError, r.URL.Query().Get("error_description"))
+		utils.WriteErrorHTML(w, http.StatusBadRequest, "Login Failed",
+			fmt.Sprintf("%s did not log you in (%s). %s", html.EscapeString(provider.Name()), html.EscapeString(upstreamError), tryAgain))
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), f.upstreamCallbackURL(r, provider), pending.CodeVerifier, pending.Nonce)
+	if err != nil {
+		log.Printf("❌ Login at identity provider %s failed: %v", provider.ID(), err)
+		utils.WriteErrorHTML(w, http.StatusBadGateway, "Login Failed",
+			fmt.Sprintf("The response of %s could not be verified. %s", html.EscapeString(provider.Name()), tryAgain))
+		return
+	}
+
+	query, _ := url.ParseQuery(pending.Query)
+	user, err := f.userAuth.AuthenticateUpstream(provider, identity, query.Get("client_id"), r.RemoteAddr)
+	if err != nil {
+		utils.WriteErrorHTML(w, http.StatusForbidden, "Access Denied",
+			fmt.Sprintf("Your %s account cannot be used to log in here. %s", html.EscapeString(provider.Name()), tryAgain))
+		return
+	}
+
+	// The provider decides how its users authenticate, so the login is
+	// recorded with the methods it reported
+	f.startSession(w, r, user.ID, identity.AMR)
+	log.Printf("✅ User %s logged in with identity provider %s", user.Username, provider.ID())
+
+	// The provider handled prompt=login, so the session must satisfy the request
+	http.Redirect(w, r, f.config.GetEffectiveBaseURL(r)+"/auth?"+withoutLoginPrompt(query).Encode(), http.StatusFound)
+}
+
+// withoutLoginPrompt removes "login" from the prompt parameter of an
+// authorization request whose user just logged in
+func withoutLoginPrompt(query url.Values) url.Values {
+	prompts := strings.Fields(query.Get("prompt"))
+	if len(prompts) == 0 {
+		return query
+	}
+
+	var remaining []string
+	for _, prompt := range prompts {
+		if prompt != "login" {
+			remaining = append(remaining, prompt)
+		}
+	}
+	if len(remaining) > 0 {
+		query.Set("prompt", strings.Join(remaining, " "))
+	} else {
+		query.Del("prompt")
+	}
+	return query
+}
+
+// upstreamCallbackURL returns the redirect URI registered with the provider
+func (f *AuthorizationCodeFlow) upstreamCallbackURL(r *http.Request, provider *auth.UpstreamProvider) string {
+	return f.config.GetEffectiveBaseURL(r) + "/login/" + provider.ID() + "/callback"
+}
+
+// generateProviderButtons creates the login buttons of the identity providers
+func (f *AuthorizationCodeFlow) generateProviderButtons(query string) string {
+	providers := f.providers.All()
+	if len(providers) == 0 {
+		return ""
+	}
+
+	var buttons strings.Builder
+	buttons.WriteString(`<div class="providers"><p>or sign in with</p>`)
+	for _, provider := range providers {
+		buttons.WriteString(fmt.Sprintf(`<a class="btn provider" href="login/%s%s">%s</a>`,
+			url.PathEscape(provider.ID()), html.EscapeString(query), html.EscapeString(provider.Name())))
+	}
+	buttons.WriteString(`</div>`)
+	return buttons.String()
+}
@@ -0,0 +1,234 @@
+package flows
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/mockidp"
+	"oauth2-server/internal/store"
+	"oauth2-server/internal/utils"
+	"oauth2-server/pkg/config"
+)
+
+const testCallbackURL = "http://example.com/login/mock/callback"
+
+var testIdentity = mockidp.Identity{
+	Subject:       "alice-1",
+	Username:      "alice",
+	Email:         "alice@example.org",
+	EmailVerified: true,
+	Name:          "Alice",
+}
+
+// newUpstreamTestFlow creates a flow with the mock identity provider as "mock"
+func newUpstreamTestFlow(t *testing.T, configure func(*config.IdentityProviderConfig)) (*AuthorizationCodeFlow, *store.UserStore) {
+	t.Helper()
+	var idp *mockidp.Server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	idp, err := mockidp.New(server.URL, "app", "app-secret", testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providerConfig := config.IdentityProviderConfig{ID: "mock", Issuer: server.URL, ClientID: "app", ClientSecret: "app-secret"}
+	if configure != nil {
+		configure(&providerConfig)
+	}
+	cfg := &config.Config{}
+	cfg.Security.JWTSecret = "test-secret"
+
+	backend := store.NewMemoryBackend()
+	users := store.NewUserStore(backend.Users())
+	userAuth := auth.NewUserAuthenticator(users, nil, lockout.NewTracker(cfg), backend.Requests(), cfg)
+	providers := auth.NewUpstreamProviders([]config.IdentityProviderConfig{providerConfig})
+	return NewAuthorizationCodeFlow(nil, userAuth, providers, users, backend.Sessions(), backend.Consents(), cfg), users
+}
+
+// upstreamCallback starts a login at the mock as identity and returns the
+// callback request with the cookie of the pending login; change, if set,
+// alters the pending login after the redirect to the provider
+func upstreamCallback(t *testing.T, f *AuthorizationCodeFlow, identity mockidp.Identity, change func(*upstreamLogin)) *http.Request {
+	t.Helper()
+	provider, _ := f.providers.Get("mock")
+	pending := upstreamLogin{
+		Provider:     "mock",
+		State:        utils.GenerateState(),
+		Nonce:        utils.GenerateNonce(),
+		CodeVerifier: utils.GenerateCodeVerifier(),
+		Query:        "client_id=app&response_type=code",
+		ExpiresAt:    time.Now().Add(upstreamLoginLifetime),
+	}
+	authURL, err := provider.AuthCodeURL(testCallbackURL, pending.State, pending.Nonce, pending.CodeVerifier, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change != nil {
+		change(&pending)
+	}
+	sealed, err := f.sealState(upstreamLoginPurpose, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := parsed.Query()
+	form.Set("action", "login")
+	form.Set("sub", identity.Subject)
+	form.Set("preferred_username", identity.Username)
+	form.Set("email", identity.Email)
+	if identity.EmailVerified {
+		form.Set("email_verified", "true")
+	}
+	form.Set("name", identity.Name)
+	parsed.RawQuery = ""
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(parsed.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(location, testCallbackURL+"?") {
+		t.Fatalf("mock identity provider answered %d %s", resp.StatusCode, location)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, location, nil)
+	r.AddCookie(&http.Cookie{Name: upstreamLoginCookieName, Value: sealed})
+	return r
+}
+
+func TestUpstreamLoginCallback(t *testing.T) {
+	f, users := newUpstreamTestFlow(t, func(p *config.IdentityProviderConfig) { p.CreateUsers = true })
+
+	w := httptest.NewRecorder()
+	f.HandleUpstreamLogin(w, upstreamCallback(t, f, testIdentity, nil))
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "http://example.com/auth?") {
+		t.Fatalf("callback answered %d %s, want a redirect to /auth", w.Code, w.Header().Get("Location"))
+	}
+
+	user, found := users.GetUserByUsername("alice")
+	if !found || user.Authenticator != "mock" || user.Identities["mock"] != "alice-1" {
+		t.Fatalf("user = %+v, want a user created for the mock identity", user)
+	}
+	var session bool
+	for _, cookie := range w.Result().Cookies() {
+		session = session || (cookie.Name == sessionCookieName && cookie.Value != "")
+	}
+	if !session {
+		t.Error("callback did not start a login session")
+	}
+}
+
+func TestUpstreamLoginCallbackRejectsMismatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(*upstreamLogin)
+		wantStatus int
+	}{
+		{"state", func(p *upstreamLogin) { p.State = utils.GenerateState() }, http.StatusBadRequest},
+		{"provider", func(p *upstreamLogin) { p.Provider = "other" }, http.StatusBadRequest},
+		{"expiry", func(p *upstreamLogin) { p.ExpiresAt = time.Now().Add(-time.Second) }, http.StatusBadRequest},
+		// The provider rejects the code or the ID token is not accepted
+		{"nonce", func(p *upstreamLogin) { p.Nonce = utils.GenerateNonce() }, http.StatusBadGateway},
+		{"code verifier", func(p *upstreamLogin) { p.CodeVerifier = utils.GenerateCodeVerifier() }, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, users := newUpstreamTestFlow(t, func(p *config.IdentityProviderConfig) { p.CreateUsers = true })
+
+			w := httptest.NewRecorder()
+			f.HandleUpstreamLogin(w, upstreamCallback(t, f, testIdentity, tt.change))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("callback with a different %s answered %d, want %d", tt.name, w.Code, tt.wantStatus)
+			}
+			if _, found := users.GetUserByUsername("alice"); found {
+				t.Errorf("callback with a different %s created a user", tt.name)
+			}
+		})
+	}
+}
+
+func TestUpstreamLoginCallbackLinksUsers(t *testing.T) {
+	tests := []struct {
+		name       string
+		provider   config.IdentityProviderConfig
+		identity   mockidp.Identity
+		wantStatus int
+		wantLinked bool
+		wantUsers  int
+	}{
+		{
+			name:       "verified email",
+			provider:   config.IdentityProviderConfig{LinkBy: config.LinkByEmail},
+			identity:   mockidp.Identity{Subject: "alice-1", Username: "alice.idp", Email: "alice@example.org", EmailVerified: true},
+			wantStatus: http.StatusFound,
+			wantLinked: true,
+			wantUsers:  1,
+		},
+		{
+			name:       "unverified email",
+			provider:   config.IdentityProviderConfig{LinkBy: config.LinkByEmail},
+			identity:   mockidp.Identity{Subject: "alice-1", Username: "alice.idp", Email: "alice@example.org"},
+			wantStatus: http.StatusForbidden,
+			wantUsers:  1,
+		},
+		{
+			name:       "unverified email with create_users",
+			provider:   config.IdentityProviderConfig{LinkBy: config.LinkByEmail, CreateUsers: true},
+			identity:   mockidp.Identity{Subject: "alice-1", Username: "alice.idp", Email: "alice@example.org"},
+			wantStatus: http.StatusFound,
+			wantUsers:  2,
+		},
+		{
+			name:       "taken username with create_users",
+			provider:   config.IdentityProviderConfig{CreateUsers: true},
+			identity:   mockidp.Identity{Subject: "alice-1", Username: "alice", Email: "mallory@example.org", EmailVerified: true},
+			wantStatus: http.StatusForbidden,
+			wantUsers:  1,
+		},
+		{
+			name:       "no linking",
+			provider:   config.IdentityProviderConfig{},
+			identity:   mockidp.Identity{Subject: "alice-1", Username: "alice", Email: "alice@example.org", EmailVerified: true},
+			wantStatus: http.StatusForbidden,
+			wantUsers:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, users := newUpstreamTestFlow(t, func(p *config.IdentityProviderConfig) {
+				p.LinkBy, p.CreateUsers = tt.provider.LinkBy, tt.provider.CreateUsers
+			})
+			local := &store.User{ID: "user-1", Username: "alice", Email: "alice@example.org", Enabled: true}
+			if err := users.SaveUser(local); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			f.HandleUpstreamLogin(w, upstreamCallback(t, f, tt.identity, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("callback answered %d, want %d", w.Code, tt.wantStatus)
+			}
+			stored, _ := users.GetUser("user-1")
+			if linked := stored.Identities["mock"] == "alice-1"; linked != tt.wantLinked {
+				t.Errorf("identity linked to the local user = %v, want %v", linked, tt.wantLinked)
+			}
+			if n := len(users.ListUsers()); n != tt.wantUsers {
+				t.Errorf("%d users, want %d", n, tt.wantUsers)
+			}
+		})
+	}
+}
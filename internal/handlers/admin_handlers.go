@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"oauth2-server/internal/admin"
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/store"
+	"oauth2-server/internal/utils"
+)
+
+// AdminHandlers serves the admin API under /admin/. Every request needs a
+// bearer token with the admin scope, e.g. from the client credentials grant.
+type AdminHandlers struct {
+	service    *admin.Service
+	tokenStore *store.TokenStore
+}
+
+// NewAdminHandlers creates the admin API handlers
+func NewAdminHandlers(service *admin.Service, tokenStore *store.TokenStore) *AdminHandlers {
+	return &AdminHandlers{
+		service:    service,
+		tokenStore: tokenStore,
+	}
+}
+
+// HandleAdmin authenticates the request and routes it:
+//
+//	GET    /admin/clients                       list clients
+//	POST   /admin/clients                       create a client
+//	GET    /admin/clients/{id}                  show a client
+//	PUT    /admin/clients/{id}                  update a client
+//	DELETE /admin/clients/{id}                  delete a client
+//	POST   /admin/clients/{id}/rotate-secret    generate a new secret
+//	GET    /admin/users                         list users
+//	POST   /admin/users                         create a user
+//	GET    /admin/users/{id|username}           show a user
+//	PUT    /admin/users/{id|username}           update or disable a user
+//	DELETE /admin/users/{id|username}           delete a user
+//	POST   /admin/users/{id|username}/password  {"password": ...}
+//	DELETE /admin/users/{id|username}/mfa       reset the second factor
+//	DELETE /admin/users/{id|username}/passkeys/{passkey-id}  delete a passkey
+//	POST   /admin/tokens/introspect             {"token": ...}
+//	POST   /admin/tokens/revoke                 {"token"|"user_id"|"client_id": ...}
+//	GET    /admin/keys                          list signing keys
+//	POST   /admin/keys/rotate                   rotate the signing key
+//	GET    /admin/lockouts                      list failed attempts and lockouts
+//	DELETE /admin/lockouts/{kind}/{key}         unlock an account, client or ip
+func (h *AdminHandlers) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	actor, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	ctx := admin.WithActor(r.Context(), actor)
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/"), "/")
+	route := r.Method + " " + parts[0]
+
+	var (
+		result interface{}
+		err    error
+	)
+	switch {
+	case route == "GET clients" && len(parts) == 1:
+		result, err = h.service.ListClients(ctx)
+	case route == "POST clients" && len(parts) == 1:
+		var client admin.Client
+		if !decodeAdminRequest(w, r, &client) {
+			return
+		}
+		created, err := h.service.CreateClient(ctx, client)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		utils.WriteJSONResponse(w, http.StatusCreated, created)
+		return
+	case route == "GET clients" && len(parts) == 2:
+		result, err = h.service.GetClient(ctx, parts[1])
+	case route == "PUT clients" && len(parts) == 2:
+		var client admin.Client
+		if !decodeAdminRequest(w, r, &client) {
+			return
+		}
+		result, err = h.service.UpdateClient(ctx, parts[1], client)
+	case route == "DELETE clients" && len(parts) == 2:
+		if err := h.service.DeleteClient(ctx, parts[1]); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case route == "POST clients" && len(parts) == 3 && parts[2] == "rotate-secret":
+		result, err = h.service.RotateClientSecret(ctx, parts[1])
+	case route == "GET users" && len(parts) == 1:
+		result, err = h.service.ListUsers(ctx)
+	case route == "POST users" && len(parts) == 1:
+		// Users are enabled unless the request says otherwise
+		user := admin.User{Enabled: true}
+		if !decodeAdminRequest(w, r, &user) {
+			return
+		}
+		created, err := h.service.CreateUser(ctx, user)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		utils.WriteJSONResponse(w, http.StatusCreated, created)
+		return
+	case route == "GET users" && len(parts) == 2:
+		result, err = h.service.GetUser(ctx, parts[1])
+	case route == "PUT users" && len(parts) == 2:
+		user := admin.User{Enabled: true}
+		if !decodeAdminRequest(w, r, &user) {
+			return
+		}
+		result, err = h.service.UpdateUser(ctx, parts[1], user)
+	case route == "DELETE users" && len(parts) == 2:
+		if err := h.service.DeleteUser(ctx, parts[1]); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case route == "POST users" && len(parts) == 3 && parts[2] == "password":
+		var req struct {
+			Password string `json:"password"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		if err := h.service.SetUserPassword(ctx, parts[1], req.Password); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case route == "DELETE users" && len(parts) == 3 && parts[2] == "mfa":
+		if err := h.service.ResetUserMFA(ctx, parts[1]); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case route == "DELETE users" && len(parts) == 4 && parts[2] == "passkeys":
+		if err := h.service.DeleteUserPasskey(ctx, parts[1], parts[3]); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case route == "POST tokens" && len(parts) == 2 && parts[1] == "introspect":
+		var req struct {
+			Token string `json:"token"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		result, err = h.service.IntrospectToken(ctx, req.Token)
+	case route == "POST tokens" && len(parts) == 2 && parts[1] == "revoke":
+		var req admin.RevokeRequest
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		result, err = h.service.RevokeTokens(ctx, req)
+	case route == "GET keys" && len(parts) == 1:
+		result, err = h.service.ListKeys(ctx)
+	case route == "POST keys" && len(parts) == 2 && parts[1] == "rotate":
+		result, err = h.service.RotateKey(ctx)
+	case route == "GET lockouts" && len(parts) == 1:
+		result, err = h.service.ListLockouts(ctx)
+	case route == "DELETE lockouts" && len(parts) == 3:
+		if err := h.service.Unlock(ctx, parts[1], parts[2]); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		utils.WriteJSONResponse(w, http.StatusNotFound, &admin.APIError{Code: "not_found", Description: "unknown admin endpoint " + r.Method + " " + r.URL.Path})
+		return
+	}
+
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	utils.WriteJSONResponse(w, http.StatusOK, result)
+}
+
+// authenticate checks the bearer token and returns the acting client, or the
+// user when the token was issued to one
+func (h *AdminHandlers) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return authenticateAdmin(w, r, h.tokenStore, func(status int, code, description string) {
+		utils.WriteJSONResponse(w, status, &admin.APIError{Code: code, Description: description})
+	})
+}
+
+// authenticateAdmin checks that the request carries an access token with the
+// admin scope; writeError writes the error body in the format of the API
+func authenticateAdmin(w http.ResponseWriter, r *http.Request, tokenStore *store.TokenStore, writeError func(status int, code, description string)) (string, bool) {
+	token, err := auth.ExtractBearerToken(r.Header.Get("Authorization"))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer scope="`+admin.Scope+`"`)
+		writeError(http.StatusUnauthorized, "invalid_token", "Access token required")
+		return "", false
+	}
+
+	info, err := tokenStore.ValidateAccessToken(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(http.StatusUnauthorized, "invalid_token", "Invalid access token")
+		return "", false
+	}
+
+	actor := info.ClientID
+	if info.UserID != "" {
+		actor = info.UserID
+	}
+
+	if !utils.Contains(info.Scopes, admin.Scope) {
+		log.Printf("❌ Admin API denied for %s: missing %s scope", actor, admin.Scope)
+		audit.Log(audit.Event{
+			Type:     "admin_access",
+			Outcome:  audit.OutcomeDenied,
+			ClientID: info.ClientID,
+			Subject:  info.UserID,
+			Reason:   "missing admin scope",
+		})
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+admin.Scope+`"`)
+		writeError(http.StatusForbidden, "insufficient_scope", "The admin scope is required")
+		return "", false
+	}
+
+	return actor, true
+}
+
+// decodeAdminRequest decodes a JSON body, writing the error response on failure
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		utils.WriteJSONResponse(w, http.StatusBadRequest, &admin.APIError{Code: "invalid_request", Description: "Invalid JSON body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// writeAdminError writes a service error with its status code
+func writeAdminError(w http.ResponseWriter, err error) {
+	apiErr := admin.ToAPIError(err)
+	if apiErr.Status >= http.StatusInternalServerError {
+		log.Printf("❌ Admin API error: %v", err)
+	}
+	utils.WriteJSONResponse(w, apiErr.Status, apiErr)
+}
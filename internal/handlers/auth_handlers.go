@@ -32,7 +32,7 @@ func (h *AuthHandler) HandleClientAuth(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authenticate client using the store
-	client, err := auth.AuthenticateClient(req.ClientID, req.ClientSecret, h.clientStore)
+	client, err := auth.AuthenticateClient(req.ClientID, req.ClientSecret, r.RemoteAddr, h.clientStore)
 	if err != nil {
 		log.Printf("❌ Client authentication failed for %s: %v", req.ClientID, err)
 		h.writeError(w, "invalid_client", "Client authentication failed")
@@ -111,7 +111,7 @@ func (h *AuthHandler) HandleIntrospection(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	_, err = auth.AuthenticateClient(clientID, clientSecret, h.clientStore)
+	_, err = auth.AuthenticateClient(clientID, clientSecret, r.RemoteAddr, h.clientStore)
 	if err != nil {
 		h.writeError(w, "invalid_client", "Client authentication failed")
 		return
@@ -163,7 +163,7 @@ func (h *AuthHandler) HandleRevocation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = auth.AuthenticateClient(clientID, clientSecret, h.clientStore)
+	_, err = auth.AuthenticateClient(clientID, clientSecret, r.RemoteAddr, h.clientStore)
 	if err != nil {
 		h.writeError(w, "invalid_client", "Client authentication failed")
 		return
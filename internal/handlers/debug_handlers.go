@@ -35,7 +35,7 @@ func (h *DebugHandlers) HandleDebugClients(w http.ResponseWriter, r *http.Reques
 	// Get all clients from config
 	var clientList []map[string]interface{}
 
-	for _, clientConfig := range h.config.Clients {
+	for _, clientConfig := range h.config.ListClients() {
 		clientInfo := map[string]interface{}{
 			"id":                         clientConfig.ID,
 			"name":                       clientConfig.Name,
@@ -80,7 +80,7 @@ func (h *DebugHandlers) HandleDebugClient(w http.ResponseWriter, r *http.Request
 
 	// Check if client exists in config
 	var foundClient *config.ClientConfig
-	for _, client := range h.config.Clients {
+	for _, client := range h.config.ListClients() {
 		if client.ID == clientID {
 			foundClient = &client
 			break
@@ -162,8 +162,8 @@ func (h *DebugHandlers) HandleDebugConfig(w http.ResponseWriter, r *http.Request
 			"require_https":                h.config.Security.RequireHTTPS,
 			"has_jwt_secret":               h.config.Security.JWTSecret != "",
 		},
-		"clients_count": len(h.config.Clients),
-		"users_count":   len(h.config.Users),
+		"clients_count": len(h.config.ListClients()),
+		"users_count":   len(h.config.ListUsers()),
 		"logging": map[string]interface{}{
 			"level":        h.config.Logging.Level,
 			"format":       h.config.Logging.Format,
@@ -1,29 +1,44 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"oauth2-server/internal/auth"
 	"oauth2-server/internal/flows"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/models"
+	"oauth2-server/internal/store"
 	"oauth2-server/internal/utils"
 	"oauth2-server/pkg/config"
 )
 
 // DeviceHandlers handles device flow user verification
 type DeviceHandlers struct {
-	deviceFlow *flows.DeviceCodeFlow
-	config     *config.Config
+	deviceFlow  *flows.DeviceCodeFlow
+	clientStore *store.ClientStore
+	users       *store.UserStore
+	userAuth    *auth.UserAuthenticator
+	lockouts    *lockout.Tracker
+	config      *config.Config
 }
 
 // NewDeviceHandlers creates a new device handlers instance
-func NewDeviceHandlers(deviceFlow *flows.DeviceCodeFlow, config *config.Config) *DeviceHandlers {
+func NewDeviceHandlers(deviceFlow *flows.DeviceCodeFlow, clientStore *store.ClientStore, users *store.UserStore, userAuth *auth.UserAuthenticator, lockouts *lockout.Tracker, config *config.Config) *DeviceHandlers {
 	return &DeviceHandlers{
-		deviceFlow: deviceFlow,
-		config:     config,
+		deviceFlow:  deviceFlow,
+		clientStore: clientStore,
+		users:       users,
+		userAuth:    userAuth,
+		lockouts:    lockouts,
+		config:      config,
 	}
 }
 
@@ -46,11 +61,7 @@ func (h *DeviceHandlers) showDeviceForm(w http.ResponseWriter, r *http.Request)
 
 	// Auto-uppercase and format the user code if present
 	if userCode != "" {
-		userCode = strings.ToUpper(strings.ReplaceAll(userCode, " ", ""))
-		// Add hyphen formatting if not present
-		if len(userCode) == 8 && !strings.Contains(userCode, "-") {
-			userCode = fmt.Sprintf("%s-%s", userCode[:4], userCode[4:])
-		}
+		userCode = normalizeUserCode(userCode)
 	}
 
 	tmpl := `
@@ -199,7 +210,13 @@ func (h *DeviceHandlers) showDeviceForm(w http.ResponseWriter, r *http.Request)
                        placeholder="Enter your password">
             </div>
             
-            <button type="submit" class="btn">Authorize Device</button>
+            <div class="form-group">
+                <label for="code">Authentication code:</label>
+                <input type="text" id="code" name="code" autocomplete="one-time-code"
+                       placeholder="Only if two-factor authentication is enabled">
+            </div>
+            
+            <button type="submit" class="btn">Continue</button>
         </form>
 
         <div class="test-users">
@@ -224,7 +241,7 @@ func (h *DeviceHandlers) showDeviceForm(w http.ResponseWriter, r *http.Request)
 	data := struct {
 		UserCode      string
 		Error         string
-		TestUsersList string
+		TestUsersList template.HTML
 	}{
 		UserCode:      userCode,
 		Error:         errorMsg,
@@ -244,16 +261,17 @@ func (h *DeviceHandlers) showDeviceForm(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// generateTestUsersList creates an HTML list of available test users
-func (h *DeviceHandlers) generateTestUsersList() string {
+// generateTestUsersList creates an HTML list of the test users of the config
+// file; stored users are not listed on this public page
+func (h *DeviceHandlers) generateTestUsersList() template.HTML {
 	var usersList strings.Builder
 
-	for _, user := range h.config.Users {
+	for _, user := range h.config.ListUsers() {
 		usersList.WriteString(fmt.Sprintf(
 			"<li><strong>%s</strong> / %s (%s)</li>",
-			user.Username,
-			user.Password,
-			user.Name,
+			template.HTMLEscapeString(user.Username),
+			template.HTMLEscapeString(user.Password),
+			template.HTMLEscapeString(user.Name),
 		))
 	}
 
@@ -261,7 +279,7 @@ func (h *DeviceHandlers) generateTestUsersList() string {
 		usersList.WriteString("<li>No test users configured</li>")
 	}
 
-	return usersList.String()
+	return template.HTML(usersList.String())
 }
 
 // handleDeviceForm processes the device verification form submission
@@ -271,7 +289,12 @@ func (h *DeviceHandlers) handleDeviceForm(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	userCode := strings.TrimSpace(strings.ToUpper(r.FormValue("user_code")))
+	if r.FormValue("action") == "consent" {
+		h.handleConsentForm(w, r)
+		return
+	}
+
+	userCode := normalizeUserCode(r.FormValue("user_code"))
 	username := strings.TrimSpace(r.FormValue("username"))
 	password := r.FormValue("password")
 
@@ -280,49 +303,332 @@ func (h *DeviceHandlers) handleDeviceForm(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if err := utils.ValidateUserCode(userCode); err != nil {
+		h.redirectWithError(w, r, "Invalid device code format")
+		return
+	}
+
 	if username == "" || password == "" {
 		h.redirectWithError(w, r, "Username and password are required")
 		return
 	}
 
-	// Authenticate user against configured users
-	user := h.authenticateUser(username, password)
-	if user == nil {
+	// Authenticate user against the authentication backends
+	user, err := h.userAuth.Authenticate(auth.LoginAttempt{
+		Username:   username,
+		Password:   password,
+		Method:     auth.LoginMethodDevice,
+		RemoteAddr: r.RemoteAddr,
+	})
+	if errors.Is(err, auth.ErrAccountLocked) {
+		h.redirectWithError(w, r, "Too many failed login attempts, please try again later")
+		return
+	}
+	if errors.Is(err, auth.ErrAuthenticationUnavailable) {
+		h.redirectWithError(w, r, "Authentication is temporarily unavailable, please try again later")
+		return
+	}
+	if err != nil {
 		h.redirectWithError(w, r, "Invalid username or password")
 		return
 	}
 
-	// Authorize the device
-	if !h.deviceFlow.AuthorizeDevice(userCode, user.ID) {
+	// Users with a second factor confirm the login with a code; enrolment
+	// needs the QR code of the browser login
+	if h.userAuth.MFARequired(user) {
+		if user.MFA == nil && len(user.Passkeys) > 0 {
+			h.redirectWithError(w, r, "Passkeys cannot be used to authorize devices, this page needs a code of an authenticator app")
+			return
+		}
+		if user.MFA == nil {
+			h.redirectWithError(w, r, "Set up two-factor authentication by logging in to an application in your browser first")
+			return
+		}
+		_, err := h.userAuth.VerifyMFA(auth.LoginAttempt{
+			Method:     auth.LoginMethodDevice,
+			RemoteAddr: r.RemoteAddr,
+		}, user.ID, r.FormValue("code"))
+		if errors.Is(err, auth.ErrAccountLocked) {
+			h.redirectWithError(w, r, "Too many failed login attempts, please try again later")
+			return
+		}
+		if err != nil {
+			h.redirectWithError(w, r, "Invalid or missing authentication code")
+			return
+		}
+	}
+
+	// Bind the user to the pending device authorization and ask for consent.
+	// Wrong codes count towards the lockout of the source IP, which the
+	// password check above honours, and of the account, which a valid login
+	// does not reset, so codes cannot be enumerated with a valid login.
+	userCodes := lockout.UserCodes(username)
+	if h.lockouts.Check(userCodes) > 0 {
+		h.redirectWithError(w, r, "Too many invalid device codes, please try again later")
+		return
+	}
+	deviceAuth, consentToken, err := h.deviceFlow.BeginConsent(userCode, user.ID)
+	if err != nil {
+		h.lockouts.Fail(lockout.CredentialUserCode, "", r.RemoteAddr, lockout.IP(r.RemoteAddr), userCodes)
+		h.redirectWithError(w, r, "Invalid or expired device code")
+		return
+	}
+
+	h.showConsentPage(w, deviceAuth, consentToken, user.Name, "")
+}
+
+// handleConsentForm processes the approve or deny decision on the consent page
+func (h *DeviceHandlers) handleConsentForm(w http.ResponseWriter, r *http.Request) {
+	userCode := normalizeUserCode(r.FormValue("user_code"))
+	consentToken := r.FormValue("consent_token")
+
+	userID, ok := h.deviceFlow.ConsentUser(userCode, consentToken)
+	if !ok {
+		h.redirectWithError(w, r, "Invalid or expired device code")
+		return
+	}
+
+	userName := userID
+	if user, found := h.users.GetUser(userID); found {
+		userName = user.Name
+	}
+
+	if r.FormValue("decision") != "approve" {
+		if !h.deviceFlow.DenyDevice(userCode, userID) {
+			h.redirectWithError(w, r, "Invalid or expired device code")
+			return
+		}
+		h.showDeniedPage(w, userName)
+		log.Printf("🚫 Device authorization denied by user: %s", userID)
+		return
+	}
+
+	grantedScopes := r.Form["scope"]
+	if len(grantedScopes) == 0 {
+		deviceAuth, consentToken, err := h.deviceFlow.BeginConsent(userCode, userID)
+		if err != nil {
+			h.redirectWithError(w, r, "Invalid or expired device code")
+			return
+		}
+		h.showConsentPage(w, deviceAuth, consentToken, userName, "Select at least one permission, or deny the request")
+		return
+	}
+
+	if !h.deviceFlow.AuthorizeDevice(userCode, userID, grantedScopes) {
 		h.redirectWithError(w, r, "Invalid or expired device code")
 		return
 	}
 
 	// Show success page
-	h.showSuccessPage(w, user.Name)
-	log.Printf("✅ Device authorized for user: %s (%s)", user.Username, user.Name)
+	h.showSuccessPage(w, userName)
+	log.Printf("✅ Device authorized for user: %s (%s)", userID, userName)
 }
 
-// authenticateUser validates user credentials against the configured users
-func (h *DeviceHandlers) authenticateUser(username, password string) *config.User {
-	// Look up user in the configuration
-	if user, found := h.config.GetUserByUsername(username); found {
-		// In a real implementation, you'd hash and compare passwords properly
-		if user.Password == password {
-			return user
+// showConsentPage displays the client and requested scopes so the user can approve or deny
+func (h *DeviceHandlers) showConsentPage(w http.ResponseWriter, deviceAuth *models.DeviceAuthorization, consentToken, userName, errorMsg string) {
+	tmpl := `
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>Authorize Device</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+        body { 
+            font-family: Arial, sans-serif; 
+            margin: 50px; 
+            background-color: #f5f5f5; 
+            line-height: 1.6;
+        }
+        .container { 
+            max-width: 500px; 
+            margin: 0 auto; 
+            background: white; 
+            padding: 30px; 
+            border-radius: 8px; 
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1); 
+        }
+        .client { 
+            display: flex; 
+            align-items: center; 
+            gap: 15px; 
+            margin-bottom: 20px; 
+        }
+        .client img { 
+            width: 64px; 
+            height: 64px; 
+            object-fit: contain; 
+            border-radius: 8px; 
+        }
+        .info { 
+            background-color: #d1ecf1; 
+            color: #0c5460; 
+            padding: 15px; 
+            border-radius: 4px; 
+            margin-bottom: 20px; 
+            border: 1px solid #bee5eb; 
+        }
+        .error { 
+            background-color: #f8d7da; 
+            color: #721c24; 
+            padding: 15px; 
+            border-radius: 4px; 
+            margin-bottom: 20px; 
+            border: 1px solid #f5c6cb; 
+        }
+        .scopes { 
+            background-color: #f8f9fa; 
+            padding: 15px; 
+            border-radius: 4px; 
+            margin-bottom: 20px; 
+        }
+        .scopes label { 
+            display: block; 
+            margin-bottom: 8px; 
+        }
+        .user-code { 
+            font-family: monospace; 
+            font-weight: bold; 
+            letter-spacing: 2px;
+        }
+        .btn { 
+            padding: 12px 24px; 
+            border: none; 
+            border-radius: 4px; 
+            cursor: pointer; 
+            font-size: 16px;
+            margin-right: 10px;
+            color: white; 
+        }
+        .btn-approve { 
+            background-color: #28a745; 
+        }
+        .btn-deny { 
+            background-color: #6c757d; 
+        }
+        .btn:hover { 
+            opacity: 0.8; 
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h2>📱 Authorize Device</h2>
+
+        <div class="client">
+            {{if .LogoURI}}<img src="{{.LogoURI}}" alt="{{.ClientName}} logo">{{end}}
+            <div>
+                <strong>{{.ClientName}}</strong><br>
+                <small>Client ID: {{.ClientID}}</small>
+            </div>
+        </div>
+
+        {{if .Error}}
+        <div class="error">❌ {{.Error}}</div>
+        {{end}}
+
+        <div class="info">
+            <strong>Hello, {{.UserName}}!</strong><br>
+            The device showing code <span class="user-code">{{.UserCode}}</span> is requesting access to your account.
+            Only approve if you started this request.
+        </div>
+
+        <form method="post" action="device">
+            <input type="hidden" name="action" value="consent">
+            <input type="hidden" name="user_code" value="{{.UserCode}}">
+            <input type="hidden" name="consent_token" value="{{.ConsentToken}}">
+
+            <div class="scopes">
+                <h4>Requested Permissions:</h4>
+                {{range .Scopes}}
+                <label>
+                    <input type="checkbox" name="scope" value="{{.Name}}" checked>
+                    <strong>{{.Name}}:</strong> {{.Description}}
+                </label>
+                {{end}}
+            </div>
+
+            <button type="submit" name="decision" value="approve" class="btn btn-approve">Approve</button>
+            <button type="submit" name="decision" value="deny" class="btn btn-deny">Deny</button>
+        </form>
+    </div>
+</body>
+</html>`
+
+	type scopeItem struct {
+		Name        string
+		Description string
+	}
+
+	var scopes []scopeItem
+	for _, scope := range deviceAuth.Scopes {
+		scopes = append(scopes, scopeItem{Name: scope, Description: utils.DescribeScope(scope)})
+	}
+
+	clientName := deviceAuth.ClientID
+	var logoURI string
+	if client, err := h.clientStore.GetClient(context.Background(), deviceAuth.ClientID); err == nil {
+		if c, ok := client.(*store.Client); ok {
+			if c.Name != "" {
+				clientName = c.Name
+			}
+			logoURI = c.LogoURI
 		}
 	}
-	return nil
+
+	data := struct {
+		ClientID     string
+		ClientName   string
+		LogoURI      string
+		UserName     string
+		UserCode     string
+		ConsentToken string
+		Scopes       []scopeItem
+		Error        string
+	}{
+		ClientID:     deviceAuth.ClientID,
+		ClientName:   clientName,
+		LogoURI:      logoURI,
+		UserName:     userName,
+		UserCode:     deviceAuth.UserCode,
+		ConsentToken: consentToken,
+		Scopes:       scopes,
+		Error:        errorMsg,
+	}
+
+	t, err := template.New("device-consent").Parse(tmpl)
+	if err != nil {
+		log.Printf("❌ Template parsing error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := t.Execute(w, data); err != nil {
+		log.Printf("❌ Template execution error: %v", err)
+	}
 }
 
 // redirectWithError redirects back to the form with an error message
 func (h *DeviceHandlers) redirectWithError(w http.ResponseWriter, r *http.Request, errorMsg string) {
-	userCode := r.FormValue("user_code")
-	redirectURL := fmt.Sprintf("/device?error=%s", errorMsg)
-	if userCode != "" {
-		redirectURL += fmt.Sprintf("&user_code=%s", userCode)
+	query := url.Values{}
+	query.Set("error", errorMsg)
+	if userCode := r.FormValue("user_code"); userCode != "" {
+		query.Set("user_code", userCode)
+	}
+	// A relative Location keeps realm path prefixes, which http.Redirect would resolve away
+	w.Header().Set("Location", "device?"+query.Encode())
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// normalizeUserCode uppercases a user code and restores the XXXX-XXXX format
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(userCode), " ", ""))
+	if len(userCode) == 8 && !strings.Contains(userCode, "-") {
+		userCode = fmt.Sprintf("%s-%s", userCode[:4], userCode[4:])
 	}
-	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+	return userCode
 }
 
 // showSuccessPage displays the success page after device authorization
@@ -390,16 +696,27 @@ func (h *DeviceHandlers) showSuccessPage(w http.ResponseWriter, userName string)
         
         <p>This window can be safely closed.</p>
         
-        <a href="/" class="btn">Return to Home</a>
+        <a href="./" class="btn">Return to Home</a>
     </div>
 </body>
-</html>`, userName)
+</html>`, template.HTMLEscapeString(userName))
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(successHTML))
 }
 
+// showDeniedPage displays the confirmation page after the user denied a device
+func (h *DeviceHandlers) showDeniedPage(w http.ResponseWriter, userName string) {
+	content := fmt.Sprintf(`
+        <h2 class="error">🚫 Request Denied</h2>
+        <p><strong>%s</strong>, the device has not been given access to your account.</p>
+        <p>This window can be safely closed.</p>
+        <p><a href="./">Return to Home</a></p>
+    `, template.HTMLEscapeString(userName))
+	utils.WriteHTMLResponse(w, http.StatusOK, content)
+}
+
 // HandleDeviceStatus returns the status of a device authorization (for AJAX polling)
 func (h *DeviceHandlers) HandleDeviceStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/http"
 
+	"oauth2-server/internal/admin"
 	"oauth2-server/internal/store"
+	"oauth2-server/internal/utils"
 	"oauth2-server/pkg/config"
 )
 
@@ -13,13 +15,15 @@ import (
 type DocsHandler struct {
 	config      *config.Config
 	clientStore *store.ClientStore
+	tokenStore  *store.TokenStore
 }
 
 // NewDocsHandler creates a new documentation handler
-func NewDocsHandler(cfg *config.Config, clientStore *store.ClientStore) *DocsHandler {
+func NewDocsHandler(cfg *config.Config, clientStore *store.ClientStore, tokenStore *store.TokenStore) *DocsHandler {
 	return &DocsHandler{
 		config:      cfg,
 		clientStore: clientStore,
+		tokenStore:  tokenStore,
 	}
 }
 
@@ -562,6 +566,11 @@ func (h *DocsHandler) generateDeviceFlowEndpoints() string {
 // generateClientMgmtEndpoints creates HTML for client management endpoints
 func (h *DocsHandler) generateClientMgmtEndpoints() string {
 	return `
+        <div class="form-group">
+            <label>Admin access token (scope ` + admin.Scope + `):</label>
+            <input id="admin-token" type="password" placeholder="Bearer token for the client management API">
+        </div>
+
         <div class="endpoint">
             <div class="endpoint-header">
                 <span class="method get">GET</span>
@@ -790,10 +799,16 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
         </div>
 
         <script>
-            // Client Management Functions
+            // Client Management Functions; the API requires an access token with the admin scope
+            function adminHeaders(headers = {}) {
+                const token = document.getElementById('admin-token').value.trim();
+                if (token) headers['Authorization'] = 'Bearer ' + token;
+                return headers;
+            }
+
             function listClients() {
                 showLoading('client-response');
-                fetch('/api/clients')
+                fetch('/api/clients', { headers: adminHeaders() })
                     .then(response => response.json())
                     .then(data => {
                         displayResponse('client-response', data, 'Client List Retrieved Successfully');
@@ -819,9 +834,7 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
                 showLoading('create-client-response');
                 fetch('/api/clients', {
                     method: 'POST',
-                    headers: {
-                        'Content-Type': 'application/json'
-                    },
+                    headers: adminHeaders({ 'Content-Type': 'application/json' }),
                     body: JSON.stringify(clientData)
                 })
                 .then(response => response.json())
@@ -839,7 +852,7 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
                 const clientId = formData.get('client_id');
                 
                 showLoading('get-client-response');
-                fetch('/api/clients/' + encodeURIComponent(clientId))
+                fetch('/api/clients/' + encodeURIComponent(clientId), { headers: adminHeaders() })
                     .then(response => {
                         if (response.status === 404) {
                             throw new Error('Client not found');
@@ -870,9 +883,7 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
                 showLoading('update-client-response');
                 fetch('/api/clients/' + encodeURIComponent(clientId), {
                     method: 'PUT',
-                    headers: {
-                        'Content-Type': 'application/json'
-                    },
+                    headers: adminHeaders({ 'Content-Type': 'application/json' }),
                     body: JSON.stringify(updateData)
                 })
                 .then(response => {
@@ -895,7 +906,8 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
                 
                 showLoading('delete-client-response');
                 fetch('/api/clients/' + encodeURIComponent(clientId), {
-                    method: 'DELETE'
+                    method: 'DELETE',
+                    headers: adminHeaders()
                 })
                 .then(response => {
                     if (response.status === 404) {
@@ -918,7 +930,7 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
                 const clientList = document.getElementById('client-list');
                 clientList.innerHTML = '<p>Loading clients...</p>';
                 
-                fetch('/api/clients')
+                fetch('/api/clients', { headers: adminHeaders() })
                     .then(response => response.json())
                     .then(clients => {
                         if (clients.length === 0) {
@@ -966,7 +978,7 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
                 updateForm.scrollIntoView({ behavior: 'smooth' });
                 
                 // Load current client data to pre-fill other fields
-                fetch('/api/clients/' + encodeURIComponent(clientId))
+                fetch('/api/clients/' + encodeURIComponent(clientId), { headers: adminHeaders() })
                     .then(response => response.json())
                     .then(client => {
                         updateForm.querySelector('input[name="name"]').value = client.name || '';
@@ -985,7 +997,8 @@ func (h *DocsHandler) generateClientMgmtEndpoints() string {
             function deleteClientFromCard(clientId) {
                 if (confirm('Are you sure you want to delete client "' + clientId + '"? This action cannot be undone.')) {
                     fetch('/api/clients/' + encodeURIComponent(clientId), {
-                        method: 'DELETE'
+                        method: 'DELETE',
+                        headers: adminHeaders()
                     })
                     .then(response => {
                         if (response.status === 204) {
@@ -1112,8 +1125,20 @@ func (h *DocsHandler) serveOpenAPISpec(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(spec)
 }
 
+// authenticate requires an access token with the admin scope, like the admin API
+func (h *DocsHandler) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := authenticateAdmin(w, r, h.tokenStore, func(status int, code, description string) {
+		http.Error(w, description, status)
+	})
+	return ok
+}
+
 // HandleClientsAPI handles the clients list API endpoint
 func (h *DocsHandler) HandleClientsAPI(w http.ResponseWriter, r *http.Request) {
+	if !h.authenticate(w, r) {
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		h.listClients(w, r)
@@ -1126,6 +1151,10 @@ func (h *DocsHandler) HandleClientsAPI(w http.ResponseWriter, r *http.Request) {
 
 // HandleClientAPI handles individual client API endpoints
 func (h *DocsHandler) HandleClientAPI(w http.ResponseWriter, r *http.Request) {
+	if !h.authenticate(w, r) {
+		return
+	}
+
 	clientID := r.URL.Path[13:] // Remove "/api/clients/" prefix
 
 	switch r.Method {
@@ -1159,6 +1188,12 @@ func (h *DocsHandler) listClients(w http.ResponseWriter, r *http.Request) {
 				"token_endpoint_auth_method": storeClient.TokenEndpointAuthMethod,
 				"public":                     storeClient.IsPublic(),
 				"enabled_flows":              storeClient.EnabledFlows,
+				"allow_impersonation":        storeClient.AllowImpersonation,
+				"may_act":                    storeClient.MayAct,
+				"token_exchange_policy":      storeClient.TokenExchangePolicy,
+				"jwks_uri":                   storeClient.JWKSURI,
+				"jwks":                       storeClient.JWKS,
+				"allowed_origins":            storeClient.AllowedOrigins,
 			}
 			clientList = append(clientList, clientInfo)
 		}
@@ -1189,6 +1224,12 @@ func (h *DocsHandler) getClient(w http.ResponseWriter, r *http.Request, clientID
 			"token_endpoint_auth_method": storeClient.TokenEndpointAuthMethod,
 			"public":                     storeClient.IsPublic(),
 			"enabled_flows":              storeClient.EnabledFlows,
+			"allow_impersonation":        storeClient.AllowImpersonation,
+			"may_act":                    storeClient.MayAct,
+			"token_exchange_policy":      storeClient.TokenExchangePolicy,
+			"jwks_uri":                   storeClient.JWKSURI,
+			"jwks":                       storeClient.JWKS,
+			"allowed_origins":            storeClient.AllowedOrigins,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -1263,6 +1304,15 @@ func (h *DocsHandler) createClient(w http.ResponseWriter, r *http.Request) {
 	if len(scopes) == 0 {
 		scopes = []string{"openid", "profile", "email"}
 	}
+	if utils.Contains(scopes, admin.Scope) {
+		http.Error(w, "The admin scope can only be granted in config.yaml or through the admin API", http.StatusBadRequest)
+		return
+	}
+
+	if field := operatorOnlyField(clientData); field != "" {
+		http.Error(w, fmt.Sprintf("%s can only be set in config.yaml or through the admin API", field), http.StatusBadRequest)
+		return
+	}
 
 	// Create the new client
 	newClient := &store.Client{
@@ -1282,8 +1332,7 @@ func (h *DocsHandler) createClient(w http.ResponseWriter, r *http.Request) {
 		newClient.TokenEndpointAuthMethod = "client_secret_basic"
 	}
 
-	err := h.clientStore.StoreClient(newClient)
-	if err != nil {
+	if err := h.clientStore.StoreClient(newClient); err != nil {
 		http.Error(w, "Failed to store client", http.StatusInternalServerError)
 		return
 	}
@@ -1302,6 +1351,12 @@ func (h *DocsHandler) createClient(w http.ResponseWriter, r *http.Request) {
 		"token_endpoint_auth_method": newClient.TokenEndpointAuthMethod,
 		"public":                     newClient.IsPublic(),
 		"enabled_flows":              newClient.EnabledFlows,
+		"allow_impersonation":        newClient.AllowImpersonation,
+		"may_act":                    newClient.MayAct,
+		"token_exchange_policy":      newClient.TokenExchangePolicy,
+		"jwks_uri":                   newClient.JWKSURI,
+		"jwks":                       newClient.JWKS,
+		"allowed_origins":            newClient.AllowedOrigins,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1324,6 +1379,11 @@ func (h *DocsHandler) updateClient(w http.ResponseWriter, r *http.Request, clien
 		return
 	}
 
+	if field := operatorOnlyField(updateData); field != "" {
+		http.Error(w, fmt.Sprintf("%s can only be set in config.yaml or through the admin API", field), http.StatusBadRequest)
+		return
+	}
+
 	// Get the existing client as our base
 	storeClient, ok := existingClient.(*store.Client)
 	if !ok {
@@ -1378,6 +1438,10 @@ func (h *DocsHandler) updateClient(w http.ResponseWriter, r *http.Request, clien
 				scopes = append(scopes, scopeStr)
 			}
 		}
+		if utils.Contains(scopes, admin.Scope) && !utils.Contains(storeClient.Scopes, admin.Scope) {
+			http.Error(w, "The admin scope can only be granted in config.yaml or through the admin API", http.StatusBadRequest)
+			return
+		}
 		storeClient.Scopes = scopes
 	}
 
@@ -1409,6 +1473,12 @@ func (h *DocsHandler) updateClient(w http.ResponseWriter, r *http.Request, clien
 		"token_endpoint_auth_method": storeClient.TokenEndpointAuthMethod,
 		"public":                     storeClient.IsPublic(),
 		"enabled_flows":              storeClient.EnabledFlows,
+		"allow_impersonation":        storeClient.AllowImpersonation,
+		"may_act":                    storeClient.MayAct,
+		"token_exchange_policy":      storeClient.TokenExchangePolicy,
+		"jwks_uri":                   storeClient.JWKSURI,
+		"jwks":                       storeClient.JWKS,
+		"allowed_origins":            storeClient.AllowedOrigins,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1440,3 +1510,17 @@ func getBoolValue(data map[string]interface{}, key string) bool {
 	}
 	return false
 }
+
+// operatorOnlyFields control delegation, assertion keys and browser access;
+// they are set in config.yaml or through the authenticated admin API
+var operatorOnlyFields = []string{"allow_impersonation", "may_act", "token_exchange_policy", "jwks_uri", "jwks", "allowed_origins"}
+
+// operatorOnlyField returns the first operator-only field present in data
+func operatorOnlyField(data map[string]interface{}) string {
+	for _, field := range operatorOnlyFields {
+		if _, ok := data[field]; ok {
+			return field
+		}
+	}
+	return ""
+}
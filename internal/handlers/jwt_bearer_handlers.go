@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/store"
+	"oauth2-server/internal/utils"
+)
+
+// JWTBearerGrantType is the grant type of JWT authorization grants (RFC 7523)
+const JWTBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// HandleJWTBearer exchanges a signed JWT assertion for an access token (RFC 7523 Section 2.1)
+func (h *TokenHandlers) HandleJWTBearer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		utils.WriteMethodNotAllowedError(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		utils.WriteInvalidRequestError(w, "Failed to parse request")
+		return
+	}
+
+	// Extract and validate client credentials
+	clientID, clientSecret, err := auth.ExtractClientCredentials(r)
+	if err != nil {
+		utils.WriteInvalidClientError(w, "Client authentication required")
+		return
+	}
+
+	if err := h.clientStore.ValidateClientCredentials(clientID, clientSecret, r.RemoteAddr); err != nil {
+		utils.WriteInvalidClientError(w, "Invalid client credentials")
+		return
+	}
+
+	fositeClient, err := h.clientStore.GetClient(r.Context(), clientID)
+	if err != nil {
+		utils.WriteInvalidClientError(w, "Invalid client")
+		return
+	}
+
+	client, ok := fositeClient.(*store.Client)
+	if !ok {
+		utils.WriteInvalidClientError(w, "Invalid client")
+		return
+	}
+
+	if !h.clientSupportsGrantType(client, JWTBearerGrantType) {
+		utils.WriteErrorResponse(w, "unauthorized_client", "Client not authorized for the jwt-bearer grant")
+		return
+	}
+
+	assertion := r.FormValue("assertion")
+	if assertion == "" {
+		utils.WriteInvalidRequestError(w, "assertion is required")
+		return
+	}
+
+	verified, err := h.bearerVerifier.Verify(assertion, client)
+	if err != nil {
+		denyJWTBearer(w, clientID, "", "invalid_grant", fmt.Sprintf("invalid assertion: %v", err))
+		return
+	}
+
+	// Map the assertion subject to a local identity
+	userID, reason := h.resolveAssertionSubject(client, verified)
+	if reason != "" {
+		denyJWTBearer(w, clientID, verified.Subject, "invalid_grant", reason)
+		return
+	}
+
+	// Scopes are limited to the client's scopes and, for federated assertions,
+	// to the scopes granted by the issuer's mapping rules
+	allowedScopes := client.GetScopes()
+	if verified.Federated {
+		allowedScopes = utils.FilterScopes(allowedScopes, verified.Scopes)
+	}
+
+	scopes, reason := determineJWTBearerScope(allowedScopes, r.FormValue("scope"))
+	if reason != "" {
+		denyJWTBearer(w, clientID, verified.Subject, "invalid_scope", reason)
+		return
+	}
+
+	accessToken, err := h.generateAccessToken()
+	if err != nil {
+		utils.WriteServerError(w, "Failed to generate access token")
+		return
+	}
+
+	accessTokenLifetime := h.config.Security.AccessTokenLifetime()
+	if err := h.tokenStore.StoreAccessToken(accessToken, clientID, userID, scopes, time.Now().Add(accessTokenLifetime)); err != nil {
+		utils.WriteServerError(w, "Failed to store access token")
+		return
+	}
+
+	audit.Log(audit.Event{
+		Type:     "jwt_bearer",
+		Outcome:  audit.OutcomeSuccess,
+		ClientID: clientID,
+		Subject:  verified.Subject,
+		Details: map[string]interface{}{
+			"assertion_issuer": verified.Issuer,
+			"scope":            strings.Join(scopes, " "),
+		},
+	})
+
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenLifetime.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(response)
+
+	log.Printf("✅ JWT bearer token issued for client %s (subject %s, issuer %s)", clientID, verified.Subject, verified.Issuer)
+}
+
+// resolveAssertionSubject maps the assertion subject to the user ID stored with the
+// token. Federated subjects are namespaced by their issuer so they never match a
+// local user; subjects of client assertions must be the client itself (a service
+// identity) or a user listed in the client's jwt_bearer_subjects.
+func (h *TokenHandlers) resolveAssertionSubject(client *store.Client, assertion *auth.BearerAssertion) (string, string) {
+	if assertion.Federated {
+		return auth.FederatedSubject(assertion.Issuer, assertion.Subject), ""
+	}
+
+	if assertion.Subject == client.ID {
+		return "", ""
+	}
+
+	user, found := h.users.FindUser(assertion.Subject)
+	if !found {
+		return "", fmt.Sprintf("assertion subject %s is not a known user", assertion.Subject)
+	}
+	if !utils.Contains(client.JWTBearerSubjects, user.ID) && !utils.Contains(client.JWTBearerSubjects, user.Username) {
+		return "", fmt.Sprintf("client %s may not assert user %s (jwt_bearer_subjects)", client.ID, assertion.Subject)
+	}
+	if !user.Enabled {
+		return "", fmt.Sprintf("user %s is disabled", assertion.Subject)
+	}
+	return user.ID, ""
+}
+
+// determineJWTBearerScope grants the requested scopes, or all allowed scopes when
+// none are requested; otherwise the reason for the denial is returned
+func determineJWTBearerScope(allowedScopes []string, requestedScope string) ([]string, string) {
+	if requestedScope == "" {
+		if len(allowedScopes) == 0 {
+			return nil, "no scopes are allowed for this assertion"
+		}
+		return allowedScopes, ""
+	}
+
+	requestedScopes := strings.Fields(requestedScope)
+	for _, scope := range requestedScopes {
+		if !utils.Contains(allowedScopes, scope) {
+			return nil, fmt.Sprintf("scope %s is not allowed for this assertion", scope)
+		}
+	}
+	return requestedScopes, ""
+}
+
+// denyJWTBearer rejects a JWT bearer request, recording the reason in the audit log
+func denyJWTBearer(w http.ResponseWriter, clientID, subject, errorCode, reason string) {
+	log.Printf("🚫 JWT bearer grant denied for client %s: %s", clientID, reason)
+	audit.Log(audit.Event{
+		Type:     "jwt_bearer",
+		Outcome:  audit.OutcomeDenied,
+		ClientID: clientID,
+		Subject:  subject,
+		Reason:   reason,
+	})
+	utils.WriteErrorResponse(w, errorCode, reason)
+}
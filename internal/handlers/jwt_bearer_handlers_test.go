@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newJWTBearerTestHandlers sets up the client "robot", which signs its own
+// assertions and may assert the user alice but not bob. It returns the
+// handlers, the token store and the keys of the client.
+func newJWTBearerTestHandlers(t *testing.T) (*TokenHandlers, *store.TokenStore, *auth.KeyManager) {
+	t.Helper()
+	keys, err := auth.NewKeyManager("robot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(keys.JWKS())
+
+	backend := store.NewMemoryBackend()
+	clients := store.NewClientStore(backend.Clients())
+	robot := &store.Client{
+		ID:                "robot",
+		Secret:            []byte("robot"),
+		GrantTypes:        []string{JWTBearerGrantType},
+		Scopes:            []string{"api"},
+		JWKS:              string(jwks),
+		JWTBearerSubjects: []string{"alice"},
+	}
+	if err := clients.StoreClient(robot); err != nil {
+		t.Fatal(err)
+	}
+
+	users := store.NewUserStore(backend.Users())
+	for _, user := range []*store.User{
+		{ID: "user-alice", Username: "alice", Enabled: true},
+		{ID: "user-bob", Username: "bob", Enabled: true},
+	} {
+		if err := users.SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trusted, err := auth.NewTrustedIssuers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.Server.BaseURL = "http://localhost:8080"
+	tokens := store.NewTokenStore(backend.Tokens())
+	return NewTokenHandlers(clients, tokens, users, nil, trusted, nil, cfg), tokens, keys
+}
+
+// signAssertion signs an assertion of robot for alice, addressed to the token
+// endpoint and valid for 5 minutes, with the claims replaced by changes
+func signAssertion(t *testing.T, keys *auth.KeyManager, jti string, changes jwt.MapClaims) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"sub": "alice",
+		"aud": "http://localhost:8080/token",
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+		"jti": jti,
+	}
+	for name, value := range changes {
+		claims[name] = value
+	}
+	assertion, err := keys.SignClaims(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestHandleJWTBearer(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes jwt.MapClaims
+		// replayed presents the assertion a second time
+		replayed  bool
+		wantUser  string
+		wantError string
+	}{
+		{name: "assertion for a listed user", wantUser: "user-alice"},
+		{name: "assertion for the client itself", changes: jwt.MapClaims{"sub": "robot"}},
+		{name: "replayed jti", replayed: true, wantError: "invalid_grant"},
+		{name: "wrong audience", changes: jwt.MapClaims{"aud": "https://other.example.com/token"}, wantError: "invalid_grant"},
+		{name: "expired assertion", changes: jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, wantError: "invalid_grant"},
+		{name: "user not in jwt_bearer_subjects", changes: jwt.MapClaims{"sub": "bob"}, wantError: "invalid_grant"},
+		{name: "unknown user", changes: jwt.MapClaims{"sub": "mallory"}, wantError: "invalid_grant"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, tokens, keys := newJWTBearerTestHandlers(t)
+			form := url.Values{
+				"grant_type": {JWTBearerGrantType},
+				"assertion":  {signAssertion(t, keys, "jti-1", tt.changes)},
+			}
+
+			status, response := clientRequest(t, h.HandleJWTBearer, "robot", form)
+			if tt.replayed {
+				if status != http.StatusOK {
+					t.Fatalf("first use = %d %v, want a token", status, response)
+				}
+				status, response = clientRequest(t, h.HandleJWTBearer, "robot", form)
+			}
+
+			if tt.wantError != "" {
+				if status != http.StatusBadRequest || response["error"] != tt.wantError || response["access_token"] != nil {
+					t.Errorf("response = %d %v, want %s", status, response, tt.wantError)
+				}
+				return
+			}
+			if status != http.StatusOK {
+				t.Fatalf("response = %d %v, want a token", status, response)
+			}
+			token, err := tokens.ValidateAccessToken(response["access_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.ClientID != "robot" || token.UserID != tt.wantUser || response["scope"] != "api" {
+				t.Errorf("token = %+v, scope %v, want a token of robot for %q with scope api", token, response["scope"], tt.wantUser)
+			}
+		})
+	}
+}
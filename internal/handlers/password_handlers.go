@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/utils"
+)
+
+// PasswordGrantType is the resource owner password credentials grant (RFC 6749 Section 4.3).
+// It is only available to clients that list it in their grant types.
+const PasswordGrantType = "password"
+
+// HandlePassword issues tokens for a username and password presented by a legacy client
+func (h *TokenHandlers) HandlePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		utils.WriteMethodNotAllowedError(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		utils.WriteInvalidRequestError(w, "Failed to parse request")
+		return
+	}
+
+	// Extract and validate client credentials
+	clientID, clientSecret, err := auth.ExtractClientCredentials(r)
+	if err != nil {
+		utils.WriteInvalidClientError(w, "Client authentication required")
+		return
+	}
+
+	client, err := h.clientStore.GetClient(r.Context(), clientID)
+	if err != nil {
+		utils.WriteInvalidClientError(w, "Invalid client")
+		return
+	}
+
+	if err := h.clientStore.ValidateClientCredentials(clientID, clientSecret, r.RemoteAddr); err != nil {
+		utils.WriteInvalidClientError(w, "Invalid client credentials")
+		return
+	}
+
+	// The password grant is opt-in per client
+	if !h.clientSupportsGrantType(client, PasswordGrantType) {
+		utils.WriteErrorResponse(w, "unauthorized_client", "Client not authorized for the password grant")
+		return
+	}
+
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	if username == "" || password == "" {
+		utils.WriteInvalidRequestError(w, "username and password are required")
+		return
+	}
+
+	requestedScope := r.FormValue("scope")
+	if requestedScope == "" {
+		requestedScope = strings.Join(client.GetScopes(), " ")
+	}
+
+	if !h.validateClientScope(client, requestedScope) {
+		utils.WriteInvalidScopeError(w, "Requested scope exceeds client permissions")
+		return
+	}
+
+	user, err := h.userAuth.Authenticate(auth.LoginAttempt{
+		Username:   username,
+		Password:   password,
+		Method:     auth.LoginMethodPasswordGrant,
+		ClientID:   clientID,
+		RemoteAddr: r.RemoteAddr,
+	})
+	if errors.Is(err, auth.ErrAccountLocked) {
+		utils.WriteInvalidGrantError(w, "Too many failed login attempts, please try again later")
+		return
+	}
+	if errors.Is(err, auth.ErrAuthenticationUnavailable) {
+		utils.WriteServerError(w, "Authentication is temporarily unavailable")
+		return
+	}
+	if errors.Is(err, auth.ErrMFARequired) {
+		utils.WriteInvalidGrantError(w, "Multi-factor authentication is required, log in through the browser")
+		return
+	}
+	if err != nil {
+		utils.WriteInvalidGrantError(w, "Invalid username or password")
+		return
+	}
+
+	accessToken, err := h.generateAccessToken()
+	if err != nil {
+		utils.WriteServerError(w, "Failed to generate access token")
+		return
+	}
+
+	scopes := strings.Fields(requestedScope)
+	accessTokenLifetime := h.config.Security.AccessTokenLifetime()
+	if err := h.tokenStore.StoreAccessToken(accessToken, clientID, user.ID, scopes, time.Now().Add(accessTokenLifetime)); err != nil {
+		utils.WriteServerError(w, "Failed to store access token")
+		return
+	}
+
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenLifetime.Seconds()),
+		"scope":        requestedScope,
+	}
+
+	// Issue a refresh token when the client may use it
+	if h.clientSupportsGrantType(client, "refresh_token") {
+		refreshToken, err := h.generateRefreshToken()
+		if err != nil {
+			log.Printf("Failed to generate refresh token: %v", err)
+		} else {
+			refreshExpiresAt := time.Now().Add(h.config.Security.RefreshTokenLifetime())
+			h.tokenStore.StoreRefreshToken(refreshToken, clientID, user.ID, scopes, refreshExpiresAt)
+			response["refresh_token"] = refreshToken
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(response)
+
+	log.Printf("✅ Password grant token issued for user %s via client %s", user.Username, clientID)
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/lockout"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// newPasswordTestHandlers sets up the client "legacy", which enables the
+// password grant, the client "modern", which does not, and the users alice,
+// bob and carol; bob has a second factor. Accounts lock after 3 wrong passwords.
+func newPasswordTestHandlers(t *testing.T) *TokenHandlers {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Security.MaxLoginAttempts = 3
+	cfg.Security.FailureDelaySeconds = -1
+
+	backend := store.NewMemoryBackend()
+	clients := store.NewClientStore(backend.Clients())
+	for _, client := range []*store.Client{
+		{ID: "legacy", Secret: []byte("legacy"), GrantTypes: []string{PasswordGrantType, "refresh_token"}, Scopes: []string{"openid", "api"}},
+		{ID: "modern", Secret: []byte("modern"), GrantTypes: []string{"client_credentials"}, Scopes: []string{"openid", "api"}},
+	} {
+		if err := clients.StoreClient(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := store.NewUserStore(backend.Users())
+	for _, user := range []*store.User{
+		{ID: "user-alice", Username: "alice", Enabled: true},
+		{ID: "user-bob", Username: "bob", Enabled: true, MFA: &store.MFA{TOTPSecret: "JBSWY3DPEHPK3PXP"}},
+		{ID: "user-carol", Username: "carol", Enabled: true},
+	} {
+		if err := user.SetPassword(user.Username + "-secret"); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	authenticators := []auth.Authenticator{auth.NewStoreAuthenticator("local", users)}
+	userAuth := auth.NewUserAuthenticator(users, authenticators, lockout.NewTracker(cfg), backend.Requests(), cfg)
+	return NewTokenHandlers(clients, store.NewTokenStore(backend.Tokens()), users, nil, nil, userAuth, cfg)
+}
+
+// passwordRequest posts a password grant for client and returns the status
+// and the decoded response
+func passwordRequest(t *testing.T, h *TokenHandlers, client string, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	form.Set("grant_type", PasswordGrantType)
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(client, client)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.HandlePassword(w, r)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response is not JSON: %s", w.Body.String())
+	}
+	return w.Code, response
+}
+
+func TestHandlePassword(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    string
+		form      url.Values
+		wantError string
+		// wantDescription is part of the error description
+		wantDescription string
+		wantScope       string
+	}{
+		{
+			name:      "client without the grant",
+			client:    "modern",
+			form:      url.Values{"username": {"alice"}, "password": {"alice-secret"}},
+			wantError: "unauthorized_client",
+		},
+		{
+			name:      "wrong password",
+			client:    "legacy",
+			form:      url.Values{"username": {"alice"}, "password": {"wrong"}},
+			wantError: "invalid_grant",
+		},
+		{
+			name:            "user with a second factor",
+			client:          "legacy",
+			form:            url.Values{"username": {"bob"}, "password": {"bob-secret"}},
+			wantError:       "invalid_grant",
+			wantDescription: "Multi-factor authentication is required",
+		},
+		{
+			name:      "scope beyond the client",
+			client:    "legacy",
+			form:      url.Values{"username": {"alice"}, "password": {"alice-secret"}, "scope": {"admin"}},
+			wantError: "invalid_scope",
+		},
+		{
+			name:      "tokens for the scopes of the client",
+			client:    "legacy",
+			form:      url.Values{"username": {"alice"}, "password": {"alice-secret"}},
+			wantScope: "openid api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newPasswordTestHandlers(t)
+			status, response := passwordRequest(t, h, tt.client, tt.form)
+			if tt.wantError != "" {
+				description, _ := response["error_description"].(string)
+				if response["error"] != tt.wantError || !strings.Contains(description, tt.wantDescription) {
+					t.Fatalf("response = %v, want error %s", response, tt.wantError)
+				}
+				return
+			}
+			if status != http.StatusOK {
+				t.Fatalf("password grant answered %d: %v", status, response)
+			}
+			if response["scope"] != tt.wantScope {
+				t.Errorf("scope = %v, want %q", response["scope"], tt.wantScope)
+			}
+			if response["refresh_token"] == nil {
+				t.Error("no refresh token for a client with the refresh_token grant")
+			}
+		})
+	}
+}
+
+func TestHandlePasswordLocksTheAccount(t *testing.T) {
+	h := newPasswordTestHandlers(t)
+
+	for i := 0; i < 3; i++ {
+		passwordRequest(t, h, "legacy", url.Values{"username": {"alice"}, "password": {"wrong"}})
+	}
+
+	// The right password is refused too while the account is locked
+	_, response := passwordRequest(t, h, "legacy", url.Values{"username": {"alice"}, "password": {"alice-secret"}})
+	description, _ := response["error_description"].(string)
+	if response["error"] != "invalid_grant" || !strings.Contains(description, "Too many failed login attempts") {
+		t.Fatalf("response = %v, want the account to be locked", response)
+	}
+
+	// Other accounts are not affected
+	if status, response := passwordRequest(t, h, "legacy", url.Values{"username": {"carol"}, "password": {"carol-secret"}}); status != http.StatusOK {
+		t.Errorf("other account answered %d: %v", status, response)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"oauth2-server/internal/admin"
 	"oauth2-server/internal/models"
 	"oauth2-server/internal/store"
 	"oauth2-server/internal/utils"
@@ -71,12 +72,34 @@ func (h *RegistrationHandlers) HandleRegistration(w http.ResponseWriter, r *http
 		scopes = []string{"openid", "profile", "email"}
 	}
 
+	// The admin scope is only granted to clients an operator configured
+	if utils.Contains(scopes, admin.Scope) {
+		utils.WriteErrorResponse(w, "invalid_client_metadata", "The admin scope cannot be requested through dynamic registration")
+		return
+	}
+
 	// Set default grant types if not provided
 	grantTypes := req.GrantTypes
 	if len(grantTypes) == 0 {
 		grantTypes = []string{"authorization_code"}
 	}
 
+	// The password grant must be enabled by an operator, not by self-registration
+	if utils.Contains(grantTypes, PasswordGrantType) {
+		utils.WriteErrorResponse(w, "invalid_client_metadata", "The password grant cannot be requested through dynamic registration")
+		return
+	}
+
+	// So must the jwt-bearer grant and the keys its assertions are verified with
+	if utils.Contains(grantTypes, JWTBearerGrantType) {
+		utils.WriteErrorResponse(w, "invalid_client_metadata", "The jwt-bearer grant cannot be requested through dynamic registration")
+		return
+	}
+	if req.Jwks != "" || req.JwksURI != "" {
+		utils.WriteErrorResponse(w, "invalid_client_metadata", "jwks and jwks_uri cannot be set through dynamic registration")
+		return
+	}
+
 	// Set default response types if not provided
 	responseTypes := req.ResponseTypes
 	if len(responseTypes) == 0 {
@@ -100,6 +123,7 @@ func (h *RegistrationHandlers) HandleRegistration(w http.ResponseWriter, r *http
 	clientInfo := models.ClientInfo{
 		ID:            clientID,
 		Secret:        clientSecret,
+		Name:          req.ClientName,
 		RedirectURIs:  req.RedirectURIs,
 		GrantTypes:    grantTypes,
 		ResponseTypes: responseTypes,
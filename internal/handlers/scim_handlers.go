@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"oauth2-server/internal/admin"
+	"oauth2-server/internal/scim"
+	"oauth2-server/internal/store"
+)
+
+// maxSCIMBody limits the size of SCIM request bodies
+const maxSCIMBody = 1 << 20
+
+// SCIMHandlers serves SCIM 2.0 provisioning under /scim/v2/. Like the admin
+// API, every request except discovery needs a bearer token with the admin scope.
+type SCIMHandlers struct {
+	service    *scim.Service
+	tokenStore *store.TokenStore
+	baseURL    string
+}
+
+// NewSCIMHandlers creates the SCIM handlers
+func NewSCIMHandlers(service *scim.Service, tokenStore *store.TokenStore, baseURL string) *SCIMHandlers {
+	return &SCIMHandlers{
+		service:    service,
+		tokenStore: tokenStore,
+		baseURL:    baseURL,
+	}
+}
+
+// HandleSCIM routes a SCIM request:
+//
+//	GET    /scim/v2/ServiceProviderConfig  supported features
+//	GET    /scim/v2/ResourceTypes          Users and Groups
+//	GET    /scim/v2/Users                  list users (filter, startIndex, count)
+//	POST   /scim/v2/Users                  provision a user
+//	GET    /scim/v2/Users/{id}             show a user
+//	PUT    /scim/v2/Users/{id}             replace a user
+//	PATCH  /scim/v2/Users/{id}             change a user, e.g. active=false
+//	DELETE /scim/v2/Users/{id}             deprovision a user and revoke its tokens
+//	...    /scim/v2/Groups[/{id}]          the same for groups
+func (h *SCIMHandlers) HandleSCIM(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/scim/v2"), "/"), "/")
+
+	if r.Method == http.MethodGet && len(parts) == 1 {
+		switch parts[0] {
+		case "ServiceProviderConfig":
+			writeSCIM(w, http.StatusOK, h.serviceProviderConfig())
+			return
+		case "ResourceTypes":
+			writeSCIM(w, http.StatusOK, h.resourceTypes())
+			return
+		}
+	}
+
+	actor, ok := authenticateAdmin(w, r, h.tokenStore, func(status int, code, description string) {
+		writeSCIM(w, status, &scim.Error{Status: status, Detail: description})
+	})
+	if !ok {
+		return
+	}
+	ctx := admin.WithActor(r.Context(), actor)
+	ifMatch := r.Header.Get("If-Match")
+
+	var (
+		result interface{}
+		err    error
+	)
+	status := http.StatusOK
+	route := r.Method + " " + parts[0]
+	switch {
+	case route == "GET Users" && len(parts) == 1:
+		query, ok := parseSCIMQuery(w, r)
+		if !ok {
+			return
+		}
+		result, err = h.service.ListUsers(ctx, query)
+	case route == "POST Users" && len(parts) == 1:
+		var user scim.User
+		if !decodeSCIMRequest(w, r, &user) {
+			return
+		}
+		result, err = h.service.CreateUser(ctx, user)
+		status = http.StatusCreated
+	case route == "GET Users" && len(parts) == 2:
+		result, err = h.service.GetUser(ctx, parts[1])
+	case route == "PUT Users" && len(parts) == 2:
+		var user scim.User
+		if !decodeSCIMRequest(w, r, &user) {
+			return
+		}
+		result, err = h.service.ReplaceUser(ctx, parts[1], user, ifMatch)
+	case route == "PATCH Users" && len(parts) == 2:
+		var patch scim.PatchRequest
+		if !decodeSCIMRequest(w, r, &patch) {
+			return
+		}
+		result, err = h.service.PatchUser(ctx, parts[1], patch, ifMatch)
+	case route == "DELETE Users" && len(parts) == 2:
+		err = h.service.DeleteUser(ctx, parts[1], ifMatch)
+		status = http.StatusNoContent
+	case route == "GET Groups" && len(parts) == 1:
+		query, ok := parseSCIMQuery(w, r)
+		if !ok {
+			return
+		}
+		result, err = h.service.ListGroups(ctx, query)
+	case route == "POST Groups" && len(parts) == 1:
+		var group scim.Group
+		if !decodeSCIMRequest(w, r, &group) {
+			return
+		}
+		result, err = h.service.CreateGroup(ctx, group)
+		status = http.StatusCreated
+	case route == "GET Groups" && len(parts) == 2:
+		result, err = h.service.GetGroup(ctx, parts[1])
+	case route == "PUT Groups" && len(parts) == 2:
+		var group scim.Group
+		if !decodeSCIMRequest(w, r, &group) {
+			return
+		}
+		result, err = h.service.ReplaceGroup(ctx, parts[1], group, ifMatch)
+	case route == "PATCH Groups" && len(parts) == 2:
+		var patch scim.PatchRequest
+		if !decodeSCIMRequest(w, r, &patch) {
+			return
+		}
+		result, err = h.service.PatchGroup(ctx, parts[1], patch, ifMatch)
+	case route == "DELETE Groups" && len(parts) == 2:
+		err = h.service.DeleteGroup(ctx, parts[1], ifMatch)
+		status = http.StatusNoContent
+	default:
+		writeSCIM(w, http.StatusNotFound, &scim.Error{Status: http.StatusNotFound, Detail: "unknown SCIM endpoint " + r.Method + " " + r.URL.Path})
+		return
+	}
+
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+
+	// Versioned resources carry an ETag; GET honours If-None-Match
+	var meta *scim.Meta
+	switch v := result.(type) {
+	case *scim.User:
+		meta = v.Meta
+	case *scim.Group:
+		meta = v.Meta
+	}
+	if meta != nil {
+		w.Header().Set("ETag", meta.Version)
+		if status == http.StatusCreated {
+			w.Header().Set("Location", meta.Location)
+		}
+		if r.Method == http.MethodGet && r.Header.Get("If-None-Match") == meta.Version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	writeSCIM(w, status, result)
+}
+
+// serviceProviderConfig describes the supported SCIM features
+func (h *SCIMHandlers) serviceProviderConfig() map[string]interface{} {
+	supported := func(ok bool) map[string]interface{} { return map[string]interface{}{"supported": ok} }
+	return map[string]interface{}{
+		"schemas":          []string{scim.SchemaServiceProviderConfig},
+		"documentationUri": h.baseURL + "/docs",
+		"patch":            supported(true),
+		"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]interface{}{"supported": true, "maxResults": scim.MaxCount},
+		"changePassword":   supported(true),
+		"sort":             supported(false),
+		"etag":             supported(true),
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": fmt.Sprintf("Access token with the %s scope, e.g. from the client credentials grant", admin.Scope),
+			"primary":     true,
+		}},
+	}
+}
+
+// resourceTypes lists the provisioned resource types
+func (h *SCIMHandlers) resourceTypes() *scim.ListResponse {
+	resourceType := func(name, endpoint, schema string) map[string]interface{} {
+		return map[string]interface{}{
+			"schemas":  []string{scim.SchemaResourceType},
+			"id":       name,
+			"name":     name,
+			"endpoint": endpoint,
+			"schema":   schema,
+			"meta": map[string]interface{}{
+				"resourceType": "ResourceType",
+				"location":     h.baseURL + "/scim/v2/ResourceTypes/" + name,
+			},
+		}
+	}
+	resources := []interface{}{
+		resourceType("User", "/Users", scim.SchemaUser),
+		resourceType("Group", "/Groups", scim.SchemaGroup),
+	}
+	return &scim.ListResponse{
+		Schemas:      []string{scim.SchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// parseSCIMQuery reads filter, startIndex and count, writing the error response on failure
+func parseSCIMQuery(w http.ResponseWriter, r *http.Request) (scim.Query, bool) {
+	query := scim.Query{Filter: r.URL.Query().Get("filter"), StartIndex: 1, Count: scim.DefaultCount}
+	for name, target := range map[string]*int{"startIndex": &query.StartIndex, "count": &query.Count} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			writeSCIM(w, http.StatusBadRequest, &scim.Error{Status: http.StatusBadRequest, Type: "invalidValue", Detail: name + " must be an integer"})
+			return query, false
+		}
+		*target = n
+	}
+	return query, true
+}
+
+// decodeSCIMRequest decodes a JSON body, writing the error response on failure
+func decodeSCIMRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSCIMBody)).Decode(v); err != nil {
+		writeSCIM(w, http.StatusBadRequest, &scim.Error{Status: http.StatusBadRequest, Type: "invalidSyntax", Detail: "Invalid JSON body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// writeSCIMError writes a service error with its status code
+func writeSCIMError(w http.ResponseWriter, err error) {
+	var scimErr *scim.Error
+	if !errors.As(err, &scimErr) {
+		log.Printf("❌ SCIM error: %v", err)
+		scimErr = &scim.Error{Status: http.StatusInternalServerError, Detail: err.Error()}
+	}
+	writeSCIM(w, scimErr.Status, scimErr)
+}
+
+// writeSCIM writes a SCIM JSON response
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scim.ContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
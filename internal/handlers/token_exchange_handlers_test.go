@@ -0,0 +1,507 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/models"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+const testCIIssuer = "https://ci.example.com"
+
+// newExchangeTestHandlers sets up clients and subject tokens for token
+// exchange on the memory backend. Clients authenticate with their ID as
+// secret. It returns the handlers, the token store and the key manager of a
+// trusted CI issuer.
+func newExchangeTestHandlers(t *testing.T) (*TokenHandlers, *store.TokenStore, *auth.KeyManager) {
+	t.Helper()
+	backend := store.NewMemoryBackend()
+	clients := store.NewClientStore(backend.Clients())
+	tokens := store.NewTokenStore(backend.Tokens())
+	tokens.UseIssuer("http://localhost:8080")
+
+	for _, client := range []*store.Client{
+		{ID: "frontend", Scopes: []string{"openid", "profile", "api"}},
+		{ID: "mobile", Scopes: []string{"openid", "api"}, MayAct: []string{"robot"}},
+		{ID: "robot", Scopes: []string{"api"}},
+		{ID: "backend", Scopes: []string{"openid", "api"}, Audience: []string{"https://api.example.com"}},
+		{ID: "impersonator", Scopes: []string{"openid", "api"}, AllowImpersonation: true},
+		{ID: "gateway", Scopes: []string{"openid", "api"}, TokenExchangePolicy: &models.TokenExchangePolicy{
+			SourceClients: []string{"frontend"},
+			Audiences:     []string{"https://api.example.com"},
+			Scopes:        []string{"api"},
+			MaxChainDepth: 1,
+
+			MaxAccessTokenLifetime:  60,
+			MaxRefreshTokenLifetime: 600,
+		}},
+	} {
+		client.Secret = []byte(client.ID)
+		if err := clients.StoreClient(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	for _, token := range []*store.Token{
+		{Token: "alice-token", ClientID: "frontend", UserID: "alice", Scopes: []string{"openid", "profile", "api"}},
+		{Token: "mobile-token", ClientID: "mobile", UserID: "alice", Scopes: []string{"openid", "api"}},
+		{Token: "robot-token", ClientID: "robot", Scopes: []string{"api"}},
+		{Token: "delegated-token", ClientID: "frontend", UserID: "alice", Scopes: []string{"openid", "api"},
+			Act: &models.ActorClaim{Subject: "backend", ClientID: "backend"}},
+	} {
+		token.TokenType = "access"
+		token.ExpiresAt = expiresAt
+		if err := tokens.StoreToken(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ciConfig, ci := newTestIssuer(t, testCIIssuer, "ci:")
+	trusted, err := auth.NewTrustedIssuers([]config.TrustedIssuerConfig{ciConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := auth.NewKeyManager("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	handlers := NewTokenHandlers(clients, tokens, store.NewUserStore(backend.Users()), keys, trusted, nil, cfg)
+	return handlers, tokens, ci
+}
+
+// newTestIssuer returns the configuration of a trusted issuer that grants the
+// scope api to tokens for the audience oauth2-server, and its key manager
+func newTestIssuer(t *testing.T, issuer, subjectPrefix string) (config.TrustedIssuerConfig, *auth.KeyManager) {
+	t.Helper()
+	keys, err := auth.NewKeyManager(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(keys.JWKS())
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return config.TrustedIssuerConfig{
+		Issuer:        issuer,
+		JWKSFile:      jwksFile,
+		Audiences:     []string{"oauth2-server"},
+		SubjectPrefix: subjectPrefix,
+		Scopes:        []string{"api"},
+	}, keys
+}
+
+// signExternalToken signs a token of issuer keys for the audience oauth2-server
+func signExternalToken(t *testing.T, keys *auth.KeyManager, subject string) string {
+	t.Helper()
+	token, err := keys.SignClaims(jwt.MapClaims{
+		"sub": subject,
+		"aud": "oauth2-server",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenExchange(t *testing.T) {
+	h, tokens, ci := newExchangeTestHandlers(t)
+
+	untrusted, err := auth.NewKeyManager("https://untrusted.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client string
+		form   url.Values
+		// wantError is the expected error code; empty expects a token with
+		// wantScope and wantAct
+		wantError string
+		wantScope string
+		wantAct   *models.ActorClaim
+	}{
+		{
+			name:      "delegation records the client as actor",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"alice-token"}},
+			wantScope: "openid api",
+			wantAct:   &models.ActorClaim{Subject: "backend", ClientID: "backend"},
+		},
+		{
+			name:      "actor token becomes the current actor",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"alice-token"}, "actor_token": {"robot-token"}},
+			wantScope: "openid api",
+			wantAct:   &models.ActorClaim{Subject: "robot", ClientID: "robot"},
+		},
+		{
+			name:      "earlier actors are nested",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"delegated-token"}, "actor_token": {"robot-token"}},
+			wantScope: "openid api",
+			wantAct: &models.ActorClaim{Subject: "robot", ClientID: "robot",
+				Act: &models.ActorClaim{Subject: "backend", ClientID: "backend"}},
+		},
+		{
+			name:      "impersonation adds no actor",
+			client:    "impersonator",
+			form:      url.Values{"subject_token": {"alice-token"}},
+			wantScope: "openid api",
+		},
+		{
+			name:      "may_act refuses other actors",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"mobile-token"}},
+			wantError: "invalid_grant",
+		},
+		{
+			name:      "may_act permits the listed actor",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"mobile-token"}, "actor_token": {"robot-token"}},
+			wantScope: "openid api",
+			wantAct:   &models.ActorClaim{Subject: "robot", ClientID: "robot"},
+		},
+		{
+			name:      "scope beyond the subject token",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"robot-token"}, "scope": {"openid"}},
+			wantError: "invalid_scope",
+		},
+		{
+			name:      "scope not registered for the client",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"alice-token"}, "scope": {"openid profile"}},
+			wantError: "invalid_scope",
+		},
+		{
+			name:      "audience not registered for the client",
+			client:    "backend",
+			form:      url.Values{"subject_token": {"alice-token"}, "audience": {"https://other.example.com"}},
+			wantError: "invalid_target",
+		},
+		{
+			name:      "policy limits the default scope",
+			client:    "gateway",
+			form:      url.Values{"subject_token": {"alice-token"}, "audience": {"https://api.example.com"}},
+			wantScope: "api",
+			wantAct:   &models.ActorClaim{Subject: "gateway", ClientID: "gateway"},
+		},
+		{
+			name:      "policy refuses the source client",
+			client:    "gateway",
+			form:      url.Values{"subject_token": {"mobile-token"}},
+			wantError: "invalid_grant",
+		},
+		{
+			name:      "policy refuses the audience",
+			client:    "gateway",
+			form:      url.Values{"subject_token": {"alice-token"}, "audience": {"https://other.example.com"}},
+			wantError: "invalid_target",
+		},
+		{
+			name:      "policy refuses the scope",
+			client:    "gateway",
+			form:      url.Values{"subject_token": {"alice-token"}, "scope": {"openid"}},
+			wantError: "invalid_scope",
+		},
+		{
+			name:      "policy limits the chain depth",
+			client:    "gateway",
+			form:      url.Values{"subject_token": {"delegated-token"}},
+			wantError: "invalid_grant",
+		},
+		{
+			name:   "trusted issuer token is mapped to a local subject",
+			client: "backend",
+			form: url.Values{
+				"subject_token":      {signExternalToken(t, ci, "deploy")},
+				"subject_token_type": {models.TokenTypeJWT},
+			},
+			wantScope: "api",
+			wantAct:   &models.ActorClaim{Subject: "backend", ClientID: "backend"},
+		},
+		{
+			name:   "untrusted issuer token is refused",
+			client: "backend",
+			form: url.Values{
+				"subject_token":      {signExternalToken(t, untrusted, "deploy")},
+				"subject_token_type": {models.TokenTypeJWT},
+			},
+			wantError: "invalid_grant",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:token-exchange"}}
+			for key, values := range tt.form {
+				form[key] = values
+			}
+			if form.Get("subject_token_type") == "" {
+				form.Set("subject_token_type", models.TokenTypeAccessToken)
+			}
+			if form.Has("actor_token") {
+				form.Set("actor_token_type", models.TokenTypeAccessToken)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(tt.client, tt.client)
+			w := httptest.NewRecorder()
+			h.HandleTokenExchange(w, r)
+
+			var response map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("response is not JSON: %s", w.Body.String())
+			}
+			if tt.wantError != "" {
+				if response["error"] != tt.wantError {
+					t.Fatalf("response = %v, want error %s", response, tt.wantError)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("exchange answered %d: %v", w.Code, response)
+			}
+			if response["scope"] != tt.wantScope {
+				t.Errorf("scope = %v, want %q", response["scope"], tt.wantScope)
+			}
+
+			issued, err := tokens.GetToken(response["access_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(issued.Act, tt.wantAct) {
+				t.Errorf("act = %+v, want %+v", issued.Act, tt.wantAct)
+			}
+		})
+	}
+}
+
+// clientRequest posts form to a token endpoint handler as client and returns
+// the status and the decoded response
+func clientRequest(t *testing.T, handle http.HandlerFunc, client string, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(client, client)
+	w := httptest.NewRecorder()
+	handle(w, r)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response is not JSON: %s", w.Body.String())
+	}
+	return w.Code, response
+}
+
+func TestRefreshKeepsTheDelegationOfExchangedTokens(t *testing.T) {
+	h, _, _ := newExchangeTestHandlers(t)
+
+	status, exchanged := clientRequest(t, h.HandleTokenExchange, "backend", url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":        {"alice-token"},
+		"subject_token_type":   {models.TokenTypeAccessToken},
+		"requested_token_type": {models.TokenTypeRefreshToken},
+		"audience":             {"https://api.example.com"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("exchange answered %d: %v", status, exchanged)
+	}
+
+	status, refreshed := clientRequest(t, h.HandleRefreshToken, "backend", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {exchanged["access_token"].(string)},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("refresh answered %d: %v", status, refreshed)
+	}
+
+	for _, tokenType := range []string{"access_token", "refresh_token"} {
+		_, introspected := clientRequest(t, h.HandleTokenIntrospection, "backend", url.Values{
+			"token": {refreshed[tokenType].(string)},
+		})
+		if introspected["active"] != true || introspected["sub"] != "alice" {
+			t.Fatalf("refreshed %s = %v, want an active token of alice", tokenType, introspected)
+		}
+		wantAct := map[string]interface{}{"sub": "backend", "client_id": "backend"}
+		if !reflect.DeepEqual(introspected["act"], wantAct) {
+			t.Errorf("refreshed %s act = %v, want %v", tokenType, introspected["act"], wantAct)
+		}
+		if wantAud := []interface{}{"https://api.example.com"}; !reflect.DeepEqual(introspected["aud"], wantAud) {
+			t.Errorf("refreshed %s aud = %v, want %v", tokenType, introspected["aud"], wantAud)
+		}
+	}
+}
+
+// failingTokenStorage reads tokens but cannot save them
+type failingTokenStorage struct {
+	store.TokenStorage
+}
+
+func (failingTokenStorage) SaveToken(context.Context, *store.Token) error {
+	return errors.New("storage unavailable")
+}
+
+func TestTokenExchangeFailsWhenTheTokenIsNotStored(t *testing.T) {
+	h, _, _ := newExchangeTestHandlers(t)
+
+	storage := store.NewMemoryBackend().Tokens()
+	subject := &store.Token{Token: "alice-token", TokenType: "access", ClientID: "frontend", UserID: "alice",
+		Scopes: []string{"openid", "api"}, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := storage.SaveToken(context.Background(), subject); err != nil {
+		t.Fatal(err)
+	}
+	h.tokenStore = store.NewTokenStore(failingTokenStorage{storage})
+
+	for _, tokenType := range []string{models.TokenTypeAccessToken, models.TokenTypeRefreshToken, models.TokenTypeJWT} {
+		status, response := clientRequest(t, h.HandleTokenExchange, "backend", url.Values{
+			"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+			"subject_token":        {"alice-token"},
+			"subject_token_type":   {models.TokenTypeAccessToken},
+			"requested_token_type": {tokenType},
+		})
+		if status != http.StatusInternalServerError || response["error"] != "server_error" || response["access_token"] != nil {
+			t.Errorf("exchange for %s = %d %v, want a server_error without a token", tokenType, status, response)
+		}
+	}
+}
+
+func TestFederatedSubjectsDoNotMatchLocalUsers(t *testing.T) {
+	h, tokens, _ := newExchangeTestHandlers(t)
+
+	partnerConfig, partner := newTestIssuer(t, "https://partner.example.com", "")
+	ruleConfig, ruled := newTestIssuer(t, "https://rules.example.com", "")
+	ruleConfig.Rules = []config.ClaimMappingRule{{Claims: map[string]string{"sub": "*"}, Subject: "{sub}", Scopes: []string{"api"}}}
+	ciConfig, ci := newTestIssuer(t, testCIIssuer, "ci:")
+	trusted, err := auth.NewTrustedIssuers([]config.TrustedIssuerConfig{partnerConfig, ruleConfig, ciConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.trustedIssuers = trusted
+
+	tests := []struct {
+		name     string
+		keys     *auth.KeyManager
+		wantUser string
+	}{
+		{name: "unmapped subject is namespaced by its issuer", keys: partner, wantUser: "federated:https://partner.example.com#alice"},
+		{name: "subject prefix maps to a local subject", keys: ci, wantUser: "ci:alice"},
+		{name: "rule subject maps to a local subject", keys: ruled, wantUser: "alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// alice is also the ID of a local user with tokens
+			status, response := clientRequest(t, h.HandleTokenExchange, "backend", url.Values{
+				"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+				"subject_token":      {signExternalToken(t, tt.keys, "alice")},
+				"subject_token_type": {models.TokenTypeJWT},
+			})
+			if status != http.StatusOK {
+				t.Fatalf("exchange answered %d: %v", status, response)
+			}
+			issued, err := tokens.GetToken(response["access_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issued.UserID != tt.wantUser {
+				t.Errorf("user = %q, want %q", issued.UserID, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestRefreshAppliesTheExchangePolicyLifetimes(t *testing.T) {
+	tests := []struct {
+		name string
+		// remaining is how long the exchanged refresh token is still valid
+		remaining        time.Duration
+		wantAccessAtMost time.Duration
+	}{
+		{name: "policy caps the access token", remaining: 5 * time.Minute, wantAccessAtMost: time.Minute},
+		{name: "tokens never outlive the exchanged token", remaining: 30 * time.Second, wantAccessAtMost: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, tokens, _ := newExchangeTestHandlers(t)
+
+			status, exchanged := clientRequest(t, h.HandleTokenExchange, "gateway", url.Values{
+				"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+				"subject_token":        {"alice-token"},
+				"subject_token_type":   {models.TokenTypeAccessToken},
+				"requested_token_type": {models.TokenTypeRefreshToken},
+			})
+			if status != http.StatusOK || exchanged["expires_in"] != float64(600) {
+				t.Fatalf("exchange = %d %v, want a refresh token capped at 600s", status, exchanged)
+			}
+
+			original, err := tokens.GetToken(exchanged["access_token"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			original.ExpiresAt = time.Now().Add(tt.remaining)
+			if err := tokens.StoreToken(original); err != nil {
+				t.Fatal(err)
+			}
+
+			status, refreshed := clientRequest(t, h.HandleRefreshToken, "gateway", url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {original.Token},
+			})
+			if status != http.StatusOK {
+				t.Fatalf("refresh answered %d: %v", status, refreshed)
+			}
+			if expiresIn := time.Duration(refreshed["expires_in"].(float64)) * time.Second; expiresIn > tt.wantAccessAtMost {
+				t.Errorf("expires_in = %s, want at most %s", expiresIn, tt.wantAccessAtMost)
+			}
+
+			for _, tokenType := range []string{"access_token", "refresh_token"} {
+				issued, err := tokens.GetToken(refreshed[tokenType].(string))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if issued.ExpiresAt.After(original.ExpiresAt) {
+					t.Errorf("%s expires at %s, after the exchanged token at %s", tokenType, issued.ExpiresAt, original.ExpiresAt)
+				}
+			}
+
+			// The caps stay with the refresh token for the next refresh
+			renewed, _ := tokens.GetToken(refreshed["refresh_token"].(string))
+			if renewed.MaxAccessTokenLifetime != time.Minute || renewed.MaxRefreshTokenLifetime != 10*time.Minute {
+				t.Errorf("renewed caps = %s/%s, want the policy caps", renewed.MaxAccessTokenLifetime, renewed.MaxRefreshTokenLifetime)
+			}
+		})
+	}
+}
+
+func TestIntrospectionReportsTheRealmIssuer(t *testing.T) {
+	h, _, _ := newExchangeTestHandlers(t)
+
+	_, introspected := clientRequest(t, h.HandleTokenIntrospection, "frontend", url.Values{"token": {"alice-token"}})
+	if introspected["active"] != true || introspected["iss"] != "http://localhost:8080" {
+		t.Errorf("introspection = %v, want the issuer of the realm", introspected)
+	}
+}
@@ -19,20 +19,44 @@ import (
 
 // TokenHandlers handles token-related endpoints
 type TokenHandlers struct {
-	clientStore *store.ClientStore
-	tokenStore  *store.TokenStore
-	config      *config.Config
+	clientStore    *store.ClientStore
+	tokenStore     *store.TokenStore
+	users          *store.UserStore
+	keyManager     *auth.KeyManager
+	trustedIssuers *auth.TrustedIssuers
+	bearerVerifier *auth.JWTBearerVerifier
+	userAuth       *auth.UserAuthenticator
+	config         *config.Config
 }
 
 // NewTokenHandlers creates a new token handlers instance
-func NewTokenHandlers(clientStore *store.ClientStore, tokenStore *store.TokenStore, cfg *config.Config) *TokenHandlers {
+func NewTokenHandlers(clientStore *store.ClientStore, tokenStore *store.TokenStore, users *store.UserStore, keyManager *auth.KeyManager, trustedIssuers *auth.TrustedIssuers, userAuth *auth.UserAuthenticator, cfg *config.Config) *TokenHandlers {
 	return &TokenHandlers{
-		clientStore: clientStore,
-		tokenStore:  tokenStore,
-		config:      cfg,
+		clientStore:    clientStore,
+		tokenStore:     tokenStore,
+		users:          users,
+		keyManager:     keyManager,
+		trustedIssuers: trustedIssuers,
+		bearerVerifier: auth.NewJWTBearerVerifier(assertionAudiences(cfg), trustedIssuers),
+		userAuth:       userAuth,
+		config:         cfg,
 	}
 }
 
+// assertionAudiences returns the audiences identifying this server in JWT bearer
+// assertions: the issuer and token endpoint, including their public variants
+func assertionAudiences(cfg *config.Config) []string {
+	var audiences []string
+	for _, baseURL := range []string{cfg.Server.BaseURL, cfg.PublicBaseURL} {
+		if baseURL == "" {
+			continue
+		}
+		baseURL = strings.TrimSuffix(baseURL, "/")
+		audiences = append(audiences, baseURL, baseURL+"/token")
+	}
+	return audiences
+}
+
 // HandleTokenRevocation handles token revocation requests (RFC 7009)
 func (h *TokenHandlers) HandleTokenRevocation(w http.ResponseWriter, r *http.Request) {
 	log.Printf("🔄 Processing token revocation request")
@@ -64,7 +88,7 @@ func (h *TokenHandlers) HandleTokenRevocation(w http.ResponseWriter, r *http.Req
 	}
 
 	// Authenticate client
-	_, err = auth.AuthenticateClient(clientID, clientSecret, h.clientStore)
+	_, err = auth.AuthenticateClient(clientID, clientSecret, r.RemoteAddr, h.clientStore)
 	if err != nil {
 		log.Printf("❌ Client authentication failed for %s: %v", clientID, err)
 		utils.WriteErrorResponse(w, "invalid_client", "Client authentication failed")
@@ -142,7 +166,7 @@ func (h *TokenHandlers) HandleTokenIntrospection(w http.ResponseWriter, r *http.
 	}
 
 	// Authenticate client
-	_, err = auth.AuthenticateClient(clientID, clientSecret, h.clientStore)
+	_, err = auth.AuthenticateClient(clientID, clientSecret, r.RemoteAddr, h.clientStore)
 	if err != nil {
 		log.Printf("❌ Client authentication failed for %s: %v", clientID, err)
 		utils.WriteErrorResponse(w, "invalid_client", "Client authentication failed")
@@ -171,11 +195,18 @@ func (h *TokenHandlers) HandleTokenIntrospection(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// Tokens issued without a user have the client as their subject
+	subject := tokenInfo.UserID
+	if subject == "" {
+		subject = tokenInfo.ClientID
+	}
+
 	// Create introspection response
 	response := map[string]interface{}{
 		"active":     tokenInfo.Active,
 		"token_type": tokenInfo.TokenType,
 		"client_id":  tokenInfo.ClientID,
+		"sub":        subject,
 		"username":   tokenInfo.UserID,
 		"exp":        tokenInfo.ExpiresAt.Unix(),
 		"iat":        tokenInfo.IssuedAt.Unix(),
@@ -188,116 +219,14 @@ func (h *TokenHandlers) HandleTokenIntrospection(w http.ResponseWriter, r *http.
 		response["scope"] = strings.Join(tokenInfo.Scopes, " ")
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	log.Printf("✅ Token introspection completed for client: %s", clientID)
-}
-
-// handleTokenExchange processes token exchange requests (RFC 8693)
-func (h *TokenHandlers) HandleTokenExchange(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		utils.WriteMethodNotAllowedError(w)
-		return
-	}
-
-	if err := r.ParseForm(); err != nil {
-		utils.WriteInvalidRequestError(w, "Failed to parse request")
-		return
-	}
-
-	// Extract and validate client credentials
-	clientID, clientSecret, err := auth.ExtractClientCredentials(r)
-	if err != nil {
-		utils.WriteInvalidClientError(w, "Client authentication required")
-		return
-	}
-
-	// Authenticate client
-	if err := h.clientStore.ValidateClientCredentials(clientID, clientSecret); err != nil {
-		utils.WriteInvalidClientError(w, "Invalid client credentials")
-		return
-	}
-
-	// Validate required parameters
-	subjectToken := r.FormValue("subject_token")
-	subjectTokenType := r.FormValue("subject_token_type")
-	audience := r.FormValue("audience")
-
-	if subjectToken == "" {
-		utils.WriteInvalidRequestError(w, "subject_token is required")
-		return
-	}
-
-	if subjectTokenType == "" {
-		utils.WriteInvalidRequestError(w, "subject_token_type is required")
-		return
-	}
-
-	// Validate subject token type
-	if subjectTokenType != "urn:ietf:params:oauth:token-type:access_token" &&
-		subjectTokenType != "urn:ietf:params:oauth:token-type:refresh_token" &&
-		subjectTokenType != "urn:ietf:params:oauth:token-type:id_token" {
-		utils.WriteUnsupportedGrantTypeError(w, "Unsupported subject_token_type")
-		return
-	}
-
-	// Validate the subject token
-	tokenInfo, err := h.tokenStore.ValidateAccessToken(subjectToken)
-	if err != nil {
-		utils.WriteInvalidGrantError(w, "Invalid or expired subject_token")
-		return
-	}
-
-	// Optional: Validate audience if provided
-	if audience != "" && !h.validateAudience(clientID, audience) {
-		utils.WriteInvalidRequestError(w, "Invalid audience")
-		return
-	}
-
-	// Generate new access token
-	newAccessToken, err := h.generateAccessToken()
-	if err != nil {
-		utils.WriteServerError(w, "Failed to generate access token")
-		return
-	}
-
-	// Determine the scope for the new token
-	requestedScope := r.FormValue("scope")
-	// Fix: Use tokenInfo.Scopes (slice) and join them
-	originalScope := strings.Join(tokenInfo.Scopes, " ")
-	scope := h.determineTokenExchangeScope(originalScope, requestedScope)
-
-	// Store the new token - Fix: Pass []string for scopes and time.Time for expiry
-	scopeSlice := strings.Fields(scope)
-	expiresAt := time.Now().Add(time.Hour)
-	h.tokenStore.StoreAccessToken(newAccessToken, clientID, tokenInfo.UserID, scopeSlice, expiresAt)
-
-	// Prepare response
-	response := map[string]interface{}{
-		"access_token":      newAccessToken,
-		"token_type":        "Bearer",
-		"expires_in":        3600,
-		"scope":             scope,
-		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
-	}
-
-	// Optional: Include refresh token if appropriate
-	if strings.Contains(scope, "offline_access") {
-		refreshToken, err := h.generateRefreshToken()
-		if err == nil {
-			refreshExpiresAt := time.Now().Add(24 * time.Hour * 30)
-			scopeSlice := strings.Fields(scope)
-			h.tokenStore.StoreRefreshToken(refreshToken, clientID, tokenInfo.UserID, scopeSlice, refreshExpiresAt)
-			response["refresh_token"] = refreshToken
-		}
+	// Delegation chain of exchanged tokens (RFC 8693 Section 4.1)
+	if tokenInfo.Act != nil {
+		response["act"] = tokenInfo.Act
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "no-store")
-	w.Header().Set("Pragma", "no-cache")
 	json.NewEncoder(w).Encode(response)
-
-	log.Printf("✅ Token exchange completed for client: %s, user: %s", clientID, tokenInfo.UserID)
+	log.Printf("✅ Token introspection completed for client: %s", clientID)
 }
 
 // handleClientCredentials processes client credentials requests (RFC 6749 Section 4.4)
@@ -326,7 +255,7 @@ func (h *TokenHandlers) HandleClientCredentials(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	if err := h.clientStore.ValidateClientCredentials(clientID, clientSecret); err != nil {
+	if err := h.clientStore.ValidateClientCredentials(clientID, clientSecret, r.RemoteAddr); err != nil {
 		utils.WriteInvalidClientError(w, "Invalid client credentials")
 		return
 	}
@@ -359,14 +288,15 @@ func (h *TokenHandlers) HandleClientCredentials(w http.ResponseWriter, r *http.R
 	// Store the token (no user ID for client credentials)
 	// Fix: Pass []string for scopes and time.Time for expiry
 	scopeSlice := strings.Fields(requestedScope)
-	expiresAt := time.Now().Add(time.Hour)
+	accessTokenLifetime := h.config.Security.AccessTokenLifetime()
+	expiresAt := time.Now().Add(accessTokenLifetime)
 	h.tokenStore.StoreAccessToken(accessToken, clientID, "", scopeSlice, expiresAt)
 
 	// Prepare response
 	response := map[string]interface{}{
 		"access_token": accessToken,
 		"token_type":   "Bearer",
-		"expires_in":   3600,
+		"expires_in":   int(accessTokenLifetime.Seconds()),
 		"scope":        requestedScope,
 	}
 
@@ -377,8 +307,8 @@ func (h *TokenHandlers) HandleClientCredentials(w http.ResponseWriter, r *http.R
 		if err != nil {
 			log.Printf("Failed to generate refresh token: %v", err)
 		} else {
-			// Store refresh token with expiry (30 days for refresh tokens)
-			refreshExpiresAt := time.Now().Add(30 * 24 * time.Hour)
+			// Store refresh token with the configured refresh token lifetime
+			refreshExpiresAt := time.Now().Add(h.config.Security.RefreshTokenLifetime())
 			h.tokenStore.StoreRefreshToken(refreshToken, clientID, "", scopeSlice, refreshExpiresAt)
 			response["refresh_token"] = refreshToken
 			log.Printf("✅ Refresh token issued for client credentials flow: %s", clientID)
@@ -424,7 +354,7 @@ func (h *TokenHandlers) HandleRefreshToken(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Authenticate client
-	_, err = auth.AuthenticateClient(clientID, clientSecret, h.clientStore)
+	_, err = auth.AuthenticateClient(clientID, clientSecret, r.RemoteAddr, h.clientStore)
 	if err != nil {
 		log.Printf("❌ Client authentication failed for %s: %v", clientID, err)
 		utils.WriteErrorResponse(w, "invalid_client", "Client authentication failed")
@@ -432,15 +362,14 @@ func (h *TokenHandlers) HandleRefreshToken(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Validate refresh token
-	tokenInfo, err := h.tokenStore.ValidateRefreshToken(refreshToken)
-	// Fix: Check for error instead of using ! operator on interface
+	previous, err := h.tokenStore.ValidRefreshToken(refreshToken)
 	if err != nil {
 		utils.WriteErrorResponse(w, "invalid_grant", "Invalid or expired refresh token")
 		return
 	}
 
 	// Verify token belongs to the client
-	if tokenInfo.ClientID != clientID {
+	if previous.ClientID != clientID {
 		utils.WriteErrorResponse(w, "invalid_grant", "Refresh token does not belong to client")
 		return
 	}
@@ -449,20 +378,19 @@ func (h *TokenHandlers) HandleRefreshToken(w http.ResponseWriter, r *http.Reques
 	var requestedScope string
 	if scope != "" {
 		// If scope is provided, it must be a subset of the original scope
-		originalScope := strings.Join(tokenInfo.Scopes, " ")
+		originalScope := strings.Join(previous.Scopes, " ")
 		if !h.isScopeSubset(scope, originalScope) {
 			utils.WriteErrorResponse(w, "invalid_scope", "Requested scope exceeds original scope")
 			return
 		}
 		requestedScope = scope
 	} else {
-		// Use tokenInfo.Scopes (slice) and join them
-		requestedScope = strings.Join(tokenInfo.Scopes, " ")
+		requestedScope = strings.Join(previous.Scopes, " ")
 	}
 
 	// Generate new access token
 	requestedScopes := strings.Fields(requestedScope)
-	newAccessToken, err := auth.GenerateAccessToken(tokenInfo.UserID, clientID, requestedScopes)
+	newAccessToken, err := auth.GenerateAccessToken(previous.UserID, clientID, requestedScopes)
 	if err != nil {
 		log.Printf("❌ Error generating access token: %v", err)
 		utils.WriteServerError(w, "Failed to generate access token")
@@ -470,27 +398,28 @@ func (h *TokenHandlers) HandleRefreshToken(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Generate new refresh token
-	newRefreshToken, err := auth.GenerateRefreshToken(tokenInfo.UserID, clientID)
+	newRefreshToken, err := auth.GenerateRefreshToken(previous.UserID, clientID)
 	if err != nil {
 		log.Printf("❌ Error generating refresh token: %v", err)
 		utils.WriteServerError(w, "Failed to generate refresh token")
 		return
 	}
 
-	// Store new tokens with correct parameters
-	accessTokenExpiry := time.Now().Add(time.Hour)
-	refreshTokenExpiry := time.Now().Add(24 * time.Hour)
+	// The new tokens keep the audience and delegation chain of the refresh token
+	now := time.Now()
+	accessTokenLifetime, refreshTokenLifetime := previous.RefreshLifetimes(now,
+		h.config.Security.AccessTokenLifetime(), h.config.Security.RefreshTokenLifetime())
+	accessTokenExpiry := now.Add(accessTokenLifetime)
+	refreshTokenExpiry := now.Add(refreshTokenLifetime)
 
-	// Pass []string for scopes and time.Time for expiry
-	err = h.tokenStore.StoreAccessToken(newAccessToken, clientID, tokenInfo.UserID, requestedScopes, accessTokenExpiry)
+	err = h.tokenStore.StoreToken(previous.Successor(newAccessToken, "access", requestedScopes, accessTokenExpiry))
 	if err != nil {
 		log.Printf("❌ Error storing access token: %v", err)
 		utils.WriteServerError(w, "Failed to store access token")
 		return
 	}
 
-	// Store new refresh token with scopes
-	err = h.tokenStore.StoreRefreshToken(newRefreshToken, clientID, tokenInfo.UserID, requestedScopes, refreshTokenExpiry)
+	err = h.tokenStore.StoreToken(previous.Successor(newRefreshToken, "refresh", requestedScopes, refreshTokenExpiry))
 	if err != nil {
 		log.Printf("❌ Error storing refresh token: %v", err)
 		utils.WriteServerError(w, "Failed to store refresh token")
@@ -508,7 +437,7 @@ func (h *TokenHandlers) HandleRefreshToken(w http.ResponseWriter, r *http.Reques
 	response := map[string]interface{}{
 		"access_token":  newAccessToken,
 		"token_type":    "Bearer",
-		"expires_in":    3600, // 1 hour
+		"expires_in":    int(accessTokenLifetime.Seconds()),
 		"refresh_token": newRefreshToken,
 		"scope":         requestedScope,
 	}
@@ -563,73 +492,16 @@ func (h *TokenHandlers) clientSupportsGrantType(client interface{}, grantType st
 }
 
 // validateClientScope validates that requested scope is allowed for the client
-func (h *TokenHandlers) validateClientScope(client interface{}, requestedScope string) bool {
-	if requestedScope == "" {
-		return true
-	}
-
-	if c, ok := client.(interface{ GetScopes() []string }); ok {
-		clientScopes := c.GetScopes()
-		requestedScopes := strings.Split(requestedScope, " ")
-
-		for _, reqScope := range requestedScopes {
-			if reqScope == "" {
-				continue
-			}
-			found := false
-			for _, clientScope := range clientScopes {
-				if clientScope == reqScope {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return false
-			}
+func (h *TokenHandlers) validateClientScope(client fosite.Client, requestedScope string) bool {
+	clientScopes := client.GetScopes()
+	for _, reqScope := range strings.Fields(requestedScope) {
+		if !utils.Contains(clientScopes, reqScope) {
+			return false
 		}
 	}
 	return true
 }
 
-// validateAudience validates the audience parameter for token exchange
-func (h *TokenHandlers) validateAudience(clientID, audience string) bool {
-	// Get client and check if the audience is in the client's allowed audiences
-	client, err := h.clientStore.GetClient(nil, clientID)
-	if err != nil {
-		return false
-	}
-
-	// Use type switch to handle different client types
-	switch c := client.(type) {
-	case interface{ GetAudience() fosite.Arguments }:
-		for _, aud := range c.GetAudience() {
-			if aud == audience {
-				return true
-			}
-		}
-	default:
-		// If client doesn't implement GetAudience, allow any audience for now
-		// In production, you might want to be more restrictive
-		return true
-	}
-	return false
-}
-
-// determineTokenExchangeScope determines the scope for token exchange
-func (h *TokenHandlers) determineTokenExchangeScope(originalScope, requestedScope string) string {
-	if requestedScope == "" {
-		return originalScope
-	}
-
-	// For token exchange, we can be more permissive, but still validate
-	if h.isScopeSubset(requestedScope, originalScope) {
-		return requestedScope
-	}
-
-	// Return original scope if requested scope is invalid
-	return originalScope
-}
-
 // isScopeSubset checks if requestedScope is a subset of originalScope
 func (h *TokenHandlers) isScopeSubset(requestedScope, originalScope string) bool {
 	if requestedScope == "" {
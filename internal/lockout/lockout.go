@@ -0,0 +1,311 @@
+// Package lockout slows down and blocks credential guessing. Failures are
+// counted per account, client and source IP; every further consecutive
+// failure doubles the wait before the next attempt, and reaching the limit of
+// the key locks it for the lockout duration of the security settings.
+package lockout
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"oauth2-server/internal/audit"
+	"oauth2-server/pkg/config"
+)
+
+// Kind is what a failure counter is kept for
+type Kind string
+
+// Kinds of failure counters
+const (
+	KindAccount Kind = "account"
+	KindClient  Kind = "client"
+	KindIP      Kind = "ip"
+	// KindUserCode counts the wrong device user codes entered by an account
+	KindUserCode Kind = "user_code"
+)
+
+// Credentials whose failures are counted, recorded in the audit log
+const (
+	CredentialPassword     = "password"
+	CredentialMFACode      = "mfa_code"
+	CredentialPasskey      = "passkey"
+	CredentialClientSecret = "client_secret"
+	CredentialUserCode     = "user_code"
+)
+
+// maxDelay caps the wait between attempts before a key is locked
+const maxDelay = time.Minute
+
+// Key identifies one failure counter
+type Key struct {
+	Kind  Kind   `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Account returns the key of a username
+func Account(username string) Key {
+	return Key{Kind: KindAccount, Value: username}
+}
+
+// Client returns the key of a client ID
+func Client(clientID string) Key {
+	return Key{Kind: KindClient, Value: clientID}
+}
+
+// UserCodes returns the key of the wrong user codes entered by an account.
+// Unlike Account it is not reset by a successful login, which the device page
+// requires before every code.
+func UserCodes(username string) Key {
+	return Key{Kind: KindUserCode, Value: username}
+}
+
+// IP returns the key of the source address of a request, without its port
+func IP(remoteAddr string) Key {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	return Key{Kind: KindIP, Value: remoteAddr}
+}
+
+// Lock describes a counter with failures, as listed by the admin API
+type Lock struct {
+	Key
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	RetryAt     *time.Time `json:"retry_at,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// counter tracks consecutive failures of one key
+type counter struct {
+	failures    int
+	lastFailure time.Time
+	retryAt     time.Time
+	lockedUntil time.Time
+}
+
+// Tracker counts failed credential checks. A nil tracker allows everything.
+type Tracker struct {
+	config   *config.Config
+	mutex    sync.Mutex
+	counters map[Key]*counter
+	now      func() time.Time
+}
+
+// NewTracker creates a tracker using the limits of cfg.Security, which are
+// read on every check so config reloads apply
+func NewTracker(cfg *config.Config) *Tracker {
+	return &Tracker{
+		config:   cfg,
+		counters: make(map[Key]*counter),
+		now:      time.Now,
+	}
+}
+
+// Check returns how long the caller has to wait before any of the keys may be
+// tried again, zero when all of them may be tried now
+func (t *Tracker) Check(keys ...Key) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	var wait time.Duration
+	for _, key := range keys {
+		c, ok := t.counters[key]
+		if !ok || key.Value == "" {
+			continue
+		}
+		for _, until := range []time.Time{c.retryAt, c.lockedUntil} {
+			if remaining := until.Sub(now); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return wait
+}
+
+// Fail counts a failed check of credential against every key and reports
+// whether one of them was locked by it. The attempt is described by clientID
+// and remoteAddr in the audit event of a lockout.
+func (t *Tracker) Fail(credential, clientID, remoteAddr string, keys ...Key) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	locked := false
+	for _, key := range keys {
+		if key.Value == "" {
+			continue
+		}
+		c, ok := t.counters[key]
+		if !ok || (!c.lockedUntil.IsZero() && now.After(c.lockedUntil)) {
+			c = &counter{}
+			t.counters[key] = c
+		}
+
+		c.failures++
+		c.lastFailure = now
+		if c.failures >= t.limit(key.Kind) {
+			c.lockedUntil = now.Add(t.config.Security.LockoutDuration())
+			c.retryAt = time.Time{}
+			locked = true
+			t.audit(key, c, credential, clientID, remoteAddr)
+			continue
+		}
+		c.retryAt = now.Add(t.delay(c.failures))
+	}
+	return locked
+}
+
+// Succeed forgets the failures of the keys after a successful check. Source
+// IPs are usually left out, so valid logins do not reset the count of guesses
+// for other accounts from the same address.
+func (t *Tracker) Succeed(keys ...Key) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(t.counters, key)
+	}
+}
+
+// List returns the counters with failures, locked ones first; RetryAt and
+// LockedUntil are only set while they are in the future
+func (t *Tracker) List() []Lock {
+	if t == nil {
+		return []Lock{}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	locks := make([]Lock, 0, len(t.counters))
+	for key, c := range t.counters {
+		lock := Lock{Key: key, Failures: c.failures, LastFailure: c.lastFailure}
+		if now.Before(c.retryAt) {
+			retryAt := c.retryAt
+			lock.RetryAt = &retryAt
+		}
+		if now.Before(c.lockedUntil) {
+			lockedUntil := c.lockedUntil
+			lock.LockedUntil = &lockedUntil
+		}
+		locks = append(locks, lock)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		if (locks[i].LockedUntil != nil) != (locks[j].LockedUntil != nil) {
+			return locks[i].LockedUntil != nil
+		}
+		if locks[i].Kind != locks[j].Kind {
+			return locks[i].Kind < locks[j].Kind
+		}
+		return locks[i].Value < locks[j].Value
+	})
+	return locks
+}
+
+// Unlock forgets the failures of a key and reports whether it had any
+func (t *Tracker) Unlock(key Key) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, ok := t.counters[key]
+	delete(t.counters, key)
+	return ok
+}
+
+// Prune forgets counters whose lockout ended or that have not grown within
+// the lockout duration, and returns how many were removed
+func (t *Tracker) Prune(ctx context.Context) (int, error) {
+	if t == nil {
+		return 0, nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	window := t.config.Security.LockoutDuration()
+	pruned := 0
+	for key, c := range t.counters {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		if now.After(c.lockedUntil) && now.Sub(c.lastFailure) > window {
+			delete(t.counters, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// limit returns the number of consecutive failures that lock a key
+func (t *Tracker) limit(kind Kind) int {
+	switch kind {
+	case KindClient:
+		return t.config.Security.ClientAttemptLimit()
+	case KindIP:
+		return t.config.Security.IPAttemptLimit()
+	default:
+		return t.config.Security.LoginAttemptLimit()
+	}
+}
+
+// delay returns the wait after the given number of consecutive failures: none
+// after the first, then the failure delay doubling up to maxDelay
+func (t *Tracker) delay(failures int) time.Duration {
+	base := t.config.Security.FailureDelay()
+	if failures < 2 || base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 2; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// audit logs and records a lockout; the caller holds the mutex
+func (t *Tracker) audit(key Key, c *counter, credential, clientID, remoteAddr string) {
+	log.Printf("🔒 Locked %s %s until %s after %d failed attempts", key.Kind, key.Value, c.lockedUntil.Format(time.RFC3339), c.failures)
+
+	details := map[string]interface{}{
+		"kind":         string(key.Kind),
+		"key":          key.Value,
+		"credential":   credential,
+		"failures":     c.failures,
+		"locked_until": c.lockedUntil.UTC().Format(time.RFC3339),
+	}
+	if remoteAddr != "" {
+		details["remote_addr"] = remoteAddr
+	}
+	event := audit.Event{
+		Type:     "lockout",
+		Outcome:  audit.OutcomeDenied,
+		ClientID: clientID,
+		Reason:   "too many failed attempts",
+		Details:  details,
+	}
+	if key.Kind == KindAccount {
+		event.Subject = key.Value
+	}
+	audit.Log(event)
+}
@@ -0,0 +1,171 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"oauth2-server/pkg/config"
+)
+
+// newTestTracker locks accounts after 3 failures, clients after 2 and IPs
+// after 4 for 5 minutes, with a failure delay of 1s, on a clock the test moves
+func newTestTracker() (*Tracker, *time.Time) {
+	cfg := &config.Config{}
+	cfg.Security.MaxLoginAttempts = 3
+	cfg.Security.MaxClientAttempts = 2
+	cfg.Security.MaxIPAttempts = 4
+	cfg.Security.LockoutDurationSeconds = 300
+	cfg.Security.FailureDelaySeconds = 1
+
+	tracker := NewTracker(cfg)
+	now := time.Unix(1700000000, 0)
+	tracker.now = func() time.Time { return now }
+	return tracker, &now
+}
+
+func TestFailLocksAtTheLimit(t *testing.T) {
+	tests := []struct {
+		key   Key
+		limit int
+	}{
+		{Account("alice"), 3},
+		{Client("app"), 2},
+		{IP("192.0.2.1:1234"), 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.key.Kind), func(t *testing.T) {
+			tracker, now := newTestTracker()
+
+			for i := 1; i < tt.limit; i++ {
+				if tracker.Fail(CredentialPassword, "app", "192.0.2.1:1234", tt.key) {
+					t.Fatalf("failure %d locked the key, want a lock after %d", i, tt.limit)
+				}
+				// Wait out the delay, which does not count as a lock
+				*now = now.Add(tracker.Check(tt.key))
+			}
+			if !tracker.Fail(CredentialPassword, "app", "192.0.2.1:1234", tt.key) {
+				t.Fatalf("failure %d did not lock the key", tt.limit)
+			}
+			if wait := tracker.Check(tt.key); wait != 5*time.Minute {
+				t.Fatalf("wait = %s, want the lockout duration", wait)
+			}
+			locks := tracker.List()
+			if len(locks) != 1 || locks[0].Failures != tt.limit || locks[0].LockedUntil == nil || locks[0].RetryAt != nil {
+				t.Fatalf("locks = %+v, want the key locked", locks)
+			}
+
+			// The lock ends after its duration and counting starts over
+			*now = now.Add(5*time.Minute + time.Second)
+			if wait := tracker.Check(tt.key); wait != 0 {
+				t.Fatalf("wait after the lockout = %s, want none", wait)
+			}
+			if tracker.Fail(CredentialPassword, "app", "192.0.2.1:1234", tt.key) {
+				t.Fatal("first failure after the lockout locked the key again")
+			}
+			if locks := tracker.List(); locks[0].Failures != 1 {
+				t.Errorf("failures after the lockout = %d, want 1", locks[0].Failures)
+			}
+		})
+	}
+}
+
+func TestFailureDelayDoubles(t *testing.T) {
+	tests := []struct {
+		name         string
+		delaySeconds int
+		failures     int
+		want         time.Duration
+	}{
+		{name: "no delay after the first failure", delaySeconds: 1, failures: 1, want: 0},
+		{name: "failure delay after the second failure", delaySeconds: 1, failures: 2, want: time.Second},
+		{name: "doubled after the third failure", delaySeconds: 1, failures: 3, want: 2 * time.Second},
+		{name: "doubled again after the fourth failure", delaySeconds: 1, failures: 4, want: 4 * time.Second},
+		{name: "capped at a minute", delaySeconds: 20, failures: 4, want: time.Minute},
+		{name: "turned off", delaySeconds: -1, failures: 4, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker, now := newTestTracker()
+			tracker.config.Security.MaxLoginAttempts = 10
+			tracker.config.Security.FailureDelaySeconds = tt.delaySeconds
+
+			key := Account("alice")
+			for i := 0; i < tt.failures; i++ {
+				*now = now.Add(tracker.Check(key))
+				tracker.Fail(CredentialPassword, "app", "", key)
+			}
+			if wait := tracker.Check(key); wait != tt.want {
+				t.Errorf("wait = %s, want %s", wait, tt.want)
+			}
+
+			// The delay runs out on its own
+			*now = now.Add(tt.want)
+			if wait := tracker.Check(key); wait != 0 {
+				t.Errorf("wait after the delay = %s, want none", wait)
+			}
+		})
+	}
+}
+
+func TestSucceedResetsTheKeys(t *testing.T) {
+	tracker, now := newTestTracker()
+	account, ip := Account("alice"), IP("192.0.2.1:1234")
+
+	tracker.Fail(CredentialPassword, "app", "192.0.2.1:1234", account, ip)
+	tracker.Fail(CredentialPassword, "app", "192.0.2.1:1234", account, ip)
+	if wait := tracker.Check(account, ip); wait != time.Second {
+		t.Fatalf("wait = %s, want the failure delay", wait)
+	}
+
+	// Only the account is reset; the address keeps counting
+	tracker.Succeed(account)
+	if wait := tracker.Check(account); wait != 0 {
+		t.Errorf("wait for the account after a success = %s, want none", wait)
+	}
+	if wait := tracker.Check(ip); wait != time.Second {
+		t.Errorf("wait for the address after a success = %s, want it unchanged", wait)
+	}
+
+	*now = now.Add(time.Second)
+	tracker.Fail(CredentialPassword, "app", "", account)
+	if wait := tracker.Check(account); wait != 0 {
+		t.Errorf("wait after the first failure since a success = %s, want counting to start over", wait)
+	}
+}
+
+func TestPruneForgetsIdleCounters(t *testing.T) {
+	tracker, now := newTestTracker()
+	locked, idle := Client("app"), Account("alice")
+
+	tracker.Fail(CredentialPassword, "", "", idle)
+	tracker.Fail(CredentialClientSecret, "app", "", locked)
+	*now = now.Add(time.Minute)
+	tracker.Fail(CredentialClientSecret, "app", "", locked)
+
+	// Counters stay within the lockout duration of their last failure
+	*now = now.Add(4*time.Minute + time.Second)
+	if pruned, err := tracker.Prune(context.Background()); err != nil || pruned != 1 {
+		t.Fatalf("Prune = %d, %v, want the idle counter pruned", pruned, err)
+	}
+	if locks := tracker.List(); len(locks) != 1 || locks[0].Key != locked {
+		t.Fatalf("locks = %+v, want the locked client to be kept", locks)
+	}
+
+	*now = now.Add(time.Minute)
+	if pruned, err := tracker.Prune(context.Background()); err != nil || pruned != 1 {
+		t.Fatalf("Prune = %d, %v, want the expired lock pruned", pruned, err)
+	}
+	if tracker.Unlock(locked) {
+		t.Error("pruned key could still be unlocked")
+	}
+}
+
+func TestNilTrackerAllowsEverything(t *testing.T) {
+	var tracker *Tracker
+	if tracker.Fail(CredentialPassword, "app", "", Account("alice")) || tracker.Check(Account("alice")) != 0 {
+		t.Error("nil tracker counted a failure")
+	}
+}
@@ -1,9 +1,17 @@
 package middleware
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"oauth2-server/internal/ratelimit"
+	"oauth2-server/internal/utils"
+	"oauth2-server/pkg/config"
 )
 
 // Logger middleware for request logging
@@ -21,19 +29,82 @@ func Logger(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// CORS middleware
-func CORS(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+// CORSPolicy describes who may call an endpoint from a browser
+type CORSPolicy struct {
+	// Methods and Headers are granted to preflight requests
+	Methods []string
+	Headers []string
+	// Public endpoints serve metadata to every origin, without credentials
+	Public bool
+	// Registered reports whether any client allows origin. Preflight requests
+	// do not name the client, so they are answered for registered origins.
+	Registered func(origin string) bool
+	// Allowed reports whether the client of r allows origin
+	Allowed func(r *http.Request, origin string) bool
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+// corsExposedHeaders are readable by scripts on the responses of allowed origins
+const corsExposedHeaders = "WWW-Authenticate, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy"
 
-		next.ServeHTTP(w, r)
+// corsMaxAge is how long browsers may cache a preflight response
+const corsMaxAge = "600"
+
+// CORS answers preflight requests and lets browsers read the responses of
+// origins the policy allows. Credentialed requests are only allowed for
+// origins that are registered by a client.
+func CORS(policy CORSPolicy) func(http.HandlerFunc) http.HandlerFunc {
+	methods := strings.Join(policy.Methods, ", ") + ", " + http.MethodOptions
+	headers := strings.Join(policy.Headers, ", ")
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if policy.Public {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				if preflight {
+					w.Header().Set("Access-Control-Allow-Methods", methods)
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+					w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			origin, ok := utils.Origin(header)
+			if preflight {
+				if !ok || !policy.Registered(origin) {
+					log.Printf("🚫 Rejected CORS preflight for %s from origin %s", r.URL.Path, header)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			// Without the headers the browser keeps the response from the script
+			if ok && policy.Allowed(r, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			} else {
+				log.Printf("🚫 No CORS access to %s for origin %s", r.URL.Path, header)
+			}
+			next.ServeHTTP(w, r)
+		}
 	}
 }
 
@@ -51,38 +122,174 @@ func ProxyAware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// RateLimiting middleware (basic implementation)
-func RateLimit(requestsPerMinute int) func(http.HandlerFunc) http.HandlerFunc {
-	clients := make(map[string][]time.Time)
+// ClientVerifier returns the ID of the client whose credentials a request
+// carries, and false when it carries none or they are wrong. It must not count
+// towards lockouts, as the handler verifies the credentials again.
+type ClientVerifier func(r *http.Request) (string, bool)
 
+// RateLimit refuses requests to endpoint once the bucket of their source IP,
+// or of their client or user, is empty, with 429 and Retry-After. Every
+// response carries the RateLimit headers of the fuller bucket. It must wrap
+// any middleware that rewrites the request from forwarded headers;
+// X-Forwarded-For is only believed from trusted proxies.
+func RateLimit(limiter *ratelimit.Limiter, endpoint string, trustedProxies []*net.IPNet, verifyClient ClientVerifier) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			clientIP := r.RemoteAddr
-			now := time.Now()
-
-			// Clean old requests
-			if requests, exists := clients[clientIP]; exists {
-				var validRequests []time.Time
-				for _, reqTime := range requests {
-					if now.Sub(reqTime) < time.Minute {
-						validRequests = append(validRequests, reqTime)
-					}
+			ip := ClientIP(r, trustedProxies)
+			key := "ip:" + ip
+			decision := limiter.Allow(r.Context(), endpoint, key)
+
+			// The source IP is always counted, so requests naming someone
+			// else's client or username cannot get around it
+			if decision.Allowed {
+				if keyed, ok := rateLimitKey(r, limiter.Key(endpoint), ip, verifyClient); ok {
+					key = keyed
+					decision = stricter(decision, limiter.Allow(r.Context(), endpoint, keyed))
 				}
-				clients[clientIP] = validRequests
 			}
 
-			// Check rate limit
-			if len(clients[clientIP]) >= requestsPerMinute {
-				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			if decision.Limit > 0 {
+				w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+				w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+				w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+				w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.Limit, ceilSeconds(decision.Window)))
+			}
+			if decision.Allowed {
+				next.ServeHTTP(w, r)
 				return
 			}
 
-			// Add current request
-			clients[clientIP] = append(clients[clientIP], now)
+			retryAfter := ceilSeconds(decision.RetryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			if decision.Unavailable {
+				description := "The service is temporarily unavailable, try again later"
+				if endpoint == config.RateLimitEndpointAuth {
+					utils.WriteErrorHTML(w, http.StatusServiceUnavailable, "Service Unavailable", description)
+					return
+				}
+				utils.WriteTemporarilyUnavailableError(w, description)
+				return
+			}
 
-			next.ServeHTTP(w, r)
+			log.Printf("🚦 Rate limit of %s exceeded by %s, retry in %ds", endpoint, key, retryAfter)
+			description := fmt.Sprintf("Too many requests, try again in %d seconds", retryAfter)
+			if endpoint == config.RateLimitEndpointAuth {
+				utils.WriteErrorHTML(w, http.StatusTooManyRequests, "Too Many Requests", description)
+				return
+			}
+			utils.WriteTooManyRequestsError(w, description)
+		}
+	}
+}
+
+// rateLimitKey returns the bucket a request is counted in besides the one of
+// its source IP. Clients only get their own bucket once their credentials
+// verify, so a request that merely names a client cannot use up its bucket;
+// users are counted per source IP for the same reason, as guessing passwords
+// across addresses is left to the account lockout.
+func rateLimitKey(r *http.Request, kind, ip string, verifyClient ClientVerifier) (string, bool) {
+	switch kind {
+	case config.RateLimitKeyClientID:
+		if verifyClient == nil {
+			return "", false
+		}
+		if clientID, ok := verifyClient(r); ok {
+			return "client:" + clientID, true
+		}
+	case config.RateLimitKeyUser:
+		if username := r.FormValue("username"); username != "" {
+			return "user:" + username + "@" + ip, true
+		}
+	}
+	return "", false
+}
+
+// stricter returns the decision of the bucket with fewer requests left
+func stricter(a, b ratelimit.Decision) ratelimit.Decision {
+	if !b.Allowed || b.Remaining < a.Remaining {
+		return b
+	}
+	return a
+}
+
+// ClientIP returns the source address of a request: the last address in
+// X-Forwarded-For that is not a trusted proxy, or X-Real-IP without it, when
+// the request came through one, and the direct peer otherwise
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromTrustedProxy(r, trustedProxies) {
+		return host
+	}
+
+	if r.Header.Get("X-Forwarded-For") == "" {
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		ip := net.ParseIP(address)
+		if ip == nil {
+			break
+		}
+		host = address
+		if !trustedIP(ip, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// RequireHTTPS rejects requests that neither arrived over TLS nor through one
+// of the trusted TLS-terminating proxies with X-Forwarded-Proto: https. It must
+// wrap any middleware that rewrites the request from forwarded headers.
+func RequireHTTPS(trustedProxies []*net.IPNet) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil || (r.Header.Get("X-Forwarded-Proto") == "https" && fromTrustedProxy(r, trustedProxies)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			log.Printf("🔒 Rejected plain HTTP request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("Cache-Control", "no-store")
+			utils.WriteJSONResponse(w, http.StatusForbidden, map[string]interface{}{
+				"error":             "invalid_request",
+				"error_description": "HTTPS is required",
+			})
+		}
+	}
+}
+
+// fromTrustedProxy reports whether the direct peer is a trusted proxy
+func fromTrustedProxy(r *http.Request, trustedProxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && trustedIP(ip, trustedProxies)
+}
+
+// trustedIP reports whether ip belongs to one of the trusted proxies
+func trustedIP(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
 		}
 	}
+	return false
 }
 
 type responseWriter struct {
@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"oauth2-server/internal/ratelimit"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// newRateLimitedHandler limits the token endpoint to a burst of 2 per key;
+// clients authenticate with the secret "right"
+func newRateLimitedHandler() http.HandlerFunc {
+	cfg := &config.Config{}
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Endpoints.Token = config.EndpointRateLimit{RequestsPerMinute: 60, Burst: 2, Key: config.RateLimitKeyClientID}
+	limiter := ratelimit.NewLimiter(store.NewMemoryBackend(), cfg)
+
+	verify := func(r *http.Request) (string, bool) {
+		if r.FormValue("client_secret") != "right" {
+			return "", false
+		}
+		return r.FormValue("client_id"), true
+	}
+	return RateLimit(limiter, config.RateLimitEndpointToken, nil, verify)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// tokenRequest posts client credentials to the token endpoint from remoteAddr
+func tokenRequest(handler http.HandlerFunc, remoteAddr, clientID, secret string) *httptest.ResponseRecorder {
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {clientID}, "client_secret": {secret}}
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	handler := newRateLimitedHandler()
+
+	w := tokenRequest(handler, "192.0.2.1:1234", "app", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request answered %d", w.Code)
+	}
+	want := map[string]string{"RateLimit-Limit": "2", "RateLimit-Remaining": "1", "RateLimit-Reset": "1", "RateLimit-Policy": "2;w=2"}
+	for header, value := range want {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+
+	tokenRequest(handler, "192.0.2.1:1234", "app", "")
+	w = tokenRequest(handler, "192.0.2.1:1234", "app", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("request beyond the burst answered %d with Retry-After %q, want 429 after 1s", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "too_many_requests") {
+		t.Errorf("body = %s, want a too_many_requests error", w.Body.String())
+	}
+}
+
+func TestRateLimitCountsClientsOnlyWithVerifiedCredentials(t *testing.T) {
+	handler := newRateLimitedHandler()
+
+	// Naming the client without its secret only uses up the bucket of the
+	// source IP, however many clients are named
+	for _, clientID := range []string{"victim", "victim", "other"} {
+		tokenRequest(handler, "198.51.100.7:1234", clientID, "wrong")
+	}
+	if w := tokenRequest(handler, "198.51.100.7:1234", "victim", "right"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("source IP beyond its burst answered %d, want 429", w.Code)
+	}
+	if w := tokenRequest(handler, "192.0.2.1:1234", "victim", "right"); w.Code != http.StatusOK {
+		t.Fatalf("client named by someone else answered %d, want 200", w.Code)
+	}
+
+	// Authenticated requests count against the bucket of the client from
+	// every source IP
+	tokenRequest(handler, "192.0.2.2:1234", "victim", "right")
+	if w := tokenRequest(handler, "192.0.2.3:1234", "victim", "right"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("client beyond its burst answered %d, want 429", w.Code)
+	}
+}
+
+// newCORSHandler wraps a handler in the CORS policy of the token endpoint.
+// The client "spa" allows https://app.example.com, "native" the origin of its
+// redirect URI and "careless" the invalid origin "*"; requests name their
+// client in client_id. It reports whether the wrapped handler was called.
+func newCORSHandler(t *testing.T, public bool) (http.HandlerFunc, *bool) {
+	t.Helper()
+	clients := store.NewClientStore(store.NewMemoryBackend().Clients())
+	for _, client := range []*store.Client{
+		{ID: "spa", AllowedOrigins: []string{"https://app.example.com"}, RedirectURIs: []string{"https://login.example.com/callback"}},
+		{ID: "native", RedirectURIs: []string{"http://localhost:3000/callback", "com.example.app:/callback"}},
+		{ID: "careless", AllowedOrigins: []string{"*"}},
+	} {
+		if err := clients.StoreClient(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	called := new(bool)
+	handler := CORS(CORSPolicy{
+		Methods:    []string{http.MethodPost},
+		Headers:    []string{"Authorization", "Content-Type"},
+		Public:     public,
+		Registered: clients.OriginRegistered,
+		Allowed: func(r *http.Request, origin string) bool {
+			return clients.ClientAllowsOrigin(r.URL.Query().Get("client_id"), origin)
+		},
+	})(func(w http.ResponseWriter, r *http.Request) {
+		*called = true
+		w.WriteHeader(http.StatusOK)
+	})
+	return handler, called
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name      string
+		public    bool
+		preflight bool
+		client    string
+		origin    string
+		// wantOrigin is the expected Access-Control-Allow-Origin, empty when
+		// the browser must not let the script read the response
+		wantOrigin string
+		wantStatus int
+	}{
+		{name: "same-origin request", client: "spa", wantStatus: http.StatusOK},
+		{name: "preflight from a registered origin", preflight: true, origin: "https://app.example.com", wantOrigin: "https://app.example.com", wantStatus: http.StatusNoContent},
+		{name: "preflight from a redirect URI origin", preflight: true, origin: "http://localhost:3000", wantOrigin: "http://localhost:3000", wantStatus: http.StatusNoContent},
+		{name: "preflight from an unknown origin", preflight: true, origin: "https://evil.example.com", wantStatus: http.StatusForbidden},
+		{name: "preflight from the wildcard", preflight: true, origin: "*", wantStatus: http.StatusForbidden},
+		{name: "preflight from an opaque origin", preflight: true, origin: "null", wantStatus: http.StatusForbidden},
+		{name: "request from the origin of the client", client: "spa", origin: "https://app.example.com", wantOrigin: "https://app.example.com", wantStatus: http.StatusOK},
+		{name: "origin is normalized", client: "spa", origin: "HTTPS://App.Example.com:443", wantOrigin: "https://app.example.com", wantStatus: http.StatusOK},
+		{name: "allowed origins replace the redirect URIs", client: "spa", origin: "https://login.example.com", wantStatus: http.StatusOK},
+		{name: "request from the origin of another client", client: "spa", origin: "http://localhost:3000", wantStatus: http.StatusOK},
+		{name: "request from the redirect URI origin of the client", client: "native", origin: "http://localhost:3000", wantOrigin: "http://localhost:3000", wantStatus: http.StatusOK},
+		{name: "wildcard allowed origin matches nothing", client: "careless", origin: "https://evil.example.com", wantStatus: http.StatusOK},
+		{name: "request without a client", origin: "https://app.example.com", wantStatus: http.StatusOK},
+		{name: "public request", public: true, origin: "https://evil.example.com", wantOrigin: "*", wantStatus: http.StatusOK},
+		{name: "public preflight", public: true, preflight: true, origin: "https://evil.example.com", wantOrigin: "*", wantStatus: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, called := newCORSHandler(t, tt.public)
+
+			method := http.MethodPost
+			if tt.preflight {
+				method = http.MethodOptions
+			}
+			r := httptest.NewRequest(method, "/token?client_id="+tt.client, nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			header := w.Header()
+			if w.Code != tt.wantStatus || header.Get("Access-Control-Allow-Origin") != tt.wantOrigin {
+				t.Fatalf("response = %d with origin %q, want %d with %q", w.Code, header.Get("Access-Control-Allow-Origin"), tt.wantStatus, tt.wantOrigin)
+			}
+			if *called == tt.preflight {
+				t.Errorf("handler called = %v, want preflight requests answered by the middleware", *called)
+			}
+
+			// Credentials are only allowed for a named origin, never for "*"
+			credentials := header.Get("Access-Control-Allow-Credentials") == "true"
+			if credentials != (tt.wantOrigin != "" && tt.wantOrigin != "*") {
+				t.Errorf("Access-Control-Allow-Credentials = %q with origin %q", header.Get("Access-Control-Allow-Credentials"), tt.wantOrigin)
+			}
+
+			// Responses that depend on the origin must not be cached for another
+			varies := header.Get("Vary") == "Origin"
+			if varies != (tt.origin != "" && !tt.public) {
+				t.Errorf("Vary = %q, want Origin for responses that depend on it", header.Get("Vary"))
+			}
+
+			if tt.preflight && w.Code == http.StatusNoContent {
+				methods, headers := header.Get("Access-Control-Allow-Methods"), header.Get("Access-Control-Allow-Headers")
+				if methods != "POST, OPTIONS" || headers != "Authorization, Content-Type" || header.Get("Access-Control-Max-Age") != corsMaxAge {
+					t.Errorf("preflight allows methods %q and headers %q for %ss", methods, headers, header.Get("Access-Control-Max-Age"))
+				}
+			}
+		})
+	}
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	handler := RequireHTTPS([]*net.IPNet{proxies})(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		proto      string
+		wantStatus int
+	}{
+		{name: "direct TLS", remoteAddr: "192.0.2.1:1234", tls: true, wantStatus: http.StatusNoContent},
+		{name: "trusted proxy terminating TLS", remoteAddr: "10.0.0.1:1234", proto: "https", wantStatus: http.StatusNoContent},
+		{name: "plain HTTP", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusForbidden},
+		{name: "untrusted client claiming https", remoteAddr: "192.0.2.1:1234", proto: "https", wantStatus: http.StatusForbidden},
+		{name: "trusted proxy forwarding plain HTTP", remoteAddr: "10.0.0.1:1234", proto: "http", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/token", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusForbidden && !strings.Contains(w.Body.String(), "HTTPS is required") {
+				t.Errorf("body = %s, want the reason", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package mockidp is a minimal OpenID Connect provider for testing upstream
+// identity provider logins without a real IdP. Every login is accepted: the
+// authorization endpoint shows a form with the claims of the user to log in,
+// prefilled with the defaults, and codes are redeemed with PKCE (S256).
+package mockidp
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/utils"
+)
+
+// Identity is the user the mock logs in
+type Identity struct {
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+// grant is an issued authorization code
+type grant struct {
+	claims        jwt.MapClaims
+	redirectURI   string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+// Server is the mock provider
+type Server struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	identity     Identity
+	keys         *auth.KeyManager
+
+	mutex  sync.Mutex
+	codes  map[string]*grant
+	tokens map[string]jwt.MapClaims
+}
+
+// New creates a provider for one client. The client secret may be empty for a
+// public client; identity is the default user of the login form.
+func New(issuer, clientID, clientSecret string, identity Identity) (*Server, error) {
+	keys, err := auth.NewKeyManager(issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		identity:     identity,
+		keys:         keys,
+		codes:        make(map[string]*grant),
+		tokens:       make(map[string]jwt.MapClaims),
+	}, nil
+}
+
+// ServeHTTP serves discovery, authorization, token, userinfo and JWKS endpoints
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                s.issuer,
+			"authorization_endpoint":                s.issuer + "/authorize",
+			"token_endpoint":                        s.issuer + "/token",
+			"userinfo_endpoint":                     s.issuer + "/userinfo",
+			"jwks_uri":                              s.issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/authorize":
+		s.handleAuthorize(w, r)
+	case "/token":
+		s.handleToken(w, r)
+	case "/userinfo":
+		s.handleUserInfo(w, r)
+	case "/jwks":
+		utils.WriteJSONResponse(w, http.StatusOK, s.keys.JWKS())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAuthorize shows the login form on GET and issues a code on POST
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		utils.WriteInvalidRequestError(w, "invalid form")
+		return
+	}
+	if r.Form.Get("client_id") != s.clientID {
+		utils.WriteErrorHTML(w, http.StatusBadRequest, "Unknown Client", "The client_id is not registered with the mock identity provider.")
+		return
+	}
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		utils.WriteErrorHTML(w, http.StatusBadRequest, "Invalid Redirect URI", "An absolute redirect_uri is required.")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		s.showLoginForm(w, r)
+		return
+	}
+
+	query := redirectURI.Query()
+	query.Set("state", r.Form.Get("state"))
+	if r.Form.Get("action") == "deny" {
+		query.Set("error", "access_denied")
+		redirectURI.RawQuery = query.Encode()
+		http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+		return
+	}
+	if r.Form.Get("code_challenge_method") != "S256" || r.Form.Get("code_challenge") == "" {
+		query.Set("error", "invalid_request")
+		query.Set("error_description", "PKCE with S256 is required")
+		redirectURI.RawQuery = query.Encode()
+		http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"sub":                r.Form.Get("sub"),
+		"preferred_username": r.Form.Get("preferred_username"),
+		"email":              r.Form.Get("email"),
+		"email_verified":     r.Form.Get("email_verified") == "true",
+		"name":               r.Form.Get("name"),
+		"groups":             utils.SplitScopes(strings.ReplaceAll(r.Form.Get("groups"), ",", " ")),
+	}
+	if nonce := r.Form.Get("nonce"); nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	code := utils.GenerateAuthCode()
+	s.mutex.Lock()
+	s.codes[code] = &grant{
+		claims:        claims,
+		redirectURI:   r.Form.Get("redirect_uri"),
+		codeChallenge: r.Form.Get("code_challenge"),
+		expiresAt:     time.Now().Add(time.Minute),
+	}
+	s.mutex.Unlock()
+
+	log.Printf("🧪 Mock identity provider logged in %s", claims["sub"])
+	query.Set("code", code)
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// showLoginForm renders the claims of the user to log in, keeping the request
+// parameters in hidden fields
+func (s *Server) showLoginForm(w http.ResponseWriter, r *http.Request) {
+	var hidden strings.Builder
+	for name, values := range r.Form {
+		for _, value := range values {
+			hidden.WriteString(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, html.EscapeString(name), html.EscapeString(value)))
+		}
+	}
+
+	field := func(label, name, value string) string {
+		return fmt.Sprintf(`<p><label>%s<br><input type="text" name="%s" value="%s"></label></p>`,
+			label, name, html.EscapeString(value))
+	}
+	verified := ""
+	if s.identity.EmailVerified {
+		verified = " checked"
+	}
+
+	content := `<h2>🧪 Mock Identity Provider</h2>
+        <p>Log in to <strong>` + html.EscapeString(s.clientID) + `</strong> as:</p>
+        <form method="post" action="authorize">` + hidden.String() +
+		field("Subject", "sub", s.identity.Subject) +
+		field("Username", "preferred_username", s.identity.Username) +
+		field("Email", "email", s.identity.Email) +
+		`<p><label><input type="checkbox" name="email_verified" value="true"` + verified + `> Email verified</label></p>` +
+		field("Name", "name", s.identity.Name) +
+		field("Groups (comma separated)", "groups", strings.Join(s.identity.Groups, ",")) + `
+            <button type="submit" name="action" value="login">Log in</button>
+            <button type="submit" name="action" value="deny">Deny</button>
+        </form>`
+	utils.WriteHTMLResponse(w, http.StatusOK, content)
+}
+
+// handleToken redeems a code for an access token and an ID token
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteMethodNotAllowedError(w)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		utils.WriteInvalidRequestError(w, "invalid form")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+	}
+	if clientID != s.clientID || clientSecret != s.clientSecret {
+		utils.WriteInvalidClientError(w, "client authentication failed")
+		return
+	}
+	if r.Form.Get("grant_type") != "authorization_code" {
+		utils.WriteUnsupportedGrantTypeError(w, "only authorization_code is supported")
+		return
+	}
+
+	code := r.Form.Get("code")
+	s.mutex.Lock()
+	issued, found := s.codes[code]
+	delete(s.codes, code)
+	s.mutex.Unlock()
+
+	switch {
+	case !found || time.Now().After(issued.expiresAt):
+		utils.WriteInvalidGrantError(w, "unknown or expired code")
+		return
+	case r.Form.Get("redirect_uri") != issued.redirectURI:
+		utils.WriteInvalidGrantError(w, "redirect_uri does not match")
+		return
+	case utils.GenerateCodeChallenge(r.Form.Get("code_verifier")) != issued.codeChallenge:
+		utils.WriteInvalidGrantError(w, "code_verifier does not match the code_challenge")
+		return
+	}
+
+	idClaims := jwt.MapClaims{
+		"aud": s.clientID,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range issued.claims {
+		idClaims[name] = value
+	}
+	idToken, err := s.keys.SignClaims(idClaims)
+	if err != nil {
+		utils.WriteServerError(w, "failed to sign id_token")
+		return
+	}
+
+	accessToken := utils.GenerateAccessToken()
+	s.mutex.Lock()
+	s.tokens[accessToken] = issued.claims
+	s.mutex.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// handleUserInfo returns the claims of an access token
+func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	claims, found := s.tokens[utils.ExtractBearerToken(r)]
+	s.mutex.Unlock()
+	if !found {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		utils.WriteErrorResponse(w, "invalid_token", "unknown access token")
+		return
+	}
+
+	userInfo := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		if name != "nonce" {
+			userInfo[name] = value
+		}
+	}
+	utils.WriteJSONResponse(w, http.StatusOK, userInfo)
+}
@@ -0,0 +1,251 @@
+package mockidp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"oauth2-server/internal/auth"
+	"oauth2-server/internal/utils"
+	"oauth2-server/pkg/config"
+)
+
+const testRedirectURI = "https://app.example/login/mock/callback"
+
+var testIdentity = Identity{
+	Subject:       "alice-1",
+	Username:      "alice",
+	Email:         "alice@example.org",
+	EmailVerified: true,
+	Name:          "Alice",
+	Groups:        []string{"admins"},
+}
+
+// testServer serves the mock; tamper, if set, changes the claims of the
+// ID token issued by the token endpoint, which is then signed with signer
+type testServer struct {
+	*httptest.Server
+	idp    *Server
+	tamper func(jwt.MapClaims)
+	signer *auth.KeyManager
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	idp, err := New(s.URL, "app", "app-secret", testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.idp = idp
+	s.signer = idp.keys
+	return s
+}
+
+func (s *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/token" || s.tamper == nil {
+		s.idp.ServeHTTP(w, r)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	s.idp.ServeHTTP(recorder, r)
+	var tokens map[string]interface{}
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &tokens) != nil {
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+		return
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokens["id_token"].(string), claims); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.tamper(claims)
+	idToken, err := s.signer.SignClaims(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokens["id_token"] = idToken
+	utils.WriteJSONResponse(w, http.StatusOK, tokens)
+}
+
+func (s *testServer) provider(configure func(*config.IdentityProviderConfig)) *auth.UpstreamProvider {
+	providerConfig := config.IdentityProviderConfig{
+		ID:           "mock",
+		Issuer:       s.URL,
+		ClientID:     "app",
+		ClientSecret: "app-secret",
+		Claims:       config.IdentityClaimsConfig{Groups: "groups"},
+	}
+	if configure != nil {
+		configure(&providerConfig)
+	}
+	return auth.NewUpstreamProvider(providerConfig)
+}
+
+// login submits the login form of the authorization URL and returns the query
+// of the redirect back to the client
+func login(t *testing.T, authURL string, identity Identity) url.Values {
+	t.Helper()
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := parsed.Query()
+	form.Set("action", "login")
+	form.Set("sub", identity.Subject)
+	form.Set("preferred_username", identity.Username)
+	form.Set("email", identity.Email)
+	if identity.EmailVerified {
+		form.Set("email_verified", "true")
+	}
+	form.Set("name", identity.Name)
+	form.Set("groups", strings.Join(identity.Groups, ","))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	parsed.RawQuery = ""
+	resp, err := client.PostForm(parsed.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned status %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query()
+}
+
+func TestUpstreamLogin(t *testing.T) {
+	server := newTestServer(t)
+	provider := server.provider(func(p *config.IdentityProviderConfig) {
+		p.GroupRoles = map[string]string{"admins": "admin"}
+	})
+
+	verifier := utils.GenerateCodeVerifier()
+	authURL, err := provider.AuthCodeURL(testRedirectURI, "state-1", "nonce-1", verifier, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := login(t, authURL, testIdentity)
+	if callback.Get("state") != "state-1" {
+		t.Fatalf("state = %q, want state-1", callback.Get("state"))
+	}
+
+	identity, err := provider.Exchange(context.Background(), callback.Get("code"), testRedirectURI, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Subject != "alice-1" || identity.Username != "alice" || identity.Email != "alice@example.org" ||
+		!identity.EmailVerified || identity.Name != "Alice" || len(identity.Roles) != 1 || identity.Roles[0] != "admin" {
+		t.Errorf("identity = %+v, want the mapped claims of alice", identity)
+	}
+
+	// Codes are redeemed once
+	if _, err := provider.Exchange(context.Background(), callback.Get("code"), testRedirectURI, verifier, "nonce-1"); err == nil {
+		t.Error("Exchange accepted a redeemed code")
+	}
+}
+
+func TestUpstreamLoginRejectsMismatches(t *testing.T) {
+	server := newTestServer(t)
+	provider := server.provider(nil)
+
+	tests := []struct {
+		name        string
+		verifier    string
+		nonce       string
+		redirectURI string
+	}{
+		{"code verifier", utils.GenerateCodeVerifier(), "nonce-1", testRedirectURI},
+		{"nonce", "", "nonce-2", testRedirectURI},
+		{"redirect uri", "", "nonce-1", "https://evil.example/callback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := utils.GenerateCodeVerifier()
+			authURL, err := provider.AuthCodeURL(testRedirectURI, "state-1", "nonce-1", verifier, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			callback := login(t, authURL, testIdentity)
+
+			if tt.verifier != "" {
+				verifier = tt.verifier
+			}
+			if _, err := provider.Exchange(context.Background(), callback.Get("code"), tt.redirectURI, verifier, tt.nonce); err == nil {
+				t.Fatalf("Exchange accepted a login with a different %s", tt.name)
+			}
+		})
+	}
+}
+
+func TestUpstreamLoginRejectsIDTokens(t *testing.T) {
+	server := newTestServer(t)
+	provider := server.provider(nil)
+	otherKeys, err := auth.NewKeyManager(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(jwt.MapClaims)
+		signer *auth.KeyManager
+	}{
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://other.example" }, nil},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other-app" }, nil},
+		{"several audiences without azp", func(c jwt.MapClaims) { c["aud"] = []string{"app", "other-app"} }, nil},
+		{"authorized party", func(c jwt.MapClaims) { c["azp"] = "other-app" }, nil},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, nil},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }, nil},
+		{"unknown key", func(jwt.MapClaims) {}, otherKeys},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.tamper = tt.tamper
+			server.signer = server.idp.keys
+			if tt.signer != nil {
+				server.signer = tt.signer
+			}
+
+			verifier := utils.GenerateCodeVerifier()
+			authURL, err := provider.AuthCodeURL(testRedirectURI, "state-1", "nonce-1", verifier, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			callback := login(t, authURL, testIdentity)
+			if _, err := provider.Exchange(context.Background(), callback.Get("code"), testRedirectURI, verifier, "nonce-1"); err == nil {
+				t.Fatal("Exchange accepted the id_token")
+			}
+		})
+	}
+
+	// The same provider still accepts a valid token
+	server.tamper = func(c jwt.MapClaims) { c["aud"] = []string{"app", "other-app"}; c["azp"] = "app" }
+	server.signer = server.idp.keys
+	verifier := utils.GenerateCodeVerifier()
+	authURL, err := provider.AuthCodeURL(testRedirectURI, "state-1", "nonce-1", verifier, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := login(t, authURL, testIdentity)
+	if _, err := provider.Exchange(context.Background(), callback.Get("code"), testRedirectURI, verifier, "nonce-1"); err != nil {
+		t.Fatalf("Exchange of a token for several audiences with azp: %v", err)
+	}
+}
@@ -7,25 +7,30 @@ import (
 
 // ClientInfo represents client information
 type ClientInfo struct {
-	ID            string    `json:"client_id"`
-	Secret        string    `json:"client_secret,omitempty"`
-	Name          string    `json:"name,omitempty"`
-	Description   string    `json:"description,omitempty"`
-	RedirectURIs  []string  `json:"redirect_uris"`
-	GrantTypes    []string  `json:"grant_types"`
-	ResponseTypes []string  `json:"response_types"`
-	Scopes        []string  `json:"scopes"`
-	Audience      []string  `json:"audience,omitempty"`
-	ClientName    string    `json:"client_name,omitempty"`
-	ClientURI     string    `json:"client_uri,omitempty"`
-	LogoURI       string    `json:"logo_uri,omitempty"`
-	ContactEmails []string  `json:"contacts,omitempty"`
-	TOSUri        string    `json:"tos_uri,omitempty"`
-	PolicyURI     string    `json:"policy_uri,omitempty"`
-	JWKSURI       string    `json:"jwks_uri,omitempty"`
-	JWKSValue     string    `json:"jwks,omitempty"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID            string   `json:"client_id"`
+	Secret        string   `json:"client_secret,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Description   string   `json:"description,omitempty"`
+	RedirectURIs  []string `json:"redirect_uris"`
+	GrantTypes    []string `json:"grant_types"`
+	ResponseTypes []string `json:"response_types"`
+	Scopes        []string `json:"scopes"`
+	Audience      []string `json:"audience,omitempty"`
+	ClientName    string   `json:"client_name,omitempty"`
+	ClientURI     string   `json:"client_uri,omitempty"`
+	LogoURI       string   `json:"logo_uri,omitempty"`
+	ContactEmails []string `json:"contacts,omitempty"`
+	TOSUri        string   `json:"tos_uri,omitempty"`
+	PolicyURI     string   `json:"policy_uri,omitempty"`
+	JWKSURI       string   `json:"jwks_uri,omitempty"`
+	JWKSValue     string   `json:"jwks,omitempty"`
+	// Token exchange delegation settings (RFC 8693)
+	AllowImpersonation bool     `json:"allow_impersonation,omitempty"`
+	MayAct             []string `json:"may_act,omitempty"`
+	// TokenExchangePolicy restricts token exchange for this client
+	TokenExchangePolicy *TokenExchangePolicy `json:"token_exchange_policy,omitempty"`
+	CreatedAt           time.Time            `json:"created_at"`
+	UpdatedAt           time.Time            `json:"updated_at"`
 }
 
 // ClientRegistrationRequest represents a dynamic client registration request
@@ -2,6 +2,14 @@ package models
 
 import "time"
 
+// DefaultDevicePollInterval is the polling interval (in seconds) handed out to
+// devices when neither the client nor the server configuration sets one
+const DefaultDevicePollInterval = 5
+
+// SlowDownIncrement is the number of seconds added to a device's polling
+// interval each time it polls too fast (RFC 8628 Section 3.5)
+const SlowDownIncrement = 5
+
 // DeviceAuthorization represents a device authorization request
 type DeviceAuthorization struct {
 	DeviceCode   string    `json:"device_code"`
@@ -10,8 +18,13 @@ type DeviceAuthorization struct {
 	Scopes       []string  `json:"scopes"`
 	ExpiresAt    time.Time `json:"expires_at"`
 	IssuedAt     time.Time `json:"issued_at"`
+	Interval     int       `json:"interval"`
+	LastPolledAt time.Time `json:"last_polled_at,omitempty"`
 	Authorized   bool      `json:"authorized"`
+	Denied       bool      `json:"denied"`
 	UserID       string    `json:"user_id,omitempty"`
+	ConsentUser  string    `json:"-"`
+	ConsentToken string    `json:"-"`
 	AccessToken  string    `json:"access_token,omitempty"`
 	RefreshToken string    `json:"refresh_token,omitempty"`
 	TokenType    string    `json:"token_type,omitempty"`
@@ -25,7 +38,7 @@ func (d *DeviceAuthorization) IsExpired() bool {
 
 // IsPending checks if the device authorization is still pending
 func (d *DeviceAuthorization) IsPending() bool {
-	return !d.Authorized && !d.IsExpired()
+	return !d.Authorized && !d.Denied && !d.IsExpired()
 }
 
 // IsAuthorized checks if the device has been authorized by a user
@@ -33,9 +46,23 @@ func (d *DeviceAuthorization) IsAuthorized() bool {
 	return d.Authorized && !d.IsExpired()
 }
 
+// IsDenied checks if the user rejected the device authorization
+func (d *DeviceAuthorization) IsDenied() bool {
+	return d.Denied
+}
+
 // CanIssueToken checks if the device authorization can be used to issue a token
 func (d *DeviceAuthorization) CanIssueToken() bool {
-	return d.Authorized && !d.Used && !d.IsExpired()
+	return d.Authorized && !d.Denied && !d.Used && !d.IsExpired()
+}
+
+// PollingTooFast reports whether a poll at the given time arrives before the
+// current interval has elapsed since the previous poll
+func (d *DeviceAuthorization) PollingTooFast(now time.Time) bool {
+	if d.LastPolledAt.IsZero() {
+		return false
+	}
+	return now.Sub(d.LastPolledAt) < time.Duration(d.Interval)*time.Second
 }
 
 // DeviceCodeRequest represents a device authorization request
@@ -1,5 +1,78 @@
 package models
 
+// Token type identifiers for token exchange (RFC 8693 Section 3)
+const (
+	TokenTypeAccessToken  = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeRefreshToken = "urn:ietf:params:oauth:token-type:refresh_token"
+	TokenTypeIDToken      = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeJWT          = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// ActorClaim represents the "act" claim of a delegated token (RFC 8693 Section 4.1).
+// The top-level actor is the current one; nested actors are the prior delegation chain.
+type ActorClaim struct {
+	Subject  string      `json:"sub"`
+	ClientID string      `json:"client_id,omitempty"`
+	Act      *ActorClaim `json:"act,omitempty"`
+}
+
+// Depth returns the number of actors in the delegation chain
+func (a *ActorClaim) Depth() int {
+	depth := 0
+	for actor := a; actor != nil; actor = actor.Act {
+		depth++
+	}
+	return depth
+}
+
+// ActorClaimFromClaim converts a decoded JWT "act" claim into an ActorClaim
+func ActorClaimFromClaim(value interface{}) *ActorClaim {
+	claim, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	actor := &ActorClaim{}
+	actor.Subject, _ = claim["sub"].(string)
+	actor.ClientID, _ = claim["client_id"].(string)
+	actor.Act = ActorClaimFromClaim(claim["act"])
+
+	if actor.Subject == "" {
+		return nil
+	}
+	return actor
+}
+
+// TokenExchangePolicy restricts what a client may obtain through token exchange.
+// Empty lists and zero values leave the corresponding aspect unrestricted.
+type TokenExchangePolicy struct {
+	// SourceClients lists the clients (or trusted issuer URLs) whose tokens may
+	// be exchanged; "*" allows any
+	SourceClients []string `json:"source_clients,omitempty" yaml:"source_clients"`
+	// Audiences the client may request
+	Audiences []string `json:"audiences,omitempty" yaml:"audiences"`
+	// Scopes the exchanged token may carry
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes"`
+	// MaxChainDepth limits the number of actors in the act claim
+	MaxChainDepth int `json:"max_chain_depth,omitempty" yaml:"max_chain_depth"`
+	// Lifetime caps in seconds for issued access and refresh tokens
+	MaxAccessTokenLifetime  int `json:"max_access_token_lifetime,omitempty" yaml:"max_access_token_lifetime"`
+	MaxRefreshTokenLifetime int `json:"max_refresh_token_lifetime,omitempty" yaml:"max_refresh_token_lifetime"`
+}
+
+// AllowsSourceClient reports whether tokens issued to the source may be exchanged
+func (p *TokenExchangePolicy) AllowsSourceClient(source string) bool {
+	if len(p.SourceClients) == 0 {
+		return true
+	}
+	for _, allowed := range p.SourceClients {
+		if allowed == "*" || allowed == source {
+			return true
+		}
+	}
+	return false
+}
+
 // TokenRequest represents an OAuth2 token request
 type TokenRequest struct {
 	GrantType    string `json:"grant_type"`
@@ -42,6 +115,8 @@ type TokenExchangeRequest struct {
 	ClientSecret       string `json:"client_secret"`
 	SubjectToken       string `json:"subject_token"`
 	SubjectTokenType   string `json:"subject_token_type"`
+	ActorToken         string `json:"actor_token,omitempty"`
+	ActorTokenType     string `json:"actor_token_type,omitempty"`
 	RequestedTokenType string `json:"requested_token_type,omitempty"`
 	Audience           string `json:"audience,omitempty"`
 	Scope              string `json:"scope,omitempty"`
@@ -0,0 +1,113 @@
+// Package ratelimit throttles the protocol endpoints with token buckets. Every
+// endpoint has a bucket per client, source IP or user that holds up to its
+// burst of requests and refills at its rate; a request takes one token and is
+// refused while the bucket is empty.
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// Decision is the outcome of a request against the bucket of its key
+type Decision struct {
+	Allowed bool
+	// Limit is the size of the bucket and Remaining the requests left in it
+	Limit     int
+	Remaining int
+	// Window is how long an empty bucket takes to refill completely
+	Window time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, zero when
+	// this one was
+	RetryAfter time.Duration
+	// Unavailable is set when the buckets could not be reached and the
+	// limiter fails closed
+	Unavailable bool
+}
+
+// Limiter counts requests in the buckets of a storage. A nil limiter allows
+// everything.
+type Limiter struct {
+	config  *config.Config
+	storage store.RateLimitStorage
+	now     func() time.Time
+}
+
+// NewLimiter creates a limiter using the limits of cfg.RateLimit. Buckets are
+// kept in the storage backend when they are shared between replicas and in
+// process memory otherwise.
+func NewLimiter(backend store.Backend, cfg *config.Config) *Limiter {
+	storage := store.RateLimitStorage(store.NewMemoryRateLimits())
+	if cfg.RateLimit.Shared {
+		storage = backend.RateLimits()
+	}
+	return &Limiter{config: cfg, storage: storage, now: time.Now}
+}
+
+// Key returns what requests to endpoint are counted per
+func (l *Limiter) Key(endpoint string) string {
+	if l == nil {
+		return config.RateLimitKeyIP
+	}
+	return l.config.RateLimit.Limit(endpoint).Key
+}
+
+// Allow takes a token from the bucket of key at endpoint. When the buckets
+// cannot be reached, requests are allowed so a database outage does not take
+// the endpoints down with it, unless fail_closed is set.
+func (l *Limiter) Allow(ctx context.Context, endpoint, key string) Decision {
+	if l == nil {
+		return Decision{Allowed: true}
+	}
+
+	limit := l.config.RateLimit.Limit(endpoint)
+	interval := limit.Interval()
+	burst := float64(limit.Burst)
+	decision := Decision{Limit: limit.Burst, Window: time.Duration(limit.Burst) * interval}
+
+	now := l.now()
+	bucket, err := l.storage.UpdateRateLimitBucket(ctx, endpoint+":"+key, func(bucket *store.RateLimitBucket) {
+		tokens := burst
+		if !bucket.UpdatedAt.IsZero() {
+			elapsed := math.Max(0, float64(now.Sub(bucket.UpdatedAt)))
+			tokens = math.Min(burst, bucket.Tokens+elapsed/float64(interval))
+		}
+		decision.Allowed = tokens >= 1
+		if decision.Allowed {
+			tokens--
+		}
+		bucket.Tokens = tokens
+		bucket.UpdatedAt = now
+		bucket.ExpiresAt = now.Add(time.Duration((burst - tokens) * float64(interval)))
+	})
+	if err != nil {
+		if l.config.RateLimit.FailClosed {
+			log.Printf("❌ Rate limit of %s not checked, refusing the request: %v", endpoint, err)
+			return Decision{Unavailable: true, RetryAfter: interval}
+		}
+		log.Printf("⚠️ Rate limit of %s not checked, allowing the request: %v", endpoint, err)
+		return Decision{Allowed: true}
+	}
+
+	decision.Remaining = int(bucket.Tokens)
+	decision.Reset = bucket.ExpiresAt.Sub(now)
+	if !decision.Allowed {
+		decision.RetryAfter = time.Duration((1 - bucket.Tokens) * float64(interval))
+	}
+	return decision
+}
+
+// Prune forgets the buckets that are full again and returns how many were removed
+func (l *Limiter) Prune(ctx context.Context) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+	return l.storage.DeleteExpiredRateLimitBuckets(ctx, l.now())
+}
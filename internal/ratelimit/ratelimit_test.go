@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// newTestLimiter limits the token endpoint to a burst of 3 refilling one
+// request per second, on a clock the test moves
+func newTestLimiter(storage store.RateLimitStorage) (*Limiter, *time.Time) {
+	cfg := &config.Config{}
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Endpoints.Token = config.EndpointRateLimit{RequestsPerMinute: 60, Burst: 3, Key: config.RateLimitKeyClientID}
+	now := time.Unix(1700000000, 0)
+	return &Limiter{config: cfg, storage: storage, now: func() time.Time { return now }}, &now
+}
+
+func TestAllowRefillsTheBucket(t *testing.T) {
+	limiter, now := newTestLimiter(store.NewMemoryRateLimits())
+	ctx := context.Background()
+
+	for i, wantRemaining := range []int{2, 1, 0} {
+		decision := limiter.Allow(ctx, config.RateLimitEndpointToken, "ip:192.0.2.1")
+		if !decision.Allowed || decision.Remaining != wantRemaining {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i+1, decision, wantRemaining)
+		}
+	}
+	if decision := limiter.Allow(ctx, config.RateLimitEndpointToken, "ip:192.0.2.1"); decision.Allowed || decision.RetryAfter != time.Second {
+		t.Fatalf("request beyond the burst = %+v, want refused for 1s", decision)
+	}
+
+	// Other keys have their own bucket
+	if decision := limiter.Allow(ctx, config.RateLimitEndpointToken, "ip:192.0.2.2"); !decision.Allowed {
+		t.Fatal("bucket of another key is empty")
+	}
+
+	// Half a request is not enough; the refused request did not cost anything
+	*now = now.Add(500 * time.Millisecond)
+	decision := limiter.Allow(ctx, config.RateLimitEndpointToken, "ip:192.0.2.1")
+	if decision.Allowed || decision.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("request after 500ms = %+v, want refused for 500ms", decision)
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	decision = limiter.Allow(ctx, config.RateLimitEndpointToken, "ip:192.0.2.1")
+	if !decision.Allowed || decision.Remaining != 0 || decision.Reset != 3*time.Second {
+		t.Fatalf("request after 1s = %+v, want allowed with 0 remaining and full in 3s", decision)
+	}
+
+	// A bucket never holds more than its burst
+	*now = now.Add(time.Hour)
+	decision = limiter.Allow(ctx, config.RateLimitEndpointToken, "ip:192.0.2.1")
+	if decision.Remaining != 2 || decision.Limit != 3 || decision.Window != 3*time.Second {
+		t.Fatalf("request after an hour = %+v, want 2 of 3 remaining in a 3s window", decision)
+	}
+}
+
+// failingBuckets is a bucket storage whose database is down
+type failingBuckets struct{}
+
+func (failingBuckets) UpdateRateLimitBucket(context.Context, string, func(*store.RateLimitBucket)) (*store.RateLimitBucket, error) {
+	return nil, errors.New("database is down")
+}
+
+func (failingBuckets) DeleteExpiredRateLimitBuckets(context.Context, time.Time) (int, error) {
+	return 0, errors.New("database is down")
+}
+
+func TestAllowWhenTheBucketsCannotBeReached(t *testing.T) {
+	limiter, _ := newTestLimiter(failingBuckets{})
+
+	decision := limiter.Allow(context.Background(), config.RateLimitEndpointToken, "ip:192.0.2.1")
+	if !decision.Allowed || decision.Unavailable {
+		t.Errorf("failing open = %+v, want allowed", decision)
+	}
+
+	limiter.config.RateLimit.FailClosed = true
+	decision = limiter.Allow(context.Background(), config.RateLimitEndpointToken, "ip:192.0.2.1")
+	if decision.Allowed || !decision.Unavailable || decision.RetryAfter != time.Second {
+		t.Errorf("failing closed = %+v, want refused as unavailable for 1s", decision)
+	}
+}
@@ -0,0 +1,359 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// Change actions recorded in the log and the audit trail
+const (
+	ActionAdded   = "added"
+	ActionUpdated = "updated"
+	ActionRemoved = "removed"
+)
+
+// Change is one client or user that differs between two configurations
+type Change struct {
+	Kind   string // "client" or "user"
+	ID     string
+	Action string
+}
+
+// Reloader applies the clients and users of config.yaml to the running server.
+// Only entries that came from the configuration are touched; clients and users
+// created at runtime through /register, /api/clients or the admin API are left
+// alone. Other settings, including added or removed realms, still require a
+// restart.
+type Reloader struct {
+	path    string
+	targets []*target
+
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// target is the running configuration and stores of the server or of a realm
+type target struct {
+	realm   string
+	config  *config.Config
+	clients *store.ClientStore
+	users   *store.UserStore
+}
+
+// NewReloader creates a reloader for the running configuration
+func NewReloader(path string, cfg *config.Config, clients *store.ClientStore, users *store.UserStore) *Reloader {
+	r := &Reloader{
+		path:    path,
+		targets: []*target{{config: cfg, clients: clients, users: users}},
+	}
+	if info, err := os.Stat(path); err == nil {
+		r.modTime, r.size = info.ModTime(), info.Size()
+	}
+	return r
+}
+
+// AddRealm applies the clients and users of a realm to its configuration and store
+func (r *Reloader) AddRealm(name string, cfg *config.Config, clients *store.ClientStore, users *store.UserStore) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.targets = append(r.targets, &target{realm: name, config: cfg, clients: clients, users: users})
+}
+
+// ReloadIfChanged reloads the configuration when the file was modified since
+// the last reload; used to watch the file
+func (r *Reloader) ReloadIfChanged(ctx context.Context) (int, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	r.mutex.Lock()
+	unchanged := info.ModTime().Equal(r.modTime) && info.Size() == r.size
+	r.mutex.Unlock()
+	if unchanged {
+		return 0, nil
+	}
+	return r.Reload(ctx)
+}
+
+// Reload loads and validates the configuration file and applies the client and
+// user changes. An invalid file keeps the previous configuration. It returns
+// the number of applied changes.
+func (r *Reloader) Reload(ctx context.Context) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return 0, r.fail(fmt.Errorf("failed to read config file: %w", err))
+	}
+	// Remember the attempt so a broken file is not retried on every check
+	r.modTime, r.size = info.ModTime(), info.Size()
+
+	next, err := config.LoadFile(r.path)
+	if err != nil {
+		return 0, r.fail(err)
+	}
+	if err := next.Validate(); err != nil {
+		return 0, r.fail(fmt.Errorf("invalid configuration: %w", err))
+	}
+
+	applied := 0
+	var errs []error
+	for _, t := range r.targets {
+		if err := ctx.Err(); err != nil {
+			return applied, err
+		}
+		nextConfig := next
+		if t.realm != "" {
+			realmConfig, ok := next.Realm(t.realm)
+			if !ok {
+				log.Printf("⚠️ Realm %s was removed from the configuration, restart to remove it", t.realm)
+				continue
+			}
+			nextConfig = realmConfig
+		}
+		n, err := r.apply(ctx, t, nextConfig.Clients, nextConfig.Users)
+		applied += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("❌ Some configuration changes failed: %v", err)
+		return applied, err
+	}
+	return applied, nil
+}
+
+// apply diffs and applies the clients and users of one target
+func (r *Reloader) apply(ctx context.Context, t *target, nextClients []config.ClientConfig, nextUsers []config.UserConfig) (int, error) {
+	previousClients := t.config.ListClients()
+	previousUsers := t.config.ListUsers()
+	changes := diffClients(previousClients, nextClients)
+	changes = append(changes, diffUsers(previousUsers, nextUsers)...)
+	if len(changes) == 0 {
+		log.Printf("🔄 Configuration reloaded%s, no client or user changes", t.label())
+		return 0, nil
+	}
+
+	// Skip config clients whose ID is taken by a client created at runtime
+	fromConfig := make(map[string]bool, len(previousClients))
+	for _, client := range previousClients {
+		fromConfig[client.ID] = true
+	}
+	clients := nextClients[:0:0]
+	for _, client := range nextClients {
+		if !fromConfig[client.ID] && t.clients.ClientExists(client.ID) {
+			log.Printf("⚠️ Config client %s%s conflicts with a client registered at runtime, skipping", client.ID, t.label())
+			r.audit(t, Change{Kind: "client", ID: client.ID, Action: ActionAdded}, audit.OutcomeFailure, "client id registered at runtime")
+			continue
+		}
+		clients = append(clients, client)
+	}
+	byID := make(map[string]config.ClientConfig, len(clients))
+	for _, client := range clients {
+		byID[client.ID] = client
+	}
+
+	// Likewise skip config users whose username or ID belongs to a user created at runtime
+	userFromConfig := make(map[string]bool, len(previousUsers))
+	for _, user := range previousUsers {
+		userFromConfig[user.Username] = true
+	}
+	users := nextUsers[:0:0]
+	for _, user := range nextUsers {
+		if !userFromConfig[user.Username] && t.runtimeUserExists(user, userFromConfig) {
+			log.Printf("⚠️ Config user %s%s conflicts with a user created at runtime, skipping", user.Username, t.label())
+			r.audit(t, Change{Kind: "user", ID: user.Username, Action: ActionAdded}, audit.OutcomeFailure, "username or id created at runtime")
+			continue
+		}
+		users = append(users, user)
+	}
+	byUsername := make(map[string]config.UserConfig, len(users))
+	for _, user := range users {
+		byUsername[user.Username] = user
+	}
+
+	applied := 0
+	var errs []error
+	for _, change := range changes {
+		if err := ctx.Err(); err != nil {
+			return applied, err
+		}
+		var err error
+		switch change.Kind {
+		case "client":
+			client, ok := byID[change.ID]
+			if change.Action != ActionRemoved && !ok {
+				continue // skipped conflict
+			}
+			err = applyClient(t.clients, change, client)
+		case "user":
+			user, ok := byUsername[change.ID]
+			if change.Action != ActionRemoved && !ok {
+				continue // skipped conflict
+			}
+			err = applyUser(t.users, change, user)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			r.audit(t, change, audit.OutcomeFailure, err.Error())
+			continue
+		}
+		log.Printf("🔄 Config %s %s %s%s", change.Kind, change.ID, change.Action, t.label())
+		r.audit(t, change, audit.OutcomeSuccess, "")
+		applied++
+	}
+
+	t.config.ReplaceClientsAndUsers(clients, users)
+	log.Printf("🔄 Configuration reloaded%s, %d changes applied", t.label(), applied)
+	return applied, errors.Join(errs...)
+}
+
+// label names the realm of a target in log messages
+func (t *target) label() string {
+	if t.realm == "" {
+		return ""
+	}
+	return " in realm " + t.realm
+}
+
+// applyClient writes one client change to the store
+func applyClient(clients *store.ClientStore, change Change, client config.ClientConfig) error {
+	if change.Action == ActionRemoved {
+		if err := clients.DeleteClient(change.ID); err != nil && clients.ClientExists(change.ID) {
+			return fmt.Errorf("failed to remove client %s: %w", change.ID, err)
+		}
+		return nil
+	}
+	return clients.StoreConfigClient(client)
+}
+
+// applyUser writes one user change to the store
+func applyUser(users *store.UserStore, change Change, user config.UserConfig) error {
+	existing, found := users.GetUserByUsername(change.ID)
+	id := user.ID
+	if id == "" {
+		id = user.Username
+	}
+	// A removed user, or one whose ID changed, is deleted under its old ID
+	if found && (change.Action == ActionRemoved || existing.ID != id) {
+		if err := users.DeleteUser(existing.ID); err != nil {
+			return fmt.Errorf("failed to remove user %s: %w", change.ID, err)
+		}
+	}
+	if change.Action == ActionRemoved {
+		return nil
+	}
+	return users.StoreConfigUser(user)
+}
+
+// runtimeUserExists reports whether the username or ID of a config user
+// belongs to a user that did not come from the configuration
+func (t *target) runtimeUserExists(user config.UserConfig, fromConfig map[string]bool) bool {
+	if existing, found := t.users.GetUserByUsername(user.Username); found && !fromConfig[existing.Username] {
+		return true
+	}
+	if user.ID == "" {
+		return false
+	}
+	existing, found := t.users.GetUser(user.ID)
+	return found && !fromConfig[existing.Username]
+}
+
+// fail logs and audits a rejected reload
+func (r *Reloader) fail(err error) error {
+	log.Printf("❌ Configuration reload rejected, keeping the previous configuration: %v", err)
+	audit.Log(audit.Event{
+		Type:    "config_reload",
+		Outcome: audit.OutcomeFailure,
+		Reason:  err.Error(),
+	})
+	return err
+}
+
+// audit records one applied change
+func (r *Reloader) audit(t *target, change Change, outcome, reason string) {
+	event := audit.Event{
+		Type:    "config_" + change.Kind + "_" + change.Action,
+		Outcome: outcome,
+		Reason:  reason,
+		Details: map[string]interface{}{"source": r.path},
+	}
+	if t.realm != "" {
+		event.Details["realm"] = t.realm
+	}
+	if change.Kind == "client" {
+		event.ClientID = change.ID
+	} else {
+		event.Subject = change.ID
+	}
+	audit.Log(event)
+}
+
+// diffClients compares clients by ID
+func diffClients(previous, next []config.ClientConfig) []Change {
+	old := make(map[string]config.ClientConfig, len(previous))
+	for _, client := range previous {
+		old[client.ID] = client
+	}
+
+	var changes []Change
+	seen := make(map[string]bool, len(next))
+	for _, client := range next {
+		seen[client.ID] = true
+		existing, ok := old[client.ID]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: "client", ID: client.ID, Action: ActionAdded})
+		case !reflect.DeepEqual(existing, client):
+			changes = append(changes, Change{Kind: "client", ID: client.ID, Action: ActionUpdated})
+		}
+	}
+	for _, client := range previous {
+		if !seen[client.ID] {
+			changes = append(changes, Change{Kind: "client", ID: client.ID, Action: ActionRemoved})
+		}
+	}
+	return changes
+}
+
+// diffUsers compares users by username, which is what logins look up
+func diffUsers(previous, next []config.UserConfig) []Change {
+	old := make(map[string]config.UserConfig, len(previous))
+	for _, user := range previous {
+		old[user.Username] = user
+	}
+
+	var changes []Change
+	seen := make(map[string]bool, len(next))
+	for _, user := range next {
+		seen[user.Username] = true
+		existing, ok := old[user.Username]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: "user", ID: user.Username, Action: ActionAdded})
+		case !reflect.DeepEqual(existing, user):
+			changes = append(changes, Change{Kind: "user", ID: user.Username, Action: ActionUpdated})
+		}
+	}
+	for _, user := range previous {
+		if !seen[user.Username] {
+			changes = append(changes, Change{Kind: "user", ID: user.Username, Action: ActionRemoved})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,147 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+const testConfigHeader = `server:
+  port: 8080
+  host: localhost
+  base_url: http://localhost:8080
+security:
+  jwt_signing_key: test-secret
+`
+
+// newTestReloader loads the configuration from a temporary file into memory
+// stores, the way the server does at startup
+func newTestReloader(t *testing.T, yaml string) (*Reloader, string, *config.Config, *store.ClientStore, *store.UserStore) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, yaml)
+
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	backend := store.NewMemoryBackend()
+	clients := store.NewClientStore(backend.Clients())
+	users := store.NewUserStore(backend.Users())
+	if err := clients.LoadClientsFromConfig(cfg.Clients); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.LoadUsersFromConfig(cfg.Users); err != nil {
+		t.Fatal(err)
+	}
+	return NewReloader(path, cfg, clients, users), path, cfg, clients, users
+}
+
+func writeConfig(t *testing.T, path, yaml string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(testConfigHeader+yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const initialConfig = `clients:
+  - id: app
+    secret: app-secret
+    grant_types: [client_credentials]
+users:
+  - username: alice
+    password: alice-secret
+`
+
+func TestReloadRejectsInvalidConfiguration(t *testing.T) {
+	reloader, path, cfg, clients, _ := newTestReloader(t, initialConfig)
+
+	writeConfig(t, path, `clients:
+  - id: app
+    secret: app-secret
+    grant_types: [client_credentials]
+  - id: other
+    secret: other-secret
+    colour: red
+`)
+	if _, err := reloader.Reload(context.Background()); err == nil {
+		t.Fatal("configuration with an unknown field was applied")
+	}
+	if clients.ClientExists("other") {
+		t.Error("client of the rejected configuration was stored")
+	}
+	if got := cfg.ListClients(); len(got) != 1 || got[0].ID != "app" {
+		t.Errorf("configured clients = %+v, want the previous ones", got)
+	}
+}
+
+func TestReloadLeavesRuntimeEntriesAlone(t *testing.T) {
+	reloader, path, cfg, clients, users := newTestReloader(t, initialConfig)
+
+	if err := clients.StoreClient(&store.Client{ID: "registered", Secret: []byte("runtime-secret")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SaveUser(&store.User{ID: "user-bob", Username: "bob", Name: "Bob from SCIM", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// app is removed and new-app added; registered and bob conflict with
+	// entries created at runtime; alice changes and carol is added
+	writeConfig(t, path, `clients:
+  - id: new-app
+    secret: new-secret
+    grant_types: [client_credentials]
+  - id: registered
+    secret: config-secret
+    grant_types: [client_credentials]
+users:
+  - username: alice
+    password: alice-secret
+    name: Alice
+  - username: bob
+    password: bob-secret
+  - username: carol
+    password: carol-secret
+`)
+	applied, err := reloader.Reload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 4 {
+		t.Errorf("applied = %d, want 4", applied)
+	}
+
+	if clients.ClientExists("app") || !clients.ClientExists("new-app") {
+		t.Error("config clients were not replaced")
+	}
+	registered, err := clients.GetClient(context.Background(), "registered")
+	if err != nil || string(registered.(*store.Client).Secret) != "runtime-secret" {
+		t.Errorf("runtime client = %+v (%v), want it unchanged", registered, err)
+	}
+	if bob, _ := users.GetUserByUsername("bob"); bob == nil || bob.Name != "Bob from SCIM" {
+		t.Errorf("runtime user = %+v, want it unchanged", bob)
+	}
+	if alice, _ := users.GetUserByUsername("alice"); alice == nil || alice.Name != "Alice" {
+		t.Errorf("config user = %+v, want the new name", alice)
+	}
+	if _, found := users.GetUserByUsername("carol"); !found {
+		t.Error("added config user was not stored")
+	}
+	for _, client := range cfg.ListClients() {
+		if client.ID == "registered" {
+			t.Error("skipped client was recorded as configured")
+		}
+	}
+
+	// The conflicts are skipped again on the next reload
+	if applied, err := reloader.Reload(context.Background()); err != nil || applied != 0 {
+		t.Errorf("second reload = %d, %v, want nothing applied", applied, err)
+	}
+}
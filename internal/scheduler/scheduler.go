@@ -0,0 +1,212 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobFunc performs one run of a job and returns the number of items it processed
+// (e.g. removed expired records)
+type JobFunc func(ctx context.Context) (int, error)
+
+// JobStats are the metrics of one job
+type JobStats struct {
+	Name          string        `json:"name"`
+	Interval      time.Duration `json:"interval"`
+	Runs          int64         `json:"runs"`
+	Failures      int64         `json:"failures"`
+	Processed     int64         `json:"processed"`
+	LastRun       time.Time     `json:"last_run,omitempty"`
+	LastDuration  time.Duration `json:"last_duration"`
+	LastError     string        `json:"last_error,omitempty"`
+	LastProcessed int           `json:"last_processed"`
+}
+
+// job is a registered job and its metrics
+type job struct {
+	name     string
+	interval time.Duration
+	run      JobFunc
+	stats    JobStats
+}
+
+// Scheduler runs registered jobs at fixed intervals until it is stopped. Each run
+// gets a context that is cancelled on Stop or when the run exceeds its interval.
+type Scheduler struct {
+	jobs    []*job
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started bool
+	mutex   sync.Mutex
+}
+
+// NewScheduler creates an empty scheduler
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// Register adds a job. Jobs must be registered before Start.
+func (s *Scheduler) Register(name string, interval time.Duration, run JobFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started {
+		log.Printf("⚠️ Job %s registered after scheduler start, ignoring", name)
+		return
+	}
+
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		interval: interval,
+		run:      run,
+		stats:    JobStats{Name: name, Interval: interval},
+	})
+}
+
+// Start launches one goroutine per job
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started {
+		return
+	}
+	s.started = true
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, j)
+	}
+
+	log.Printf("⏱️ Scheduler started with %d jobs", len(s.jobs))
+}
+
+// Stop cancels running jobs and waits for their goroutines to exit
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	cancel := s.cancel
+	s.mutex.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	s.wg.Wait()
+
+	log.Printf("⏱️ Scheduler stopped")
+}
+
+// RunNow runs the named job immediately, e.g. a final snapshot during shutdown
+func (s *Scheduler) RunNow(ctx context.Context, name string) error {
+	for _, j := range s.jobs {
+		if j.name == name {
+			return s.execute(ctx, j)
+		}
+	}
+	return fmt.Errorf("unknown job: %s", name)
+}
+
+// loop runs a job at its interval until the context is cancelled
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runCtx, cancel := context.WithTimeout(ctx, j.interval)
+			s.execute(runCtx, j)
+			cancel()
+		}
+	}
+}
+
+// execute runs a job once and records its metrics
+func (s *Scheduler) execute(ctx context.Context, j *job) (err error) {
+	start := time.Now()
+	processed := 0
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+
+		s.mutex.Lock()
+		j.stats.Runs++
+		j.stats.Processed += int64(processed)
+		j.stats.LastRun = start
+		j.stats.LastDuration = time.Since(start)
+		j.stats.LastProcessed = processed
+		j.stats.LastError = ""
+		if err != nil {
+			j.stats.Failures++
+			j.stats.LastError = err.Error()
+		}
+		s.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("❌ Job %s failed: %v", j.name, err)
+		} else if processed > 0 {
+			log.Printf("🗑️ Job %s processed %d items", j.name, processed)
+		}
+	}()
+
+	processed, err = j.run(ctx)
+	return err
+}
+
+// Stats returns the metrics of all jobs ordered by name
+func (s *Scheduler) Stats() []JobStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := make([]JobStats, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		stats = append(stats, j.stats)
+	}
+	sort.Slice(stats, func(a, b int) bool { return stats[a].Name < stats[b].Name })
+	return stats
+}
+
+// WriteMetrics writes the job metrics in the Prometheus text exposition format
+func (s *Scheduler) WriteMetrics(w io.Writer) {
+	stats := s.Stats()
+
+	metrics := []struct {
+		name, help, kind string
+		value            func(JobStats) float64
+	}{
+		{"oauth2_job_runs_total", "Number of job runs.", "counter",
+			func(st JobStats) float64 { return float64(st.Runs) }},
+		{"oauth2_job_failures_total", "Number of failed job runs.", "counter",
+			func(st JobStats) float64 { return float64(st.Failures) }},
+		{"oauth2_job_processed_total", "Number of items processed by the job.", "counter",
+			func(st JobStats) float64 { return float64(st.Processed) }},
+		{"oauth2_job_last_run_timestamp_seconds", "Start time of the last job run.", "gauge",
+			func(st JobStats) float64 {
+				if st.LastRun.IsZero() {
+					return 0
+				}
+				return float64(st.LastRun.UnixNano()) / 1e9
+			}},
+		{"oauth2_job_last_duration_seconds", "Duration of the last job run.", "gauge",
+			func(st JobStats) float64 { return st.LastDuration.Seconds() }},
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, st := range stats {
+			fmt.Fprintf(w, "%s{job=%q} %g\n", metric.name, st.Name, metric.value(st))
+		}
+	}
+}
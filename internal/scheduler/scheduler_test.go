@@ -0,0 +1,147 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it holds or a second has passed
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerRunsJobsUntilStopped(t *testing.T) {
+	s := NewScheduler()
+
+	var runs atomic.Int64
+	s.Register("count", 5*time.Millisecond, func(ctx context.Context) (int, error) {
+		runs.Add(1)
+		return 2, nil
+	})
+	// blocking runs until its context is cancelled, after its interval or on Stop
+	blocking := make(chan struct{}, 1)
+	s.Register("blocking", 5*time.Millisecond, func(ctx context.Context) (int, error) {
+		select {
+		case blocking <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+
+	s.Start(context.Background())
+	waitFor(t, "repeated runs", func() bool { return runs.Load() >= 3 })
+	<-blocking
+
+	s.Stop()
+	stopped := runs.Load()
+	time.Sleep(20 * time.Millisecond)
+	if runs.Load() != stopped {
+		t.Errorf("job ran %d times after Stop", runs.Load()-stopped)
+	}
+
+	stats := s.Stats()
+	if len(stats) != 2 || stats[0].Name != "blocking" || stats[1].Name != "count" {
+		t.Fatalf("stats = %+v, want both jobs ordered by name", stats)
+	}
+	if count := stats[1]; count.Runs != stopped || count.Processed != 2*stopped || count.Failures != 0 {
+		t.Errorf("count stats = %+v, want %d runs processing 2 items each", count, stopped)
+	}
+	if blocked := stats[0]; blocked.Failures == 0 || blocked.LastError == "" {
+		t.Errorf("blocking stats = %+v, want the cancelled run recorded as a failure", blocked)
+	}
+}
+
+func TestRegisterAfterStartIsIgnored(t *testing.T) {
+	s := NewScheduler()
+	s.Start(context.Background())
+	defer s.Stop()
+
+	s.Register("late", time.Minute, func(ctx context.Context) (int, error) { return 0, nil })
+	if stats := s.Stats(); len(stats) != 0 {
+		t.Errorf("stats = %+v, want no jobs", stats)
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	tests := []struct {
+		name          string
+		run           JobFunc
+		wantErr       string
+		wantProcessed int64
+	}{
+		{
+			name:          "success",
+			run:           func(ctx context.Context) (int, error) { return 3, nil },
+			wantProcessed: 3,
+		},
+		{
+			name:    "failure",
+			run:     func(ctx context.Context) (int, error) { return 0, errors.New("storage unavailable") },
+			wantErr: "storage unavailable",
+		},
+		{
+			name:    "panic",
+			run:     func(ctx context.Context) (int, error) { panic("broken job") },
+			wantErr: "job panicked: broken job",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScheduler()
+			// The interval is never reached; the job only runs on demand
+			s.Register("job", time.Hour, tt.run)
+
+			err := s.RunNow(context.Background(), "job")
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("RunNow = %v, want %q", err, tt.wantErr)
+			}
+
+			stats := s.Stats()[0]
+			wantFailures := int64(0)
+			if tt.wantErr != "" {
+				wantFailures = 1
+			}
+			if stats.Runs != 1 || stats.Failures != wantFailures || stats.Processed != tt.wantProcessed || stats.LastError != tt.wantErr || stats.LastRun.IsZero() {
+				t.Errorf("stats = %+v, want one run", stats)
+			}
+		})
+	}
+
+	if err := NewScheduler().RunNow(context.Background(), "missing"); err == nil {
+		t.Error("RunNow ran an unknown job")
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := NewScheduler()
+	s.Register("cleanup", time.Hour, func(ctx context.Context) (int, error) { return 4, nil })
+	if err := s.RunNow(context.Background(), "cleanup"); err != nil {
+		t.Fatal(err)
+	}
+
+	var metrics strings.Builder
+	s.WriteMetrics(&metrics)
+	for _, line := range []string{
+		"# TYPE oauth2_job_runs_total counter",
+		`oauth2_job_runs_total{job="cleanup"} 1`,
+		`oauth2_job_failures_total{job="cleanup"} 0`,
+		`oauth2_job_processed_total{job="cleanup"} 4`,
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, metrics.String())
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// filter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2). It is
+// evaluated against the JSON form of a resource.
+type filter interface {
+	match(resource map[string]interface{}) bool
+}
+
+type logicalFilter struct {
+	and         bool
+	left, right filter
+}
+
+func (f *logicalFilter) match(resource map[string]interface{}) bool {
+	if f.and {
+		return f.left.match(resource) && f.right.match(resource)
+	}
+	return f.left.match(resource) || f.right.match(resource)
+}
+
+type notFilter struct {
+	inner filter
+}
+
+func (f *notFilter) match(resource map[string]interface{}) bool {
+	return !f.inner.match(resource)
+}
+
+// compareFilter compares an attribute with a value; the value is nil for "pr"
+type compareFilter struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+func (f *compareFilter) match(resource map[string]interface{}) bool {
+	values := lookup(resource, f.path)
+	switch f.op {
+	case "pr":
+		for _, value := range values {
+			if present(value) {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !(&compareFilter{path: f.path, op: "eq", value: f.value}).match(resource)
+	}
+
+	if f.value == nil {
+		// "eq null" matches absent attributes
+		return f.op == "eq" && !(&compareFilter{path: f.path, op: "pr"}).match(resource)
+	}
+	for _, value := range values {
+		if compare(value, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuePathFilter matches when an element of a multi-valued attribute matches the inner filter
+type valuePathFilter struct {
+	path  []string
+	inner filter
+}
+
+func (f *valuePathFilter) match(resource map[string]interface{}) bool {
+	for _, element := range elements(resource, f.path) {
+		if f.inner.match(element) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFilter parses a filter expression
+func parseFilter(expression string) (filter, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+type filterToken struct {
+	text string
+	// quoted is set for string literals
+	quoted bool
+}
+
+// tokenizeFilter splits a filter into words, string literals and brackets
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.ContainsRune("()[]", rune(c)):
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			var text string
+			if err := json.Unmarshal([]byte(expression[i:end+1]), &text); err != nil {
+				return nil, fmt.Errorf("invalid string %s", expression[i:end+1])
+			}
+			tokens = append(tokens, filterToken{text: text, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(expression) && !strings.ContainsRune(" \t()[]\"", rune(expression[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: expression[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// peekWord returns the next unquoted token in lower case
+func (p *filterParser) peekWord() string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return ""
+	}
+	return strings.ToLower(p.tokens[p.pos].text)
+}
+
+func (p *filterParser) expect(text string) error {
+	if p.peekWord() != text {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected %q at end of filter", text)
+		}
+		return fmt.Errorf("expected %q, got %q", text, p.tokens[p.pos].text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) parseOr() (filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord() == "and" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalFilter{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filter, error) {
+	switch p.peekWord() {
+	case "":
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("unexpected end of filter")
+		}
+		return nil, fmt.Errorf("unexpected string %q", p.tokens[p.pos].text)
+	case "not":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &notFilter{inner: inner}, nil
+	case "(":
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	path := attributePath(p.tokens[p.pos].text)
+	p.pos++
+
+	if p.peekWord() == "[" {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &valuePathFilter{path: path, inner: inner}, nil
+	}
+
+	op := p.peekWord()
+	switch op {
+	case "pr":
+		p.pos++
+		return &compareFilter{path: path, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+		p.pos++
+	default:
+		return nil, fmt.Errorf("expected an operator after %s", strings.Join(path, "."))
+	}
+
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("expected a value after %s", op)
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	if token.quoted {
+		return &compareFilter{path: path, op: op, value: token.text}, nil
+	}
+	switch strings.ToLower(token.text) {
+	case "true":
+		return &compareFilter{path: path, op: op, value: true}, nil
+	case "false":
+		return &compareFilter{path: path, op: op, value: false}, nil
+	case "null":
+		return &compareFilter{path: path, op: op}, nil
+	}
+	number, err := strconv.ParseFloat(token.text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", token.text)
+	}
+	return &compareFilter{path: path, op: op, value: number}, nil
+}
+
+// attributePath splits an attribute path into its names, dropping a schema
+// URN prefix such as urn:ietf:params:scim:schemas:core:2.0:User:
+func attributePath(path string) []string {
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		path = path[i+1:]
+	}
+	return strings.Split(path, ".")
+}
+
+// lookup returns the values at path. Multi-valued attributes contribute all
+// elements, and complex elements compare by their "value" sub-attribute.
+func lookup(value interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		switch v := value.(type) {
+		case []interface{}:
+			var values []interface{}
+			for _, element := range v {
+				values = append(values, lookup(element, nil)...)
+			}
+			return values
+		case map[string]interface{}:
+			if inner, ok := v[findKey(v, "value")]; ok {
+				return []interface{}{inner}
+			}
+			return nil
+		}
+		return []interface{}{value}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		inner, ok := v[findKey(v, path[0])]
+		if !ok {
+			return nil
+		}
+		return lookup(inner, path[1:])
+	case []interface{}:
+		var values []interface{}
+		for _, element := range v {
+			values = append(values, lookup(element, path)...)
+		}
+		return values
+	}
+	return nil
+}
+
+// elements returns the complex elements of a multi-valued attribute
+func elements(resource map[string]interface{}, path []string) []map[string]interface{} {
+	var result []map[string]interface{}
+	var value interface{} = resource
+	for _, name := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[findKey(m, name)]
+	}
+	list, _ := value.([]interface{})
+	for _, element := range list {
+		if m, ok := element.(map[string]interface{}); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// findKey returns the key of m that matches name case-insensitively, or name
+func findKey(m map[string]interface{}, name string) string {
+	if _, ok := m[name]; ok {
+		return name
+	}
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// present reports whether a value counts as set for "pr"
+func present(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// compare applies a comparison operator. Strings compare case-insensitively;
+// timestamps are RFC 3339 strings in UTC and therefore compare as strings.
+func compare(actual interface{}, op string, expected interface{}) bool {
+	switch want := expected.(type) {
+	case string:
+		got, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		got, want = strings.ToLower(got), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return got == want
+		case "co":
+			return strings.Contains(got, want)
+		case "sw":
+			return strings.HasPrefix(got, want)
+		case "ew":
+			return strings.HasSuffix(got, want)
+		case "gt":
+			return got > want
+		case "ge":
+			return got >= want
+		case "lt":
+			return got < want
+		case "le":
+			return got <= want
+		}
+	case bool:
+		got, ok := actual.(bool)
+		return ok && op == "eq" && got == want
+	case float64:
+		got, ok := actual.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return got == want
+		case "gt":
+			return got > want
+		case "ge":
+			return got >= want
+		case "lt":
+			return got < want
+		case "le":
+			return got <= want
+		}
+	}
+	return false
+}
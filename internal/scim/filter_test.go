@@ -0,0 +1,119 @@
+package scim
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// testResource returns the JSON form of a user for filter and patch tests
+func testResource(t testing.TB) map[string]interface{} {
+	t.Helper()
+	var resource map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"id": "user-1",
+		"userName": "alice",
+		"name": {"givenName": "Alice", "familyName": "Smith"},
+		"active": true,
+		"emails": [
+			{"value": "alice@work.example", "type": "work", "primary": true},
+			{"value": "alice@home.example", "type": "home"}
+		],
+		"groups": [{"value": "group-1", "display": "admins"}],
+		"meta": {"lastModified": "2024-05-01T12:00:00Z", "version": "W/\"1\""}
+	}`), &resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resource
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`userName eq "alice"`, true},
+		{`userName eq "ALICE"`, true},
+		{`UserName Eq "alice"`, true},
+		{`userName ne "alice"`, false},
+		{`userName eq "bob"`, false},
+		{`userName co "lic"`, true},
+		{`userName sw "al"`, true},
+		{`userName ew "ce"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice"`, true},
+		{`name.familyName eq "Smith"`, true},
+		{`name.middleName pr`, false},
+		{`name.middleName eq null`, true},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`emails pr`, true},
+		{`emails eq "alice@home.example"`, true},
+		{`emails.type eq "home"`, true},
+		{`emails[type eq "work" and value co "work"]`, true},
+		{`emails[type eq "work" and value co "home"]`, false},
+		{`groups[display eq "admins"]`, true},
+		{`meta.lastModified gt "2024-01-01T00:00:00Z"`, true},
+		{`meta.lastModified lt "2024-01-01T00:00:00Z"`, false},
+		{`userName eq "bob" or name.givenName eq "Alice"`, true},
+		{`userName eq "bob" or userName eq "carol" and active eq true`, false},
+		{`(userName eq "bob" or userName eq "alice") and active eq true`, true},
+		{`not (userName eq "alice")`, false},
+		{`not (userName eq "bob") and emails[type eq "home"]`, true},
+	}
+
+	resource := testResource(t)
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := parseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("parseFilter = %v", err)
+			}
+			if got := f.match(resource); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName equals "alice"`,
+		`userName eq alice`,
+		`userName eq "alice`,
+		`"alice" eq userName`,
+		`(userName eq "alice"`,
+		`userName eq "alice")`,
+		`emails[type eq "work"`,
+		`not userName eq "alice"`,
+		`userName eq "alice" and`,
+	} {
+		if _, err := parseFilter(expression); err == nil {
+			t.Errorf("parseFilter(%q) succeeded", expression)
+		}
+	}
+}
+
+func FuzzParseFilter(f *testing.F) {
+	for _, seed := range []string{
+		`userName eq "alice"`,
+		`emails[type eq "work" and value co "@"]`,
+		`not (active eq false) or meta.lastModified gt "2024-01-01T00:00:00Z"`,
+		`name.familyName pr`,
+		`x eq "\"\\"`,
+	} {
+		f.Add(seed)
+	}
+
+	resource := testResource(f)
+	f.Fuzz(func(t *testing.T, expression string) {
+		parsed, err := parseFilter(expression)
+		if err != nil {
+			return
+		}
+		parsed.match(resource)
+	})
+}
@@ -0,0 +1,273 @@
+package scim
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// PatchRequest is the body of a PATCH request (RFC 7644 section 3.5.2)
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation adds, replaces or removes the attribute at Path, or the
+// attributes of Value when Path is empty
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchPath is a parsed operation path: attr[filter].sub
+type patchPath struct {
+	attribute []string
+	filter    filter
+	sub       string
+}
+
+// parsePatchPath parses the path of an operation
+func parsePatchPath(path string) (*patchPath, error) {
+	open := strings.Index(path, "[")
+	if open < 0 {
+		return &patchPath{attribute: attributePath(path)}, nil
+	}
+
+	end := strings.LastIndex(path, "]")
+	if end < open {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+	f, err := parseFilter(path[open+1 : end])
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	parsed := &patchPath{attribute: attributePath(path[:open]), filter: f}
+	if rest := path[end+1:]; rest != "" {
+		if !strings.HasPrefix(rest, ".") || strings.Contains(rest[1:], ".") {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+		parsed.sub = rest[1:]
+	}
+	return parsed, nil
+}
+
+// applyPatch applies the operations to the JSON form of a resource
+func applyPatch(resource map[string]interface{}, operations []PatchOperation) error {
+	if len(operations) == 0 {
+		return invalidValue("no operations")
+	}
+	for _, operation := range operations {
+		if err := applyOperation(resource, operation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyOperation(resource map[string]interface{}, operation PatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return invalidValue("unknown op %q", operation.Op)
+	}
+
+	if operation.Path == "" {
+		if op == "remove" {
+			return &Error{Status: 400, Type: "noTarget", Detail: "remove requires a path"}
+		}
+		values, ok := operation.Value.(map[string]interface{})
+		if !ok {
+			return invalidValue("value must be an object when path is empty")
+		}
+		for name, value := range values {
+			path, err := parsePatchPath(name)
+			if err != nil {
+				return invalidPath(err)
+			}
+			if err := setAttribute(resource, path.attribute, value, op == "add"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path, err := parsePatchPath(operation.Path)
+	if err != nil {
+		return invalidPath(err)
+	}
+	if path.filter != nil {
+		return applyFiltered(resource, op, path, operation.Value)
+	}
+	if op == "remove" {
+		return removeAttribute(resource, path.attribute, operation.Value)
+	}
+	return setAttribute(resource, path.attribute, operation.Value, op == "add")
+}
+
+// setAttribute replaces the attribute at path; with add, values are appended
+// to multi-valued attributes instead. Complex values are merged.
+func setAttribute(resource map[string]interface{}, path []string, value interface{}, add bool) error {
+	parent := resource
+	for _, name := range path[:len(path)-1] {
+		key := findKey(parent, name)
+		child, ok := parent[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			parent[key] = child
+		}
+		parent = child
+	}
+
+	key := findKey(parent, path[len(path)-1])
+	existing, isList := parent[key].([]interface{})
+	if nested, ok := value.(map[string]interface{}); ok && !isList {
+		// A complex value sets the given sub-attributes and keeps the others
+		target, ok := parent[key].(map[string]interface{})
+		if !ok {
+			target = make(map[string]interface{})
+			parent[key] = target
+		}
+		for name, inner := range nested {
+			target[findKey(target, name)] = inner
+		}
+		return nil
+	}
+	if !add || !isList {
+		parent[key] = value
+		return nil
+	}
+
+	added, ok := value.([]interface{})
+	if !ok {
+		added = []interface{}{value}
+	}
+	for _, element := range added {
+		if !containsElement(existing, element) {
+			existing = append(existing, element)
+		}
+	}
+	parent[key] = existing
+	return nil
+}
+
+// removeAttribute removes the attribute at path, or only the given elements
+// of a multi-valued attribute
+func removeAttribute(resource map[string]interface{}, path []string, value interface{}) error {
+	parent := resource
+	for _, name := range path[:len(path)-1] {
+		child, ok := parent[findKey(parent, name)].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		parent = child
+	}
+
+	key := findKey(parent, path[len(path)-1])
+	existing, isList := parent[key].([]interface{})
+	removed, hasValues := value.([]interface{})
+	if element, ok := value.(map[string]interface{}); ok {
+		removed, hasValues = []interface{}{element}, true
+	}
+	if !isList || !hasValues {
+		delete(parent, key)
+		return nil
+	}
+
+	kept := existing[:0]
+	for _, element := range existing {
+		if !containsElement(removed, element) {
+			kept = append(kept, element)
+		}
+	}
+	parent[key] = kept
+	return nil
+}
+
+// applyFiltered changes or removes the elements of a multi-valued attribute
+// that match the path filter. Adding or replacing a sub-attribute with an "eq"
+// filter and no matching element creates the element, e.g.
+// emails[type eq "work"].value, the way identity providers provision it.
+func applyFiltered(resource map[string]interface{}, op string, path *patchPath, value interface{}) error {
+	parent := resource
+	for _, name := range path.attribute[:len(path.attribute)-1] {
+		child, ok := parent[findKey(parent, name)].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			parent[findKey(parent, name)] = child
+		}
+		parent = child
+	}
+	key := findKey(parent, path.attribute[len(path.attribute)-1])
+	existing, _ := parent[key].([]interface{})
+
+	matched := false
+	var kept []interface{}
+	for _, element := range existing {
+		m, ok := element.(map[string]interface{})
+		if !ok || !path.filter.match(m) {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+		switch {
+		case op == "remove" && path.sub == "":
+			continue
+		case op == "remove":
+			delete(m, findKey(m, path.sub))
+		case path.sub != "":
+			m[findKey(m, path.sub)] = value
+		default:
+			replacement, ok := value.(map[string]interface{})
+			if !ok {
+				return invalidValue("value must be an object")
+			}
+			for name, inner := range replacement {
+				m[findKey(m, name)] = inner
+			}
+		}
+		kept = append(kept, m)
+	}
+
+	if !matched {
+		if op == "remove" {
+			return nil
+		}
+		compare, ok := path.filter.(*compareFilter)
+		if !ok || compare.op != "eq" || len(compare.path) != 1 || path.sub == "" {
+			return &Error{Status: 400, Type: "noTarget", Detail: "no value matches the path filter"}
+		}
+		kept = append(kept, map[string]interface{}{compare.path[0]: compare.value, path.sub: value})
+	}
+	if kept == nil {
+		kept = []interface{}{}
+	}
+	parent[key] = kept
+	return nil
+}
+
+// containsElement compares complex elements by their "value" sub-attribute
+func containsElement(list []interface{}, element interface{}) bool {
+	for _, existing := range list {
+		if sameElement(existing, element) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameElement(a, b interface{}) bool {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if aok && bok {
+		av, aHas := am[findKey(am, "value")]
+		bv, bHas := bm[findKey(bm, "value")]
+		if aHas && bHas {
+			return reflect.DeepEqual(av, bv)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func invalidPath(err error) error {
+	return &Error{Status: 400, Type: "invalidPath", Detail: err.Error()}
+}
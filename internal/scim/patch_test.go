@@ -0,0 +1,211 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// decodeJSON decodes a JSON literal of a test case
+func decodeJSON(t testing.TB, literal string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(literal), &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// patchOperation builds an operation with a JSON value, or no value when
+// value is empty
+func patchOperation(t testing.TB, op, path, value string) PatchOperation {
+	t.Helper()
+	operation := PatchOperation{Op: op, Path: path}
+	if value != "" {
+		operation.Value = decodeJSON(t, value)
+	}
+	return operation
+}
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    string
+		path  string
+		value string
+		// attribute is the top-level attribute compared with want
+		attribute string
+		want      string
+	}{
+		{
+			name: "replace a simple attribute",
+			op:   "replace", path: "userName", value: `"alice2"`,
+			attribute: "userName", want: `"alice2"`,
+		},
+		{
+			name: "op and attribute names are case insensitive",
+			op:   "Replace", path: "USERNAME", value: `"alice2"`,
+			attribute: "userName", want: `"alice2"`,
+		},
+		{
+			name: "replace with a URN prefix",
+			op:   "replace", path: "urn:ietf:params:scim:schemas:core:2.0:User:active", value: `false`,
+			attribute: "active", want: `false`,
+		},
+		{
+			name: "replace a sub-attribute",
+			op:   "replace", path: "name.givenName", value: `"Ally"`,
+			attribute: "name", want: `{"givenName": "Ally", "familyName": "Smith"}`,
+		},
+		{
+			name: "replace a complex attribute keeps the other sub-attributes",
+			op:   "replace", path: "name", value: `{"familyName": "Jones"}`,
+			attribute: "name", want: `{"givenName": "Alice", "familyName": "Jones"}`,
+		},
+		{
+			name: "add a new attribute",
+			op:   "add", path: "title", value: `"Engineer"`,
+			attribute: "title", want: `"Engineer"`,
+		},
+		{
+			name: "add appends to a multi-valued attribute",
+			op:   "add", path: "groups", value: `[{"value": "group-2"}]`,
+			attribute: "groups", want: `[{"value": "group-1", "display": "admins"}, {"value": "group-2"}]`,
+		},
+		{
+			name: "add skips elements that are already present",
+			op:   "add", path: "groups", value: `[{"value": "group-1"}, {"value": "group-2"}]`,
+			attribute: "groups", want: `[{"value": "group-1", "display": "admins"}, {"value": "group-2"}]`,
+		},
+		{
+			name: "replace a multi-valued attribute",
+			op:   "replace", path: "groups", value: `[{"value": "group-2"}]`,
+			attribute: "groups", want: `[{"value": "group-2"}]`,
+		},
+		{
+			name: "add without a path",
+			op:   "add", value: `{"title": "Engineer", "name.givenName": "Ally"}`,
+			attribute: "name", want: `{"givenName": "Ally", "familyName": "Smith"}`,
+		},
+		{
+			name: "remove an attribute",
+			op:   "remove", path: "name.familyName",
+			attribute: "name", want: `{"givenName": "Alice"}`,
+		},
+		{
+			name: "remove a multi-valued attribute",
+			op:   "remove", path: "groups",
+			attribute: "groups", want: `null`,
+		},
+		{
+			name: "remove elements of a multi-valued attribute",
+			op:   "remove", path: "emails", value: `[{"value": "alice@home.example"}]`,
+			attribute: "emails", want: `[{"value": "alice@work.example", "type": "work", "primary": true}]`,
+		},
+		{
+			name: "replace a sub-attribute of matching elements",
+			op:   "replace", path: `emails[type eq "work"].value`, value: `"alice@new.example"`,
+			attribute: "emails", want: `[{"value": "alice@new.example", "type": "work", "primary": true}, {"value": "alice@home.example", "type": "home"}]`,
+		},
+		{
+			name: "replace matching elements",
+			op:   "replace", path: `emails[type eq "home"]`, value: `{"value": "alice@elsewhere.example"}`,
+			attribute: "emails", want: `[{"value": "alice@work.example", "type": "work", "primary": true}, {"value": "alice@elsewhere.example", "type": "home"}]`,
+		},
+		{
+			name: "add creates the element an eq filter selects",
+			op:   "add", path: `emails[type eq "other"].value`, value: `"alice@other.example"`,
+			attribute: "emails", want: `[{"value": "alice@work.example", "type": "work", "primary": true}, {"value": "alice@home.example", "type": "home"}, {"value": "alice@other.example", "type": "other"}]`,
+		},
+		{
+			name: "replace creates the element an eq filter selects",
+			op:   "replace", path: `emails[type eq "other"].value`, value: `"alice@other.example"`,
+			attribute: "emails", want: `[{"value": "alice@work.example", "type": "work", "primary": true}, {"value": "alice@home.example", "type": "home"}, {"value": "alice@other.example", "type": "other"}]`,
+		},
+		{
+			name: "remove matching elements",
+			op:   "remove", path: `emails[type eq "work"]`,
+			attribute: "emails", want: `[{"value": "alice@home.example", "type": "home"}]`,
+		},
+		{
+			name: "remove a sub-attribute of matching elements",
+			op:   "remove", path: `emails[primary eq true].primary`,
+			attribute: "emails", want: `[{"value": "alice@work.example", "type": "work"}, {"value": "alice@home.example", "type": "home"}]`,
+		},
+		{
+			name: "remove without a match changes nothing",
+			op:   "remove", path: `emails[type eq "other"]`,
+			attribute: "emails", want: `[{"value": "alice@work.example", "type": "work", "primary": true}, {"value": "alice@home.example", "type": "home"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := testResource(t)
+			if err := applyPatch(resource, []PatchOperation{patchOperation(t, tt.op, tt.path, tt.value)}); err != nil {
+				t.Fatalf("applyPatch = %v", err)
+			}
+			if got, want := resource[tt.attribute], decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s = %v, want %v", tt.attribute, got, want)
+			}
+		})
+	}
+}
+
+func TestApplyPatchErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       string
+		path     string
+		value    string
+		wantType string
+	}{
+		{name: "unknown op", op: "move", path: "userName", value: `"bob"`, wantType: "invalidValue"},
+		{name: "remove without a path", op: "remove", wantType: "noTarget"},
+		{name: "add without a path or object", op: "add", value: `"bob"`, wantType: "invalidValue"},
+		{name: "unterminated filter", op: "replace", path: `emails[type eq "work".value`, value: `"x"`, wantType: "invalidPath"},
+		{name: "invalid filter", op: "replace", path: `emails[type is "work"].value`, value: `"x"`, wantType: "invalidPath"},
+		{name: "nested sub-attribute", op: "replace", path: `emails[type eq "work"].value.x`, value: `"x"`, wantType: "invalidPath"},
+		{name: "invalid path without a filter", op: "add", value: `{"emails[type": "x"}`, wantType: "invalidPath"},
+		{name: "replace without a match for a non-eq filter", op: "replace", path: `emails[type sw "other"].value`, value: `"x"`, wantType: "noTarget"},
+		{name: "add without a match for a non-eq filter", op: "add", path: `emails[type co "other"].value`, value: `"x"`, wantType: "noTarget"},
+		{name: "replace matching elements with a non-object", op: "replace", path: `emails[type eq "work"]`, value: `"x"`, wantType: "invalidValue"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := applyPatch(testResource(t), []PatchOperation{patchOperation(t, tt.op, tt.path, tt.value)})
+			var scimErr *Error
+			if !errors.As(err, &scimErr) || scimErr.Status != 400 || scimErr.Type != tt.wantType {
+				t.Errorf("applyPatch = %v, want a %s error", err, tt.wantType)
+			}
+		})
+	}
+
+	if err := applyPatch(testResource(t), nil); err == nil {
+		t.Error("patch without operations was applied")
+	}
+}
+
+func FuzzParsePatchPath(f *testing.F) {
+	for _, seed := range []string{
+		`userName`,
+		`name.givenName`,
+		`urn:ietf:params:scim:schemas:core:2.0:User:emails`,
+		`emails[type eq "work"].value`,
+		`members[value eq "user-1"]`,
+		`emails[type eq "work" and not (primary eq true)]`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		if _, err := parsePatchPath(path); err != nil {
+			return
+		}
+		for _, op := range []string{"add", "replace", "remove"} {
+			applyOperation(testResource(t), PatchOperation{Op: op, Path: path, Value: "x"})
+		}
+	})
+}
@@ -0,0 +1,248 @@
+// Package scim implements SCIM 2.0 provisioning (RFC 7643, RFC 7644) of users
+// and groups on top of the user store. Groups map onto user roles: the members
+// of a group are the users that have its display name as a role.
+package scim
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schema URNs
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// Paging limits of list requests
+const (
+	DefaultCount = 100
+	MaxCount     = 1000
+)
+
+// User is the SCIM representation of a user account
+type User struct {
+	Schemas     []string   `json:"schemas"`
+	ID          string     `json:"id,omitempty"`
+	ExternalID  string     `json:"externalId,omitempty"`
+	UserName    string     `json:"userName"`
+	Name        *Name      `json:"name,omitempty"`
+	DisplayName string     `json:"displayName,omitempty"`
+	Emails      []Email    `json:"emails,omitempty"`
+	Active      *Bool      `json:"active,omitempty"`
+	Password    string     `json:"password,omitempty"`
+	Groups      []GroupRef `json:"groups,omitempty"`
+	Meta        *Meta      `json:"meta,omitempty"`
+}
+
+// Name is the name of a user
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+}
+
+// Email is an email address of a user; the server keeps the primary one
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary Bool   `json:"primary,omitempty"`
+}
+
+// GroupRef is a group a user belongs to
+type GroupRef struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// Group is the SCIM representation of a role
+type Group struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []Member `json:"members"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// Member is a user in a group
+type Member struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// Meta describes a resource
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+	Version      string    `json:"version"`
+}
+
+// ListResponse is a page of query results
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// Query selects and pages the resources of a list request
+type Query struct {
+	Filter     string
+	StartIndex int
+	Count      int
+}
+
+// Bool accepts the "True" and "False" strings some provisioning clients send
+type Bool bool
+
+// UnmarshalJSON decodes a boolean or a boolean string
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = Bool(v)
+	case string:
+		switch strings.ToLower(v) {
+		case "true":
+			*b = true
+		case "false":
+			*b = false
+		default:
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// Error is a SCIM error response; Type is the scimType of the error
+type Error struct {
+	Status int
+	Type   string
+	Detail string
+}
+
+func (e *Error) Error() string { return e.Detail }
+
+// MarshalJSON writes the error in the SCIM format, with the status as a string
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}{[]string{SchemaError}, fmt.Sprint(e.Status), e.Type, e.Detail})
+}
+
+func invalidValue(format string, args ...interface{}) error {
+	return &Error{Status: 400, Type: "invalidValue", Detail: fmt.Sprintf(format, args...)}
+}
+
+func notFound(kind, id string) error {
+	return &Error{Status: 404, Detail: fmt.Sprintf("%s %s not found", kind, id)}
+}
+
+func uniqueness(format string, args ...interface{}) error {
+	return &Error{Status: 409, Type: "uniqueness", Detail: fmt.Sprintf(format, args...)}
+}
+
+func mutability(format string, args ...interface{}) error {
+	return &Error{Status: 400, Type: "mutability", Detail: fmt.Sprintf(format, args...)}
+}
+
+// ErrPreconditionFailed is returned when If-Match does not match the current version
+var ErrPreconditionFailed = &Error{Status: 412, Detail: "resource was modified, version does not match If-Match"}
+
+// version computes the weak ETag of a resource from its content
+func version(resource interface{}) string {
+	data, _ := json.Marshal(resource)
+	sum := sha256.Sum256(data)
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// checkVersion compares an If-Match header with the current version
+func checkVersion(ifMatch, current string) error {
+	if ifMatch == "" || ifMatch == "*" {
+		return nil
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(candidate) == current {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// toMap converts a resource to its JSON form for filtering and patching
+func toMap(resource interface{}) map[string]interface{} {
+	data, _ := json.Marshal(resource)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
+
+// fromMap converts the JSON form of a resource back
+func fromMap(m map[string]interface{}, resource interface{}) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, resource); err != nil {
+		return invalidValue("invalid resource after patch: %v", err)
+	}
+	return nil
+}
+
+// page applies startIndex and count to the matching resources
+func page(resources []interface{}, query Query) *ListResponse {
+	start := query.StartIndex
+	if start < 1 {
+		start = 1
+	}
+	count := query.Count
+	switch {
+	case count < 0:
+		count = 0
+	case count > MaxCount:
+		count = MaxCount
+	}
+
+	response := &ListResponse{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   start,
+		Resources:    []interface{}{},
+	}
+	if start <= len(resources) {
+		end := start - 1 + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		response.Resources = resources[start-1 : end]
+	}
+	response.ItemsPerPage = len(response.Resources)
+	return response
+}
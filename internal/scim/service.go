@@ -0,0 +1,666 @@
+package scim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/admin"
+	"oauth2-server/internal/audit"
+	"oauth2-server/internal/store"
+	"oauth2-server/internal/utils"
+	"oauth2-server/pkg/config"
+)
+
+// Attributes of store.User that hold SCIM name parts; they are also returned
+// as the OpenID Connect claims of the same name
+const (
+	attributeGivenName  = "given_name"
+	attributeFamilyName = "family_name"
+)
+
+// Service provisions users and groups. Users defined in config.yaml are
+// listed but cannot be changed, like in the admin API.
+type Service struct {
+	backend store.Backend
+	users   *store.UserStore
+	admin   *admin.Service
+	config  *config.Config
+}
+
+// NewService creates the SCIM service; the admin service revokes the tokens
+// of deprovisioned users
+func NewService(backend store.Backend, adminService *admin.Service, cfg *config.Config) *Service {
+	return &Service{
+		backend: backend,
+		users:   store.NewUserStore(backend.Users()),
+		admin:   adminService,
+		config:  cfg,
+	}
+}
+
+// ListUsers returns the users matching the query
+func (s *Service) ListUsers(ctx context.Context, query Query) (*ListResponse, error) {
+	f, err := parseQueryFilter(query.Filter)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.backend.Users().ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	groupIDs, err := s.groupIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []interface{}
+	for _, user := range stored {
+		resource := s.toUser(user, groupIDs)
+		if f == nil || f.match(toMap(resource)) {
+			resources = append(resources, resource)
+		}
+	}
+	return page(resources, query), nil
+}
+
+// GetUser returns one user
+func (s *Service) GetUser(ctx context.Context, id string) (*User, error) {
+	stored, found := s.users.GetUser(id)
+	if !found {
+		return nil, notFound("user", id)
+	}
+	groupIDs, err := s.groupIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user := s.toUser(stored, groupIDs)
+	return &user, nil
+}
+
+// CreateUser provisions a user; users are active unless the request says otherwise
+func (s *Service) CreateUser(ctx context.Context, user User) (*User, error) {
+	stored := &store.User{ID: utils.GenerateUserID(), Enabled: true}
+	if err := s.applyUser(stored, user); err != nil {
+		return nil, err
+	}
+	if err := s.saveUser(stored); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ SCIM provisioned user %s (%s)", stored.Username, stored.ID)
+	s.audit(ctx, "scim_user_created", stored.ID, nil)
+	return s.GetUser(ctx, stored.ID)
+}
+
+// ReplaceUser replaces a user (PUT)
+func (s *Service) ReplaceUser(ctx context.Context, id string, user User, ifMatch string) (*User, error) {
+	stored, err := s.getRuntimeUser(ctx, id, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateUser(ctx, stored, user)
+}
+
+// PatchUser applies patch operations to a user
+func (s *Service) PatchUser(ctx context.Context, id string, patch PatchRequest, ifMatch string) (*User, error) {
+	stored, err := s.getRuntimeUser(ctx, id, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	resource := toMap(current)
+	if err := applyPatch(resource, patch.Operations); err != nil {
+		return nil, err
+	}
+	var patched User
+	if err := fromMap(resource, &patched); err != nil {
+		return nil, err
+	}
+	return s.updateUser(ctx, stored, patched)
+}
+
+// DeleteUser deprovisions a user and revokes its tokens
+func (s *Service) DeleteUser(ctx context.Context, id, ifMatch string) error {
+	stored, err := s.getRuntimeUser(ctx, id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if err := s.users.DeleteUser(stored.ID); err != nil {
+		return fmt.Errorf("failed to delete user %s: %w", stored.ID, err)
+	}
+
+	log.Printf("🗑️ SCIM deprovisioned user %s", stored.Username)
+	s.audit(ctx, "scim_user_deleted", stored.ID, nil)
+	return s.revokeTokens(ctx, stored.ID)
+}
+
+// updateUser stores the changes of a PUT or PATCH and revokes the tokens of
+// users that were deactivated
+func (s *Service) updateUser(ctx context.Context, stored *store.User, user User) (*User, error) {
+	wasEnabled := stored.Enabled
+	if err := s.applyUser(stored, user); err != nil {
+		return nil, err
+	}
+	if err := s.saveUser(stored); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ SCIM updated user %s", stored.Username)
+	s.audit(ctx, "scim_user_updated", stored.ID, nil)
+	if wasEnabled && !stored.Enabled {
+		log.Printf("🚫 SCIM deactivated user %s", stored.Username)
+		if err := s.revokeTokens(ctx, stored.ID); err != nil {
+			return nil, err
+		}
+	}
+	return s.GetUser(ctx, stored.ID)
+}
+
+// ListGroups returns the groups matching the query
+func (s *Service) ListGroups(ctx context.Context, query Query) (*ListResponse, error) {
+	f, err := parseQueryFilter(query.Filter)
+	if err != nil {
+		return nil, err
+	}
+	groups, members, err := s.loadGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []interface{}
+	for _, group := range groups {
+		resource := s.toGroup(group, members[group.DisplayName])
+		if f == nil || f.match(toMap(resource)) {
+			resources = append(resources, resource)
+		}
+	}
+	return page(resources, query), nil
+}
+
+// GetGroup returns one group
+func (s *Service) GetGroup(ctx context.Context, id string) (*Group, error) {
+	group, members, err := s.getGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	resource := s.toGroup(group, members)
+	return &resource, nil
+}
+
+// CreateGroup creates a group and gives its members the group's role
+func (s *Service) CreateGroup(ctx context.Context, group Group) (*Group, error) {
+	name := strings.TrimSpace(group.DisplayName)
+	if name == "" {
+		return nil, invalidValue("displayName is required")
+	}
+	if _, _, err := s.findGroupByName(ctx, name); err == nil {
+		return nil, uniqueness("group %s already exists", name)
+	}
+
+	stored := &store.Group{ID: utils.GenerateGroupID(), DisplayName: name, ExternalID: group.ExternalID}
+	if err := s.setMembers(ctx, "", name, nil, group.Members); err != nil {
+		return nil, err
+	}
+	if err := s.saveGroup(ctx, stored); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ SCIM created group %s", name)
+	s.audit(ctx, "scim_group_created", "", map[string]interface{}{"group": name})
+	return s.GetGroup(ctx, stored.ID)
+}
+
+// ReplaceGroup replaces the name and members of a group (PUT)
+func (s *Service) ReplaceGroup(ctx context.Context, id string, group Group, ifMatch string) (*Group, error) {
+	stored, members, err := s.getGroupVersion(ctx, id, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateGroup(ctx, stored, members, group)
+}
+
+// PatchGroup applies patch operations to a group, typically adding or removing members
+func (s *Service) PatchGroup(ctx context.Context, id string, patch PatchRequest, ifMatch string) (*Group, error) {
+	stored, members, err := s.getGroupVersion(ctx, id, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	resource := toMap(s.toGroup(stored, members))
+	if err := applyPatch(resource, patch.Operations); err != nil {
+		return nil, err
+	}
+	var patched Group
+	if err := fromMap(resource, &patched); err != nil {
+		return nil, err
+	}
+	return s.updateGroup(ctx, stored, members, patched)
+}
+
+// DeleteGroup removes a group and its role from the members
+func (s *Service) DeleteGroup(ctx context.Context, id, ifMatch string) error {
+	stored, members, err := s.getGroupVersion(ctx, id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if err := s.setMembers(ctx, stored.DisplayName, "", members, nil); err != nil {
+		return err
+	}
+	if err := s.backend.Groups().DeleteGroup(ctx, stored.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to delete group %s: %w", stored.DisplayName, err)
+	}
+
+	log.Printf("🗑️ SCIM deleted group %s", stored.DisplayName)
+	s.audit(ctx, "scim_group_deleted", "", map[string]interface{}{"group": stored.DisplayName})
+	return nil
+}
+
+// updateGroup renames a group and replaces its members
+func (s *Service) updateGroup(ctx context.Context, stored *store.Group, members []*store.User, group Group) (*Group, error) {
+	name := strings.TrimSpace(group.DisplayName)
+	if name == "" {
+		return nil, invalidValue("displayName is required")
+	}
+	if name != stored.DisplayName {
+		if _, _, err := s.findGroupByName(ctx, name); err == nil {
+			return nil, uniqueness("group %s already exists", name)
+		}
+	}
+
+	if err := s.setMembers(ctx, stored.DisplayName, name, members, group.Members); err != nil {
+		return nil, err
+	}
+	stored.DisplayName = name
+	stored.ExternalID = group.ExternalID
+	if err := s.saveGroup(ctx, stored); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ SCIM updated group %s", name)
+	s.audit(ctx, "scim_group_updated", "", map[string]interface{}{"group": name})
+	return s.GetGroup(ctx, stored.ID)
+}
+
+// setMembers moves the role of a group from its previous members to the given
+// members, renaming the role at the same time. Users from config.yaml cannot
+// change, so changes that affect them are rejected before anything is stored.
+func (s *Service) setMembers(ctx context.Context, previousName, name string, previous []*store.User, members []Member) error {
+	affected := make(map[string]*store.User)
+	for _, user := range previous {
+		affected[user.ID] = user
+	}
+	wanted := make(map[string]bool, len(members))
+	for _, member := range members {
+		if member.Type != "" && member.Type != "User" {
+			return invalidValue("only users can be group members, got %s", member.Type)
+		}
+		user, found := s.users.GetUser(member.Value)
+		if !found {
+			return invalidValue("member %s is not a user", member.Value)
+		}
+		wanted[user.ID] = true
+		if _, ok := affected[user.ID]; !ok {
+			affected[user.ID] = user
+		}
+	}
+
+	var changed []*store.User
+	for _, user := range affected {
+		roles := make([]string, 0, len(user.Roles)+1)
+		for _, role := range user.Roles {
+			if role != previousName && role != name {
+				roles = append(roles, role)
+			}
+		}
+		if wanted[user.ID] {
+			roles = append(roles, name)
+		}
+		if equalRoles(roles, user.Roles) {
+			continue
+		}
+		if s.fromConfig(user.Username) {
+			return mutability("user %s is defined in config.yaml, change its roles there", user.Username)
+		}
+		user.Roles = roles
+		changed = append(changed, user)
+	}
+
+	for _, user := range changed {
+		if err := s.users.SaveUser(user); err != nil {
+			return fmt.Errorf("failed to update the roles of %s: %w", user.Username, err)
+		}
+	}
+	return nil
+}
+
+// loadGroups returns the stored groups and a group for every role that has
+// none, with the members of each group by display name
+func (s *Service) loadGroups(ctx context.Context) ([]*store.Group, map[string][]*store.User, error) {
+	groups, err := s.backend.Groups().ListGroups(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	users, err := s.backend.Users().ListUsers(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	members := make(map[string][]*store.User)
+	for _, user := range users {
+		for _, role := range user.Roles {
+			members[role] = append(members[role], user)
+		}
+	}
+
+	named := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		named[group.DisplayName] = true
+	}
+	for role, users := range members {
+		if named[role] {
+			continue
+		}
+		// Roles without a stored group use their name as ID
+		group := &store.Group{ID: role, DisplayName: role}
+		for _, user := range users {
+			if group.CreatedAt.IsZero() || user.CreatedAt.Before(group.CreatedAt) {
+				group.CreatedAt = user.CreatedAt
+			}
+			if user.UpdatedAt.After(group.UpdatedAt) {
+				group.UpdatedAt = user.UpdatedAt
+			}
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].DisplayName < groups[j].DisplayName })
+	return groups, members, nil
+}
+
+// getGroup returns a group by ID with its members
+func (s *Service) getGroup(ctx context.Context, id string) (*store.Group, []*store.User, error) {
+	groups, members, err := s.loadGroups(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, group := range groups {
+		if group.ID == id {
+			return group, members[group.DisplayName], nil
+		}
+	}
+	return nil, nil, notFound("group", id)
+}
+
+// getGroupVersion returns a group after checking If-Match
+func (s *Service) getGroupVersion(ctx context.Context, id, ifMatch string) (*store.Group, []*store.User, error) {
+	group, members, err := s.getGroup(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkVersion(ifMatch, s.toGroup(group, members).Meta.Version); err != nil {
+		return nil, nil, err
+	}
+	return group, members, nil
+}
+
+// findGroupByName returns the group with a display name
+func (s *Service) findGroupByName(ctx context.Context, name string) (*store.Group, []*store.User, error) {
+	groups, members, err := s.loadGroups(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, group := range groups {
+		if group.DisplayName == name {
+			return group, members[name], nil
+		}
+	}
+	return nil, nil, notFound("group", name)
+}
+
+// groupIDs maps role names to group IDs
+func (s *Service) groupIDs(ctx context.Context) (map[string]string, error) {
+	groups, err := s.backend.Groups().ListGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	ids := make(map[string]string, len(groups))
+	for _, group := range groups {
+		ids[group.DisplayName] = group.ID
+	}
+	return ids, nil
+}
+
+// saveGroup stores a group, also turning a role without a group into a stored group
+func (s *Service) saveGroup(ctx context.Context, group *store.Group) error {
+	now := time.Now()
+	if group.CreatedAt.IsZero() {
+		group.CreatedAt = now
+	}
+	group.UpdatedAt = now
+	return s.backend.Groups().SaveGroup(ctx, group)
+}
+
+// getRuntimeUser loads a user that may be changed after checking If-Match
+func (s *Service) getRuntimeUser(ctx context.Context, id, ifMatch string) (*store.User, error) {
+	current, err := s.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(ifMatch, current.Meta.Version); err != nil {
+		return nil, err
+	}
+	if s.fromConfig(current.UserName) {
+		return nil, mutability("user %s is defined in config.yaml and must be changed there", current.UserName)
+	}
+	stored, found := s.users.GetUser(id)
+	if !found {
+		return nil, notFound("user", id)
+	}
+	return stored, nil
+}
+
+// saveUser stores a user whose username must be unique and not reserved by config.yaml
+func (s *Service) saveUser(user *store.User) error {
+	if s.fromConfig(user.Username) {
+		return uniqueness("userName %s is already taken", user.Username)
+	}
+	err := s.users.SaveUser(user)
+	if errors.Is(err, store.ErrUsernameTaken) {
+		return uniqueness("userName %s is already taken", user.Username)
+	}
+	return err
+}
+
+// fromConfig reports whether a user is defined in the configuration
+func (s *Service) fromConfig(username string) bool {
+	_, ok := s.config.GetUserByUsername(username)
+	return ok
+}
+
+// revokeTokens revokes the tokens of a deprovisioned or deactivated user
+func (s *Service) revokeTokens(ctx context.Context, userID string) error {
+	_, err := s.admin.RevokeTokens(ctx, admin.RevokeRequest{UserID: userID})
+	return err
+}
+
+// applyUser copies the writable attributes of a SCIM user onto a stored user;
+// groups are read-only and changed through the groups
+func (s *Service) applyUser(stored *store.User, user User) error {
+	username := strings.TrimSpace(user.UserName)
+	if username == "" || strings.ContainsAny(username, " \t\r\n") {
+		return invalidValue("userName is required and must not contain whitespace")
+	}
+
+	stored.Username = username
+	stored.ExternalID = user.ExternalID
+	stored.Email = ""
+	for _, email := range user.Emails {
+		if stored.Email == "" || email.Primary {
+			stored.Email = email.Value
+		}
+	}
+	if user.Active != nil {
+		stored.Enabled = bool(*user.Active)
+	}
+
+	var name Name
+	if user.Name != nil {
+		name = *user.Name
+	}
+	// displayName and name.formatted both map to the name; the one that changed wins
+	switch {
+	case user.DisplayName != "" && user.DisplayName != stored.Name:
+		stored.Name = user.DisplayName
+	case name.Formatted != "" && name.Formatted != stored.Name:
+		stored.Name = name.Formatted
+	case user.DisplayName == "" && name.Formatted == "":
+		stored.Name = strings.TrimSpace(name.GivenName + " " + name.FamilyName)
+	}
+	setAttribute := func(key, value string) {
+		if value == "" {
+			delete(stored.Attributes, key)
+			return
+		}
+		if stored.Attributes == nil {
+			stored.Attributes = make(map[string]string)
+		}
+		stored.Attributes[key] = value
+	}
+	setAttribute(attributeGivenName, name.GivenName)
+	setAttribute(attributeFamilyName, name.FamilyName)
+
+	if user.Password != "" {
+		if stored.Authenticator != "" {
+			return mutability("the password of %s is managed by authentication backend %s", stored.Username, stored.Authenticator)
+		}
+		if err := stored.SetPassword(user.Password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toUser converts a stored user without its password hash
+func (s *Service) toUser(user *store.User, groupIDs map[string]string) User {
+	active := Bool(user.Enabled)
+	resource := User{
+		Schemas:     []string{SchemaUser},
+		ID:          user.ID,
+		ExternalID:  user.ExternalID,
+		UserName:    user.Username,
+		DisplayName: user.Name,
+		Active:      &active,
+	}
+	name := Name{
+		Formatted:  user.Name,
+		GivenName:  user.Attributes[attributeGivenName],
+		FamilyName: user.Attributes[attributeFamilyName],
+	}
+	if name != (Name{}) {
+		resource.Name = &name
+	}
+	if user.Email != "" {
+		resource.Emails = []Email{{Value: user.Email, Type: "work", Primary: true}}
+	}
+	for _, role := range user.Roles {
+		id := role
+		if groupID, ok := groupIDs[role]; ok {
+			id = groupID
+		}
+		resource.Groups = append(resource.Groups, GroupRef{Value: id, Ref: s.location("Groups", id), Display: role})
+	}
+
+	resource.Meta = &Meta{
+		ResourceType: "User",
+		Created:      user.CreatedAt.UTC(),
+		LastModified: user.UpdatedAt.UTC(),
+		Location:     s.location("Users", user.ID),
+	}
+	resource.Meta.Version = version(resource)
+	return resource
+}
+
+// toGroup converts a group with its members
+func (s *Service) toGroup(group *store.Group, members []*store.User) Group {
+	resource := Group{
+		Schemas:     []string{SchemaGroup},
+		ID:          group.ID,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members:     []Member{},
+	}
+	for _, user := range members {
+		resource.Members = append(resource.Members, Member{
+			Value:   user.ID,
+			Ref:     s.location("Users", user.ID),
+			Display: user.Username,
+			Type:    "User",
+		})
+	}
+
+	resource.Meta = &Meta{
+		ResourceType: "Group",
+		Created:      group.CreatedAt.UTC(),
+		LastModified: group.UpdatedAt.UTC(),
+		Location:     s.location("Groups", group.ID),
+	}
+	resource.Meta.Version = version(resource)
+	return resource
+}
+
+// location is the URL of a resource
+func (s *Service) location(resourceType, id string) string {
+	return s.config.Server.BaseURL + "/scim/v2/" + resourceType + "/" + id
+}
+
+// audit records a provisioning change
+func (s *Service) audit(ctx context.Context, eventType, userID string, details map[string]interface{}) {
+	if details == nil {
+		details = make(map[string]interface{})
+	}
+	details["actor"] = admin.ActorFrom(ctx)
+	audit.Log(audit.Event{
+		Type:    eventType,
+		Outcome: audit.OutcomeSuccess,
+		Subject: userID,
+		Details: details,
+	})
+}
+
+// parseQueryFilter parses the filter of a list request
+func parseQueryFilter(expression string) (filter, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+	f, err := parseFilter(expression)
+	if err != nil {
+		return nil, &Error{Status: 400, Type: "invalidFilter", Detail: err.Error()}
+	}
+	return f, nil
+}
+
+// equalRoles compares two role lists ignoring order
+func equalRoles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, role := range a {
+		counts[role]++
+	}
+	for _, role := range b {
+		if counts[role] == 0 {
+			return false
+		}
+		counts[role]--
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package scim
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"oauth2-server/internal/admin"
+	"oauth2-server/internal/store"
+	"oauth2-server/pkg/config"
+)
+
+// staleVersion is a version the resources of the tests never have
+const staleVersion = `W/"0000000000000000"`
+
+// newTestService returns a SCIM service on a memory backend and a
+// provisioned user with a token
+func newTestService(t *testing.T) (*Service, store.Backend, *User) {
+	t.Helper()
+	cfg := &config.Config{}
+	backend := store.NewMemoryBackend()
+	s := NewService(backend, admin.NewService(backend, nil, nil, cfg), cfg)
+
+	user, err := s.CreateUser(context.Background(), User{UserName: "alice", DisplayName: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Meta == nil || user.Meta.Version == "" {
+		t.Fatalf("created user has no version: %+v", user.Meta)
+	}
+	token := &store.Token{Token: "alice-token", TokenType: "access", ClientID: "app", UserID: user.ID}
+	if err := store.NewTokenStore(backend.Tokens()).StoreToken(token); err != nil {
+		t.Fatal(err)
+	}
+	return s, backend, user
+}
+
+func TestUserIfMatch(t *testing.T) {
+	changes := []struct {
+		name   string
+		change func(s *Service, id, ifMatch string) error
+	}{
+		{"patch", func(s *Service, id, ifMatch string) error {
+			_, err := s.PatchUser(context.Background(), id, PatchRequest{Operations: []PatchOperation{
+				{Op: "replace", Path: "displayName", Value: "Alice Smith"},
+			}}, ifMatch)
+			return err
+		}},
+		{"replace", func(s *Service, id, ifMatch string) error {
+			_, err := s.ReplaceUser(context.Background(), id, User{UserName: "alice", DisplayName: "Alice Smith"}, ifMatch)
+			return err
+		}},
+		{"delete", func(s *Service, id, ifMatch string) error {
+			return s.DeleteUser(context.Background(), id, ifMatch)
+		}},
+	}
+	tests := []struct {
+		name string
+		// ifMatch returns the If-Match header for the current version
+		ifMatch func(current string) string
+		wantErr bool
+	}{
+		{"stale version", func(string) string { return staleVersion }, true},
+		{"strong form of the version", func(current string) string { return current[2:] }, true},
+		{"current version", func(current string) string { return current }, false},
+		{"list with the current version", func(current string) string { return staleVersion + ", " + current }, false},
+		{"any version", func(string) string { return "*" }, false},
+		{"no If-Match", func(string) string { return "" }, false},
+	}
+
+	for _, change := range changes {
+		for _, tt := range tests {
+			t.Run(change.name+" with "+tt.name, func(t *testing.T) {
+				s, _, user := newTestService(t)
+
+				err := change.change(s, user.ID, tt.ifMatch(user.Meta.Version))
+				if tt.wantErr {
+					if !errors.Is(err, ErrPreconditionFailed) {
+						t.Fatalf("error = %v, want %v", err, ErrPreconditionFailed)
+					}
+					if current, err := s.GetUser(context.Background(), user.ID); err != nil || current.Meta.Version != user.Meta.Version {
+						t.Errorf("user was changed after a failed precondition: %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				current, err := s.GetUser(context.Background(), user.ID)
+				if change.name == "delete" {
+					if err == nil {
+						t.Error("deleted user still exists")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if current.DisplayName != "Alice Smith" || current.Meta.Version == user.Meta.Version {
+					t.Errorf("user = %q version %s, want the change and a new version", current.DisplayName, current.Meta.Version)
+				}
+			})
+		}
+	}
+}
+
+func TestUserVersionIsStableWhileUnchanged(t *testing.T) {
+	s, _, user := newTestService(t)
+
+	current, err := s.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Meta.Version != user.Meta.Version {
+		t.Errorf("version = %s, want %s for an unchanged user", current.Meta.Version, user.Meta.Version)
+	}
+}
+
+func TestDeprovisioningRevokesTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		provision func(s *Service, id, ifMatch string) error
+	}{
+		{"delete", func(s *Service, id, ifMatch string) error {
+			return s.DeleteUser(context.Background(), id, ifMatch)
+		}},
+		{"deactivate", func(s *Service, id, ifMatch string) error {
+			_, err := s.PatchUser(context.Background(), id, PatchRequest{Operations: []PatchOperation{
+				{Op: "replace", Path: "active", Value: false},
+			}}, ifMatch)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, backend, user := newTestService(t)
+			if err := tt.provision(s, user.ID, user.Meta.Version); err != nil {
+				t.Fatal(err)
+			}
+			token, err := backend.Tokens().GetToken(context.Background(), "alice-token")
+			if err != nil || !token.Revoked {
+				t.Errorf("token = %+v (%v), want it revoked", token, err)
+			}
+		})
+	}
+}
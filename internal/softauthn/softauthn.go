@@ -0,0 +1,305 @@
+// Package softauthn is a software WebAuthn authenticator for testing passkey
+// logins without a browser or security key. It answers the options the login
+// pages embed for navigator.credentials.create() and get() with the JSON the
+// pages post back, holding P-256 (ES256) passkeys in memory. Every ceremony
+// counts as verified by the user; attestation is always "none".
+package softauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// Authenticator data flags (WebAuthn §6.1)
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// ErrNoCredential is returned by Get when no passkey matches the options
+var ErrNoCredential = errors.New("no matching passkey")
+
+// ErrExcluded is returned by Create when the authenticator holds one of the
+// excluded credentials, like browsers do
+var ErrExcluded = errors.New("the authenticator already holds a passkey of the user")
+
+// credential is a passkey held by the authenticator
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// Authenticator holds passkeys and signs for pages served at one origin
+type Authenticator struct {
+	origin string
+
+	mutex       sync.Mutex
+	credentials []*credential
+}
+
+// New creates an authenticator without passkeys for pages served at origin,
+// e.g. http://localhost:8080
+func New(origin string) *Authenticator {
+	return &Authenticator{origin: strings.TrimSuffix(origin, "/")}
+}
+
+// Len returns the number of passkeys the authenticator holds
+func (a *Authenticator) Len() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.credentials)
+}
+
+// Create registers a new passkey for the options of
+// navigator.credentials.create(), {"publicKey": {...}}, and returns the
+// registration response as JSON
+func (a *Authenticator) Create(options []byte) ([]byte, error) {
+	var creation protocol.CredentialCreation
+	if err := json.Unmarshal(options, &creation); err != nil {
+		return nil, fmt.Errorf("invalid creation options: %w", err)
+	}
+	request := creation.Response
+
+	rpID := request.RelyingParty.ID
+	if err := a.checkRPID(rpID); err != nil {
+		return nil, err
+	}
+	if !supportsES256(request.Parameters) {
+		return nil, errors.New("the relying party does not accept ES256 keys")
+	}
+	userHandle, err := decodeUserID(request.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, excluded := range request.CredentialExcludeList {
+		if a.find(rpID, excluded.CredentialID) != nil {
+			return nil, ErrExcluded
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	created := &credential{id: id, rpID: rpID, userHandle: userHandle, key: key}
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Attested credential data: AAGUID (all zero), credential ID length, ID, key
+	attested := make([]byte, 16, 18+len(id)+len(publicKey))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(append(attested, id...), publicKey...)
+	authData := append(authenticatorData(rpID, flagUserPresent|flagUserVerified|flagAttestedData, 0), attested...)
+
+	attestationObject, err := webauthncbor.Marshal(struct {
+		Format    string         `cbor:"fmt"`
+		Statement map[string]any `cbor:"attStmt"`
+		AuthData  []byte         `cbor:"authData"`
+	}{"none", map[string]any{}, authData})
+	if err != nil {
+		return nil, err
+	}
+
+	clientData, err := a.clientData(protocol.CreateCeremony, request.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	a.credentials = append(a.credentials, created)
+	return json.Marshal(protocol.CredentialCreationResponse{
+		PublicKeyCredential: describe(id),
+		AttestationResponse: protocol.AuthenticatorAttestationResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: clientData},
+			Transports:            []string{string(protocol.Internal)},
+			AttestationObject:     attestationObject,
+		},
+	})
+}
+
+// Get signs the challenge of navigator.credentials.get() options,
+// {"publicKey": {...}}, with a matching passkey and returns the assertion
+// response as JSON. Without allowed credentials the most recently created
+// passkey of the relying party is used.
+func (a *Authenticator) Get(options []byte) ([]byte, error) {
+	var assertion protocol.CredentialAssertion
+	if err := json.Unmarshal(options, &assertion); err != nil {
+		return nil, fmt.Errorf("invalid request options: %w", err)
+	}
+	request := assertion.Response
+
+	rpID := request.RelyingPartyID
+	if rpID == "" {
+		parsed, err := url.Parse(a.origin)
+		if err != nil {
+			return nil, err
+		}
+		rpID = parsed.Hostname()
+	}
+	if err := a.checkRPID(rpID); err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var selected *credential
+	if len(request.AllowedCredentials) == 0 {
+		for i := len(a.credentials) - 1; i >= 0 && selected == nil; i-- {
+			if a.credentials[i].rpID == rpID {
+				selected = a.credentials[i]
+			}
+		}
+	}
+	for _, allowed := range request.AllowedCredentials {
+		if selected = a.find(rpID, allowed.CredentialID); selected != nil {
+			break
+		}
+	}
+	if selected == nil {
+		return nil, ErrNoCredential
+	}
+
+	clientData, err := a.clientData(protocol.AssertCeremony, request.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	selected.signCount++
+	authData := authenticatorData(rpID, flagUserPresent|flagUserVerified, selected.signCount)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, selected.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(protocol.CredentialAssertionResponse{
+		PublicKeyCredential: describe(selected.id),
+		AssertionResponse: protocol.AuthenticatorAssertionResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: clientData},
+			AuthenticatorData:     authData,
+			Signature:             signature,
+			UserHandle:            selected.userHandle,
+		},
+	})
+}
+
+// optionsPattern finds the options the pages embed for their passkey button
+var optionsPattern = regexp.MustCompile(`(?s)<script type="application/json" id="passkey-options">(.*?)</script>`)
+
+// FindOptions returns the passkey options embedded in a login page
+func FindOptions(page []byte) ([]byte, bool) {
+	match := optionsPattern.FindSubmatch(page)
+	if match == nil {
+		return nil, false
+	}
+	return match[1], true
+}
+
+// checkRPID rejects relying party IDs the origin may not use, like browsers do
+func (a *Authenticator) checkRPID(rpID string) error {
+	parsed, err := url.Parse(a.origin)
+	if err != nil {
+		return err
+	}
+	host := parsed.Hostname()
+	if rpID == "" || (host != rpID && !strings.HasSuffix(host, "."+rpID)) {
+		return fmt.Errorf("relying party ID %q is not valid for origin %s", rpID, a.origin)
+	}
+	return nil
+}
+
+// find returns the passkey with the ID for the relying party
+func (a *Authenticator) find(rpID string, id []byte) *credential {
+	for _, candidate := range a.credentials {
+		if candidate.rpID == rpID && string(candidate.id) == string(id) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// clientData returns the client data JSON a browser passes to the authenticator
+func (a *Authenticator) clientData(ceremony protocol.CeremonyType, challenge protocol.URLEncodedBase64) ([]byte, error) {
+	return json.Marshal(protocol.CollectedClientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+}
+
+// authenticatorData returns the RP ID hash, flags and signature counter
+func authenticatorData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, signCount)
+}
+
+// describe returns the public key credential fields of a response
+func describe(id []byte) protocol.PublicKeyCredential {
+	return protocol.PublicKeyCredential{
+		Credential: protocol.Credential{
+			ID:   base64.RawURLEncoding.EncodeToString(id),
+			Type: string(protocol.PublicKeyCredentialType),
+		},
+		RawID:                   id,
+		AuthenticatorAttachment: string(protocol.Platform),
+	}
+}
+
+// supportsES256 reports whether the relying party accepts ES256 keys
+func supportsES256(parameters []protocol.CredentialParameter) bool {
+	for _, parameter := range parameters {
+		if parameter.Type == protocol.PublicKeyCredentialType && parameter.Algorithm == webauthncose.AlgES256 {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeUserID decodes the base64url user handle of creation options
+func decodeUserID(id any) ([]byte, error) {
+	encoded, ok := id.(string)
+	if !ok || encoded == "" {
+		return nil, errors.New("creation options have no user ID")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+}
@@ -3,11 +3,13 @@ package store
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"log"
-	"sync"
 	"time"
 
+	"oauth2-server/internal/lockout"
 	"oauth2-server/internal/models"
 	"oauth2-server/internal/utils"
 	"oauth2-server/pkg/config"
@@ -15,17 +17,25 @@ import (
 	"github.com/ory/fosite"
 )
 
-// ClientStore manages OAuth2 clients
+// ErrClientLocked is returned while a client or its source IP is locked after
+// too many wrong secrets
+var ErrClientLocked = errors.New("too many failed client authentications, try again later")
+
+// ClientStore manages OAuth2 clients on top of a storage backend
 type ClientStore struct {
-	clients map[string]fosite.Client
-	mutex   sync.RWMutex
+	storage  ClientStorage
+	lockouts *lockout.Tracker
 }
 
 // NewClientStore creates a new client store
-func NewClientStore() *ClientStore {
-	return &ClientStore{
-		clients: make(map[string]fosite.Client),
-	}
+func NewClientStore(storage ClientStorage) *ClientStore {
+	return &ClientStore{storage: storage}
+}
+
+// UseLockout makes ValidateClientCredentials count wrong secrets per client
+// and source IP and refuse them while they are locked
+func (s *ClientStore) UseLockout(lockouts *lockout.Tracker) {
+	s.lockouts = lockouts
 }
 
 // Client represents an OAuth2 client
@@ -40,8 +50,31 @@ type Client struct {
 	Public                  bool
 	Name                    string
 	Description             string
+	LogoURI                 string
 	TokenEndpointAuthMethod string
 	EnabledFlows            []string
+	DevicePollInterval      int
+	// AllowImpersonation lets the client exchange tokens without an act claim;
+	// otherwise token exchange always records the acting party (delegation)
+	AllowImpersonation bool
+	// MayAct lists the subjects or client IDs that may act on behalf of the
+	// subjects of tokens issued to this client (RFC 8693 may_act)
+	MayAct []string
+	// TokenExchangePolicy restricts the tokens this client can obtain through
+	// token exchange. Without one the client may exchange tokens of any source
+	// for its registered audiences and scopes, with any chain depth and the
+	// realm's token lifetimes
+	TokenExchangePolicy *models.TokenExchangePolicy
+	// JWKSURI or JWKS (inline document) hold the keys used to verify the
+	// client's JWT bearer assertions
+	JWKSURI string
+	JWKS    string
+	// JWTBearerSubjects lists the users the client may name as sub of its
+	// own JWT bearer assertions
+	JWTBearerSubjects []string
+	// AllowedOrigins may call the token, revocation and userinfo endpoints
+	// from a browser; empty allows the origins of the redirect URIs
+	AllowedOrigins []string
 }
 
 // GetID returns the client ID
@@ -94,6 +127,29 @@ func (c *Client) ValidateRedirectURI(requestedURI string) bool {
 	return utils.ValidateClientRedirectURI(requestedURI, c.RedirectURIs)
 }
 
+// Origins returns the origins that may call the token, revocation and userinfo
+// endpoints from a browser: the allowed origins, or those of the http(s)
+// redirect URIs when none are set
+func (c *Client) Origins() []string {
+	uris := c.AllowedOrigins
+	if len(uris) == 0 {
+		uris = c.RedirectURIs
+	}
+
+	origins := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		if origin, ok := utils.Origin(uri); ok && !utils.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// AllowsOrigin reports whether origin may call the endpoints for this client
+func (c *Client) AllowsOrigin(origin string) bool {
+	return utils.Contains(c.Origins(), origin)
+}
+
 // CreateDefaultClient creates a default client from ClientInfo
 func CreateDefaultClient(info models.ClientInfo) *Client {
 	return &Client{
@@ -106,77 +162,115 @@ func CreateDefaultClient(info models.ClientInfo) *Client {
 		Audience:      info.Audience,
 		Public:        false, // You can add this field to models.ClientInfo if needed
 		Name:          info.Name,
+		LogoURI:       info.LogoURI,
+
+		AllowImpersonation:  info.AllowImpersonation,
+		MayAct:              info.MayAct,
+		TokenExchangePolicy: info.TokenExchangePolicy,
+		JWKSURI:             info.JWKSURI,
+		JWKS:                info.JWKSValue,
 	}
 }
 
 // StoreClient stores a client
 func (s *ClientStore) StoreClient(client fosite.Client) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	s.clients[client.GetID()] = client
-	return nil
+	ourClient, ok := client.(*Client)
+	if !ok {
+		return fmt.Errorf("unsupported client type %T", client)
+	}
+	return s.storage.SaveClient(context.Background(), ourClient)
 }
 
 // GetClient retrieves a client by ID
 func (s *ClientStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	client, exists := s.clients[id]
-	if !exists {
+	client, err := s.storage.GetClient(ctx, id)
+	if errors.Is(err, ErrNotFound) {
 		return nil, errors.New("client not found")
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	return client, nil
 }
 
-// ValidateClientCredentials validates client credentials
-func (s *ClientStore) ValidateClientCredentials(clientID, clientSecret string) error {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	client, exists := s.clients[clientID]
-	if !exists {
+// ValidateClientCredentials validates client credentials sent from remoteAddr
+func (s *ClientStore) ValidateClientCredentials(clientID, clientSecret, remoteAddr string) error {
+	client, err := s.storage.GetClient(context.Background(), clientID)
+	if err != nil {
 		return errors.New("client not found")
 	}
 
-	// Type assert to our Client struct to access Public field
-	if ourClient, ok := client.(*Client); ok {
-		// For public clients, no secret is required
-		if ourClient.Public {
-			return nil
-		}
+	// For public clients, no secret is required
+	if client.Public {
+		return nil
+	}
+
+	keys := []lockout.Key{lockout.Client(clientID), lockout.IP(remoteAddr)}
+	if s.lockouts.Check(keys...) > 0 {
+		return ErrClientLocked
 	}
 
 	// Compare client secret (convert byte slice to string for comparison)
 	if !bytes.Equal(client.GetHashedSecret(), []byte(clientSecret)) {
+		s.lockouts.Fail(lockout.CredentialClientSecret, clientID, remoteAddr, keys...)
 		return errors.New("invalid client secret")
 	}
 
+	s.lockouts.Succeed(lockout.Client(clientID))
 	return nil
 }
 
+// VerifySecret reports whether secret is the secret of a confidential client.
+// Unlike ValidateClientCredentials it leaves the lockout counters alone, for
+// callers that only look at a request before it is handled.
+func (s *ClientStore) VerifySecret(clientID, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	client, err := s.storage.GetClient(context.Background(), clientID)
+	if err != nil || client.Public {
+		return false
+	}
+	return subtle.ConstantTimeCompare(client.GetHashedSecret(), []byte(secret)) == 1
+}
+
+// SecretHasher lets fosite compare client secrets the way
+// ValidateClientCredentials does, since secrets are stored as configured
+type SecretHasher struct{}
+
+// Compare implements fosite.Hasher
+func (SecretHasher) Compare(_ context.Context, hash, data []byte) error {
+	if subtle.ConstantTimeCompare(hash, data) != 1 {
+		return errors.New("invalid client secret")
+	}
+	return nil
+}
+
+// Hash implements fosite.Hasher
+func (SecretHasher) Hash(_ context.Context, data []byte) ([]byte, error) {
+	return data, nil
+}
+
 // DeleteClient removes a client
 func (s *ClientStore) DeleteClient(clientID string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	if _, exists := s.clients[clientID]; !exists {
+	err := s.storage.DeleteClient(context.Background(), clientID)
+	if errors.Is(err, ErrNotFound) {
 		return errors.New("client not found")
 	}
-
-	delete(s.clients, clientID)
-	return nil
+	return err
 }
 
 // ListClients returns all clients
 func (s *ClientStore) ListClients() []fosite.Client {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	stored, err := s.storage.ListClients(context.Background())
+	if err != nil {
+		log.Printf("❌ Failed to list clients: %v", err)
+		return nil
+	}
 
-	clients := make([]fosite.Client, 0, len(s.clients))
-	for _, client := range s.clients {
+	clients := make([]fosite.Client, 0, len(stored))
+	for _, client := range stored {
 		clients = append(clients, client)
 	}
 
@@ -185,26 +279,39 @@ func (s *ClientStore) ListClients() []fosite.Client {
 
 // UpdateClient updates an existing client
 func (s *ClientStore) UpdateClient(info models.ClientInfo) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	if _, exists := s.clients[info.ID]; !exists {
+	if !s.ClientExists(info.ID) {
 		return errors.New("client not found")
 	}
 
-	updatedClient := CreateDefaultClient(info)
-	s.clients[info.ID] = updatedClient
+	return s.storage.SaveClient(context.Background(), CreateDefaultClient(info))
+}
 
-	return nil
+// ClientAllowsOrigin reports whether the client allows browser requests from origin
+func (s *ClientStore) ClientAllowsOrigin(clientID, origin string) bool {
+	client, err := s.storage.GetClient(context.Background(), clientID)
+	return err == nil && client.AllowsOrigin(origin)
+}
+
+// OriginRegistered reports whether any client allows browser requests from
+// origin; CORS preflight requests do not name the client
+func (s *ClientStore) OriginRegistered(origin string) bool {
+	clients, err := s.storage.ListClients(context.Background())
+	if err != nil {
+		log.Printf("❌ Failed to list clients: %v", err)
+		return false
+	}
+	for _, client := range clients {
+		if client.AllowsOrigin(origin) {
+			return true
+		}
+	}
+	return false
 }
 
 // ClientExists checks if a client exists
 func (s *ClientStore) ClientExists(clientID string) bool {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	_, exists := s.clients[clientID]
-	return exists
+	_, err := s.storage.GetClient(context.Background(), clientID)
+	return err == nil
 }
 
 // LoadDefaultClients loads default clients into the store
@@ -220,36 +327,52 @@ func (s *ClientStore) LoadDefaultClients(frontendClient, backendClient models.Cl
 
 // LoadClientsFromConfig loads clients from configuration into the store
 func (cs *ClientStore) LoadClientsFromConfig(clients []config.ClientConfig) error {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
 	for _, clientConfig := range clients {
-		// Hash the client secret if it exists
-		var hashedSecret []byte
-		if clientConfig.Secret != "" {
-			// In production, use proper password hashing (bcrypt, argon2, etc.)
-			hashedSecret = []byte(clientConfig.Secret) // Simplified for now
+		if err := cs.StoreConfigClient(clientConfig); err != nil {
+			return err
 		}
+		log.Printf("✅ Loaded client from config: %s (%s) Redirect URIs: %v", clientConfig.ID, clientConfig.Name, clientConfig.RedirectURIs)
+	}
 
-		client := &Client{
-			ID:                      clientConfig.ID,
-			Secret:                  hashedSecret,
-			Name:                    clientConfig.Name,
-			Description:             clientConfig.Description,
-			RedirectURIs:            clientConfig.RedirectURIs,
-			GrantTypes:              clientConfig.GrantTypes,
-			ResponseTypes:           clientConfig.ResponseTypes,
-			Scopes:                  clientConfig.Scopes,
-			Audience:                clientConfig.Audience,
-			TokenEndpointAuthMethod: clientConfig.TokenEndpointAuthMethod,
-			Public:                  clientConfig.Public,
-			EnabledFlows:            clientConfig.EnabledFlows,
-		}
+	log.Printf("📦 Loaded %d clients from configuration", len(clients))
+	return nil
+}
 
-		cs.clients[clientConfig.ID] = client
-		log.Printf("✅ Loaded client from config: %s (%s) Redirect URIs: %v", client.ID, client.Name, client.RedirectURIs)
+// StoreConfigClient creates or replaces a client defined in the configuration
+func (cs *ClientStore) StoreConfigClient(clientConfig config.ClientConfig) error {
+	// Hash the client secret if it exists
+	var hashedSecret []byte
+	if clientConfig.Secret != "" {
+		// In production, use proper password hashing (bcrypt, argon2, etc.)
+		hashedSecret = []byte(clientConfig.Secret) // Simplified for now
 	}
 
-	log.Printf("📦 Loaded %d clients from configuration", len(clients))
+	client := &Client{
+		ID:                      clientConfig.ID,
+		Secret:                  hashedSecret,
+		Name:                    clientConfig.Name,
+		Description:             clientConfig.Description,
+		LogoURI:                 clientConfig.LogoURI,
+		RedirectURIs:            clientConfig.RedirectURIs,
+		GrantTypes:              clientConfig.GrantTypes,
+		ResponseTypes:           clientConfig.ResponseTypes,
+		Scopes:                  clientConfig.Scopes,
+		Audience:                clientConfig.Audience,
+		TokenEndpointAuthMethod: clientConfig.TokenEndpointAuthMethod,
+		Public:                  clientConfig.Public,
+		EnabledFlows:            clientConfig.EnabledFlows,
+		DevicePollInterval:      clientConfig.DevicePollInterval,
+		AllowImpersonation:      clientConfig.AllowImpersonation,
+		MayAct:                  clientConfig.MayAct,
+		TokenExchangePolicy:     clientConfig.TokenExchangePolicy,
+		JWKSURI:                 clientConfig.JWKSURI,
+		JWKS:                    clientConfig.JWKS,
+		JWTBearerSubjects:       clientConfig.JWTBearerSubjects,
+		AllowedOrigins:          clientConfig.AllowedOrigins,
+	}
+
+	if err := cs.storage.SaveClient(context.Background(), client); err != nil {
+		return fmt.Errorf("failed to store client %s: %w", client.ID, err)
+	}
 	return nil
 }
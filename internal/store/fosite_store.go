@@ -0,0 +1,286 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+)
+
+// requestKindClientAssertion records used client assertion JWT IDs
+const requestKindClientAssertion = "client_assertion_jti"
+
+// FositeStore implements the fosite storage interfaces on top of the client
+// store and a RequestStorage, so authorization codes and fosite-issued tokens
+// live in the same backend as everything else
+type FositeStore struct {
+	clients  *ClientStore
+	requests RequestStorage
+}
+
+// NewFositeStore creates the fosite storage adapter
+func NewFositeStore(clients *ClientStore, requests RequestStorage) *FositeStore {
+	return &FositeStore{
+		clients:  clients,
+		requests: requests,
+	}
+}
+
+// storedRequest is the serialized form of a fosite request
+type storedRequest struct {
+	ID                string          `json:"id"`
+	RequestedAt       time.Time       `json:"requested_at"`
+	ClientID          string          `json:"client_id"`
+	RequestedScope    []string        `json:"requested_scope"`
+	GrantedScope      []string        `json:"granted_scope"`
+	RequestedAudience []string        `json:"requested_audience"`
+	GrantedAudience   []string        `json:"granted_audience"`
+	Form              url.Values      `json:"form"`
+	Session           json.RawMessage `json:"session"`
+}
+
+// GetClient implements fosite.ClientManager
+func (s *FositeStore) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	client, err := s.clients.GetClient(ctx, id)
+	if err != nil {
+		return nil, fosite.ErrNotFound.WithWrap(err)
+	}
+	return client, nil
+}
+
+// ClientAssertionJWTValid implements fosite.ClientManager
+func (s *FositeStore) ClientAssertionJWTValid(ctx context.Context, jti string) error {
+	record, err := s.requests.GetRequest(ctx, requestKindClientAssertion, jti)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if record.ExpiresAt.After(time.Now()) {
+		return fosite.ErrJTIKnown
+	}
+	return nil
+}
+
+// SetClientAssertionJWT implements fosite.ClientManager
+func (s *FositeStore) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
+	if err := s.ClientAssertionJWTValid(ctx, jti); err != nil {
+		return err
+	}
+	return s.requests.SaveRequest(ctx, &RequestRecord{
+		Kind:      requestKindClientAssertion,
+		Signature: jti,
+		Active:    true,
+		ExpiresAt: exp,
+	})
+}
+
+// CreateAuthorizeCodeSession implements oauth2.AuthorizeCodeStorage
+func (s *FositeStore) CreateAuthorizeCodeSession(ctx context.Context, code string, request fosite.Requester) error {
+	return s.saveRequest(ctx, RequestKindAuthorizeCode, code, request, fosite.AuthorizeCode)
+}
+
+// GetAuthorizeCodeSession implements oauth2.AuthorizeCodeStorage
+func (s *FositeStore) GetAuthorizeCodeSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+	request, active, err := s.loadRequest(ctx, RequestKindAuthorizeCode, code, session)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		// fosite expects the request together with the error to revoke issued tokens
+		return request, fosite.ErrInvalidatedAuthorizeCode
+	}
+	return request, nil
+}
+
+// InvalidateAuthorizeCodeSession implements oauth2.AuthorizeCodeStorage
+func (s *FositeStore) InvalidateAuthorizeCodeSession(ctx context.Context, code string) error {
+	return notFound(s.requests.DeactivateRequest(ctx, RequestKindAuthorizeCode, code))
+}
+
+// CreatePKCERequestSession implements pkce.PKCERequestStorage
+func (s *FositeStore) CreatePKCERequestSession(ctx context.Context, code string, request fosite.Requester) error {
+	return s.saveRequest(ctx, RequestKindPKCE, code, request, fosite.AuthorizeCode)
+}
+
+// GetPKCERequestSession implements pkce.PKCERequestStorage
+func (s *FositeStore) GetPKCERequestSession(ctx context.Context, code string, session fosite.Session) (fosite.Requester, error) {
+	request, _, err := s.loadRequest(ctx, RequestKindPKCE, code, session)
+	return request, err
+}
+
+// DeletePKCERequestSession implements pkce.PKCERequestStorage
+func (s *FositeStore) DeletePKCERequestSession(ctx context.Context, code string) error {
+	return s.requests.DeleteRequest(ctx, RequestKindPKCE, code)
+}
+
+// CreateOpenIDConnectSession implements openid.OpenIDConnectRequestStorage
+func (s *FositeStore) CreateOpenIDConnectSession(ctx context.Context, authorizeCode string, request fosite.Requester) error {
+	return s.saveRequest(ctx, RequestKindOpenIDConnect, authorizeCode, request, fosite.AuthorizeCode)
+}
+
+// GetOpenIDConnectSession implements openid.OpenIDConnectRequestStorage
+func (s *FositeStore) GetOpenIDConnectSession(ctx context.Context, authorizeCode string, request fosite.Requester) (fosite.Requester, error) {
+	stored, _, err := s.loadRequest(ctx, RequestKindOpenIDConnect, authorizeCode, request.GetSession())
+	return stored, err
+}
+
+// DeleteOpenIDConnectSession implements openid.OpenIDConnectRequestStorage
+func (s *FositeStore) DeleteOpenIDConnectSession(ctx context.Context, authorizeCode string) error {
+	return s.requests.DeleteRequest(ctx, RequestKindOpenIDConnect, authorizeCode)
+}
+
+// CreateAccessTokenSession implements oauth2.AccessTokenStorage
+func (s *FositeStore) CreateAccessTokenSession(ctx context.Context, signature string, request fosite.Requester) error {
+	return s.saveRequest(ctx, RequestKindAccessToken, signature, request, fosite.AccessToken)
+}
+
+// GetAccessTokenSession implements oauth2.AccessTokenStorage
+func (s *FositeStore) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	request, active, err := s.loadRequest(ctx, RequestKindAccessToken, signature, session)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		// Revoked access tokens behave as if they were deleted
+		return nil, fosite.ErrNotFound
+	}
+	return request, nil
+}
+
+// DeleteAccessTokenSession implements oauth2.AccessTokenStorage
+func (s *FositeStore) DeleteAccessTokenSession(ctx context.Context, signature string) error {
+	return s.requests.DeleteRequest(ctx, RequestKindAccessToken, signature)
+}
+
+// CreateRefreshTokenSession implements oauth2.RefreshTokenStorage
+func (s *FositeStore) CreateRefreshTokenSession(ctx context.Context, signature string, _ string, request fosite.Requester) error {
+	return s.saveRequest(ctx, RequestKindRefreshToken, signature, request, fosite.RefreshToken)
+}
+
+// GetRefreshTokenSession implements oauth2.RefreshTokenStorage
+func (s *FositeStore) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, error) {
+	request, active, err := s.loadRequest(ctx, RequestKindRefreshToken, signature, session)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return request, fosite.ErrInactiveToken
+	}
+	return request, nil
+}
+
+// DeleteRefreshTokenSession implements oauth2.RefreshTokenStorage
+func (s *FositeStore) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
+	return s.requests.DeleteRequest(ctx, RequestKindRefreshToken, signature)
+}
+
+// RotateRefreshToken implements oauth2.RefreshTokenStorage by revoking the old token family
+func (s *FositeStore) RotateRefreshToken(ctx context.Context, requestID string, _ string) error {
+	if err := s.RevokeRefreshToken(ctx, requestID); err != nil {
+		return err
+	}
+	return s.RevokeAccessToken(ctx, requestID)
+}
+
+// RevokeRefreshToken implements oauth2.TokenRevocationStorage
+func (s *FositeStore) RevokeRefreshToken(ctx context.Context, requestID string) error {
+	return s.requests.DeactivateRequestsByID(ctx, RequestKindRefreshToken, requestID)
+}
+
+// RevokeAccessToken implements oauth2.TokenRevocationStorage
+func (s *FositeStore) RevokeAccessToken(ctx context.Context, requestID string) error {
+	return s.requests.DeactivateRequestsByID(ctx, RequestKindAccessToken, requestID)
+}
+
+// saveRequest serializes a fosite request under the signature
+func (s *FositeStore) saveRequest(ctx context.Context, kind, signature string, request fosite.Requester, tokenType fosite.TokenType) error {
+	session, err := json.Marshal(request.GetSession())
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	data, err := json.Marshal(storedRequest{
+		ID:                request.GetID(),
+		RequestedAt:       request.GetRequestedAt(),
+		ClientID:          request.GetClient().GetID(),
+		RequestedScope:    request.GetRequestedScopes(),
+		GrantedScope:      request.GetGrantedScopes(),
+		RequestedAudience: request.GetRequestedAudience(),
+		GrantedAudience:   request.GetGrantedAudience(),
+		Form:              request.GetRequestForm(),
+		Session:           session,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	record := &RequestRecord{
+		Kind:      kind,
+		Signature: signature,
+		RequestID: request.GetID(),
+		ClientID:  request.GetClient().GetID(),
+		Active:    true,
+		Data:      data,
+	}
+	if request.GetSession() != nil {
+		record.Subject = request.GetSession().GetSubject()
+		record.ExpiresAt = request.GetSession().GetExpiresAt(tokenType)
+	}
+
+	return s.requests.SaveRequest(ctx, record)
+}
+
+// loadRequest restores a fosite request, decoding its session into the given session
+func (s *FositeStore) loadRequest(ctx context.Context, kind, signature string, session fosite.Session) (fosite.Requester, bool, error) {
+	record, err := s.requests.GetRequest(ctx, kind, signature)
+	if err != nil {
+		return nil, false, notFound(err)
+	}
+
+	var stored storedRequest
+	if err := json.Unmarshal(record.Data, &stored); err != nil {
+		return nil, false, fmt.Errorf("failed to decode request: %w", err)
+	}
+
+	client, err := s.clients.GetClient(ctx, stored.ClientID)
+	if err != nil {
+		return nil, false, fosite.ErrNotFound.WithWrap(err)
+	}
+
+	if session == nil {
+		session = &fosite.DefaultSession{}
+	}
+	if len(stored.Session) > 0 {
+		if err := json.Unmarshal(stored.Session, session); err != nil {
+			return nil, false, fmt.Errorf("failed to decode session: %w", err)
+		}
+	}
+
+	request := &fosite.Request{
+		ID:                stored.ID,
+		RequestedAt:       stored.RequestedAt,
+		Client:            client,
+		RequestedScope:    stored.RequestedScope,
+		GrantedScope:      stored.GrantedScope,
+		RequestedAudience: stored.RequestedAudience,
+		GrantedAudience:   stored.GrantedAudience,
+		Form:              stored.Form,
+		Session:           session,
+	}
+
+	return request, record.Active, nil
+}
+
+// notFound maps ErrNotFound to the error fosite expects
+func notFound(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return fosite.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,695 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"oauth2-server/internal/models"
+)
+
+// MemoryBackend keeps all state in process memory. State is lost on restart and
+// not shared between replicas, so it is meant for development and tests.
+type MemoryBackend struct {
+	clients      *memoryClients
+	users        *memoryUsers
+	groups       *memoryGroups
+	tokens       *memoryTokens
+	requests     *memoryRequests
+	deviceGrants *memoryDeviceGrants
+	sessions     *memorySessions
+	consents     *memoryConsents
+	rateLimits   *MemoryRateLimits
+	signingKeys  *memorySigningKeys
+}
+
+// NewMemoryBackend creates an empty in-memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		clients:      &memoryClients{clients: make(map[string]*Client)},
+		users:        &memoryUsers{users: make(map[string]*User), usernames: make(map[string]string)},
+		groups:       &memoryGroups{groups: make(map[string]*Group)},
+		tokens:       &memoryTokens{tokens: make(map[string]*Token)},
+		requests:     &memoryRequests{records: make(map[string]*RequestRecord)},
+		deviceGrants: &memoryDeviceGrants{grants: make(map[string]*models.DeviceAuthorization), userCodes: make(map[string]string)},
+		sessions:     &memorySessions{sessions: make(map[string]*Session)},
+		consents:     &memoryConsents{consents: make(map[string]*Consent)},
+		rateLimits:   NewMemoryRateLimits(),
+		signingKeys:  &memorySigningKeys{keys: make(map[string]*SigningKey)},
+	}
+}
+
+// Clients returns the client storage
+func (b *MemoryBackend) Clients() ClientStorage { return b.clients }
+
+// Users returns the user storage
+func (b *MemoryBackend) Users() UserStorage { return b.users }
+
+// Groups returns the group storage
+func (b *MemoryBackend) Groups() GroupStorage { return b.groups }
+
+// Tokens returns the token storage
+func (b *MemoryBackend) Tokens() TokenStorage { return b.tokens }
+
+// Requests returns the fosite request storage
+func (b *MemoryBackend) Requests() RequestStorage { return b.requests }
+
+// DeviceGrants returns the device authorization storage
+func (b *MemoryBackend) DeviceGrants() DeviceGrantStorage { return b.deviceGrants }
+
+// Sessions returns the login session storage
+func (b *MemoryBackend) Sessions() SessionStorage { return b.sessions }
+
+// Consents returns the consent storage
+func (b *MemoryBackend) Consents() ConsentStorage { return b.consents }
+
+// RateLimits returns the rate limit bucket storage
+func (b *MemoryBackend) RateLimits() RateLimitStorage { return b.rateLimits }
+
+// SigningKeys returns the signing key storage
+func (b *MemoryBackend) SigningKeys() SigningKeyStorage { return b.signingKeys }
+
+// Close is a no-op for the memory backend
+func (b *MemoryBackend) Close() error { return nil }
+
+// memoryClients stores clients in a map
+type memoryClients struct {
+	clients map[string]*Client
+	mutex   sync.RWMutex
+}
+
+func (s *memoryClients) SaveClient(_ context.Context, client *Client) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *client
+	s.clients[client.ID] = &copied
+	return nil
+}
+
+func (s *memoryClients) GetClient(_ context.Context, id string) (*Client, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	client, exists := s.clients[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *client
+	return &copied, nil
+}
+
+func (s *memoryClients) DeleteClient(_ context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.clients[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.clients, id)
+	return nil
+}
+
+func (s *memoryClients) ListClients(_ context.Context) ([]*Client, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		copied := *client
+		clients = append(clients, &copied)
+	}
+	return clients, nil
+}
+
+// memoryUsers stores users by ID with a username index
+type memoryUsers struct {
+	users     map[string]*User
+	usernames map[string]string
+	mutex     sync.RWMutex
+}
+
+func (s *memoryUsers) SaveUser(_ context.Context, user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if id, taken := s.usernames[user.Username]; taken && id != user.ID {
+		return ErrUsernameTaken
+	}
+	if existing, ok := s.users[user.ID]; ok {
+		delete(s.usernames, existing.Username)
+	}
+	s.users[user.ID] = copyUser(user)
+	s.usernames[user.Username] = user.ID
+	return nil
+}
+
+func (s *memoryUsers) GetUser(_ context.Context, id string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	user, exists := s.users[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (s *memoryUsers) GetUserByUsername(_ context.Context, username string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	id, exists := s.usernames[username]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return copyUser(s.users[id]), nil
+}
+
+func (s *memoryUsers) DeleteUser(_ context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, exists := s.users[id]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(s.usernames, user.Username)
+	delete(s.users, id)
+	return nil
+}
+
+func (s *memoryUsers) ListUsers(_ context.Context) ([]*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// copyUser copies a user including its slices and attributes
+func copyUser(user *User) *User {
+	copied := *user
+	copied.Roles = append([]string(nil), user.Roles...)
+	copied.Scopes = append([]string(nil), user.Scopes...)
+	if user.Attributes != nil {
+		copied.Attributes = make(map[string]string, len(user.Attributes))
+		for key, value := range user.Attributes {
+			copied.Attributes[key] = value
+		}
+	}
+	if user.MFA != nil {
+		mfa := *user.MFA
+		mfa.RecoveryCodes = append([]string(nil), user.MFA.RecoveryCodes...)
+		copied.MFA = &mfa
+	}
+	copied.Passkeys = append([]Passkey(nil), user.Passkeys...)
+	return &copied
+}
+
+// memoryGroups stores groups by ID
+type memoryGroups struct {
+	groups map[string]*Group
+	mutex  sync.RWMutex
+}
+
+func (s *memoryGroups) SaveGroup(_ context.Context, group *Group) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *group
+	s.groups[group.ID] = &copied
+	return nil
+}
+
+func (s *memoryGroups) GetGroup(_ context.Context, id string) (*Group, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	group, exists := s.groups[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *group
+	return &copied, nil
+}
+
+func (s *memoryGroups) DeleteGroup(_ context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.groups[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.groups, id)
+	return nil
+}
+
+func (s *memoryGroups) ListGroups(_ context.Context) ([]*Group, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	groups := make([]*Group, 0, len(s.groups))
+	for _, group := range s.groups {
+		copied := *group
+		groups = append(groups, &copied)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].DisplayName < groups[j].DisplayName })
+	return groups, nil
+}
+
+// memoryTokens stores opaque tokens in a map
+type memoryTokens struct {
+	tokens map[string]*Token
+	mutex  sync.RWMutex
+}
+
+func (s *memoryTokens) SaveToken(_ context.Context, token *Token) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *token
+	s.tokens[token.Token] = &copied
+	return nil
+}
+
+func (s *memoryTokens) GetToken(_ context.Context, value string) (*Token, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	token, exists := s.tokens[value]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *memoryTokens) ListTokens(_ context.Context, userID, clientID string) ([]*Token, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var tokens []*Token
+	for _, token := range s.tokens {
+		if (userID == "" || token.UserID == userID) && (clientID == "" || token.ClientID == clientID) {
+			copied := *token
+			tokens = append(tokens, &copied)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *memoryTokens) DeleteExpiredTokens(_ context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+	for value, token := range s.tokens {
+		if before.After(token.ExpiresAt) {
+			delete(s.tokens, value)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// memoryRequests stores fosite request records keyed by kind and signature
+type memoryRequests struct {
+	records map[string]*RequestRecord
+	mutex   sync.RWMutex
+}
+
+func requestKey(kind, signature string) string {
+	return kind + "\x00" + signature
+}
+
+func (s *memoryRequests) SaveRequest(_ context.Context, record *RequestRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *record
+	s.records[requestKey(record.Kind, record.Signature)] = &copied
+	return nil
+}
+
+func (s *memoryRequests) GetRequest(_ context.Context, kind, signature string) (*RequestRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	record, exists := s.records[requestKey(kind, signature)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (s *memoryRequests) DeleteRequest(_ context.Context, kind, signature string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.records, requestKey(kind, signature))
+	return nil
+}
+
+func (s *memoryRequests) DeactivateRequest(_ context.Context, kind, signature string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, exists := s.records[requestKey(kind, signature)]
+	if !exists {
+		return ErrNotFound
+	}
+	record.Active = false
+	return nil
+}
+
+func (s *memoryRequests) DeactivateRequestsByID(_ context.Context, kind, requestID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, record := range s.records {
+		if record.Kind == kind && record.RequestID == requestID {
+			record.Active = false
+		}
+	}
+	return nil
+}
+
+func (s *memoryRequests) DeactivateRequestsOf(_ context.Context, subject, clientID string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	requests := make(map[string]bool)
+	for _, record := range s.records {
+		if !record.Active || (subject != "" && record.Subject != subject) || (clientID != "" && record.ClientID != clientID) {
+			continue
+		}
+		record.Active = false
+		requests[record.RequestID] = true
+	}
+	return len(requests), nil
+}
+
+func (s *memoryRequests) DeleteExpiredRequests(_ context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+	for key, record := range s.records {
+		if !record.ExpiresAt.IsZero() && before.After(record.ExpiresAt) {
+			delete(s.records, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// memoryDeviceGrants stores device authorizations indexed by device and user code
+type memoryDeviceGrants struct {
+	grants    map[string]*models.DeviceAuthorization
+	userCodes map[string]string
+	mutex     sync.RWMutex
+}
+
+func copyDeviceGrant(grant *models.DeviceAuthorization) *models.DeviceAuthorization {
+	copied := *grant
+	copied.Scopes = append([]string(nil), grant.Scopes...)
+	return &copied
+}
+
+func (s *memoryDeviceGrants) SaveDeviceGrant(_ context.Context, grant *models.DeviceAuthorization) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.grants[grant.DeviceCode] = copyDeviceGrant(grant)
+	s.userCodes[grant.UserCode] = grant.DeviceCode
+	return nil
+}
+
+func (s *memoryDeviceGrants) GetDeviceGrant(_ context.Context, deviceCode string) (*models.DeviceAuthorization, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	grant, exists := s.grants[deviceCode]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return copyDeviceGrant(grant), nil
+}
+
+func (s *memoryDeviceGrants) GetDeviceGrantByUserCode(ctx context.Context, userCode string) (*models.DeviceAuthorization, error) {
+	s.mutex.RLock()
+	deviceCode, exists := s.userCodes[userCode]
+	s.mutex.RUnlock()
+
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return s.GetDeviceGrant(ctx, deviceCode)
+}
+
+func (s *memoryDeviceGrants) UpdateDeviceGrant(_ context.Context, deviceCode string, update func(grant *models.DeviceAuthorization) error) (*models.DeviceAuthorization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	grant, exists := s.grants[deviceCode]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	updated := copyDeviceGrant(grant)
+	if err := update(updated); err != nil {
+		return nil, err
+	}
+
+	s.grants[deviceCode] = updated
+	return copyDeviceGrant(updated), nil
+}
+
+func (s *memoryDeviceGrants) DeleteDeviceGrant(_ context.Context, deviceCode string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if grant, exists := s.grants[deviceCode]; exists {
+		delete(s.userCodes, grant.UserCode)
+		delete(s.grants, deviceCode)
+	}
+	return nil
+}
+
+func (s *memoryDeviceGrants) ListDeviceGrants(_ context.Context) ([]*models.DeviceAuthorization, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	grants := make([]*models.DeviceAuthorization, 0, len(s.grants))
+	for _, grant := range s.grants {
+		grants = append(grants, copyDeviceGrant(grant))
+	}
+	return grants, nil
+}
+
+func (s *memoryDeviceGrants) DeleteExpiredDeviceGrants(_ context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+	for deviceCode, grant := range s.grants {
+		if before.After(grant.ExpiresAt) {
+			delete(s.userCodes, grant.UserCode)
+			delete(s.grants, deviceCode)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// memorySessions stores login sessions in a map
+type memorySessions struct {
+	sessions map[string]*Session
+	mutex    sync.RWMutex
+}
+
+func (s *memorySessions) SaveSession(_ context.Context, session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *session
+	copied.AMR = append([]string(nil), session.AMR...)
+	s.sessions[session.ID] = &copied
+	return nil
+}
+
+func (s *memorySessions) GetSession(_ context.Context, id string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	session, exists := s.sessions[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (s *memorySessions) DeleteSession(_ context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessions) DeleteExpiredSessions(_ context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+	for id, session := range s.sessions {
+		if before.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// memoryConsents stores consents keyed by user and client
+type memoryConsents struct {
+	consents map[string]*Consent
+	mutex    sync.RWMutex
+}
+
+func consentKey(userID, clientID string) string {
+	return userID + "\x00" + clientID
+}
+
+func (s *memoryConsents) SaveConsent(_ context.Context, consent *Consent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *consent
+	copied.Scopes = append([]string(nil), consent.Scopes...)
+	s.consents[consentKey(consent.UserID, consent.ClientID)] = &copied
+	return nil
+}
+
+func (s *memoryConsents) GetConsent(_ context.Context, userID, clientID string) (*Consent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	consent, exists := s.consents[consentKey(userID, clientID)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *consent
+	return &copied, nil
+}
+
+func (s *memoryConsents) DeleteConsent(_ context.Context, userID, clientID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.consents, consentKey(userID, clientID))
+	return nil
+}
+
+func (s *memoryConsents) ListConsents(_ context.Context, userID string) ([]*Consent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var consents []*Consent
+	for _, consent := range s.consents {
+		if userID == "" || consent.UserID == userID {
+			copied := *consent
+			consents = append(consents, &copied)
+		}
+	}
+	return consents, nil
+}
+
+// MemoryRateLimits keeps rate limit buckets in process memory; it is also
+// used by the SQL backends when buckets are not shared between replicas
+type MemoryRateLimits struct {
+	buckets map[string]*RateLimitBucket
+	mutex   sync.Mutex
+}
+
+// NewMemoryRateLimits creates an empty in-memory bucket storage
+func NewMemoryRateLimits() *MemoryRateLimits {
+	return &MemoryRateLimits{buckets: make(map[string]*RateLimitBucket)}
+}
+
+func (s *MemoryRateLimits) UpdateRateLimitBucket(_ context.Context, key string, update func(bucket *RateLimitBucket)) (*RateLimitBucket, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucket, exists := s.buckets[key]
+	if !exists {
+		bucket = &RateLimitBucket{Key: key}
+		s.buckets[key] = bucket
+	}
+	update(bucket)
+	copied := *bucket
+	return &copied, nil
+}
+
+func (s *MemoryRateLimits) DeleteExpiredRateLimitBuckets(_ context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+	for key, bucket := range s.buckets {
+		if bucket.ExpiresAt.Before(before) {
+			delete(s.buckets, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// memorySigningKeys stores signing keys by key ID
+type memorySigningKeys struct {
+	keys  map[string]*SigningKey
+	mutex sync.RWMutex
+}
+
+func (s *memorySigningKeys) SaveSigningKey(_ context.Context, key *SigningKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *key
+	s.keys[key.ID] = &copied
+	return nil
+}
+
+func (s *memorySigningKeys) ListSigningKeys(_ context.Context, issuer string) ([]*SigningKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keys []*SigningKey
+	for _, key := range s.keys {
+		if key.Issuer == issuer {
+			copied := *key
+			keys = append(keys, &copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *memorySigningKeys) DeleteSigningKey(_ context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.keys[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
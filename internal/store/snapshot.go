@@ -0,0 +1,367 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"oauth2-server/internal/models"
+)
+
+// SnapshotFormatVersion is the version of the snapshot payload. Snapshots with a
+// different version are rejected instead of being partially restored.
+const SnapshotFormatVersion = 1
+
+// snapshotMagic identifies snapshot files
+var snapshotMagic = []byte("OA2SNAP")
+
+// ErrSnapshotVersion is returned for snapshots written in an unsupported format
+var ErrSnapshotVersion = errors.New("unsupported snapshot format version")
+
+// snapshot is the serialized state of a MemoryBackend
+type snapshot struct {
+	Version      int                    `json:"version"`
+	CreatedAt    time.Time              `json:"created_at"`
+	Clients      []*Client              `json:"clients"`
+	Users        []*User                `json:"users,omitempty"`
+	Groups       []*Group               `json:"groups,omitempty"`
+	Tokens       []*Token               `json:"tokens"`
+	Requests     []*RequestRecord       `json:"requests"`
+	DeviceGrants []*snapshotDeviceGrant `json:"device_grants"`
+	Sessions     []*Session             `json:"sessions"`
+	Consents     []*Consent             `json:"consents"`
+	SigningKeys  []*SigningKey          `json:"signing_keys,omitempty"`
+}
+
+// snapshotDeviceGrant keeps the consent fields that the model leaves out of its JSON form
+type snapshotDeviceGrant struct {
+	*models.DeviceAuthorization
+	ConsentUser  string `json:"consent_user,omitempty"`
+	ConsentToken string `json:"consent_token,omitempty"`
+}
+
+// SnapshotStats counts the records written to or restored from a snapshot
+type SnapshotStats struct {
+	Clients      int
+	Users        int
+	Groups       int
+	Tokens       int
+	Requests     int
+	DeviceGrants int
+	Sessions     int
+	Consents     int
+	SigningKeys  int
+	Skipped      int
+}
+
+// WriteSnapshot encrypts the current state with the key and atomically replaces
+// the snapshot file
+func (b *MemoryBackend) WriteSnapshot(path, key string) (*SnapshotStats, error) {
+	state := b.capture()
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	sealed, err := sealSnapshot(payload, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	return &SnapshotStats{
+		Clients:      len(state.Clients),
+		Users:        len(state.Users),
+		Groups:       len(state.Groups),
+		Tokens:       len(state.Tokens),
+		Requests:     len(state.Requests),
+		DeviceGrants: len(state.DeviceGrants),
+		Sessions:     len(state.Sessions),
+		Consents:     len(state.Consents),
+		SigningKeys:  len(state.SigningKeys),
+	}, nil
+}
+
+// LoadSnapshot restores the state saved by WriteSnapshot, skipping entries that
+// expired in the meantime. A missing file is not an error.
+func (b *MemoryBackend) LoadSnapshot(path, key string) (*SnapshotStats, error) {
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &SnapshotStats{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	payload, err := openSnapshot(sealed, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var state snapshot
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if state.Version != SnapshotFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, state.Version)
+	}
+
+	return b.restore(&state, time.Now()), nil
+}
+
+// capture copies the state of every store
+func (b *MemoryBackend) capture() *snapshot {
+	state := &snapshot{
+		Version:   SnapshotFormatVersion,
+		CreatedAt: time.Now(),
+	}
+
+	b.clients.mutex.RLock()
+	for _, client := range b.clients.clients {
+		copied := *client
+		state.Clients = append(state.Clients, &copied)
+	}
+	b.clients.mutex.RUnlock()
+
+	b.users.mutex.RLock()
+	for _, user := range b.users.users {
+		state.Users = append(state.Users, copyUser(user))
+	}
+	b.users.mutex.RUnlock()
+
+	b.groups.mutex.RLock()
+	for _, group := range b.groups.groups {
+		copied := *group
+		state.Groups = append(state.Groups, &copied)
+	}
+	b.groups.mutex.RUnlock()
+
+	b.tokens.mutex.RLock()
+	for _, token := range b.tokens.tokens {
+		copied := *token
+		state.Tokens = append(state.Tokens, &copied)
+	}
+	b.tokens.mutex.RUnlock()
+
+	b.requests.mutex.RLock()
+	for _, record := range b.requests.records {
+		copied := *record
+		state.Requests = append(state.Requests, &copied)
+	}
+	b.requests.mutex.RUnlock()
+
+	b.deviceGrants.mutex.RLock()
+	for _, grant := range b.deviceGrants.grants {
+		copied := copyDeviceGrant(grant)
+		state.DeviceGrants = append(state.DeviceGrants, &snapshotDeviceGrant{
+			DeviceAuthorization: copied,
+			ConsentUser:         copied.ConsentUser,
+			ConsentToken:        copied.ConsentToken,
+		})
+	}
+	b.deviceGrants.mutex.RUnlock()
+
+	b.sessions.mutex.RLock()
+	for _, session := range b.sessions.sessions {
+		copied := *session
+		state.Sessions = append(state.Sessions, &copied)
+	}
+	b.sessions.mutex.RUnlock()
+
+	b.consents.mutex.RLock()
+	for _, consent := range b.consents.consents {
+		copied := *consent
+		state.Consents = append(state.Consents, &copied)
+	}
+	b.consents.mutex.RUnlock()
+
+	b.signingKeys.mutex.RLock()
+	for _, key := range b.signingKeys.keys {
+		copied := *key
+		state.SigningKeys = append(state.SigningKeys, &copied)
+	}
+	b.signingKeys.mutex.RUnlock()
+
+	return state
+}
+
+// restore adds the unexpired entries of a snapshot to the stores
+func (b *MemoryBackend) restore(state *snapshot, now time.Time) *SnapshotStats {
+	stats := &SnapshotStats{}
+	expired := func(expiresAt time.Time) bool {
+		return !expiresAt.IsZero() && now.After(expiresAt)
+	}
+
+	b.clients.mutex.Lock()
+	for _, client := range state.Clients {
+		b.clients.clients[client.ID] = client
+		stats.Clients++
+	}
+	b.clients.mutex.Unlock()
+
+	b.users.mutex.Lock()
+	for _, user := range state.Users {
+		b.users.users[user.ID] = user
+		b.users.usernames[user.Username] = user.ID
+		stats.Users++
+	}
+	b.users.mutex.Unlock()
+
+	b.groups.mutex.Lock()
+	for _, group := range state.Groups {
+		b.groups.groups[group.ID] = group
+		stats.Groups++
+	}
+	b.groups.mutex.Unlock()
+
+	b.tokens.mutex.Lock()
+	for _, token := range state.Tokens {
+		if expired(token.ExpiresAt) {
+			stats.Skipped++
+			continue
+		}
+		b.tokens.tokens[token.Token] = token
+		stats.Tokens++
+	}
+	b.tokens.mutex.Unlock()
+
+	b.requests.mutex.Lock()
+	for _, record := range state.Requests {
+		if expired(record.ExpiresAt) {
+			stats.Skipped++
+			continue
+		}
+		b.requests.records[requestKey(record.Kind, record.Signature)] = record
+		stats.Requests++
+	}
+	b.requests.mutex.Unlock()
+
+	b.deviceGrants.mutex.Lock()
+	for _, entry := range state.DeviceGrants {
+		if entry.DeviceAuthorization == nil || expired(entry.ExpiresAt) {
+			stats.Skipped++
+			continue
+		}
+		grant := entry.DeviceAuthorization
+		grant.ConsentUser = entry.ConsentUser
+		grant.ConsentToken = entry.ConsentToken
+		b.deviceGrants.grants[grant.DeviceCode] = grant
+		b.deviceGrants.userCodes[grant.UserCode] = grant.DeviceCode
+		stats.DeviceGrants++
+	}
+	b.deviceGrants.mutex.Unlock()
+
+	b.sessions.mutex.Lock()
+	for _, session := range state.Sessions {
+		if expired(session.ExpiresAt) {
+			stats.Skipped++
+			continue
+		}
+		b.sessions.sessions[session.ID] = session
+		stats.Sessions++
+	}
+	b.sessions.mutex.Unlock()
+
+	b.consents.mutex.Lock()
+	for _, consent := range state.Consents {
+		b.consents.consents[consentKey(consent.UserID, consent.ClientID)] = consent
+		stats.Consents++
+	}
+	b.consents.mutex.Unlock()
+
+	b.signingKeys.mutex.Lock()
+	for _, key := range state.SigningKeys {
+		b.signingKeys.keys[key.ID] = key
+		stats.SigningKeys++
+	}
+	b.signingKeys.mutex.Unlock()
+
+	return stats
+}
+
+// snapshotCipher derives an AES-256-GCM cipher from the snapshot key
+func snapshotCipher(key string) (cipher.AEAD, error) {
+	if key == "" {
+		return nil, errors.New("snapshot key is required")
+	}
+
+	derived := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSnapshot encrypts the payload. The file layout is magic, format version
+// byte, nonce and ciphertext; the header is authenticated as additional data.
+func sealSnapshot(payload []byte, key string) ([]byte, error) {
+	aead, err := snapshotCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte(nil), snapshotMagic...), byte(SnapshotFormatVersion))
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, payload, header), nil
+}
+
+// openSnapshot checks the header and decrypts the payload
+func openSnapshot(sealed []byte, key string) ([]byte, error) {
+	aead, err := snapshotCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := len(snapshotMagic) + 1
+	if len(sealed) < headerSize+aead.NonceSize() || !bytes.Equal(sealed[:len(snapshotMagic)], snapshotMagic) {
+		return nil, errors.New("not a snapshot file")
+	}
+	if version := int(sealed[len(snapshotMagic)]); version != SnapshotFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, version)
+	}
+
+	header := sealed[:headerSize]
+	nonce := sealed[headerSize : headerSize+aead.NonceSize()]
+	payload, err := aead.Open(nil, nonce, sealed[headerSize+aead.NonceSize():], header)
+	if err != nil {
+		return nil, errors.New("failed to decrypt snapshot: wrong key or corrupted file")
+	}
+	return payload, nil
+}
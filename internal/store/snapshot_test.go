@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"oauth2-server/internal/models"
+)
+
+const testSnapshotKey = "snapshot-key"
+
+// writeTestSnapshot saves a backend with live and expired entries and
+// returns the path of its snapshot
+func writeTestSnapshot(t *testing.T) string {
+	t.Helper()
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	live := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Minute)
+
+	steps := []error{
+		backend.Clients().SaveClient(ctx, &Client{ID: "app", Secret: []byte("secret"), Scopes: []string{"openid"}}),
+		backend.Users().SaveUser(ctx, &User{ID: "user-alice", Username: "alice", Enabled: true}),
+		backend.Tokens().SaveToken(ctx, &Token{Token: "live-token", TokenType: "access", ClientID: "app", ExpiresAt: live}),
+		backend.Tokens().SaveToken(ctx, &Token{Token: "expired-token", TokenType: "access", ClientID: "app", ExpiresAt: expired}),
+		backend.Sessions().SaveSession(ctx, &Session{ID: "expired-session", UserID: "user-alice", ExpiresAt: expired}),
+		backend.DeviceGrants().SaveDeviceGrant(ctx, &models.DeviceAuthorization{
+			DeviceCode: "device-code", UserCode: "ABCD-EFGH", ClientID: "app", ExpiresAt: live,
+			ConsentUser: "user-alice", ConsentToken: "consent-token",
+		}),
+		backend.SigningKeys().SaveSigningKey(ctx, &SigningKey{ID: "kid-1", Issuer: "http://localhost:8080", PrivateKey: []byte("key"), CreatedAt: time.Now()}),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "state.snapshot")
+	if _, err := backend.WriteSnapshot(path, testSnapshotKey); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := writeTestSnapshot(t)
+
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("live-token")) {
+		t.Fatal("snapshot contains a token in plain text")
+	}
+
+	restored := NewMemoryBackend()
+	stats, err := restored.LoadSnapshot(path, testSnapshotKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SnapshotStats{Clients: 1, Users: 1, Tokens: 1, DeviceGrants: 1, SigningKeys: 1, Skipped: 2}
+	if *stats != want {
+		t.Errorf("stats = %+v, want %+v", *stats, want)
+	}
+
+	ctx := context.Background()
+	if _, err := restored.Tokens().GetToken(ctx, "expired-token"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired token was restored: %v", err)
+	}
+	if _, err := restored.Sessions().GetSession(ctx, "expired-session"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired session was restored: %v", err)
+	}
+	grant, err := restored.DeviceGrants().GetDeviceGrantByUserCode(ctx, "ABCD-EFGH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.ConsentUser != "user-alice" || grant.ConsentToken != "consent-token" {
+		t.Errorf("device grant consent = %q/%q, want it restored", grant.ConsentUser, grant.ConsentToken)
+	}
+	if user, err := restored.Users().GetUserByUsername(ctx, "alice"); err != nil || user.ID != "user-alice" {
+		t.Errorf("user = %+v (%v), want alice", user, err)
+	}
+}
+
+func TestLoadSnapshotRejectsForeignFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		change func(sealed []byte) []byte
+		want   error
+	}{
+		{name: "wrong key", key: "other-key"},
+		{name: "tampered magic", change: func(sealed []byte) []byte { sealed[0] ^= 0xff; return sealed }},
+		{name: "tampered version", change: func(sealed []byte) []byte { sealed[len(snapshotMagic)]++; return sealed }, want: ErrSnapshotVersion},
+		{name: "tampered nonce", change: func(sealed []byte) []byte { sealed[len(snapshotMagic)+1] ^= 0xff; return sealed }},
+		{name: "tampered body", change: func(sealed []byte) []byte { sealed[len(sealed)-20] ^= 0xff; return sealed }},
+		{name: "truncated body", change: func(sealed []byte) []byte { return sealed[:len(sealed)-1] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestSnapshot(t)
+			sealed, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				sealed = tt.change(sealed)
+			}
+			if err := os.WriteFile(path, sealed, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			key := tt.key
+			if key == "" {
+				key = testSnapshotKey
+			}
+			restored := NewMemoryBackend()
+			_, err = restored.LoadSnapshot(path, key)
+			if err == nil {
+				t.Fatal("foreign snapshot was loaded")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+			if clients, _ := restored.Clients().ListClients(context.Background()); len(clients) != 0 {
+				t.Errorf("rejected snapshot restored %d clients", len(clients))
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotWithoutFile(t *testing.T) {
+	stats, err := NewMemoryBackend().LoadSnapshot(filepath.Join(t.TempDir(), "missing"), testSnapshotKey)
+	if err != nil || *stats != (SnapshotStats{}) {
+		t.Errorf("LoadSnapshot = %+v, %v, want nothing restored", stats, err)
+	}
+}
@@ -0,0 +1,130 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"oauth2-server/internal/models"
+)
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const deviceGrantColumns = "consent_user, consent_token, data"
+
+// scanDeviceGrant decodes a device grant row. The consent fields are not part of
+// the JSON form of the model, so they are kept in their own columns.
+func scanDeviceGrant(row rowScanner) (*models.DeviceAuthorization, error) {
+	var consentUser, consentToken, data string
+	if err := row.Scan(&consentUser, &consentToken, &data); err != nil {
+		return nil, notFound(err)
+	}
+
+	var grant models.DeviceAuthorization
+	if err := json.Unmarshal([]byte(data), &grant); err != nil {
+		return nil, err
+	}
+	grant.ConsentUser = consentUser
+	grant.ConsentToken = consentToken
+	return &grant, nil
+}
+
+// SaveDeviceGrant inserts or replaces a device authorization
+func (s *Store) SaveDeviceGrant(ctx context.Context, grant *models.DeviceAuthorization) error {
+	return s.saveDeviceGrant(ctx, s.db, grant)
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *Store) saveDeviceGrant(ctx context.Context, db execer, grant *models.DeviceAuthorization) error {
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, s.rebind(`INSERT INTO device_grants (device_code, user_code, expires_at, consent_user, consent_token, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (device_code) DO UPDATE SET user_code = excluded.user_code, expires_at = excluded.expires_at,
+			consent_user = excluded.consent_user, consent_token = excluded.consent_token, data = excluded.data`),
+		grant.DeviceCode, grant.UserCode, toUnix(grant.ExpiresAt), grant.ConsentUser, grant.ConsentToken, string(data))
+	return err
+}
+
+// GetDeviceGrant loads a device authorization by device code
+func (s *Store) GetDeviceGrant(ctx context.Context, deviceCode string) (*models.DeviceAuthorization, error) {
+	return scanDeviceGrant(s.queryRow(ctx, "SELECT "+deviceGrantColumns+" FROM device_grants WHERE device_code = ?", deviceCode))
+}
+
+// GetDeviceGrantByUserCode loads a device authorization by user code
+func (s *Store) GetDeviceGrantByUserCode(ctx context.Context, userCode string) (*models.DeviceAuthorization, error) {
+	return scanDeviceGrant(s.queryRow(ctx, "SELECT "+deviceGrantColumns+" FROM device_grants WHERE user_code = ?", userCode))
+}
+
+// UpdateDeviceGrant applies update to the stored grant inside a transaction. The
+// row is locked on PostgreSQL; SQLite serializes writers on its own.
+func (s *Store) UpdateDeviceGrant(ctx context.Context, deviceCode string, update func(grant *models.DeviceAuthorization) error) (*models.DeviceAuthorization, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT " + deviceGrantColumns + " FROM device_grants WHERE device_code = ?"
+	if s.driver == DriverPostgres {
+		query += " FOR UPDATE"
+	}
+
+	grant, err := scanDeviceGrant(tx.QueryRowContext(ctx, s.rebind(query), deviceCode))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := update(grant); err != nil {
+		return nil, err
+	}
+
+	if err := s.saveDeviceGrant(ctx, tx, grant); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// DeleteDeviceGrant removes a device authorization
+func (s *Store) DeleteDeviceGrant(ctx context.Context, deviceCode string) error {
+	_, err := s.exec(ctx, "DELETE FROM device_grants WHERE device_code = ?", deviceCode)
+	return err
+}
+
+// ListDeviceGrants returns all device authorizations
+func (s *Store) ListDeviceGrants(ctx context.Context) ([]*models.DeviceAuthorization, error) {
+	rows, err := s.query(ctx, "SELECT "+deviceGrantColumns+" FROM device_grants")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []*models.DeviceAuthorization
+	for rows.Next() {
+		grant, err := scanDeviceGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// DeleteExpiredDeviceGrants removes device authorizations that expired before the given time
+func (s *Store) DeleteExpiredDeviceGrants(ctx context.Context, before time.Time) (int, error) {
+	return s.deleteExpired(ctx, "device_grants", before)
+}
@@ -0,0 +1,69 @@
+package sqlstore
+
+import (
+	"context"
+	"encoding/json"
+
+	"oauth2-server/internal/store"
+)
+
+// SaveGroup inserts or replaces a group
+func (s *Store) SaveGroup(ctx context.Context, group *store.Group) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `INSERT INTO user_groups (id, display_name, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET display_name = excluded.display_name, data = excluded.data`,
+		group.ID, group.DisplayName, string(data))
+	return err
+}
+
+// GetGroup loads a group by ID
+func (s *Store) GetGroup(ctx context.Context, id string) (*store.Group, error) {
+	var data string
+	if err := s.queryRow(ctx, "SELECT data FROM user_groups WHERE id = ?", id).Scan(&data); err != nil {
+		return nil, notFound(err)
+	}
+
+	var group store.Group
+	if err := json.Unmarshal([]byte(data), &group); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// DeleteGroup removes a group
+func (s *Store) DeleteGroup(ctx context.Context, id string) error {
+	result, err := s.exec(ctx, "DELETE FROM user_groups WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// ListGroups returns all groups ordered by display name
+func (s *Store) ListGroups(ctx context.Context) ([]*store.Group, error) {
+	rows, err := s.query(ctx, "SELECT data FROM user_groups ORDER BY display_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*store.Group
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var group store.Group
+		if err := json.Unmarshal([]byte(data), &group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, &group)
+	}
+	return groups, rows.Err()
+}
@@ -0,0 +1,183 @@
+package sqlstore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one schema change; versions are applied in order and never edited
+// once released
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations use SQL that SQLite and PostgreSQL both understand. Timestamps are
+// unix nanoseconds and booleans are integers.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		statements: []string{
+			`CREATE TABLE clients (
+				id TEXT PRIMARY KEY,
+				data TEXT NOT NULL
+			)`,
+			`CREATE TABLE tokens (
+				token TEXT PRIMARY KEY,
+				token_type TEXT NOT NULL,
+				client_id TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				expires_at BIGINT NOT NULL,
+				data TEXT NOT NULL
+			)`,
+			`CREATE INDEX tokens_user_id ON tokens (user_id)`,
+			`CREATE INDEX tokens_client_id ON tokens (client_id)`,
+			`CREATE TABLE requests (
+				kind TEXT NOT NULL,
+				signature TEXT NOT NULL,
+				request_id TEXT NOT NULL,
+				client_id TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				active INTEGER NOT NULL,
+				expires_at BIGINT NOT NULL,
+				data TEXT NOT NULL,
+				PRIMARY KEY (kind, signature)
+			)`,
+			`CREATE INDEX requests_request_id ON requests (kind, request_id)`,
+			`CREATE TABLE device_grants (
+				device_code TEXT PRIMARY KEY,
+				user_code TEXT NOT NULL UNIQUE,
+				expires_at BIGINT NOT NULL,
+				consent_user TEXT NOT NULL,
+				consent_token TEXT NOT NULL,
+				data TEXT NOT NULL
+			)`,
+			`CREATE TABLE sessions (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				expires_at BIGINT NOT NULL
+			)`,
+			`CREATE TABLE consents (
+				user_id TEXT NOT NULL,
+				client_id TEXT NOT NULL,
+				scopes TEXT NOT NULL,
+				granted_at BIGINT NOT NULL,
+				PRIMARY KEY (user_id, client_id)
+			)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "users",
+		statements: []string{
+			`CREATE TABLE users (
+				id TEXT PRIMARY KEY,
+				username TEXT NOT NULL UNIQUE,
+				data TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 3,
+		name:    "groups",
+		statements: []string{
+			`CREATE TABLE user_groups (
+				id TEXT PRIMARY KEY,
+				display_name TEXT NOT NULL,
+				data TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "requests by subject",
+		statements: []string{
+			`CREATE INDEX requests_subject ON requests (subject)`,
+		},
+	},
+	{
+		version: 5,
+		name:    "session authentication methods",
+		statements: []string{
+			`ALTER TABLE sessions ADD COLUMN amr TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE sessions ADD COLUMN acr TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 6,
+		name:    "rate limits",
+		statements: []string{
+			`CREATE TABLE rate_limits (
+				bucket_key TEXT PRIMARY KEY,
+				tokens DOUBLE PRECISION NOT NULL,
+				updated_at BIGINT NOT NULL,
+				expires_at BIGINT NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 7,
+		name:    "signing keys",
+		statements: []string{
+			`CREATE TABLE signing_keys (
+				kid TEXT PRIMARY KEY,
+				issuer TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				data TEXT NOT NULL
+			)`,
+			`CREATE INDEX signing_keys_issuer ON signing_keys (issuer, created_at)`,
+		},
+	},
+}
+
+// migrate creates the schema_migrations table and applies pending migrations,
+// each in its own transaction
+func (s *Store) migrate(ctx context.Context) error {
+	if _, err := s.exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	var current int
+	if err := s.queryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range m.statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, s.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), m.version, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", m.version, err)
+		}
+
+		log.Printf("🗄️ Applied storage migration %d: %s", m.version, m.name)
+	}
+
+	return nil
+}
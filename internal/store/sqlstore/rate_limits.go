@@ -0,0 +1,53 @@
+package sqlstore
+
+import (
+	"context"
+	"time"
+
+	"oauth2-server/internal/store"
+)
+
+// UpdateRateLimitBucket applies update to the bucket of key inside a
+// transaction. The row is created first, so concurrent requests of a new key
+// lock the same row on PostgreSQL; SQLite serializes writers on its own.
+func (s *Store) UpdateRateLimitBucket(ctx context.Context, key string, update func(bucket *store.RateLimitBucket)) (*store.RateLimitBucket, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO rate_limits (bucket_key, tokens, updated_at, expires_at)
+		VALUES (?, 0, 0, 0) ON CONFLICT (bucket_key) DO NOTHING`), key); err != nil {
+		return nil, err
+	}
+
+	query := "SELECT tokens, updated_at, expires_at FROM rate_limits WHERE bucket_key = ?"
+	if s.driver == DriverPostgres {
+		query += " FOR UPDATE"
+	}
+	bucket := &store.RateLimitBucket{Key: key}
+	var updatedAt, expiresAt int64
+	if err := tx.QueryRowContext(ctx, s.rebind(query), key).Scan(&bucket.Tokens, &updatedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+	bucket.UpdatedAt = fromUnix(updatedAt)
+	bucket.ExpiresAt = fromUnix(expiresAt)
+
+	update(bucket)
+
+	if _, err := tx.ExecContext(ctx, s.rebind("UPDATE rate_limits SET tokens = ?, updated_at = ?, expires_at = ? WHERE bucket_key = ?"),
+		bucket.Tokens, toUnix(bucket.UpdatedAt), toUnix(bucket.ExpiresAt), key); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// DeleteExpiredRateLimitBuckets removes buckets that were full again before the given time
+func (s *Store) DeleteExpiredRateLimitBuckets(ctx context.Context, before time.Time) (int, error) {
+	return s.deleteExpired(ctx, "rate_limits", before)
+}
@@ -0,0 +1,209 @@
+package sqlstore
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"oauth2-server/internal/store"
+)
+
+// SaveClient inserts or replaces a client
+func (s *Store) SaveClient(ctx context.Context, client *store.Client) error {
+	data, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `INSERT INTO clients (id, data) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`, client.ID, string(data))
+	return err
+}
+
+// GetClient loads a client by ID
+func (s *Store) GetClient(ctx context.Context, id string) (*store.Client, error) {
+	var data string
+	if err := s.queryRow(ctx, "SELECT data FROM clients WHERE id = ?", id).Scan(&data); err != nil {
+		return nil, notFound(err)
+	}
+
+	var client store.Client
+	if err := json.Unmarshal([]byte(data), &client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// DeleteClient removes a client
+func (s *Store) DeleteClient(ctx context.Context, id string) error {
+	result, err := s.exec(ctx, "DELETE FROM clients WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// ListClients returns all clients
+func (s *Store) ListClients(ctx context.Context) ([]*store.Client, error) {
+	rows, err := s.query(ctx, "SELECT data FROM clients ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []*store.Client
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var client store.Client
+		if err := json.Unmarshal([]byte(data), &client); err != nil {
+			return nil, err
+		}
+		clients = append(clients, &client)
+	}
+	return clients, rows.Err()
+}
+
+// SaveToken inserts or replaces a token
+func (s *Store) SaveToken(ctx context.Context, token *store.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `INSERT INTO tokens (token, token_type, client_id, user_id, expires_at, data) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (token) DO UPDATE SET token_type = excluded.token_type, client_id = excluded.client_id,
+			user_id = excluded.user_id, expires_at = excluded.expires_at, data = excluded.data`,
+		token.Token, token.TokenType, token.ClientID, token.UserID, toUnix(token.ExpiresAt), string(data))
+	return err
+}
+
+// GetToken loads a token by value
+func (s *Store) GetToken(ctx context.Context, value string) (*store.Token, error) {
+	var data string
+	if err := s.queryRow(ctx, "SELECT data FROM tokens WHERE token = ?", value).Scan(&data); err != nil {
+		return nil, notFound(err)
+	}
+
+	var token store.Token
+	if err := json.Unmarshal([]byte(data), &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ListTokens returns the tokens of a user and/or client; empty filters match all
+func (s *Store) ListTokens(ctx context.Context, userID, clientID string) ([]*store.Token, error) {
+	rows, err := s.query(ctx, `SELECT data FROM tokens
+		WHERE (? = '' OR user_id = ?) AND (? = '' OR client_id = ?)`,
+		userID, userID, clientID, clientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*store.Token
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var token store.Token
+		if err := json.Unmarshal([]byte(data), &token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteExpiredTokens removes tokens that expired before the given time
+func (s *Store) DeleteExpiredTokens(ctx context.Context, before time.Time) (int, error) {
+	return s.deleteExpired(ctx, "tokens", before)
+}
+
+// SaveRequest inserts or replaces a fosite request record
+func (s *Store) SaveRequest(ctx context.Context, record *store.RequestRecord) error {
+	_, err := s.exec(ctx, `INSERT INTO requests (kind, signature, request_id, client_id, subject, active, expires_at, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (kind, signature) DO UPDATE SET request_id = excluded.request_id, client_id = excluded.client_id,
+			subject = excluded.subject, active = excluded.active, expires_at = excluded.expires_at, data = excluded.data`,
+		record.Kind, record.Signature, record.RequestID, record.ClientID, record.Subject,
+		boolToInt(record.Active), toUnix(record.ExpiresAt), string(record.Data))
+	return err
+}
+
+// GetRequest loads a fosite request record
+func (s *Store) GetRequest(ctx context.Context, kind, signature string) (*store.RequestRecord, error) {
+	record := &store.RequestRecord{Kind: kind, Signature: signature}
+	var active int
+	var expiresAt int64
+	var data string
+
+	err := s.queryRow(ctx, `SELECT request_id, client_id, subject, active, expires_at, data
+		FROM requests WHERE kind = ? AND signature = ?`, kind, signature).
+		Scan(&record.RequestID, &record.ClientID, &record.Subject, &active, &expiresAt, &data)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	record.Active = active != 0
+	record.ExpiresAt = fromUnix(expiresAt)
+	record.Data = []byte(data)
+	return record, nil
+}
+
+// DeleteRequest removes a fosite request record
+func (s *Store) DeleteRequest(ctx context.Context, kind, signature string) error {
+	_, err := s.exec(ctx, "DELETE FROM requests WHERE kind = ? AND signature = ?", kind, signature)
+	return err
+}
+
+// DeactivateRequest marks a fosite request record inactive
+func (s *Store) DeactivateRequest(ctx context.Context, kind, signature string) error {
+	result, err := s.exec(ctx, "UPDATE requests SET active = 0 WHERE kind = ? AND signature = ?", kind, signature)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// DeactivateRequestsByID marks all records of a request inactive
+func (s *Store) DeactivateRequestsByID(ctx context.Context, kind, requestID string) error {
+	_, err := s.exec(ctx, "UPDATE requests SET active = 0 WHERE kind = ? AND request_id = ?", kind, requestID)
+	return err
+}
+
+// DeactivateRequestsOf marks the records of a subject and/or client inactive
+func (s *Store) DeactivateRequestsOf(ctx context.Context, subject, clientID string) (int, error) {
+	where := "active = 1"
+	var args []interface{}
+	if subject != "" {
+		where += " AND subject = ?"
+		args = append(args, subject)
+	}
+	if clientID != "" {
+		where += " AND client_id = ?"
+		args = append(args, clientID)
+	}
+
+	var requests int
+	if err := s.queryRow(ctx, "SELECT COUNT(DISTINCT request_id) FROM requests WHERE "+where, args...).Scan(&requests); err != nil {
+		return 0, err
+	}
+	if _, err := s.exec(ctx, "UPDATE requests SET active = 0 WHERE "+where, args...); err != nil {
+		return 0, err
+	}
+	return requests, nil
+}
+
+// DeleteExpiredRequests removes request records that expired before the given time
+func (s *Store) DeleteExpiredRequests(ctx context.Context, before time.Time) (int, error) {
+	return s.deleteExpired(ctx, "requests", before)
+}
@@ -0,0 +1,72 @@
+package sqlstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"oauth2-server/internal/store"
+)
+
+func TestDeactivateRequestsOf(t *testing.T) {
+	sqlite, err := Open(DriverSQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+
+	backends := map[string]store.Backend{
+		"memory": store.NewMemoryBackend(),
+		"sqlite": sqlite,
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			requests := backend.Requests()
+			expiresAt := time.Now().Add(time.Hour)
+			records := []store.RequestRecord{
+				{Kind: store.RequestKindAuthorizeCode, Signature: "code-1", RequestID: "req-1", ClientID: "app", Subject: "alice"},
+				{Kind: store.RequestKindAccessToken, Signature: "at-1", RequestID: "req-1", ClientID: "app", Subject: "alice"},
+				{Kind: store.RequestKindRefreshToken, Signature: "rt-1", RequestID: "req-1", ClientID: "app", Subject: "alice"},
+				{Kind: store.RequestKindAccessToken, Signature: "at-2", RequestID: "req-2", ClientID: "other", Subject: "alice"},
+				{Kind: store.RequestKindAccessToken, Signature: "at-3", RequestID: "req-3", ClientID: "app", Subject: "bob"},
+			}
+			for i := range records {
+				records[i].Active = true
+				records[i].ExpiresAt = expiresAt
+				records[i].Data = []byte("{}")
+				if err := requests.SaveRequest(ctx, &records[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deactivated, err := requests.DeactivateRequestsOf(ctx, "alice", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deactivated != 1 {
+				t.Fatalf("deactivated %d requests of alice at app, want 1", deactivated)
+			}
+
+			deactivated, err = requests.DeactivateRequestsOf(ctx, "alice", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deactivated != 1 {
+				t.Fatalf("deactivated %d further requests of alice, want 1", deactivated)
+			}
+
+			want := map[string]bool{"code-1": false, "at-1": false, "rt-1": false, "at-2": false, "at-3": true}
+			for _, record := range records {
+				stored, err := requests.GetRequest(ctx, record.Kind, record.Signature)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Active != want[record.Signature] {
+					t.Errorf("%s active = %v, want %v", record.Signature, stored.Active, want[record.Signature])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package sqlstore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"oauth2-server/internal/store"
+)
+
+// SaveSession inserts or replaces a login session
+func (s *Store) SaveSession(ctx context.Context, session *store.Session) error {
+	_, err := s.exec(ctx, `INSERT INTO sessions (id, user_id, created_at, expires_at, amr, acr) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, created_at = excluded.created_at, expires_at = excluded.expires_at,
+		amr = excluded.amr, acr = excluded.acr`,
+		session.ID, session.UserID, toUnix(session.CreatedAt), toUnix(session.ExpiresAt), strings.Join(session.AMR, " "), session.ACR)
+	return err
+}
+
+// GetSession loads a login session
+func (s *Store) GetSession(ctx context.Context, id string) (*store.Session, error) {
+	session := &store.Session{ID: id}
+	var createdAt, expiresAt int64
+	var amr string
+
+	err := s.queryRow(ctx, "SELECT user_id, created_at, expires_at, amr, acr FROM sessions WHERE id = ?", id).
+		Scan(&session.UserID, &createdAt, &expiresAt, &amr, &session.ACR)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	session.CreatedAt = fromUnix(createdAt)
+	session.ExpiresAt = fromUnix(expiresAt)
+	session.AMR = strings.Fields(amr)
+	return session, nil
+}
+
+// DeleteSession removes a login session
+func (s *Store) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, "DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// DeleteExpiredSessions removes sessions that expired before the given time
+func (s *Store) DeleteExpiredSessions(ctx context.Context, before time.Time) (int, error) {
+	return s.deleteExpired(ctx, "sessions", before)
+}
+
+// SaveConsent inserts or replaces the consent of a user for a client
+func (s *Store) SaveConsent(ctx context.Context, consent *store.Consent) error {
+	_, err := s.exec(ctx, `INSERT INTO consents (user_id, client_id, scopes, granted_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, client_id) DO UPDATE SET scopes = excluded.scopes, granted_at = excluded.granted_at`,
+		consent.UserID, consent.ClientID, strings.Join(consent.Scopes, " "), toUnix(consent.GrantedAt))
+	return err
+}
+
+// GetConsent loads the consent of a user for a client
+func (s *Store) GetConsent(ctx context.Context, userID, clientID string) (*store.Consent, error) {
+	var scopes string
+	var grantedAt int64
+
+	err := s.queryRow(ctx, "SELECT scopes, granted_at FROM consents WHERE user_id = ? AND client_id = ?", userID, clientID).
+		Scan(&scopes, &grantedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &store.Consent{
+		UserID:    userID,
+		ClientID:  clientID,
+		Scopes:    strings.Fields(scopes),
+		GrantedAt: fromUnix(grantedAt),
+	}, nil
+}
+
+// DeleteConsent removes the consent of a user for a client
+func (s *Store) DeleteConsent(ctx context.Context, userID, clientID string) error {
+	_, err := s.exec(ctx, "DELETE FROM consents WHERE user_id = ? AND client_id = ?", userID, clientID)
+	return err
+}
+
+// ListConsents returns the consents of a user
+func (s *Store) ListConsents(ctx context.Context, userID string) ([]*store.Consent, error) {
+	rows, err := s.query(ctx, "SELECT client_id, scopes, granted_at FROM consents WHERE user_id = ? ORDER BY client_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var consents []*store.Consent
+	for rows.Next() {
+		consent := &store.Consent{UserID: userID}
+		var scopes string
+		var grantedAt int64
+		if err := rows.Scan(&consent.ClientID, &scopes, &grantedAt); err != nil {
+			return nil, err
+		}
+		consent.Scopes = strings.Fields(scopes)
+		consent.GrantedAt = fromUnix(grantedAt)
+		consents = append(consents, consent)
+	}
+	return consents, rows.Err()
+}
@@ -0,0 +1,55 @@
+package sqlstore
+
+import (
+	"context"
+	"encoding/json"
+
+	"oauth2-server/internal/store"
+)
+
+// SaveSigningKey inserts or replaces a signing key
+func (s *Store) SaveSigningKey(ctx context.Context, key *store.SigningKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `INSERT INTO signing_keys (kid, issuer, created_at, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kid) DO UPDATE SET issuer = excluded.issuer, created_at = excluded.created_at, data = excluded.data`,
+		key.ID, key.Issuer, toUnix(key.CreatedAt), string(data))
+	return err
+}
+
+// ListSigningKeys returns the signing keys of an issuer, newest first
+func (s *Store) ListSigningKeys(ctx context.Context, issuer string) ([]*store.SigningKey, error) {
+	rows, err := s.query(ctx, "SELECT data FROM signing_keys WHERE issuer = ? ORDER BY created_at DESC", issuer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*store.SigningKey
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var key store.SigningKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteSigningKey removes a signing key
+func (s *Store) DeleteSigningKey(ctx context.Context, id string) error {
+	result, err := s.exec(ctx, "DELETE FROM signing_keys WHERE kid = ?", id)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
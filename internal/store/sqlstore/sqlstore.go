@@ -0,0 +1,194 @@
+// Package sqlstore implements the storage interfaces of the store package on
+// top of SQLite or PostgreSQL, so that state survives restarts and can be
+// shared between replicas.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Database drivers
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+
+	"oauth2-server/internal/store"
+)
+
+// Supported drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// Store is a SQL storage backend. It implements every storage interface of the
+// store package and store.Backend.
+type Store struct {
+	db     *sql.DB
+	driver string
+}
+
+var _ store.Backend = (*Store)(nil)
+
+// Open connects to the database and applies pending migrations
+func Open(driver, dsn string) (*Store, error) {
+	var db *sql.DB
+	var err error
+
+	switch driver {
+	case DriverSQLite:
+		db, err = sql.Open("sqlite", sqliteDSN(dsn))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+		}
+		// SQLite allows a single writer; serializing access avoids SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	case DriverPostgres:
+		db, err = sql.Open("pgx", dsn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open postgres database: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported storage driver: %s", driver)
+	}
+
+	s := &Store{db: db, driver: driver}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// sqliteDSN enables WAL and a busy timeout unless the DSN sets pragmas itself
+func sqliteDSN(dsn string) string {
+	if strings.Contains(dsn, "_pragma=") {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
+// Clients returns the client storage
+func (s *Store) Clients() store.ClientStorage { return s }
+
+// Users returns the user storage
+func (s *Store) Users() store.UserStorage { return s }
+
+// Groups returns the group storage
+func (s *Store) Groups() store.GroupStorage { return s }
+
+// Tokens returns the token storage
+func (s *Store) Tokens() store.TokenStorage { return s }
+
+// Requests returns the fosite request storage
+func (s *Store) Requests() store.RequestStorage { return s }
+
+// DeviceGrants returns the device authorization storage
+func (s *Store) DeviceGrants() store.DeviceGrantStorage { return s }
+
+// Sessions returns the login session storage
+func (s *Store) Sessions() store.SessionStorage { return s }
+
+// Consents returns the consent storage
+func (s *Store) Consents() store.ConsentStorage { return s }
+
+// RateLimits returns the rate limit bucket storage
+func (s *Store) RateLimits() store.RateLimitStorage { return s }
+
+// SigningKeys returns the signing key storage
+func (s *Store) SigningKeys() store.SigningKeyStorage { return s }
+
+// Close closes the database connection
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// rebind rewrites ? placeholders to $n for PostgreSQL
+func (s *Store) rebind(query string) string {
+	if s.driver != DriverPostgres {
+		return query
+	}
+
+	var builder strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+func (s *Store) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *Store) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+func (s *Store) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.rebind(query), args...)
+}
+
+// deleteExpired removes the rows of table that expired before the given time
+func (s *Store) deleteExpired(ctx context.Context, table string, before time.Time) (int, error) {
+	result, err := s.exec(ctx, "DELETE FROM "+table+" WHERE expires_at > 0 AND expires_at < ?", toUnix(before))
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// toUnix converts a time to unix nanoseconds, keeping the zero time as 0
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnix converts unix nanoseconds back to a time
+func fromUnix(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// boolToInt stores booleans as integers, which both databases accept
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// notFound maps sql.ErrNoRows to store.ErrNotFound
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return store.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package sqlstore
+
+import (
+	"context"
+	"encoding/json"
+
+	"oauth2-server/internal/store"
+)
+
+// SaveUser inserts or replaces a user
+func (s *Store) SaveUser(ctx context.Context, user *store.User) error {
+	var owner string
+	err := s.queryRow(ctx, "SELECT id FROM users WHERE username = ?", user.Username).Scan(&owner)
+	if err == nil && owner != user.ID {
+		return store.ErrUsernameTaken
+	}
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `INSERT INTO users (id, username, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET username = excluded.username, data = excluded.data`,
+		user.ID, user.Username, string(data))
+	return err
+}
+
+// GetUser loads a user by ID
+func (s *Store) GetUser(ctx context.Context, id string) (*store.User, error) {
+	return s.getUser(ctx, "SELECT data FROM users WHERE id = ?", id)
+}
+
+// GetUserByUsername loads a user by username
+func (s *Store) GetUserByUsername(ctx context.Context, username string) (*store.User, error) {
+	return s.getUser(ctx, "SELECT data FROM users WHERE username = ?", username)
+}
+
+func (s *Store) getUser(ctx context.Context, query string, arg string) (*store.User, error) {
+	var data string
+	if err := s.queryRow(ctx, query, arg).Scan(&data); err != nil {
+		return nil, notFound(err)
+	}
+
+	var user store.User
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// DeleteUser removes a user
+func (s *Store) DeleteUser(ctx context.Context, id string) error {
+	result, err := s.exec(ctx, "DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// ListUsers returns all users ordered by username
+func (s *Store) ListUsers(ctx context.Context) ([]*store.User, error) {
+	rows, err := s.query(ctx, "SELECT data FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*store.User
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var user store.User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"oauth2-server/internal/models"
+)
+
+// ErrNotFound is returned by storage backends for records that do not exist
+var ErrNotFound = errors.New("record not found")
+
+// Request kinds stored through RequestStorage
+const (
+	RequestKindAuthorizeCode = "authorize_code"
+	RequestKindPKCE          = "pkce"
+	RequestKindOpenIDConnect = "oidc"
+	RequestKindAccessToken   = "access_token"
+	RequestKindRefreshToken  = "refresh_token"
+)
+
+// RequestRecord is a serialized fosite request stored under a code or token signature
+type RequestRecord struct {
+	Kind      string
+	Signature string
+	RequestID string
+	ClientID  string
+	Subject   string
+	Active    bool
+	ExpiresAt time.Time
+	Data      []byte
+}
+
+// Session is an authenticated browser session of a user
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// AMR lists the authentication methods of the login (e.g. pwd, otp) and
+	// ACR the resulting authentication context class
+	AMR []string `json:"amr,omitempty"`
+	ACR string   `json:"acr,omitempty"`
+}
+
+// Consent records the scopes a user granted to a client
+type Consent struct {
+	UserID    string    `json:"user_id"`
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// Group is a named group of users, provisioned through SCIM. Members are the
+// users that have the group's display name as a role.
+type Group struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"display_name"`
+	ExternalID  string    `json:"external_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// RateLimitBucket is the token bucket of one rate limit key. A bucket that
+// was never used has a zero UpdatedAt and counts as full.
+type RateLimitBucket struct {
+	Key       string
+	Tokens    float64
+	UpdatedAt time.Time
+	// ExpiresAt is when the bucket is full again and may be forgotten
+	ExpiresAt time.Time
+}
+
+// SigningKey is a private key that signs the JWTs of an issuer
+type SigningKey struct {
+	ID     string `json:"kid"`
+	Issuer string `json:"issuer"`
+	// PrivateKey is the PKCS #8 DER encoding of the key
+	PrivateKey []byte    `json:"private_key"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ClientStorage persists OAuth2 clients
+type ClientStorage interface {
+	SaveClient(ctx context.Context, client *Client) error
+	GetClient(ctx context.Context, id string) (*Client, error)
+	DeleteClient(ctx context.Context, id string) error
+	ListClients(ctx context.Context) ([]*Client, error)
+}
+
+// UserStorage persists user accounts
+type UserStorage interface {
+	SaveUser(ctx context.Context, user *User) error
+	GetUser(ctx context.Context, id string) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	DeleteUser(ctx context.Context, id string) error
+	ListUsers(ctx context.Context) ([]*User, error)
+}
+
+// GroupStorage persists groups
+type GroupStorage interface {
+	SaveGroup(ctx context.Context, group *Group) error
+	GetGroup(ctx context.Context, id string) (*Group, error)
+	DeleteGroup(ctx context.Context, id string) error
+	ListGroups(ctx context.Context) ([]*Group, error)
+}
+
+// TokenStorage persists opaque access and refresh tokens
+type TokenStorage interface {
+	SaveToken(ctx context.Context, token *Token) error
+	GetToken(ctx context.Context, value string) (*Token, error)
+	// ListTokens returns the tokens of a user and/or client; empty filters match all
+	ListTokens(ctx context.Context, userID, clientID string) ([]*Token, error)
+	DeleteExpiredTokens(ctx context.Context, before time.Time) (int, error)
+}
+
+// RequestStorage persists fosite requests: authorization codes, PKCE and OpenID
+// Connect sessions, and the access and refresh tokens issued by fosite
+type RequestStorage interface {
+	SaveRequest(ctx context.Context, record *RequestRecord) error
+	GetRequest(ctx context.Context, kind, signature string) (*RequestRecord, error)
+	DeleteRequest(ctx context.Context, kind, signature string) error
+	DeactivateRequest(ctx context.Context, kind, signature string) error
+	// DeactivateRequestsByID marks all records of a request (e.g. a token family) inactive
+	DeactivateRequestsByID(ctx context.Context, kind, requestID string) error
+	// DeactivateRequestsOf marks the records of every request of a subject, a
+	// client or a subject at one client inactive; empty values match any. It
+	// returns how many requests were deactivated.
+	DeactivateRequestsOf(ctx context.Context, subject, clientID string) (int, error)
+	DeleteExpiredRequests(ctx context.Context, before time.Time) (int, error)
+}
+
+// DeviceGrantStorage persists device authorizations (RFC 8628)
+type DeviceGrantStorage interface {
+	SaveDeviceGrant(ctx context.Context, grant *models.DeviceAuthorization) error
+	GetDeviceGrant(ctx context.Context, deviceCode string) (*models.DeviceAuthorization, error)
+	GetDeviceGrantByUserCode(ctx context.Context, userCode string) (*models.DeviceAuthorization, error)
+	// UpdateDeviceGrant atomically applies update to the stored grant; the grant is
+	// left unchanged when update returns an error
+	UpdateDeviceGrant(ctx context.Context, deviceCode string, update func(grant *models.DeviceAuthorization) error) (*models.DeviceAuthorization, error)
+	DeleteDeviceGrant(ctx context.Context, deviceCode string) error
+	ListDeviceGrants(ctx context.Context) ([]*models.DeviceAuthorization, error)
+	DeleteExpiredDeviceGrants(ctx context.Context, before time.Time) (int, error)
+}
+
+// SessionStorage persists browser login sessions
+type SessionStorage interface {
+	SaveSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, id string) (*Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	DeleteExpiredSessions(ctx context.Context, before time.Time) (int, error)
+}
+
+// ConsentStorage persists the consent decisions of users
+type ConsentStorage interface {
+	SaveConsent(ctx context.Context, consent *Consent) error
+	GetConsent(ctx context.Context, userID, clientID string) (*Consent, error)
+	DeleteConsent(ctx context.Context, userID, clientID string) error
+	ListConsents(ctx context.Context, userID string) ([]*Consent, error)
+}
+
+// RateLimitStorage shares rate limit buckets between replicas
+type RateLimitStorage interface {
+	// UpdateRateLimitBucket atomically applies update to the bucket of key,
+	// creating it when it does not exist
+	UpdateRateLimitBucket(ctx context.Context, key string, update func(bucket *RateLimitBucket)) (*RateLimitBucket, error)
+	DeleteExpiredRateLimitBuckets(ctx context.Context, before time.Time) (int, error)
+}
+
+// SigningKeyStorage persists JWT signing keys, so issued tokens stay valid
+// across restarts and every replica signs with the same keys
+type SigningKeyStorage interface {
+	SaveSigningKey(ctx context.Context, key *SigningKey) error
+	// ListSigningKeys returns the keys of an issuer, newest first
+	ListSigningKeys(ctx context.Context, issuer string) ([]*SigningKey, error)
+	DeleteSigningKey(ctx context.Context, id string) error
+}
+
+// Backend bundles the storage implementations of one storage driver
+type Backend interface {
+	Clients() ClientStorage
+	Users() UserStorage
+	Groups() GroupStorage
+	Tokens() TokenStorage
+	Requests() RequestStorage
+	DeviceGrants() DeviceGrantStorage
+	Sessions() SessionStorage
+	Consents() ConsentStorage
+	RateLimits() RateLimitStorage
+	SigningKeys() SigningKeyStorage
+	Close() error
+}
@@ -1,9 +1,12 @@
 package store
 
 import (
+	"context"
 	"errors"
-	"sync"
+	"log"
 	"time"
+
+	"oauth2-server/internal/models"
 )
 
 // Token represents an access or refresh token
@@ -16,49 +19,60 @@ type Token struct {
 	ExpiresAt time.Time `json:"expires_at"`
 	Revoked   bool      `json:"revoked"`
 	CreatedAt time.Time `json:"created_at"`
+	// Audience overrides the default audience of the token when set
+	Audience []string `json:"audience,omitempty"`
+	// Act records the delegation chain of exchanged tokens (RFC 8693)
+	Act *models.ActorClaim `json:"act,omitempty"`
+	// MaxAccessTokenLifetime and MaxRefreshTokenLifetime are the lifetime caps
+	// of the token exchange policy an exchanged refresh token was issued under;
+	// they apply again whenever it is refreshed
+	MaxAccessTokenLifetime  time.Duration `json:"max_access_token_lifetime,omitempty"`
+	MaxRefreshTokenLifetime time.Duration `json:"max_refresh_token_lifetime,omitempty"`
+}
+
+// audience returns the audience of the token, defaulting to the API audience
+func (t *Token) audience() []string {
+	if len(t.Audience) > 0 {
+		return t.Audience
+	}
+	return []string{"api"}
 }
 
 // TokenInfo represents token information for validation
 type TokenInfo struct {
-	Token     string    `json:"token"`
-	TokenType string    `json:"token_type"`
-	ClientID  string    `json:"client_id"`
-	UserID    string    `json:"user_id"`
-	Scopes    []string  `json:"scopes"`
-	ExpiresAt time.Time `json:"expires_at"`
-	Active    bool      `json:"active"`
-	IssuedAt  time.Time `json:"iat"`
-	Issuer    string    `json:"iss"`
-	Audience  []string  `json:"aud"`
+	Token     string             `json:"token"`
+	TokenType string             `json:"token_type"`
+	ClientID  string             `json:"client_id"`
+	UserID    string             `json:"user_id"`
+	Scopes    []string           `json:"scopes"`
+	ExpiresAt time.Time          `json:"expires_at"`
+	Active    bool               `json:"active"`
+	IssuedAt  time.Time          `json:"iat"`
+	Issuer    string             `json:"iss"`
+	Audience  []string           `json:"aud"`
+	Act       *models.ActorClaim `json:"act,omitempty"`
 }
 
-// TokenStore manages tokens
+// TokenStore manages tokens on top of a storage backend
 type TokenStore struct {
-	tokens        map[string]*Token
-	refreshTokens map[string]*Token // Separate storage for refresh tokens
-	mutex         sync.RWMutex
+	storage TokenStorage
+	issuer  string
 }
 
 // NewTokenStore creates a new token store
-func NewTokenStore() *TokenStore {
-	return &TokenStore{
-		tokens:        make(map[string]*Token),
-		refreshTokens: make(map[string]*Token),
-	}
+func NewTokenStore(storage TokenStorage) *TokenStore {
+	return &TokenStore{storage: storage}
+}
+
+// UseIssuer sets the issuer that token information reports, the issuer of
+// the realm the tokens belong to
+func (s *TokenStore) UseIssuer(issuer string) {
+	s.issuer = issuer
 }
 
 // StoreToken stores a token
 func (s *TokenStore) StoreToken(token *Token) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	if token.TokenType == "refresh" {
-		s.refreshTokens[token.Token] = token
-	} else {
-		s.tokens[token.Token] = token
-	}
-
-	return nil
+	return s.storage.SaveToken(context.Background(), token)
 }
 
 // StoreAccessToken stores an access token
@@ -95,50 +109,42 @@ func (s *TokenStore) StoreRefreshToken(tokenString, clientID, userID string, sco
 
 // GetToken retrieves a token
 func (s *TokenStore) GetToken(token string) (*Token, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	// Check access tokens first
-	if tokenData, exists := s.tokens[token]; exists {
-		return tokenData, nil
-	}
-
-	// Check refresh tokens
-	if tokenData, exists := s.refreshTokens[token]; exists {
-		return tokenData, nil
+	tokenData, err := s.storage.GetToken(context.Background(), token)
+	if errors.Is(err, ErrNotFound) {
+		return nil, errors.New("token not found")
 	}
-
-	return nil, errors.New("token not found")
+	return tokenData, err
 }
 
 // GetAccessToken retrieves an access token
 func (s *TokenStore) GetAccessToken(token string) (*Token, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	tokenData, exists := s.tokens[token]
-	if !exists {
+	tokenData, err := s.storage.GetToken(context.Background(), token)
+	if errors.Is(err, ErrNotFound) || (err == nil && tokenData.TokenType == "refresh") {
 		return nil, errors.New("access token not found")
 	}
-
-	return tokenData, nil
+	return tokenData, err
 }
 
 // GetRefreshToken retrieves a refresh token
 func (s *TokenStore) GetRefreshToken(token string) (*Token, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	tokenData, exists := s.refreshTokens[token]
-	if !exists {
+	tokenData, err := s.storage.GetToken(context.Background(), token)
+	if errors.Is(err, ErrNotFound) || (err == nil && tokenData.TokenType != "refresh") {
 		return nil, errors.New("refresh token not found")
 	}
-
-	return tokenData, nil
+	return tokenData, err
 }
 
 // ValidateRefreshToken validates a refresh token and returns token info
 func (s *TokenStore) ValidateRefreshToken(token string) (*TokenInfo, error) {
+	refreshToken, err := s.ValidRefreshToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return refreshToken.info(s.issuer), nil
+}
+
+// ValidRefreshToken returns a refresh token that is neither revoked nor expired
+func (s *TokenStore) ValidRefreshToken(token string) (*Token, error) {
 	refreshToken, err := s.GetRefreshToken(token)
 	if err != nil {
 		return nil, err
@@ -152,21 +158,45 @@ func (s *TokenStore) ValidateRefreshToken(token string) (*TokenInfo, error) {
 		return nil, errors.New("refresh token has expired")
 	}
 
-	// Convert to TokenInfo
-	tokenInfo := &TokenInfo{
-		Token:     refreshToken.Token,
-		TokenType: refreshToken.TokenType,
-		ClientID:  refreshToken.ClientID,
-		UserID:    refreshToken.UserID,
-		Scopes:    refreshToken.Scopes,
-		ExpiresAt: refreshToken.ExpiresAt,
-		Active:    true,
-		IssuedAt:  refreshToken.CreatedAt,
-		Issuer:    "oauth2-server",
-		Audience:  []string{"api"},
+	return refreshToken, nil
+}
+
+// Successor returns a token of tokenType issued by refreshing t. It keeps the
+// client, user, audience and delegation chain of t, so refreshing an exchanged
+// token does not turn it into an impersonation token.
+func (t *Token) Successor(token, tokenType string, scopes []string, expiresAt time.Time) *Token {
+	return &Token{
+		Token:     token,
+		TokenType: tokenType,
+		ClientID:  t.ClientID,
+		UserID:    t.UserID,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+		Audience:  t.Audience,
+		Act:       t.Act,
+
+		MaxAccessTokenLifetime:  t.MaxAccessTokenLifetime,
+		MaxRefreshTokenLifetime: t.MaxRefreshTokenLifetime,
+	}
+}
+
+// RefreshLifetimes returns the lifetimes of the tokens issued by refreshing t
+// at now, given the lifetimes of the realm. The lifetime caps recorded on t
+// apply again, and the tokens of a capped refresh token never outlive it.
+func (t *Token) RefreshLifetimes(now time.Time, accessLifetime, refreshLifetime time.Duration) (time.Duration, time.Duration) {
+	if t.MaxAccessTokenLifetime <= 0 && t.MaxRefreshTokenLifetime <= 0 {
+		return accessLifetime, refreshLifetime
 	}
 
-	return tokenInfo, nil
+	if t.MaxAccessTokenLifetime > 0 && t.MaxAccessTokenLifetime < accessLifetime {
+		accessLifetime = t.MaxAccessTokenLifetime
+	}
+	if t.MaxRefreshTokenLifetime > 0 && t.MaxRefreshTokenLifetime < refreshLifetime {
+		refreshLifetime = t.MaxRefreshTokenLifetime
+	}
+	remaining := t.ExpiresAt.Sub(now)
+	return min(accessLifetime, remaining), min(refreshLifetime, remaining)
 }
 
 // ValidateAccessToken validates an access token and returns token info
@@ -184,69 +214,57 @@ func (s *TokenStore) ValidateAccessToken(token string) (*TokenInfo, error) {
 		return nil, errors.New("access token has expired")
 	}
 
-	// Convert to TokenInfo
-	tokenInfo := &TokenInfo{
-		Token:     accessToken.Token,
-		TokenType: accessToken.TokenType,
-		ClientID:  accessToken.ClientID,
-		UserID:    accessToken.UserID,
-		Scopes:    accessToken.Scopes,
-		ExpiresAt: accessToken.ExpiresAt,
+	return accessToken.info(s.issuer), nil
+}
+
+// info converts a valid token of issuer to TokenInfo
+func (t *Token) info(issuer string) *TokenInfo {
+	return &TokenInfo{
+		Token:     t.Token,
+		TokenType: t.TokenType,
+		ClientID:  t.ClientID,
+		UserID:    t.UserID,
+		Scopes:    t.Scopes,
+		ExpiresAt: t.ExpiresAt,
 		Active:    true,
-		IssuedAt:  accessToken.CreatedAt,
-		Issuer:    "oauth2-server",
-		Audience:  []string{"api"},
+		IssuedAt:  t.CreatedAt,
+		Issuer:    issuer,
+		Audience:  t.audience(),
+		Act:       t.Act,
 	}
-
-	return tokenInfo, nil
 }
 
 // RevokeToken marks a token as revoked
 func (s *TokenStore) RevokeToken(token string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Check access tokens first
-	if tokenData, exists := s.tokens[token]; exists {
-		tokenData.Revoked = true
-		return nil
-	}
-
-	// Check refresh tokens
-	if tokenData, exists := s.refreshTokens[token]; exists {
-		tokenData.Revoked = true
-		return nil
+	tokenData, err := s.GetToken(token)
+	if err != nil {
+		return err
 	}
 
-	return errors.New("token not found")
+	tokenData.Revoked = true
+	return s.StoreToken(tokenData)
 }
 
 // RevokeAccessToken revokes an access token
 func (s *TokenStore) RevokeAccessToken(token string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	tokenData, exists := s.tokens[token]
-	if !exists {
-		return errors.New("access token not found")
+	tokenData, err := s.GetAccessToken(token)
+	if err != nil {
+		return err
 	}
 
 	tokenData.Revoked = true
-	return nil
+	return s.StoreToken(tokenData)
 }
 
 // RevokeRefreshToken revokes a refresh token
 func (s *TokenStore) RevokeRefreshToken(token string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	tokenData, exists := s.refreshTokens[token]
-	if !exists {
-		return errors.New("refresh token not found")
+	tokenData, err := s.GetRefreshToken(token)
+	if err != nil {
+		return err
 	}
 
 	tokenData.Revoked = true
-	return nil
+	return s.StoreToken(tokenData)
 }
 
 // IsTokenValid checks if a token is valid (not expired or revoked)
@@ -256,154 +274,74 @@ func (s *TokenStore) IsTokenValid(token string) bool {
 		return false
 	}
 
-	if tokenData.Revoked {
-		return false
-	}
-
-	if time.Now().After(tokenData.ExpiresAt) {
-		return false
-	}
-
-	return true
+	return tokenData.isValid()
 }
 
 // IsAccessTokenValid checks if an access token is valid
 func (s *TokenStore) IsAccessTokenValid(token string) bool {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	tokenData, exists := s.tokens[token]
-	if !exists {
-		return false
-	}
-
-	if tokenData.Revoked {
-		return false
-	}
-
-	if time.Now().After(tokenData.ExpiresAt) {
+	tokenData, err := s.GetAccessToken(token)
+	if err != nil {
 		return false
 	}
 
-	return true
+	return tokenData.isValid()
 }
 
 // IsRefreshTokenValid checks if a refresh token is valid
 func (s *TokenStore) IsRefreshTokenValid(token string) bool {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	tokenData, exists := s.refreshTokens[token]
-	if !exists {
-		return false
-	}
-
-	if tokenData.Revoked {
-		return false
-	}
-
-	if time.Now().After(tokenData.ExpiresAt) {
+	tokenData, err := s.GetRefreshToken(token)
+	if err != nil {
 		return false
 	}
 
-	return true
+	return tokenData.isValid()
 }
 
-// CleanupExpiredTokens removes expired tokens
-func (s *TokenStore) CleanupExpiredTokens() int {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	now := time.Now()
-	var expiredTokens []string
-	var expiredRefreshTokens []string
-
-	// Clean up access tokens
-	for token, tokenData := range s.tokens {
-		if now.After(tokenData.ExpiresAt) {
-			expiredTokens = append(expiredTokens, token)
-		}
-	}
-
-	// Clean up refresh tokens
-	for token, tokenData := range s.refreshTokens {
-		if now.After(tokenData.ExpiresAt) {
-			expiredRefreshTokens = append(expiredRefreshTokens, token)
-		}
-	}
-
-	// Delete expired tokens
-	for _, token := range expiredTokens {
-		delete(s.tokens, token)
-	}
-
-	for _, token := range expiredRefreshTokens {
-		delete(s.refreshTokens, token)
-	}
+// isValid reports whether the token is neither revoked nor expired
+func (t *Token) isValid() bool {
+	return !t.Revoked && !time.Now().After(t.ExpiresAt)
+}
 
-	totalCleaned := len(expiredTokens) + len(expiredRefreshTokens)
-	return totalCleaned
+// CleanupExpiredTokens removes expired tokens and returns how many were deleted
+func (s *TokenStore) CleanupExpiredTokens(ctx context.Context) (int, error) {
+	return s.storage.DeleteExpiredTokens(ctx, time.Now())
 }
 
 // GetTokensByUser retrieves all tokens for a specific user
 func (s *TokenStore) GetTokensByUser(userID string) ([]*Token, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	var userTokens []*Token
-
-	// Check access tokens
-	for _, token := range s.tokens {
-		if token.UserID == userID {
-			userTokens = append(userTokens, token)
-		}
-	}
-
-	// Check refresh tokens
-	for _, token := range s.refreshTokens {
-		if token.UserID == userID {
-			userTokens = append(userTokens, token)
-		}
-	}
-
-	return userTokens, nil
+	return s.storage.ListTokens(context.Background(), userID, "")
 }
 
 // GetTokensByClient retrieves all tokens for a specific client
 func (s *TokenStore) GetTokensByClient(clientID string) ([]*Token, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	var clientTokens []*Token
-
-	// Check access tokens
-	for _, token := range s.tokens {
-		if token.ClientID == clientID {
-			clientTokens = append(clientTokens, token)
-		}
-	}
-
-	// Check refresh tokens
-	for _, token := range s.refreshTokens {
-		if token.ClientID == clientID {
-			clientTokens = append(clientTokens, token)
-		}
-	}
-
-	return clientTokens, nil
+	return s.storage.ListTokens(context.Background(), "", clientID)
 }
 
 // GetStats returns statistics about stored tokens
 func (s *TokenStore) GetStats() map[string]interface{} {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	tokens, err := s.storage.ListTokens(context.Background(), "", "")
+	if err != nil {
+		log.Printf("❌ Failed to list tokens: %v", err)
+	}
 
 	now := time.Now()
-	var activeAccess, expiredAccess, revokedAccess int
-	var activeRefresh, expiredRefresh, revokedRefresh int
+	var totalAccess, activeAccess, expiredAccess, revokedAccess int
+	var totalRefresh, activeRefresh, expiredRefresh, revokedRefresh int
+
+	for _, token := range tokens {
+		if token.TokenType == "refresh" {
+			totalRefresh++
+			if token.Revoked {
+				revokedRefresh++
+			} else if now.After(token.ExpiresAt) {
+				expiredRefresh++
+			} else {
+				activeRefresh++
+			}
+			continue
+		}
 
-	// Count access token stats
-	for _, token := range s.tokens {
+		totalAccess++
 		if token.Revoked {
 			revokedAccess++
 		} else if now.After(token.ExpiresAt) {
@@ -413,26 +351,15 @@ func (s *TokenStore) GetStats() map[string]interface{} {
 		}
 	}
 
-	// Count refresh token stats
-	for _, token := range s.refreshTokens {
-		if token.Revoked {
-			revokedRefresh++
-		} else if now.After(token.ExpiresAt) {
-			expiredRefresh++
-		} else {
-			activeRefresh++
-		}
-	}
-
 	return map[string]interface{}{
 		"access_tokens": map[string]int{
-			"total":   len(s.tokens),
+			"total":   totalAccess,
 			"active":  activeAccess,
 			"expired": expiredAccess,
 			"revoked": revokedAccess,
 		},
 		"refresh_tokens": map[string]int{
-			"total":   len(s.refreshTokens),
+			"total":   totalRefresh,
 			"active":  activeRefresh,
 			"expired": expiredRefresh,
 			"revoked": revokedRefresh,
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"oauth2-server/pkg/config"
+)
+
+// ErrUsernameTaken is returned when saving a user whose username belongs to another user
+var ErrUsernameTaken = errors.New("username is already taken")
+
+// dummyPasswordHash is compared against when a username does not exist, so
+// that unknown users take as long to reject as wrong passwords
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("unknown-user"), bcrypt.DefaultCost)
+
+// User is a user account. Passwords are only kept as bcrypt hashes.
+type User struct {
+	ID           string            `json:"id"`
+	Username     string            `json:"username"`
+	PasswordHash string            `json:"password_hash,omitempty"`
+	Email        string            `json:"email,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Enabled      bool              `json:"enabled"`
+	Roles        []string          `json:"roles,omitempty"`
+	Scopes       []string          `json:"scopes,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	ExternalID   string            `json:"external_id,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	// Authenticator names the htpasswd or LDAP backend or the upstream identity
+	// provider that owns the account; empty for users with a password hash in
+	// the store
+	Authenticator string `json:"authenticator,omitempty"`
+	// Identities are the subjects of the user at upstream identity providers,
+	// by provider ID
+	Identities map[string]string `json:"identities,omitempty"`
+	// MFA is the enrolled second factor; nil until the user enrols
+	MFA *MFA `json:"mfa,omitempty"`
+	// Passkeys are the WebAuthn credentials the user registered
+	Passkeys []Passkey `json:"passkeys,omitempty"`
+}
+
+// MFA is an enrolled TOTP authenticator (RFC 6238) with its recovery codes
+type MFA struct {
+	// TOTPSecret is the base32 secret shared with the authenticator app
+	TOTPSecret string    `json:"totp_secret"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+	// LastStep is the time step of the last accepted code, which is not
+	// accepted again
+	LastStep int64 `json:"last_step,omitempty"`
+	// RecoveryCodes are SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// Passkey is a registered WebAuthn credential
+type Passkey struct {
+	// ID is the base64url encoded credential ID chosen by the authenticator
+	ID string `json:"id"`
+	// Name describes the passkey to the user, e.g. the device it was created on
+	Name string `json:"name,omitempty"`
+	// PublicKey is the COSE_Key the authenticator signs assertions with
+	PublicKey  []byte   `json:"public_key"`
+	AAGUID     []byte   `json:"aaguid,omitempty"`
+	SignCount  uint32   `json:"sign_count,omitempty"`
+	Transports []string `json:"transports,omitempty"`
+	// BackupEligible is set for synced passkeys; it never changes
+	BackupEligible bool      `json:"backup_eligible,omitempty"`
+	BackupState    bool      `json:"backup_state,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at,omitempty"`
+}
+
+// SetPassword replaces the password hash
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// CheckPassword reports whether password matches the stored hash
+func (u *User) CheckPassword(password string) bool {
+	return u.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// UserStore manages user accounts on top of a storage backend
+type UserStore struct {
+	storage UserStorage
+}
+
+// NewUserStore creates a new user store
+func NewUserStore(storage UserStorage) *UserStore {
+	return &UserStore{storage: storage}
+}
+
+// GetUser returns a user by ID
+func (s *UserStore) GetUser(id string) (*User, bool) {
+	user, err := s.storage.GetUser(context.Background(), id)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("❌ Failed to load user %s: %v", id, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// GetUserByUsername returns a user by username
+func (s *UserStore) GetUserByUsername(username string) (*User, bool) {
+	user, err := s.storage.GetUserByUsername(context.Background(), username)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("❌ Failed to load user %s: %v", username, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// FindUser returns a user by ID or, failing that, by username
+func (s *UserStore) FindUser(idOrUsername string) (*User, bool) {
+	if user, found := s.GetUser(idOrUsername); found {
+		return user, true
+	}
+	return s.GetUserByUsername(idOrUsername)
+}
+
+// FindUserByIdentity returns the user linked to a subject of an upstream identity provider
+func (s *UserStore) FindUserByIdentity(provider, subject string) (*User, bool) {
+	for _, user := range s.ListUsers() {
+		if linked, ok := user.Identities[provider]; ok && linked == subject {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// FindUserByEmail returns the only user with the email address, compared case-insensitively
+func (s *UserStore) FindUserByEmail(email string) (*User, bool) {
+	var found *User
+	for _, user := range s.ListUsers() {
+		if user.Email != "" && strings.EqualFold(user.Email, email) {
+			if found != nil {
+				return nil, false
+			}
+			found = user
+		}
+	}
+	return found, found != nil
+}
+
+// ListUsers returns all users ordered by username
+func (s *UserStore) ListUsers() []*User {
+	users, err := s.storage.ListUsers(context.Background())
+	if err != nil {
+		log.Printf("❌ Failed to list users: %v", err)
+		return nil
+	}
+	return users
+}
+
+// Authenticate returns the user when the password matches. Unknown users are
+// checked against a dummy hash so both cases take the same time.
+func (s *UserStore) Authenticate(username, password string) (*User, bool) {
+	user, found := s.GetUserByUsername(username)
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, false
+	}
+	return user, user.CheckPassword(password)
+}
+
+// SaveUser creates or replaces a user; the username must not belong to another user
+func (s *UserStore) SaveUser(user *User) error {
+	if existing, found := s.GetUserByUsername(user.Username); found && existing.ID != user.ID {
+		return ErrUsernameTaken
+	}
+	now := time.Now()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	user.UpdatedAt = now
+	return s.storage.SaveUser(context.Background(), user)
+}
+
+// DeleteUser removes a user
+func (s *UserStore) DeleteUser(id string) error {
+	err := s.storage.DeleteUser(context.Background(), id)
+	if errors.Is(err, ErrNotFound) {
+		return errors.New("user not found")
+	}
+	return err
+}
+
+// LoadUsersFromConfig loads users from configuration into the store
+func (s *UserStore) LoadUsersFromConfig(users []config.UserConfig) error {
+	for _, userConfig := range users {
+		if err := s.StoreConfigUser(userConfig); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("📦 Loaded %d users from configuration", len(users))
+	return nil
+}
+
+// StoreConfigUser creates or replaces a user defined in the configuration.
+// Users without an ID use their username as ID. The config file owns these
+// users: a stored user that matches it is left alone, and one that was
+// changed elsewhere, e.g. through SCIM or the admin API, is replaced with a
+// warning.
+func (s *UserStore) StoreConfigUser(userConfig config.UserConfig) error {
+	user := &User{
+		ID:         userConfig.ID,
+		Username:   userConfig.Username,
+		Email:      userConfig.Email,
+		Name:       userConfig.Name,
+		Enabled:    userConfig.IsEnabled(),
+		Roles:      userConfig.Roles,
+		Scopes:     userConfig.Scopes,
+		Attributes: userConfig.Attributes,
+	}
+	if user.ID == "" {
+		user.ID = user.Username
+	}
+
+	// Keep the creation time, linked identities, second factors and the hash
+	// while the password is unchanged
+	existing, found := s.GetUser(user.ID)
+	if found {
+		user.CreatedAt = existing.CreatedAt
+		user.Identities = existing.Identities
+		user.MFA = existing.MFA
+		user.Passkeys = existing.Passkeys
+		if existing.CheckPassword(userConfig.Password) {
+			user.PasswordHash = existing.PasswordHash
+		}
+	}
+	if user.PasswordHash == "" {
+		if err := user.SetPassword(userConfig.Password); err != nil {
+			return err
+		}
+	}
+
+	if found {
+		if sameConfigUser(existing, user) {
+			return nil
+		}
+		log.Printf("⚠️ Stored user %s differs from the configuration and is replaced by it", user.Username)
+	}
+
+	if err := s.SaveUser(user); err != nil {
+		return fmt.Errorf("failed to store user %s: %w", user.Username, err)
+	}
+	return nil
+}
+
+// sameConfigUser reports whether a stored user has the settings and
+// password hash a config user would get
+func sameConfigUser(stored, configured *User) bool {
+	return stored.Username == configured.Username &&
+		stored.PasswordHash == configured.PasswordHash &&
+		stored.Email == configured.Email &&
+		stored.Name == configured.Name &&
+		stored.Enabled == configured.Enabled &&
+		stored.Authenticator == configured.Authenticator &&
+		slices.Equal(stored.Roles, configured.Roles) &&
+		slices.Equal(stored.Scopes, configured.Scopes) &&
+		maps.Equal(stored.Attributes, configured.Attributes)
+}
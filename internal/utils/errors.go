@@ -66,3 +66,11 @@ func WriteInvalidScopeError(w http.ResponseWriter, description string) {
 func WriteServerError(w http.ResponseWriter, description string) {
 	writeOAuth2Error(w, http.StatusInternalServerError, "server_error", description)
 }
+
+func WriteTooManyRequestsError(w http.ResponseWriter, description string) {
+	writeOAuth2Error(w, http.StatusTooManyRequests, "too_many_requests", description)
+}
+
+func WriteTemporarilyUnavailableError(w http.ResponseWriter, description string) {
+	writeOAuth2Error(w, http.StatusServiceUnavailable, "temporarily_unavailable", description)
+}
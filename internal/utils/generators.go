@@ -63,6 +63,18 @@ func GenerateClientID() string {
 	return "client_" + id
 }
 
+// GenerateUserID generates a unique user ID
+func GenerateUserID() string {
+	id, _ := GenerateRandomString(16)
+	return "user_" + id
+}
+
+// GenerateGroupID generates a unique group ID
+func GenerateGroupID() string {
+	id, _ := GenerateRandomString(16)
+	return "group_" + id
+}
+
 // GenerateClientSecret generates a secure client secret
 func GenerateClientSecret() string {
 	secret, _ := GenerateRandomString(32)
@@ -157,6 +157,26 @@ func NormalizeScope(scopes string) string {
 	return JoinScopes(scopeList)
 }
 
+// scopeDescriptions holds the human readable descriptions shown on consent screens
+var scopeDescriptions = map[string]string{
+	"openid":         "Verify your identity",
+	"profile":        "Access your basic profile information",
+	"email":          "Access your email address",
+	"api:read":       "Read access to API resources",
+	"api:write":      "Write access to API resources",
+	"api:admin":      "Administrative access to API resources",
+	"offline":        "Access your data when you're not actively using the app",
+	"offline_access": "Access your data when you're not actively using the app",
+}
+
+// DescribeScope returns a human readable description for a scope
+func DescribeScope(scope string) string {
+	if description, ok := scopeDescriptions[scope]; ok {
+		return description
+	}
+	return fmt.Sprintf("Access to %s", scope)
+}
+
 // FilterScopes filters requested scopes against allowed scopes
 func FilterScopes(requestedScopes, allowedScopes []string) []string {
 	var filtered []string
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -55,3 +56,23 @@ func NormalizeRedirectURI(baseURL, uri string) string {
 	}
 	return uri
 }
+
+// Origin returns the origin of an http or https URL as browsers send it in the
+// Origin header: lowercase scheme and host, and the port unless it is the
+// default of the scheme
+func Origin(rawURL string) (string, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", false
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	port := parsed.Port()
+	if port == "" || (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+		return parsed.Scheme + "://" + host, true
+	}
+	return parsed.Scheme + "://" + host + ":" + port, true
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Authenticator types
+const (
+	AuthenticatorConfigUsers = "config"
+	AuthenticatorHtpasswd    = "htpasswd"
+	AuthenticatorLDAP        = "ldap"
+)
+
+// Chain modes of the authentication section
+const (
+	// ChainFirstSuccess tries the next backend after a wrong password
+	ChainFirstSuccess = "first_success"
+	// ChainFirstMatch lets the first backend that knows the username decide
+	ChainFirstMatch = "first_match"
+)
+
+// Defaults of the LDAP backend
+const (
+	DefaultLDAPUserFilter         = "(uid={username})"
+	DefaultLDAPGroupFilter        = "(|(member={dn})(uniqueMember={dn}))"
+	DefaultLDAPGroupNameAttribute = "cn"
+	DefaultLDAPTimeoutSeconds     = 10
+)
+
+// AuthenticationConfig selects the backends that check user passwords for the
+// login form, device verification and the password grant
+type AuthenticationConfig struct {
+	// Chain is first_success (default) or first_match
+	Chain string `yaml:"chain"`
+	// Backends are tried in order; empty uses the config users only
+	Backends []AuthenticatorConfig `yaml:"backends"`
+}
+
+// AuthenticatorConfig is one authentication backend
+type AuthenticatorConfig struct {
+	// Type is config, htpasswd or ldap
+	Type string `yaml:"type"`
+	// Name identifies the backend in logs, the audit log and the admin API;
+	// defaults to the type
+	Name string `yaml:"name"`
+	// Roles and Scopes are given to every user of an htpasswd or LDAP backend
+	Roles  []string `yaml:"roles"`
+	Scopes []string `yaml:"scopes"`
+	// File is the Apache htpasswd file of the htpasswd backend; it is re-read
+	// when it changes
+	File string     `yaml:"file"`
+	LDAP LDAPConfig `yaml:"ldap"`
+}
+
+// LDAPConfig configures the LDAP backend. Users are looked up with the
+// service account and authenticated by binding with their own DN.
+type LDAPConfig struct {
+	// URL is ldap://host:389 or ldaps://host:636
+	URL                string `yaml:"url"`
+	StartTLS           bool   `yaml:"start_tls"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// BindDN and BindPassword are the service account used for searches;
+	// empty binds anonymously. BindPasswordFile reads the password from a file.
+	BindDN           string `yaml:"bind_dn"`
+	BindPassword     string `yaml:"bind_password"`
+	BindPasswordFile string `yaml:"bind_password_file"`
+	// UserBaseDN and UserFilter find the user; {username} is replaced by the
+	// escaped username. The filter defaults to (uid={username}).
+	UserBaseDN string `yaml:"user_base_dn"`
+	UserFilter string `yaml:"user_filter"`
+	// Attributes map profile claims to LDAP attributes. email and name fill the
+	// profile, other claims become user attributes. Defaults to mail and cn.
+	Attributes map[string]string `yaml:"attributes"`
+	// GroupBaseDN enables group lookup with GroupFilter, where {dn} is the
+	// user's DN and {username} the username
+	GroupBaseDN        string `yaml:"group_base_dn"`
+	GroupFilter        string `yaml:"group_filter"`
+	GroupNameAttribute string `yaml:"group_name_attribute"`
+	// GroupRoles maps group names to roles; when empty, group names are roles
+	GroupRoles     map[string]string `yaml:"group_roles"`
+	TimeoutSeconds int               `yaml:"timeout_seconds"`
+}
+
+// ChainMode returns the configured chain mode, defaulting to first_success
+func (a AuthenticationConfig) ChainMode() string {
+	if a.Chain == "" {
+		return ChainFirstSuccess
+	}
+	return a.Chain
+}
+
+// AuthenticatorBackends returns the configured backends or the config users alone
+func (a AuthenticationConfig) AuthenticatorBackends() []AuthenticatorConfig {
+	if len(a.Backends) == 0 {
+		return []AuthenticatorConfig{{Type: AuthenticatorConfigUsers}}
+	}
+	return a.Backends
+}
+
+// BackendName returns the name of the backend, defaulting to its type
+func (a AuthenticatorConfig) BackendName() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.Type
+}
+
+// UserFilterTemplate returns the configured user filter or the default
+func (l LDAPConfig) UserFilterTemplate() string {
+	if l.UserFilter == "" {
+		return DefaultLDAPUserFilter
+	}
+	return l.UserFilter
+}
+
+// GroupFilterTemplate returns the configured group filter or the default
+func (l LDAPConfig) GroupFilterTemplate() string {
+	if l.GroupFilter == "" {
+		return DefaultLDAPGroupFilter
+	}
+	return l.GroupFilter
+}
+
+// GroupName returns the attribute holding group names, defaulting to cn
+func (l LDAPConfig) GroupName() string {
+	if l.GroupNameAttribute == "" {
+		return DefaultLDAPGroupNameAttribute
+	}
+	return l.GroupNameAttribute
+}
+
+// AttributeMapping returns the claim to attribute mapping with the defaults
+// for email and name
+func (l LDAPConfig) AttributeMapping() map[string]string {
+	mapping := map[string]string{"email": "mail", "name": "cn"}
+	for claim, attribute := range l.Attributes {
+		mapping[claim] = attribute
+	}
+	return mapping
+}
+
+// Timeout returns the time limit of LDAP connections and operations
+func (l LDAPConfig) Timeout() time.Duration {
+	return secondsOrDefault(l.TimeoutSeconds, DefaultLDAPTimeoutSeconds)
+}
+
+// Password returns the service account password, read from BindPasswordFile if set
+func (l LDAPConfig) Password() (string, error) {
+	if l.BindPasswordFile == "" {
+		return l.BindPassword, nil
+	}
+	data, err := os.ReadFile(l.BindPasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read ldap bind password: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func validateAuthentication(v *validator, prefix string, authentication AuthenticationConfig) {
+	v.oneOf(prefix+".chain", authentication.Chain, validChainModes)
+
+	names := make(map[string]int)
+	for i, backend := range authentication.Backends {
+		path := fmt.Sprintf("%s.backends[%d]", prefix, i)
+		if backend.Type == "" {
+			v.add(path+".type", "type is required")
+		}
+		v.oneOf(path+".type", backend.Type, validAuthenticatorTypes)
+		if first, ok := names[backend.BackendName()]; ok {
+			v.add(path+".name", "duplicate backend name %q, also used by backends[%d]", backend.BackendName(), first)
+		}
+		names[backend.BackendName()] = i
+
+		for j, scope := range backend.Scopes {
+			validateScope(v, fmt.Sprintf("%s.scopes[%d]", path, j), scope)
+		}
+
+		switch backend.Type {
+		case AuthenticatorConfigUsers:
+			if len(backend.Roles) > 0 || len(backend.Scopes) > 0 {
+				v.add(path, "roles and scopes of config users are set per user")
+			}
+		case AuthenticatorHtpasswd:
+			if backend.File == "" {
+				v.add(path+".file", "htpasswd backend requires a file")
+			}
+		case AuthenticatorLDAP:
+			validateLDAP(v, path+".ldap", backend.LDAP)
+		}
+	}
+}
+
+func validateLDAP(v *validator, path string, ldap LDAPConfig) {
+	switch {
+	case ldap.URL == "":
+		v.add(path+".url", "ldap backend requires a url")
+	case !isAbsoluteURL(ldap.URL, "ldap", "ldaps"):
+		v.add(path+".url", "must be an ldap:// or ldaps:// URL, got %q", ldap.URL)
+	case ldap.StartTLS && strings.HasPrefix(ldap.URL, "ldaps:"):
+		v.add(path+".start_tls", "start_tls cannot be used with ldaps://")
+	}
+	if ldap.UserBaseDN == "" {
+		v.add(path+".user_base_dn", "user_base_dn is required")
+	}
+	if !strings.Contains(ldap.UserFilterTemplate(), "{username}") {
+		v.add(path+".user_filter", "user_filter must contain {username}")
+	}
+	if ldap.BindPassword != "" && ldap.BindPasswordFile != "" {
+		v.add(path+".bind_password_file", "only one of bind_password and bind_password_file may be set")
+	}
+	for claim, attribute := range ldap.Attributes {
+		if claim == "" || attribute == "" {
+			v.add(path+".attributes", "claims and attributes must not be empty")
+		}
+	}
+	for group, role := range ldap.GroupRoles {
+		if strings.TrimSpace(role) == "" {
+			v.add(path+".group_roles", "group %q maps to an empty role", group)
+		}
+	}
+	v.nonNegative(path+".timeout_seconds", ldap.TimeoutSeconds)
+}
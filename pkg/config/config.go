@@ -6,6 +6,8 @@ import (
 	"oauth2-server/internal/models"
 	"oauth2-server/internal/utils"
 	"os"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,29 +15,71 @@ import (
 // Config holds the application configuration
 type Config struct {
 	// Server configuration
-	Server   ServerConfig
-	Security SecurityConfig
-	Logging  LoggingConfig
+	Server   ServerConfig   `yaml:"server"`
+	Security SecurityConfig `yaml:"security"`
+	Logging  LoggingConfig  `yaml:"logging"`
 
 	// Legacy fields for backward compatibility
-	BaseURL string
-	Port    string
-	Host    string
+	BaseURL string `yaml:"-"`
+	Port    string `yaml:"-"`
+	Host    string `yaml:"-"`
 
 	// Dynamic configuration from YAML
-	YAMLConfig *YAMLConfig
+	YAMLConfig *YAMLConfig `yaml:"-"`
 
 	// Clients loaded from YAML
-	Clients []ClientConfig
+	Clients []ClientConfig `yaml:"clients"`
 
 	// Users loaded from YAML
-	Users []UserConfig
+	Users []UserConfig `yaml:"users"`
+
+	// usersMutex guards Clients and Users, which are replaced on config reload
+	usersMutex sync.RWMutex
+
+	// Token exchange settings (RFC 8693)
+	TokenExchange TokenExchangeConfig `yaml:"token_exchange"`
+
+	// Persistent storage settings
+	Storage StorageConfig `yaml:"storage"`
+
+	// Authentication backends that check user passwords
+	Authentication AuthenticationConfig `yaml:"authentication"`
+
+	// Upstream OIDC and OAuth2 providers offered on the login page
+	IdentityProviders []IdentityProviderConfig `yaml:"identity_providers"`
+
+	// TOTP second factor for password logins
+	MFA MFAConfig `yaml:"mfa"`
+
+	// Passkey logins and second factors
+	WebAuthn WebAuthnConfig `yaml:"webauthn"`
+
+	// Reverse proxy settings from the proxy section
+	Proxy ProxyConfig `yaml:"proxy"`
+
+	// Token bucket limits of the protocol endpoints
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// Scopes advertised in discovery; empty advertises DefaultScopes
+	Scopes []string `yaml:"scopes"`
+
+	// Realms are tenants served under /realms/{name} or their own issuer host
+	Realms []RealmConfig `yaml:"realms"`
+
+	// RealmName is set on the configuration derived for a realm
+	RealmName string `yaml:"-"`
 
 	// Reverse Proxy Configuration (can be overridden by YAML)
-	TrustProxyHeaders bool
-	PublicBaseURL     string
-	ForceHTTPS        bool
-	TrustedProxies    string
+	TrustProxyHeaders bool   `yaml:"-"`
+	PublicBaseURL     string `yaml:"-"`
+	ForceHTTPS        bool   `yaml:"-"`
+	TrustedProxies    string `yaml:"-"`
+
+	// source is the parsed config file, used to report problems with line numbers
+	source     *yaml.Node
+	sourceFile string
+	// decodeProblems are the unknown fields and type mismatches found while loading
+	decodeProblems []Problem
 }
 
 // ServerConfig holds server-specific configuration
@@ -46,6 +90,50 @@ type ServerConfig struct {
 	ReadTimeout     int    `yaml:"read_timeout"`
 	WriteTimeout    int    `yaml:"write_timeout"`
 	ShutdownTimeout int    `yaml:"shutdown_timeout"`
+	// CleanupIntervalSeconds is how often expired tokens, codes, device grants
+	// and sessions are purged
+	CleanupIntervalSeconds int `yaml:"cleanup_interval_seconds"`
+	// ConfigReloadIntervalSeconds is how often the config file is checked for
+	// client and user changes; 0 reloads on SIGHUP only
+	ConfigReloadIntervalSeconds int `yaml:"config_reload_interval_seconds"`
+	// TLS serves HTTPS natively instead of relying on a terminating proxy
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// Server lifecycle defaults in seconds
+const (
+	DefaultReadTimeoutSeconds     = 30
+	DefaultWriteTimeoutSeconds    = 30
+	DefaultShutdownTimeoutSeconds = 5
+	DefaultCleanupIntervalSeconds = 300
+)
+
+// secondsOrDefault converts a configured number of seconds, using the default when unset
+func secondsOrDefault(seconds, defaultSeconds int) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(defaultSeconds) * time.Second
+}
+
+// ReadTimeoutDuration returns the maximum duration for reading a request
+func (s ServerConfig) ReadTimeoutDuration() time.Duration {
+	return secondsOrDefault(s.ReadTimeout, DefaultReadTimeoutSeconds)
+}
+
+// WriteTimeoutDuration returns the maximum duration for writing a response
+func (s ServerConfig) WriteTimeoutDuration() time.Duration {
+	return secondsOrDefault(s.WriteTimeout, DefaultWriteTimeoutSeconds)
+}
+
+// ShutdownTimeoutDuration returns how long in-flight requests may drain on shutdown
+func (s ServerConfig) ShutdownTimeoutDuration() time.Duration {
+	return secondsOrDefault(s.ShutdownTimeout, DefaultShutdownTimeoutSeconds)
+}
+
+// CleanupInterval returns the interval of the expired record cleanup jobs
+func (s ServerConfig) CleanupInterval() time.Duration {
+	return secondsOrDefault(s.CleanupIntervalSeconds, DefaultCleanupIntervalSeconds)
 }
 
 // SecurityConfig holds security-related configuration
@@ -54,8 +142,93 @@ type SecurityConfig struct {
 	TokenExpirySeconds        int    `yaml:"token_expiry_seconds"`
 	RefreshTokenExpirySeconds int    `yaml:"refresh_token_expiry_seconds"`
 	DeviceCodeExpirySeconds   int    `yaml:"device_code_expiry_seconds"`
+	DevicePollIntervalSeconds int    `yaml:"device_poll_interval_seconds"`
 	EnablePKCE                bool   `yaml:"enable_pkce"`
 	RequireHTTPS              bool   `yaml:"require_https"`
+	MaxLoginAttempts          int    `yaml:"max_login_attempts"`
+	LockoutDurationSeconds    int    `yaml:"lockout_duration_seconds"`
+	// Failed client secrets that lock a client, and failed passwords, client
+	// secrets and device codes that lock a source IP
+	MaxClientAttempts int `yaml:"max_client_attempts"`
+	MaxIPAttempts     int `yaml:"max_ip_attempts"`
+	// Wait after the second consecutive failure, doubled on every further one;
+	// -1 turns the waits off
+	FailureDelaySeconds int `yaml:"failure_delay_seconds"`
+}
+
+// Default token lifetimes applied when the configuration leaves them unset
+const (
+	DefaultTokenExpirySeconds        = 3600
+	DefaultRefreshTokenExpirySeconds = 86400
+)
+
+// AccessTokenLifetime returns the lifetime applied to every issued access token
+func (s SecurityConfig) AccessTokenLifetime() time.Duration {
+	if s.TokenExpirySeconds > 0 {
+		return time.Duration(s.TokenExpirySeconds) * time.Second
+	}
+	return DefaultTokenExpirySeconds * time.Second
+}
+
+// RefreshTokenLifetime returns the lifetime applied to every issued refresh token
+func (s SecurityConfig) RefreshTokenLifetime() time.Duration {
+	if s.RefreshTokenExpirySeconds > 0 {
+		return time.Duration(s.RefreshTokenExpirySeconds) * time.Second
+	}
+	return DefaultRefreshTokenExpirySeconds * time.Second
+}
+
+// Default lockout applied when the configuration leaves it unset
+const (
+	DefaultMaxLoginAttempts       = 5
+	DefaultLockoutDurationSeconds = 900
+	DefaultMaxClientAttempts      = 10
+	DefaultMaxIPAttempts          = 50
+	DefaultFailureDelaySeconds    = 1
+)
+
+// LoginAttemptLimit returns the number of consecutive failed logins that lock an account
+func (s SecurityConfig) LoginAttemptLimit() int {
+	if s.MaxLoginAttempts > 0 {
+		return s.MaxLoginAttempts
+	}
+	return DefaultMaxLoginAttempts
+}
+
+// LockoutDuration returns how long an account stays locked after too many failed logins
+func (s SecurityConfig) LockoutDuration() time.Duration {
+	if s.LockoutDurationSeconds > 0 {
+		return time.Duration(s.LockoutDurationSeconds) * time.Second
+	}
+	return DefaultLockoutDurationSeconds * time.Second
+}
+
+// ClientAttemptLimit returns the number of consecutive failed client secrets that lock a client
+func (s SecurityConfig) ClientAttemptLimit() int {
+	if s.MaxClientAttempts > 0 {
+		return s.MaxClientAttempts
+	}
+	return DefaultMaxClientAttempts
+}
+
+// IPAttemptLimit returns the number of consecutive failures that lock a source IP
+func (s SecurityConfig) IPAttemptLimit() int {
+	if s.MaxIPAttempts > 0 {
+		return s.MaxIPAttempts
+	}
+	return DefaultMaxIPAttempts
+}
+
+// FailureDelay returns the first wait between attempts after repeated
+// failures; a negative setting turns the delays off
+func (s SecurityConfig) FailureDelay() time.Duration {
+	if s.FailureDelaySeconds < 0 {
+		return 0
+	}
+	if s.FailureDelaySeconds > 0 {
+		return time.Duration(s.FailureDelaySeconds) * time.Second
+	}
+	return DefaultFailureDelaySeconds * time.Second
 }
 
 // LoggingConfig holds logging configuration
@@ -71,6 +244,7 @@ type ClientConfig struct {
 	Secret                  string   `yaml:"secret"`
 	Name                    string   `yaml:"name"`
 	Description             string   `yaml:"description"`
+	LogoURI                 string   `yaml:"logo_uri"`
 	RedirectURIs            []string `yaml:"redirect_uris"`
 	GrantTypes              []string `yaml:"grant_types"`
 	ResponseTypes           []string `yaml:"response_types"`
@@ -79,6 +253,107 @@ type ClientConfig struct {
 	TokenEndpointAuthMethod string   `yaml:"token_endpoint_auth_method"`
 	Public                  bool     `yaml:"public"`
 	EnabledFlows            []string `yaml:"enabled_flows"`
+	DevicePollInterval      int      `yaml:"device_poll_interval"`
+	AllowImpersonation      bool     `yaml:"allow_impersonation"`
+	MayAct                  []string `yaml:"may_act"`
+	// JWKSURI or JWKS (an inline JWKS document) hold the keys the client signs
+	// JWT bearer assertions with
+	JWKSURI string `yaml:"jwks_uri"`
+	JWKS    string `yaml:"jwks"`
+	// JWTBearerSubjects lists the users (ID or username) the client may name
+	// as sub of its own JWT bearer assertions, besides itself
+	JWTBearerSubjects []string `yaml:"jwt_bearer_subjects"`
+	// AllowedOrigins may call the token, revocation and userinfo endpoints
+	// from a browser; defaults to the origins of the http(s) redirect URIs
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	TokenExchangePolicy *models.TokenExchangePolicy `yaml:"token_exchange_policy"`
+}
+
+// Storage drivers
+const (
+	StorageDriverMemory   = "memory"
+	StorageDriverSQLite   = "sqlite"
+	StorageDriverPostgres = "postgres"
+)
+
+// StorageConfig selects where clients, tokens, codes, device grants, sessions
+// and consents are kept. The memory driver loses all state on restart.
+type StorageConfig struct {
+	Driver string `yaml:"driver"` // memory (default), sqlite or postgres
+	// DSN is the SQLite file path or the PostgreSQL connection string
+	DSN string `yaml:"dsn"`
+	// Snapshot persists the memory driver to an encrypted file
+	Snapshot SnapshotConfig `yaml:"snapshot"`
+}
+
+// DefaultSnapshotIntervalSeconds is used when no snapshot interval is configured
+const DefaultSnapshotIntervalSeconds = 300
+
+// SnapshotConfig lets single-node deployments without a database keep the
+// in-memory state across restarts
+type SnapshotConfig struct {
+	// File enables snapshots; it is written at intervals and on shutdown and
+	// loaded at startup
+	File            string `yaml:"file"`
+	Key             string `yaml:"key"` // encryption key, prefer STORAGE_SNAPSHOT_KEY
+	IntervalSeconds int    `yaml:"interval_seconds"`
+}
+
+// Enabled reports whether snapshots are configured
+func (s SnapshotConfig) Enabled() bool {
+	return s.File != ""
+}
+
+// Interval returns the time between periodic snapshots
+func (s SnapshotConfig) Interval() time.Duration {
+	return secondsOrDefault(s.IntervalSeconds, DefaultSnapshotIntervalSeconds)
+}
+
+// StorageDriver returns the configured storage driver, defaulting to memory
+func (s StorageConfig) StorageDriver() string {
+	if s.Driver == "" {
+		return StorageDriverMemory
+	}
+	return s.Driver
+}
+
+// TokenExchangeConfig holds token exchange settings
+type TokenExchangeConfig struct {
+	// TrustedIssuers lists external issuers whose JWTs are accepted as subject tokens
+	TrustedIssuers []TrustedIssuerConfig `yaml:"trusted_issuers"`
+}
+
+// TrustedIssuerConfig describes an external JWT issuer (e.g. Kubernetes service
+// accounts or CI OIDC tokens) accepted by token exchange
+type TrustedIssuerConfig struct {
+	Issuer   string `yaml:"issuer"`
+	JWKSFile string `yaml:"jwks_file"`
+	JWKSURL  string `yaml:"jwks_url"`
+	// Audiences the external token must be issued for; at least one has to match
+	Audiences []string `yaml:"audiences"`
+	// SubjectClaim is the claim used as local subject (defaults to "sub")
+	SubjectClaim string `yaml:"subject_claim"`
+	// SubjectPrefix is prepended to the subject. Without a prefix or a rule
+	// subject, subjects are namespaced by the issuer and never match local users.
+	SubjectPrefix string `yaml:"subject_prefix"`
+	// Scopes granted to tokens of this issuer when no rules are configured
+	Scopes []string `yaml:"scopes"`
+	// Rules map claims to subjects and scopes; the first matching rule wins and
+	// tokens matching no rule are rejected
+	Rules []ClaimMappingRule `yaml:"rules"`
+	// AllowJWTBearer also accepts the issuer's tokens as JWT bearer
+	// authorization grants (RFC 7523); the audience must name this server
+	AllowJWTBearer bool `yaml:"allow_jwt_bearer"`
+}
+
+// ClaimMappingRule maps external tokens whose claims match to a subject and scopes
+type ClaimMappingRule struct {
+	// Claims are matched against the token with path.Match patterns, e.g. "repo:acme/*"
+	Claims map[string]string `yaml:"claims"`
+	// Subject is a template where {claim} is replaced by the claim value
+	Subject string   `yaml:"subject"`
+	Scopes  []string `yaml:"scopes"`
 }
 
 // UserConfig represents a user configuration from YAML
@@ -88,6 +363,18 @@ type UserConfig struct {
 	Password string `yaml:"password"`
 	Email    string `yaml:"email"`
 	Name     string `yaml:"name"`
+	// Enabled defaults to true; disabled users cannot log in
+	Enabled *bool `yaml:"enabled"`
+	// Roles and Scopes are the user's entitlements; scopes must be offered by a client
+	Roles  []string `yaml:"roles"`
+	Scopes []string `yaml:"scopes"`
+	// Attributes are free-form profile values, e.g. department or locale
+	Attributes map[string]string `yaml:"attributes"`
+}
+
+// IsEnabled reports whether the user may log in
+func (u UserConfig) IsEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
 }
 
 // YAMLConfig represents the raw YAML configuration structure
@@ -98,6 +385,9 @@ type YAMLConfig struct {
 	Clients  []ClientConfig `yaml:"clients"`
 	Users    []UserConfig   `yaml:"users"`
 	Proxy    *ProxyConfig   `yaml:"proxy,omitempty"`
+
+	TokenExchange TokenExchangeConfig `yaml:"token_exchange"`
+	Storage       StorageConfig       `yaml:"storage"`
 }
 
 // ProxyConfig holds proxy-related configuration
@@ -105,6 +395,10 @@ type ProxyConfig struct {
 	TrustHeaders  bool   `yaml:"trust_headers"`
 	PublicBaseURL string `yaml:"public_base_url"`
 	ForceHTTPS    bool   `yaml:"force_https"`
+	// TrustedProxies lists the IPs or CIDRs of TLS-terminating proxies whose
+	// X-Forwarded-Proto header is believed when require_https is set, and
+	// whose X-Forwarded-For or X-Real-IP header names the client IP
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 // ToModelsClientInfo converts ClientConfig to models.ClientInfo
@@ -113,11 +407,19 @@ func (c ClientConfig) ToModelsClientInfo() models.ClientInfo {
 		ID:            c.ID,
 		Secret:        c.Secret,
 		Name:          c.Name,
+		Description:   c.Description,
+		LogoURI:       c.LogoURI,
 		RedirectURIs:  c.RedirectURIs,
 		GrantTypes:    c.GrantTypes,
 		ResponseTypes: c.ResponseTypes,
 		Scopes:        c.Scopes,
 		Audience:      c.Audience,
+		JWKSURI:       c.JWKSURI,
+		JWKSValue:     c.JWKS,
+
+		AllowImpersonation:  c.AllowImpersonation,
+		MayAct:              c.MayAct,
+		TokenExchangePolicy: c.TokenExchangePolicy,
 	}
 }
 
@@ -134,47 +436,29 @@ func (u UserConfig) ToModelsUser() models.User {
 		Password: u.Password,
 		Email:    u.Email,
 		Name:     u.Name,
+		Roles:    u.Roles,
+		Active:   u.IsEnabled(),
 	}
 }
 
-// Validate validates the configuration
-func (c *Config) Validate() error {
-	if c.Security.JWTSecret == "" {
-		return fmt.Errorf("JWT secret is required")
+// ValidateTokenExchangePolicy checks a client's token exchange policy for invalid values
+func ValidateTokenExchangePolicy(policy *models.TokenExchangePolicy) error {
+	if policy.MaxChainDepth < 0 {
+		return fmt.Errorf("token exchange policy: invalid max_chain_depth: %d", policy.MaxChainDepth)
 	}
-
-	if c.Server.Port <= 0 || c.Server.Port > 65535 {
-		return fmt.Errorf("invalid server port: %d", c.Server.Port)
+	if policy.MaxAccessTokenLifetime < 0 {
+		return fmt.Errorf("token exchange policy: invalid max_access_token_lifetime: %d", policy.MaxAccessTokenLifetime)
 	}
-
-	if c.Server.Host == "" {
-		return fmt.Errorf("server host is required")
+	if policy.MaxRefreshTokenLifetime < 0 {
+		return fmt.Errorf("token exchange policy: invalid max_refresh_token_lifetime: %d", policy.MaxRefreshTokenLifetime)
 	}
-
-	// Validate clients
-	for i, client := range c.Clients {
-		if client.ID == "" {
-			return fmt.Errorf("client %d: client ID is required", i)
-		}
-
-		// Public clients don't need secrets, but confidential clients do
-		if !client.Public && client.Secret == "" {
-			return fmt.Errorf("client %s: client secret is required for confidential clients", client.ID)
-		}
-
-		// Validate grant types
-		for _, grantType := range client.GrantTypes {
-			if !isValidGrantType(grantType) {
-				return fmt.Errorf("client %s: invalid grant type: %s", client.ID, grantType)
+	for _, values := range [][]string{policy.SourceClients, policy.Audiences, policy.Scopes} {
+		for _, value := range values {
+			if value == "" {
+				return fmt.Errorf("token exchange policy: empty source client, audience or scope")
 			}
 		}
-
-		// Authorization code flow requires redirect URIs
-		if contains(client.GrantTypes, "authorization_code") && len(client.RedirectURIs) == 0 {
-			return fmt.Errorf("client %s: redirect URIs required for authorization_code grant", client.ID)
-		}
 	}
-
 	return nil
 }
 
@@ -186,9 +470,33 @@ func (c *Config) GetEffectiveBaseURL(r *http.Request) string {
 	return utils.GetEffectiveBaseURL(c.PublicBaseURL, r)
 }
 
+// ListClients returns the configured clients; use it instead of Clients once
+// the server is running, as a reload may replace them
+func (c *Config) ListClients() []ClientConfig {
+	c.usersMutex.RLock()
+	defer c.usersMutex.RUnlock()
+	return c.Clients
+}
+
+// ListUsers returns the configured users; use it instead of Users once the
+// server is running, as a reload may replace them
+func (c *Config) ListUsers() []UserConfig {
+	c.usersMutex.RLock()
+	defer c.usersMutex.RUnlock()
+	return c.Users
+}
+
+// ReplaceClientsAndUsers swaps in the clients and users of a reloaded configuration
+func (c *Config) ReplaceClientsAndUsers(clients []ClientConfig, users []UserConfig) {
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	c.Clients = clients
+	c.Users = users
+}
+
 // GetClientByID returns a client by ID
 func (c *Config) GetClientByID(clientID string) (*ClientConfig, bool) {
-	for _, client := range c.Clients {
+	for _, client := range c.ListClients() {
 		if client.ID == clientID {
 			return &client, true
 		}
@@ -198,7 +506,7 @@ func (c *Config) GetClientByID(clientID string) (*ClientConfig, bool) {
 
 // GetUserByUsername returns a user by username
 func (c *Config) GetUserByUsername(username string) (*UserConfig, bool) {
-	for _, user := range c.Users {
+	for _, user := range c.ListUsers() {
 		if user.Username == username {
 			return &user, true
 		}
@@ -208,7 +516,7 @@ func (c *Config) GetUserByUsername(username string) (*UserConfig, bool) {
 
 // GetUserByID returns a user by ID
 func (c *Config) GetUserByID(userID string) (*UserConfig, bool) {
-	for _, user := range c.Users {
+	for _, user := range c.ListUsers() {
 		if user.ID == userID {
 			return &user, true
 		}
@@ -218,16 +526,16 @@ func (c *Config) GetUserByID(userID string) (*UserConfig, bool) {
 
 // GetFirstClient returns the first configured client (useful for testing)
 func (c *Config) GetFirstClient() (*ClientConfig, bool) {
-	if len(c.Clients) > 0 {
-		return &c.Clients[0], true
+	if clients := c.ListClients(); len(clients) > 0 {
+		return &clients[0], true
 	}
 	return nil, false
 }
 
 // GetFirstUser returns the first configured user (useful for testing)
 func (c *Config) GetFirstUser() (*UserConfig, bool) {
-	if len(c.Users) > 0 {
-		return &c.Users[0], true
+	if users := c.ListUsers(); len(users) > 0 {
+		return &users[0], true
 	}
 	return nil, false
 }
@@ -270,14 +578,3 @@ func contains(slice []string, item string) bool {
 	}
 	return false
 }
-
-func isValidGrantType(grantType string) bool {
-	validGrantTypes := []string{
-		"authorization_code",
-		"client_credentials",
-		"refresh_token",
-		"urn:ietf:params:oauth:grant-type:device_code",
-		"urn:ietf:params:oauth:grant-type:token-exchange",
-	}
-	return contains(validGrantTypes, grantType)
-}
@@ -61,7 +61,23 @@ func (c *Config) LoadFromEnv() {
 
 	if trustedProxies := os.Getenv("TRUSTED_PROXIES"); trustedProxies != "" {
 		c.TrustedProxies = trustedProxies
-		// Note: Store in main config as ProxyConfig doesn't have TrustedProxies field
+		c.Proxy.TrustedProxies = nil
+		for _, proxy := range strings.Split(trustedProxies, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				c.Proxy.TrustedProxies = append(c.Proxy.TrustedProxies, proxy)
+			}
+		}
+	}
+
+	// TLS overrides, so certificates can be mounted from a secret
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		c.Server.TLS.CertFile = certFile
+	}
+	if keyFile := os.Getenv("TLS_KEY_FILE"); keyFile != "" {
+		c.Server.TLS.KeyFile = keyFile
+	}
+	if tlsPort := os.Getenv("TLS_PORT"); tlsPort != "" {
+		c.Server.TLS.Port = GetEnvInt("TLS_PORT", 0)
 	}
 
 	// Security configuration overrides
@@ -104,6 +120,20 @@ func (c *Config) LoadFromEnv() {
 		}
 	}
 
+	// Storage overrides, so the DSN can come from a secret
+	if driver := os.Getenv("STORAGE_DRIVER"); driver != "" {
+		c.Storage.Driver = driver
+	}
+	if dsn := os.Getenv("STORAGE_DSN"); dsn != "" {
+		c.Storage.DSN = dsn
+	}
+	if snapshotFile := os.Getenv("STORAGE_SNAPSHOT_FILE"); snapshotFile != "" {
+		c.Storage.Snapshot.File = snapshotFile
+	}
+	if snapshotKey := os.Getenv("STORAGE_SNAPSHOT_KEY"); snapshotKey != "" {
+		c.Storage.Snapshot.Key = snapshotKey
+	}
+
 	// Add support for dynamic client configuration via environment variables
 	c.loadClientsFromEnv()
 
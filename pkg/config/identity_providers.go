@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Identity provider types
+const (
+	IdentityProviderOIDC   = "oidc"
+	IdentityProviderOAuth2 = "oauth2"
+)
+
+// Ways to match an upstream identity to an existing user
+const (
+	LinkByEmail    = "email"
+	LinkByUsername = "username"
+)
+
+// IdentityProviderConfig is an upstream OpenID Connect or OAuth2 provider
+// offered as a button on the login page
+type IdentityProviderConfig struct {
+	// ID appears in the callback URL {base_url}/login/{id}/callback, which has
+	// to be registered with the provider
+	ID string `yaml:"id"`
+	// Name is the label of the login button; defaults to the ID
+	Name string `yaml:"name"`
+	// Type is oidc (default) or oauth2 for providers without ID tokens
+	Type string `yaml:"type"`
+	// Issuer of an OIDC provider; endpoints that are not set are discovered
+	// from {issuer}/.well-known/openid-configuration
+	Issuer                  string `yaml:"issuer"`
+	AuthorizationURL        string `yaml:"authorization_url"`
+	TokenURL                string `yaml:"token_url"`
+	UserInfoURL             string `yaml:"userinfo_url"`
+	JWKSURL                 string `yaml:"jwks_url"`
+	ClientID                string `yaml:"client_id"`
+	ClientSecret            string `yaml:"client_secret"`
+	TokenEndpointAuthMethod string `yaml:"token_endpoint_auth_method"` // client_secret_basic (default) or client_secret_post
+	// Scopes requested from the provider; OIDC defaults to openid, profile and email
+	Scopes []string `yaml:"scopes"`
+	// Claims selects the upstream claims of the local profile
+	Claims IdentityClaimsConfig `yaml:"claims"`
+	// GroupRoles maps upstream groups to roles; when empty, groups are roles
+	GroupRoles map[string]string `yaml:"group_roles"`
+	// Roles and UserScopes are given to users created for this provider
+	Roles      []string `yaml:"roles"`
+	UserScopes []string `yaml:"user_scopes"`
+	// CreateUsers provisions a user on the first login of an unknown identity
+	CreateUsers bool `yaml:"create_users"`
+	// LinkBy links an unknown identity to the existing user with the same
+	// email (which the provider must report as verified) or username
+	LinkBy string `yaml:"link_by"`
+}
+
+// IdentityClaimsConfig names the upstream claims mapped to the local profile
+type IdentityClaimsConfig struct {
+	Subject  string `yaml:"subject"`  // default sub, e.g. id for GitHub
+	Username string `yaml:"username"` // default preferred_username
+	Email    string `yaml:"email"`    // default email
+	Name     string `yaml:"name"`     // default name
+	Groups   string `yaml:"groups"`   // no default, e.g. groups
+	// Attributes map user attributes to upstream claims
+	Attributes map[string]string `yaml:"attributes"`
+}
+
+// ProviderType returns the provider type, defaulting to oidc
+func (p IdentityProviderConfig) ProviderType() string {
+	if p.Type == "" {
+		return IdentityProviderOIDC
+	}
+	return p.Type
+}
+
+// DisplayName returns the label of the login button
+func (p IdentityProviderConfig) DisplayName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.ID
+}
+
+// RequestedScopes returns the scopes requested from the provider
+func (p IdentityProviderConfig) RequestedScopes() []string {
+	if len(p.Scopes) == 0 && p.ProviderType() == IdentityProviderOIDC {
+		return []string{"openid", "profile", "email"}
+	}
+	return p.Scopes
+}
+
+// ClaimNames returns the claim mapping with defaults applied
+func (p IdentityProviderConfig) ClaimNames() IdentityClaimsConfig {
+	claims := p.Claims
+	for _, field := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&claims.Subject, "sub"},
+		{&claims.Username, "preferred_username"},
+		{&claims.Email, "email"},
+		{&claims.Name, "name"},
+	} {
+		if *field.value == "" {
+			*field.value = field.fallback
+		}
+	}
+	return claims
+}
+
+func validateIdentityProviders(v *validator, prefix string, providers []IdentityProviderConfig, authentication AuthenticationConfig) {
+	backends := make(map[string]bool)
+	for _, backend := range authentication.AuthenticatorBackends() {
+		backends[backend.BackendName()] = true
+	}
+
+	ids := make(map[string]int)
+	for i, provider := range providers {
+		path := fmt.Sprintf("%s[%d]", prefix, i)
+
+		switch first, ok := ids[provider.ID]; {
+		case provider.ID == "":
+			v.add(path+".id", "id is required")
+		case !realmNamePattern.MatchString(provider.ID):
+			v.add(path+".id", "invalid id %q, use lowercase letters, digits and dashes", provider.ID)
+		case ok:
+			v.add(path+".id", "duplicate identity provider id %q, also used by %s[%d]", provider.ID, prefix, first)
+		case backends[provider.ID]:
+			v.add(path+".id", "id %q is also the name of an authentication backend", provider.ID)
+		default:
+			ids[provider.ID] = i
+		}
+
+		v.oneOf(path+".type", provider.Type, validIdentityProviderTypes)
+		v.oneOf(path+".token_endpoint_auth_method", provider.TokenEndpointAuthMethod, validUpstreamAuthMethods)
+		v.oneOf(path+".link_by", provider.LinkBy, validLinkBy)
+		if provider.ClientID == "" {
+			v.add(path+".client_id", "client_id is required")
+		}
+		if !provider.CreateUsers && provider.LinkBy == "" {
+			v.add(path, "set create_users or link_by, otherwise nobody can log in")
+		}
+
+		urls := map[string]string{
+			"authorization_url": provider.AuthorizationURL,
+			"token_url":         provider.TokenURL,
+			"userinfo_url":      provider.UserInfoURL,
+			"jwks_url":          provider.JWKSURL,
+		}
+		for name, value := range urls {
+			if value != "" && !isAbsoluteURL(value, "http", "https") {
+				v.add(path+"."+name, "must be an absolute http or https URL")
+			}
+		}
+
+		switch provider.ProviderType() {
+		case IdentityProviderOIDC:
+			if !isAbsoluteURL(provider.Issuer, "http", "https") {
+				v.add(path+".issuer", "oidc providers require an absolute http or https issuer URL")
+			}
+			if !contains(provider.RequestedScopes(), "openid") {
+				v.add(path+".scopes", "oidc providers require the openid scope")
+			}
+		case IdentityProviderOAuth2:
+			for _, name := range []string{"authorization_url", "token_url", "userinfo_url"} {
+				if urls[name] == "" {
+					v.add(path+"."+name, "oauth2 providers require %s", name)
+				}
+			}
+		}
+
+		for j, scope := range provider.UserScopes {
+			validateScope(v, fmt.Sprintf("%s.user_scopes[%d]", path, j), scope)
+		}
+		for group, role := range provider.GroupRoles {
+			if strings.TrimSpace(role) == "" {
+				v.add(path+".group_roles", "group %q maps to an empty role", group)
+			}
+		}
+	}
+}
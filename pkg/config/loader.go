@@ -1,7 +1,10 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"oauth2-server/internal/utils"
 	"os"
 	"strconv"
@@ -10,20 +13,37 @@ import (
 )
 
 func (c *Config) NormalizeAllClientRedirectURIs() {
-	for i := range c.Clients {
-		for j, uri := range c.Clients[i].RedirectURIs {
-			c.Clients[i].RedirectURIs[j] = utils.NormalizeRedirectURI(c.Server.BaseURL, uri)
+	normalizeRedirectURIs(c.Server.BaseURL, c.Clients)
+	for _, realm := range c.Realms {
+		normalizeRedirectURIs(realm.IssuerURL(c.Server.BaseURL), realm.Clients)
+	}
+}
+
+// normalizeRedirectURIs makes relative redirect URIs absolute against baseURL
+func normalizeRedirectURIs(baseURL string, clients []ClientConfig) {
+	for i := range clients {
+		for j, uri := range clients[i].RedirectURIs {
+			clients[i].RedirectURIs[j] = utils.NormalizeRedirectURI(baseURL, uri)
 		}
 	}
 }
 
 // LoadConfig loads configuration from environment variables and config file
 func Load() (*Config, error) {
+	configPath := FilePath()
+	if _, err := os.Stat(configPath); err != nil {
+		configPath = ""
+	}
+	return LoadFile(configPath)
+}
+
+// LoadFile loads the config file at path, skipped when empty, and applies the
+// environment variable overrides
+func LoadFile(configPath string) (*Config, error) {
 	cfg := &Config{}
 
 	// 1. Load YAML config
-	configPath := getEnv("CONFIG_FILE", "config.yaml")
-	if _, err := os.Stat(configPath); err == nil {
+	if configPath != "" {
 		if err := LoadFromFile(configPath, cfg); err != nil {
 			return nil, fmt.Errorf("failed to load config file: %w", err)
 		}
@@ -42,14 +62,37 @@ func Load() (*Config, error) {
 	return cfg, nil
 }
 
-// LoadFromFile loads configuration from a YAML file
+// FilePath returns the path of the configuration file, set by CONFIG_FILE
+func FilePath() string {
+	return getEnv("CONFIG_FILE", "config.yaml")
+}
+
+// LoadFromFile loads configuration from a YAML file. Decoding is strict:
+// unknown fields and type mismatches do not fail the load but are reported by
+// Validate together with every other problem. Only syntax errors fail here.
 func LoadFromFile(path string, cfg *Config) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	if err := yaml.Unmarshal(data, cfg); err != nil {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	cfg.source = &root
+	cfg.sourceFile = path
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+	case errors.As(err, &typeErr):
+		cfg.decodeProblems = decodeProblems(&root, typeErr)
+	default:
 		return fmt.Errorf("failed to parse config file: %w", err)
 	}
 
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Defaults of the mfa section
+const (
+	DefaultRecoveryCodes = 10
+	maxRecoveryCodes     = 50
+)
+
+// MFAConfig configures TOTP multi-factor authentication (RFC 6238) for
+// password logins. Users who enrolled always confirm their password with a
+// code; users and roles listed here must enrol on their next login.
+type MFAConfig struct {
+	// Issuer labels the account in authenticator apps; defaults to the host of
+	// the base URL
+	Issuer string `yaml:"issuer"`
+	// RequiredRoles and RequiredUsers (usernames) must use a second factor
+	RequiredRoles []string `yaml:"required_roles"`
+	RequiredUsers []string `yaml:"required_users"`
+	// RecoveryCodes is how many one-time recovery codes are issued on
+	// enrolment; defaults to 10
+	RecoveryCodes int `yaml:"recovery_codes"`
+}
+
+// Required reports whether a user with the username and roles must use a
+// second factor
+func (m MFAConfig) Required(username string, roles []string) bool {
+	if contains(m.RequiredUsers, username) {
+		return true
+	}
+	for _, role := range roles {
+		if contains(m.RequiredRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecoveryCodeCount returns the configured number of recovery codes or the default
+func (m MFAConfig) RecoveryCodeCount() int {
+	if m.RecoveryCodes <= 0 {
+		return DefaultRecoveryCodes
+	}
+	return m.RecoveryCodes
+}
+
+func validateMFA(v *validator, prefix string, mfa MFAConfig) {
+	v.nonNegative(prefix+".recovery_codes", mfa.RecoveryCodes)
+	if mfa.RecoveryCodes > maxRecoveryCodes {
+		v.add(prefix+".recovery_codes", "must not exceed %d, got %d", maxRecoveryCodes, mfa.RecoveryCodes)
+	}
+	for i, role := range mfa.RequiredRoles {
+		if strings.TrimSpace(role) == "" {
+			v.add(fmt.Sprintf("%s.required_roles[%d]", prefix, i), "role must not be empty")
+		}
+	}
+	for i, username := range mfa.RequiredUsers {
+		if strings.TrimSpace(username) == "" {
+			v.add(fmt.Sprintf("%s.required_users[%d]", prefix, i), "username must not be empty")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import "time"
+
+// Endpoints with a rate limit
+const (
+	RateLimitEndpointToken               = "token"
+	RateLimitEndpointDeviceAuthorization = "device_authorization"
+	RateLimitEndpointRegister            = "register"
+	RateLimitEndpointAuth                = "auth"
+)
+
+// What requests are counted per
+const (
+	RateLimitKeyClientID = "client_id"
+	RateLimitKeyIP       = "ip"
+	RateLimitKeyUser     = "user"
+)
+
+var validRateLimitKeys = []string{RateLimitKeyClientID, RateLimitKeyIP, RateLimitKeyUser}
+
+// defaultRateLimits apply to endpoints without configured limits
+var defaultRateLimits = map[string]EndpointRateLimit{
+	RateLimitEndpointToken:               {RequestsPerMinute: 120, Burst: 30, Key: RateLimitKeyClientID},
+	RateLimitEndpointDeviceAuthorization: {RequestsPerMinute: 30, Burst: 10, Key: RateLimitKeyClientID},
+	RateLimitEndpointRegister:            {RequestsPerMinute: 10, Burst: 5, Key: RateLimitKeyIP},
+	RateLimitEndpointAuth:                {RequestsPerMinute: 60, Burst: 20, Key: RateLimitKeyIP},
+}
+
+// RateLimitConfig throttles the protocol endpoints with a token bucket per
+// endpoint and client, source IP or user
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Shared keeps the buckets in the storage backend, so all replicas count
+	// against the same limits; requires the sqlite or postgres driver
+	Shared bool `yaml:"shared"`
+	// FailClosed refuses requests with 503 when the buckets cannot be
+	// reached; by default they are let through
+	FailClosed bool               `yaml:"fail_closed"`
+	Endpoints  RateLimitEndpoints `yaml:"endpoints"`
+}
+
+// RateLimitEndpoints holds the limits of each endpoint; unset fields use the
+// defaults of the endpoint
+type RateLimitEndpoints struct {
+	Token               EndpointRateLimit `yaml:"token"`
+	DeviceAuthorization EndpointRateLimit `yaml:"device_authorization"`
+	Register            EndpointRateLimit `yaml:"register"`
+	Auth                EndpointRateLimit `yaml:"auth"`
+}
+
+// EndpointRateLimit is the token bucket of one endpoint
+type EndpointRateLimit struct {
+	// RequestsPerMinute is the rate the bucket refills at
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	// Burst is the size of the bucket, the requests allowed at once
+	Burst int `yaml:"burst"`
+	// Key is what requests are counted per besides the source IP: client_id
+	// for clients that authenticate with their secret, user for a username
+	// from the same source IP, or ip alone
+	Key string `yaml:"key"`
+}
+
+// Interval returns the time it takes to refill one request
+func (l EndpointRateLimit) Interval() time.Duration {
+	return time.Minute / time.Duration(l.RequestsPerMinute)
+}
+
+// Limit returns the limit of an endpoint with the defaults filled in
+func (r RateLimitConfig) Limit(endpoint string) EndpointRateLimit {
+	var limit EndpointRateLimit
+	switch endpoint {
+	case RateLimitEndpointToken:
+		limit = r.Endpoints.Token
+	case RateLimitEndpointDeviceAuthorization:
+		limit = r.Endpoints.DeviceAuthorization
+	case RateLimitEndpointRegister:
+		limit = r.Endpoints.Register
+	case RateLimitEndpointAuth:
+		limit = r.Endpoints.Auth
+	}
+
+	defaults := defaultRateLimits[endpoint]
+	if limit.RequestsPerMinute == 0 {
+		limit.RequestsPerMinute = defaults.RequestsPerMinute
+	}
+	if limit.Burst == 0 {
+		limit.Burst = defaults.Burst
+	}
+	if limit.Key == "" {
+		limit.Key = defaults.Key
+	}
+	return limit
+}
+
+func validateRateLimit(v *validator, prefix string, rateLimit RateLimitConfig, storage StorageConfig) {
+	if rateLimit.Enabled && rateLimit.Shared && storage.StorageDriver() == StorageDriverMemory {
+		v.add(prefix+".shared", "shared rate limits require the sqlite or postgres storage driver")
+	}
+
+	endpoints := []struct {
+		name  string
+		limit EndpointRateLimit
+	}{
+		{RateLimitEndpointToken, rateLimit.Endpoints.Token},
+		{RateLimitEndpointDeviceAuthorization, rateLimit.Endpoints.DeviceAuthorization},
+		{RateLimitEndpointRegister, rateLimit.Endpoints.Register},
+		{RateLimitEndpointAuth, rateLimit.Endpoints.Auth},
+	}
+	for _, endpoint := range endpoints {
+		path := prefix + ".endpoints." + endpoint.name
+		v.nonNegative(path+".requests_per_minute", endpoint.limit.RequestsPerMinute)
+		v.nonNegative(path+".burst", endpoint.limit.Burst)
+		v.oneOf(path+".key", endpoint.limit.Key, validRateLimitKeys)
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RealmPathPrefix is the path under which realms are served, followed by the realm name
+const RealmPathPrefix = "/realms/"
+
+// realmNamePattern restricts realm names to what can appear in a URL path
+var realmNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// DefaultScopes are advertised in discovery when no scopes are configured
+var DefaultScopes = []string{"openid", "profile", "email", "offline_access", "api:read", "api:write", "admin"}
+
+// RealmConfig is a tenant with its own clients, users, signing keys, storage
+// and token policy. Tokens issued in one realm are not accepted in another.
+type RealmConfig struct {
+	Name string `yaml:"name"`
+	// Issuer is the realm's issuer URL, e.g. https://login.partner.example.com.
+	// Requests for its host are served by the realm. Defaults to
+	// {server.base_url}/realms/{name}; the realm is always reachable there.
+	Issuer string `yaml:"issuer"`
+	// Scopes are advertised in the realm's discovery document and are the only
+	// scopes its clients may be registered with; empty allows any scope
+	Scopes []string `yaml:"scopes"`
+	// TokenPolicy overrides the lifetimes and lockout of the security section
+	TokenPolicy TokenPolicyConfig `yaml:"token_policy"`
+	// Storage is required unless the server uses the memory driver, as realms
+	// must not share a database
+	Storage           StorageConfig            `yaml:"storage"`
+	TokenExchange     TokenExchangeConfig      `yaml:"token_exchange"`
+	Authentication    AuthenticationConfig     `yaml:"authentication"`
+	IdentityProviders []IdentityProviderConfig `yaml:"identity_providers"`
+	MFA               MFAConfig                `yaml:"mfa"`
+	WebAuthn          WebAuthnConfig           `yaml:"webauthn"`
+	Clients           []ClientConfig           `yaml:"clients"`
+	Users             []UserConfig             `yaml:"users"`
+}
+
+// TokenPolicyConfig overrides security settings for a realm; zero keeps the server setting
+type TokenPolicyConfig struct {
+	TokenExpirySeconds        int `yaml:"token_expiry_seconds"`
+	RefreshTokenExpirySeconds int `yaml:"refresh_token_expiry_seconds"`
+	DeviceCodeExpirySeconds   int `yaml:"device_code_expiry_seconds"`
+	MaxLoginAttempts          int `yaml:"max_login_attempts"`
+	LockoutDurationSeconds    int `yaml:"lockout_duration_seconds"`
+	MaxClientAttempts         int `yaml:"max_client_attempts"`
+	MaxIPAttempts             int `yaml:"max_ip_attempts"`
+}
+
+// PathPrefix returns the path the realm is served under, e.g. /realms/partners
+func (r RealmConfig) PathPrefix() string {
+	return strings.TrimSuffix(RealmPathPrefix, "/") + "/" + r.Name
+}
+
+// IssuerURL returns the configured issuer or the realm path under baseURL
+func (r RealmConfig) IssuerURL(baseURL string) string {
+	if r.Issuer != "" {
+		return strings.TrimSuffix(r.Issuer, "/")
+	}
+	return strings.TrimSuffix(baseURL, "/") + r.PathPrefix()
+}
+
+// SupportedScopes returns the configured scopes or DefaultScopes
+func (c *Config) SupportedScopes() []string {
+	if len(c.Scopes) > 0 {
+		return c.Scopes
+	}
+	return DefaultScopes
+}
+
+// RealmNames lists the configured realms in order
+func (c *Config) RealmNames() []string {
+	names := make([]string, 0, len(c.Realms))
+	for _, realm := range c.Realms {
+		names = append(names, realm.Name)
+	}
+	return names
+}
+
+// Realm returns the configuration of a realm: the server settings with the
+// realm's issuer, storage, token policy, clients and users
+func (c *Config) Realm(name string) (*Config, bool) {
+	for _, realm := range c.Realms {
+		if realm.Name == name {
+			return c.realmConfig(realm), true
+		}
+	}
+	return nil, false
+}
+
+// realmConfig derives the configuration of a realm
+func (c *Config) realmConfig(realm RealmConfig) *Config {
+	issuer := realm.IssuerURL(c.Server.BaseURL)
+
+	derived := &Config{
+		Server:            c.Server,
+		Security:          c.Security,
+		Logging:           c.Logging,
+		Proxy:             c.Proxy,
+		RateLimit:         c.RateLimit,
+		Storage:           realm.Storage,
+		TokenExchange:     realm.TokenExchange,
+		Authentication:    realm.Authentication,
+		IdentityProviders: realm.IdentityProviders,
+		MFA:               realm.MFA,
+		WebAuthn:          realm.WebAuthn,
+		Scopes:            realm.Scopes,
+		Clients:           realm.Clients,
+		Users:             realm.Users,
+		RealmName:         realm.Name,
+
+		BaseURL:           issuer,
+		Port:              c.Port,
+		Host:              c.Host,
+		YAMLConfig:        c.YAMLConfig,
+		TrustProxyHeaders: c.TrustProxyHeaders,
+		ForceHTTPS:        c.ForceHTTPS,
+		TrustedProxies:    c.TrustedProxies,
+		// The issuer of a realm is fixed, not derived from the request
+		PublicBaseURL: issuer,
+	}
+	derived.Server.BaseURL = issuer
+	derived.Proxy.PublicBaseURL = issuer
+
+	policy := realm.TokenPolicy
+	overrideSeconds(&derived.Security.TokenExpirySeconds, policy.TokenExpirySeconds)
+	overrideSeconds(&derived.Security.RefreshTokenExpirySeconds, policy.RefreshTokenExpirySeconds)
+	overrideSeconds(&derived.Security.DeviceCodeExpirySeconds, policy.DeviceCodeExpirySeconds)
+	overrideSeconds(&derived.Security.MaxLoginAttempts, policy.MaxLoginAttempts)
+	overrideSeconds(&derived.Security.LockoutDurationSeconds, policy.LockoutDurationSeconds)
+	overrideSeconds(&derived.Security.MaxClientAttempts, policy.MaxClientAttempts)
+	overrideSeconds(&derived.Security.MaxIPAttempts, policy.MaxIPAttempts)
+
+	return derived
+}
+
+// overrideSeconds replaces a setting with a realm override when it is set
+func overrideSeconds(setting *int, override int) {
+	if override > 0 {
+		*setting = override
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// SchemaID identifies the published JSON Schema of config.yaml
+const SchemaID = "https://github.com/harrykodden/oauth2-server/config.schema.json"
+
+// schemaEnums restricts fields to the values Validate accepts, keyed by
+// struct type and field name
+var schemaEnums = map[string][]string{
+	"AuthenticationConfig.Chain":                     validChainModes,
+	"AuthenticatorConfig.Type":                       validAuthenticatorTypes,
+	"ClientConfig.GrantTypes":                        validGrantTypes,
+	"IdentityProviderConfig.Type":                    validIdentityProviderTypes,
+	"IdentityProviderConfig.TokenEndpointAuthMethod": validUpstreamAuthMethods,
+	"IdentityProviderConfig.LinkBy":                  validLinkBy,
+	"ClientConfig.TokenEndpointAuthMethod":           validAuthMethods,
+	"LoggingConfig.Level":                            validLogLevels,
+	"LoggingConfig.Format":                           validLogFormats,
+	"EndpointRateLimit.Key":                          validRateLimitKeys,
+	"StorageConfig.Driver":                           validStorageDrivers,
+	"TLSConfig.MinVersion":                           validTLSVersions,
+}
+
+// schemaPatterns constrain string fields with a regular expression
+var schemaPatterns = map[string]string{
+	"ClientConfig.ResponseTypes": `^(none|(code|token|id_token)( (code|token|id_token)){0,2})$`,
+}
+
+// schemaMinimums lowers the minimum of integer fields that accept negative
+// values; all others must not be negative
+var schemaMinimums = map[string]int{
+	"SecurityConfig.FailureDelaySeconds": -1,
+}
+
+// JSONSchema returns the JSON Schema (draft 2020-12) of config.yaml. It is
+// derived from the Config struct, so unknown keys are rejected exactly like
+// the strict decoder does.
+func JSONSchema() ([]byte, error) {
+	schema := schemaFor(reflect.TypeOf(Config{}), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = SchemaID
+	schema["title"] = "OAuth2 server configuration"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaFor describes a Go type; field is "Type.Field" for enum lookups
+func schemaFor(t reflect.Type, field string) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		schema := map[string]interface{}{"type": "string"}
+		if values, ok := schemaEnums[field]; ok {
+			schema["enum"] = values
+		}
+		if pattern, ok := schemaPatterns[field]; ok {
+			schema["pattern"] = pattern
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer", "minimum": schemaMinimums[field]}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaFor(t.Elem(), field),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaFor(t.Elem(), field),
+		}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			properties[name] = schemaFor(f.Type, t.Name()+"."+f.Name)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	default:
+		return map[string]interface{}{}
+	}
+}
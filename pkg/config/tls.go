@@ -0,0 +1,129 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultTLSReloadIntervalSeconds is how often certificate files are checked for changes
+const DefaultTLSReloadIntervalSeconds = 60
+
+// TLSConfig configures the native HTTPS listener
+type TLSConfig struct {
+	// CertFile and KeyFile enable TLS; both are PEM files that are reloaded
+	// when they change on disk
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Port adds an HTTPS listener next to plain HTTP on server.port. When 0,
+	// server.port serves HTTPS only.
+	Port int `yaml:"port"`
+	// MinVersion is "1.2" (default) or "1.3"
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites restricts the TLS 1.2 cipher suites by their Go names, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Empty uses Go's secure defaults.
+	CipherSuites          []string `yaml:"cipher_suites"`
+	ReloadIntervalSeconds int      `yaml:"reload_interval_seconds"`
+}
+
+// Enabled reports whether TLS is configured
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// ReloadInterval returns the time between certificate change checks
+func (t TLSConfig) ReloadInterval() time.Duration {
+	return secondsOrDefault(t.ReloadIntervalSeconds, DefaultTLSReloadIntervalSeconds)
+}
+
+// TLSMinVersion returns the minimum protocol version as a crypto/tls constant
+func (t TLSConfig) TLSMinVersion() (uint16, error) {
+	switch t.MinVersion {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid tls min_version %q: must be 1.2 or 1.3", t.MinVersion)
+	}
+}
+
+// CipherSuiteIDs resolves the configured cipher suite names. Insecure suites
+// and TLS 1.3 suites, which Go does not allow to be configured, are rejected.
+func (t TLSConfig) CipherSuiteIDs() ([]uint16, error) {
+	if len(t.CipherSuites) == 0 {
+		return nil, nil
+	}
+
+	available := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite
+	}
+
+	ids := make([]uint16, 0, len(t.CipherSuites))
+	for _, name := range t.CipherSuites {
+		suite, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure tls cipher suite: %s", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("tls cipher suite %s is a TLS 1.3 suite and cannot be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// Validate checks the TLS settings against the plain HTTP port
+func (t TLSConfig) Validate(httpPort int) error {
+	if !t.Enabled() {
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("tls requires both cert_file and key_file")
+	}
+	if t.Port < 0 || t.Port > 65535 {
+		return fmt.Errorf("invalid tls port: %d", t.Port)
+	}
+	if t.Port == httpPort {
+		return fmt.Errorf("tls port %d must differ from the server port, or be 0 to serve TLS on it", t.Port)
+	}
+	if t.ReloadIntervalSeconds < 0 {
+		return fmt.Errorf("invalid tls reload interval: %d", t.ReloadIntervalSeconds)
+	}
+	if _, err := t.TLSMinVersion(); err != nil {
+		return err
+	}
+	_, err := t.CipherSuiteIDs()
+	return err
+}
+
+// TrustedProxyNetworks parses the trusted proxies; single IPs become host networks
+func (p ProxyConfig) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(p.TrustedProxies))
+	for _, proxy := range p.TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
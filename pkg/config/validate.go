@@ -0,0 +1,691 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"oauth2-server/internal/utils"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Values accepted by the configuration
+var (
+	validGrantTypes = []string{
+		"authorization_code",
+		"client_credentials",
+		"refresh_token",
+		"urn:ietf:params:oauth:grant-type:device_code",
+		"urn:ietf:params:oauth:grant-type:token-exchange",
+		"urn:ietf:params:oauth:grant-type:jwt-bearer",
+		"password",
+	}
+	// validResponseTypeValues are combined with spaces, e.g. "code id_token"
+	validResponseTypeValues    = []string{"code", "token", "id_token"}
+	validAuthMethods           = []string{"client_secret_basic", "client_secret_post", "client_secret_jwt", "private_key_jwt", "none"}
+	validLogLevels             = []string{"debug", "info", "warn", "error"}
+	validLogFormats            = []string{"json", "text"}
+	validStorageDrivers        = []string{StorageDriverMemory, StorageDriverSQLite, StorageDriverPostgres}
+	validTLSVersions           = []string{"1.2", "1.3"}
+	validAuthenticatorTypes    = []string{AuthenticatorConfigUsers, AuthenticatorHtpasswd, AuthenticatorLDAP}
+	validChainModes            = []string{ChainFirstSuccess, ChainFirstMatch}
+	validIdentityProviderTypes = []string{IdentityProviderOIDC, IdentityProviderOAuth2}
+	validUpstreamAuthMethods   = []string{"client_secret_basic", "client_secret_post"}
+	validLinkBy                = []string{LinkByEmail, LinkByUsername}
+)
+
+// Problem is one error found in the configuration
+type Problem struct {
+	// Line in the config file, 0 when the value did not come from the file
+	// (e.g. environment overrides)
+	Line int
+	// Path of the offending value, e.g. clients[2].grant_types[0]
+	Path    string
+	Message string
+}
+
+// String formats the problem as "line 12: clients[0].id: message"
+func (p Problem) String() string {
+	var prefix string
+	if p.Line > 0 {
+		prefix = fmt.Sprintf("line %d: ", p.Line)
+	}
+	if p.Path != "" {
+		prefix += p.Path + ": "
+	}
+	return prefix + p.Message
+}
+
+// ValidationError reports every problem found in a configuration
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+// Error lists the problems, one per line
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d configuration problems:", len(e.Problems))
+	for _, problem := range e.Problems {
+		b.WriteString("\n  ")
+		b.WriteString(problem.String())
+	}
+	return b.String()
+}
+
+// validator collects problems and resolves their line numbers
+type validator struct {
+	root     *yaml.Node
+	problems []Problem
+}
+
+// add records a problem for the value at path
+func (v *validator) add(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Line:    nodeLine(v.root, path),
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// nonNegative records a problem when a number of seconds or a count is negative
+func (v *validator) nonNegative(path string, value int) {
+	if value < 0 {
+		v.add(path, "must not be negative, got %d", value)
+	}
+}
+
+// oneOf records a problem when a set value is not one of the allowed values
+func (v *validator) oneOf(path, value string, allowed []string) {
+	if value != "" && !contains(allowed, value) {
+		v.add(path, "invalid value %q, expected one of %s", value, strings.Join(allowed, ", "))
+	}
+}
+
+// Validate checks the configuration and returns a *ValidationError listing
+// every problem, including unknown fields found while loading the file
+func (c *Config) Validate() error {
+	v := &validator{root: c.source}
+	v.problems = append(v.problems, c.decodeProblems...)
+
+	c.validateServer(v)
+	c.validateSecurity(v)
+	validateStorage(v, "storage", c.Storage)
+	validateTokenExchange(v, "token_exchange", c.TokenExchange)
+	validateClients(v, "clients", c.Clients, c.Scopes)
+	validateUsers(v, "users", c.Users, c.Clients)
+	validateAuthentication(v, "authentication", c.Authentication)
+	validateIdentityProviders(v, "identity_providers", c.IdentityProviders, c.Authentication)
+	validateMFA(v, "mfa", c.MFA)
+	validateWebAuthn(v, "webauthn", c.WebAuthn)
+	validateRateLimit(v, "rate_limit", c.RateLimit, c.Storage)
+	c.validateRealms(v)
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	// Report in file order; problems without a line (environment) come last
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i].Line, v.problems[j].Line
+		if a == 0 || b == 0 {
+			return a != 0 && b == 0
+		}
+		return a < b
+	})
+	return &ValidationError{File: c.sourceFile, Problems: v.problems}
+}
+
+// ValidateClient checks a single client with the rules applied to config.yaml;
+// used for clients managed through the admin API. Problem paths are relative
+// to the client.
+func ValidateClient(client ClientConfig) error {
+	v := &validator{}
+	validateClients(v, "clients", []ClientConfig{client}, nil)
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	for i := range v.problems {
+		path := strings.TrimPrefix(v.problems[i].Path, "clients[0]")
+		v.problems[i].Path = strings.TrimPrefix(path, ".")
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+func (c *Config) validateServer(v *validator) {
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		v.add("server.port", "invalid port: %d", c.Server.Port)
+	}
+	if c.Server.Host == "" {
+		v.add("server.host", "host is required")
+	}
+	if c.Server.BaseURL != "" && !isAbsoluteURL(c.Server.BaseURL, "http", "https") {
+		v.add("server.base_url", "must be an absolute http or https URL, got %q", c.Server.BaseURL)
+	}
+
+	v.nonNegative("server.read_timeout", c.Server.ReadTimeout)
+	v.nonNegative("server.write_timeout", c.Server.WriteTimeout)
+	v.nonNegative("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	v.nonNegative("server.cleanup_interval_seconds", c.Server.CleanupIntervalSeconds)
+	v.nonNegative("server.config_reload_interval_seconds", c.Server.ConfigReloadIntervalSeconds)
+
+	if err := c.Server.TLS.Validate(c.Server.Port); err != nil {
+		v.add("server.tls", "%v", err)
+	}
+
+	for i, proxy := range c.Proxy.TrustedProxies {
+		if _, err := (ProxyConfig{TrustedProxies: []string{proxy}}).TrustedProxyNetworks(); err != nil {
+			v.add(fmt.Sprintf("proxy.trusted_proxies[%d]", i), "%v", err)
+		}
+	}
+
+	v.oneOf("logging.level", c.Logging.Level, validLogLevels)
+	v.oneOf("logging.format", c.Logging.Format, validLogFormats)
+}
+
+func (c *Config) validateSecurity(v *validator) {
+	if c.Security.JWTSecret == "" {
+		v.add("security.jwt_signing_key", "JWT secret is required")
+	}
+
+	v.nonNegative("security.token_expiry_seconds", c.Security.TokenExpirySeconds)
+	v.nonNegative("security.refresh_token_expiry_seconds", c.Security.RefreshTokenExpirySeconds)
+	v.nonNegative("security.device_code_expiry_seconds", c.Security.DeviceCodeExpirySeconds)
+	v.nonNegative("security.device_poll_interval_seconds", c.Security.DevicePollIntervalSeconds)
+	v.nonNegative("security.max_login_attempts", c.Security.MaxLoginAttempts)
+	v.nonNegative("security.lockout_duration_seconds", c.Security.LockoutDurationSeconds)
+	v.nonNegative("security.max_client_attempts", c.Security.MaxClientAttempts)
+	v.nonNegative("security.max_ip_attempts", c.Security.MaxIPAttempts)
+}
+
+func validateStorage(v *validator, prefix string, storage StorageConfig) {
+	switch storage.StorageDriver() {
+	case StorageDriverMemory:
+	case StorageDriverSQLite, StorageDriverPostgres:
+		if storage.DSN == "" {
+			v.add(prefix+".dsn", "storage driver %s requires a dsn", storage.Driver)
+		}
+	default:
+		v.oneOf(prefix+".driver", storage.Driver, validStorageDrivers)
+	}
+
+	if storage.Snapshot.Enabled() {
+		if storage.StorageDriver() != StorageDriverMemory {
+			v.add(prefix+".snapshot", "snapshots are only supported by the memory driver")
+		}
+		if storage.Snapshot.Key == "" {
+			v.add(prefix+".snapshot.key", "snapshot requires an encryption key")
+		}
+		v.nonNegative(prefix+".snapshot.interval_seconds", storage.Snapshot.IntervalSeconds)
+	}
+}
+
+func validateTokenExchange(v *validator, prefix string, tokenExchange TokenExchangeConfig) {
+	for i, issuer := range tokenExchange.TrustedIssuers {
+		path := fmt.Sprintf("%s.trusted_issuers[%d]", prefix, i)
+		if issuer.Issuer == "" {
+			v.add(path+".issuer", "issuer is required")
+		}
+		if (issuer.JWKSFile == "") == (issuer.JWKSURL == "") {
+			v.add(path, "exactly one of jwks_file or jwks_url is required")
+		}
+		if issuer.JWKSURL != "" && !isAbsoluteURL(issuer.JWKSURL, "http", "https") {
+			v.add(path+".jwks_url", "must be an absolute http or https URL")
+		}
+		if len(issuer.Audiences) == 0 {
+			v.add(path+".audiences", "at least one audience is required")
+		}
+		for j, scope := range issuer.Scopes {
+			validateScope(v, fmt.Sprintf("%s.scopes[%d]", path, j), scope)
+		}
+		for j, rule := range issuer.Rules {
+			for k, scope := range rule.Scopes {
+				validateScope(v, fmt.Sprintf("%s.rules[%d].scopes[%d]", path, j, k), scope)
+			}
+		}
+	}
+}
+
+// validateClients checks the clients at prefix; when supported scopes are
+// given, client scopes must be among them
+func validateClients(v *validator, prefix string, clients []ClientConfig, supportedScopes []string) {
+	seen := make(map[string]int)
+	for i, client := range clients {
+		path := fmt.Sprintf("%s[%d]", prefix, i)
+
+		if client.ID == "" {
+			v.add(path+".id", "client ID is required")
+		} else if first, ok := seen[client.ID]; ok {
+			v.add(path+".id", "duplicate client ID %q, also used by %s[%d]", client.ID, prefix, first)
+		} else {
+			seen[client.ID] = i
+		}
+
+		for j, grantType := range client.GrantTypes {
+			v.oneOf(fmt.Sprintf("%s.grant_types[%d]", path, j), grantType, validGrantTypes)
+		}
+
+		codeResponse := false
+		for j, responseType := range client.ResponseTypes {
+			if !isValidResponseType(responseType) {
+				v.add(fmt.Sprintf("%s.response_types[%d]", path, j),
+					"invalid response type %q, expected a combination of %s", responseType, strings.Join(validResponseTypeValues, ", "))
+			}
+			if contains(strings.Fields(responseType), "code") {
+				codeResponse = true
+			}
+		}
+
+		authorizationCode := contains(client.GrantTypes, "authorization_code")
+		if authorizationCode && len(client.RedirectURIs) == 0 {
+			v.add(path+".redirect_uris", "redirect URIs are required for the authorization_code grant")
+		}
+		if authorizationCode && !codeResponse {
+			v.add(path+".response_types", "the authorization_code grant requires the code response type")
+		}
+		if codeResponse && !authorizationCode {
+			v.add(path+".grant_types", "the code response type requires the authorization_code grant")
+		}
+
+		for j, redirectURI := range client.RedirectURIs {
+			if problem := redirectURIProblem(redirectURI); problem != "" {
+				v.add(fmt.Sprintf("%s.redirect_uris[%d]", path, j), "%s", problem)
+			}
+		}
+
+		for j, scope := range client.Scopes {
+			scopePath := fmt.Sprintf("%s.scopes[%d]", path, j)
+			validateScope(v, scopePath, scope)
+			if scope != "" && len(supportedScopes) > 0 && !contains(supportedScopes, scope) {
+				v.add(scopePath, "scope %q is not in the supported scopes", scope)
+			}
+		}
+
+		validateClientAuth(v, path, client)
+
+		v.nonNegative(path+".device_poll_interval", client.DevicePollInterval)
+
+		if client.JWKSURI != "" && !isAbsoluteURL(client.JWKSURI, "http", "https") {
+			v.add(path+".jwks_uri", "must be an absolute http or https URL")
+		}
+
+		for j, origin := range client.AllowedOrigins {
+			if normalized, ok := utils.Origin(origin); !ok || normalized != strings.ToLower(strings.TrimSuffix(origin, "/")) {
+				v.add(fmt.Sprintf("%s.allowed_origins[%d]", path, j), "must be an origin such as https://app.example.com, without path or default port, got %q", origin)
+			}
+		}
+
+		if policy := client.TokenExchangePolicy; policy != nil {
+			if err := ValidateTokenExchangePolicy(policy); err != nil {
+				v.add(path+".token_exchange_policy", "%v", err)
+			}
+			if !contains(client.GrantTypes, "urn:ietf:params:oauth:grant-type:token-exchange") {
+				v.add(path+".token_exchange_policy", "requires the token-exchange grant type")
+			}
+			for j, scope := range policy.Scopes {
+				if len(client.Scopes) > 0 && !contains(client.Scopes, scope) {
+					v.add(fmt.Sprintf("%s.token_exchange_policy.scopes[%d]", path, j), "scope %q is not in the client's scopes", scope)
+				}
+			}
+		}
+	}
+}
+
+// validateClientAuth cross-checks the token endpoint auth method with the
+// client type, secret, keys and grant types
+func validateClientAuth(v *validator, path string, client ClientConfig) {
+	method := client.TokenEndpointAuthMethod
+	v.oneOf(path+".token_endpoint_auth_method", method, validAuthMethods)
+
+	switch {
+	case client.Public && method != "" && method != "none":
+		v.add(path+".token_endpoint_auth_method", "public clients must use none, got %q", method)
+	case !client.Public && method == "none":
+		v.add(path+".token_endpoint_auth_method", "none is only allowed for public clients")
+	}
+
+	if client.Public {
+		for _, grantType := range []string{"client_credentials", "urn:ietf:params:oauth:grant-type:jwt-bearer"} {
+			if contains(client.GrantTypes, grantType) {
+				v.add(path+".grant_types", "public clients cannot use the %s grant", grantType)
+			}
+		}
+		return
+	}
+
+	if method == "private_key_jwt" {
+		if client.JWKS == "" && client.JWKSURI == "" {
+			v.add(path, "private_key_jwt requires jwks or jwks_uri")
+		}
+	} else if client.Secret == "" {
+		v.add(path+".secret", "client secret is required for confidential clients")
+	}
+
+	if client.JWKS != "" && client.JWKSURI != "" {
+		v.add(path, "only one of jwks or jwks_uri may be set")
+	}
+}
+
+func validateUsers(v *validator, prefix string, users []UserConfig, clients []ClientConfig) {
+	// Users can only get scopes that some client offers
+	offered := make(map[string]bool)
+	for _, client := range clients {
+		for _, scope := range client.Scopes {
+			offered[scope] = true
+		}
+	}
+
+	usernames := make(map[string]int)
+	ids := make(map[string]int)
+	for i, user := range users {
+		path := fmt.Sprintf("%s[%d]", prefix, i)
+
+		if user.Username == "" {
+			v.add(path+".username", "username is required")
+		} else if first, ok := usernames[user.Username]; ok {
+			v.add(path+".username", "duplicate username %q, also used by %s[%d]", user.Username, prefix, first)
+		} else {
+			usernames[user.Username] = i
+		}
+
+		if user.ID != "" {
+			if first, ok := ids[user.ID]; ok {
+				v.add(path+".id", "duplicate user ID %q, also used by %s[%d]", user.ID, prefix, first)
+			} else {
+				ids[user.ID] = i
+			}
+		}
+
+		if user.Password == "" {
+			v.add(path+".password", "password is required")
+		}
+
+		for j, role := range user.Roles {
+			if strings.TrimSpace(role) == "" {
+				v.add(fmt.Sprintf("%s.roles[%d]", path, j), "role must not be empty")
+			}
+		}
+
+		for j, scope := range user.Scopes {
+			scopePath := fmt.Sprintf("%s.scopes[%d]", path, j)
+			validateScope(v, scopePath, scope)
+			if scope != "" && len(offered) > 0 && !offered[scope] {
+				v.add(scopePath, "scope %q is not offered by any client", scope)
+			}
+		}
+	}
+}
+
+// validateRealms checks each realm like the top level and makes sure realms
+// do not share a name, issuer or database
+func (c *Config) validateRealms(v *validator) {
+	for i, scope := range c.Scopes {
+		validateScope(v, fmt.Sprintf("scopes[%d]", i), scope)
+	}
+
+	names := make(map[string]int)
+	issuers := make(map[string]int)
+	dsns := map[string]string{c.Storage.DSN: "storage"}
+	for i, realm := range c.Realms {
+		path := fmt.Sprintf("realms[%d]", i)
+
+		switch first, ok := names[realm.Name]; {
+		case realm.Name == "":
+			v.add(path+".name", "realm name is required")
+		case !realmNamePattern.MatchString(realm.Name):
+			v.add(path+".name", "invalid realm name %q, use lowercase letters, digits and dashes", realm.Name)
+		case ok:
+			v.add(path+".name", "duplicate realm name %q, also used by realms[%d]", realm.Name, first)
+		default:
+			names[realm.Name] = i
+		}
+
+		if realm.Issuer != "" {
+			parsed, err := url.Parse(realm.Issuer)
+			switch {
+			case !isAbsoluteURL(realm.Issuer, "http", "https"):
+				v.add(path+".issuer", "must be an absolute http or https URL, got %q", realm.Issuer)
+			case err == nil && (parsed.RawQuery != "" || parsed.Fragment != ""):
+				v.add(path+".issuer", "must not contain a query or fragment")
+			case err == nil && strings.Trim(parsed.Path, "/") != "":
+				v.add(path+".issuer", "must not contain a path; realms with a path are served under %s{name}", RealmPathPrefix)
+			default:
+				// Requests are routed to realms by host name, regardless of port
+				host := strings.ToLower(parsed.Hostname())
+				if first, ok := issuers[host]; ok {
+					v.add(path+".issuer", "host %s is also used by realms[%d]", parsed.Hostname(), first)
+				}
+				issuers[host] = i
+			}
+		}
+
+		for j, scope := range realm.Scopes {
+			validateScope(v, fmt.Sprintf("%s.scopes[%d]", path, j), scope)
+		}
+
+		policy := realm.TokenPolicy
+		v.nonNegative(path+".token_policy.token_expiry_seconds", policy.TokenExpirySeconds)
+		v.nonNegative(path+".token_policy.refresh_token_expiry_seconds", policy.RefreshTokenExpirySeconds)
+		v.nonNegative(path+".token_policy.device_code_expiry_seconds", policy.DeviceCodeExpirySeconds)
+		v.nonNegative(path+".token_policy.max_login_attempts", policy.MaxLoginAttempts)
+		v.nonNegative(path+".token_policy.lockout_duration_seconds", policy.LockoutDurationSeconds)
+		v.nonNegative(path+".token_policy.max_client_attempts", policy.MaxClientAttempts)
+		v.nonNegative(path+".token_policy.max_ip_attempts", policy.MaxIPAttempts)
+
+		if c.Storage.StorageDriver() != StorageDriverMemory && realm.Storage.StorageDriver() == StorageDriverMemory {
+			v.add(path+".storage", "realms need their own storage when the server uses the %s driver", c.Storage.StorageDriver())
+		}
+		validateStorage(v, path+".storage", realm.Storage)
+		if dsn := realm.Storage.DSN; dsn != "" {
+			if other, ok := dsns[dsn]; ok {
+				v.add(path+".storage.dsn", "realms must not share a database, dsn is also used by %s", other)
+			}
+			dsns[dsn] = path + ".storage"
+		}
+
+		validateTokenExchange(v, path+".token_exchange", realm.TokenExchange)
+		validateClients(v, path+".clients", realm.Clients, realm.Scopes)
+		validateUsers(v, path+".users", realm.Users, realm.Clients)
+		validateAuthentication(v, path+".authentication", realm.Authentication)
+		validateIdentityProviders(v, path+".identity_providers", realm.IdentityProviders, realm.Authentication)
+		validateMFA(v, path+".mfa", realm.MFA)
+		validateWebAuthn(v, path+".webauthn", realm.WebAuthn)
+	}
+}
+
+// validateScope checks a single scope token (RFC 6749 section 3.3)
+func validateScope(v *validator, path, scope string) {
+	if scope == "" || strings.ContainsAny(scope, " \t\n\"\\") {
+		v.add(path, "invalid scope %q", scope)
+	}
+}
+
+// isValidResponseType accepts "none" or a space separated combination of
+// code, token and id_token without repetitions
+func isValidResponseType(responseType string) bool {
+	if responseType == "none" {
+		return true
+	}
+	values := strings.Fields(responseType)
+	if len(values) == 0 {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if !contains(validResponseTypeValues, value) || seen[value] {
+			return false
+		}
+		seen[value] = true
+	}
+	return true
+}
+
+// redirectURIProblem describes why a redirect URI is unusable (RFC 6749 section 3.1.2)
+func redirectURIProblem(redirectURI string) string {
+	parsed, err := url.Parse(redirectURI)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("invalid redirect URI %q: %v", redirectURI, err)
+	case parsed.Scheme == "":
+		return fmt.Sprintf("redirect URI %q must be absolute", redirectURI)
+	case parsed.Fragment != "":
+		return fmt.Sprintf("redirect URI %q must not contain a fragment", redirectURI)
+	case (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host == "":
+		return fmt.Sprintf("redirect URI %q has no host", redirectURI)
+	}
+	return ""
+}
+
+// isAbsoluteURL reports whether value is an absolute URL with one of the schemes
+func isAbsoluteURL(value string, schemes ...string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && parsed.Host != "" && contains(schemes, parsed.Scheme)
+}
+
+// typeErrorLine matches the messages of yaml.TypeError
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// unknownField matches yaml's known field check messages
+var unknownField = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+
+// decodeProblems converts a yaml.TypeError into problems with paths
+func decodeProblems(root *yaml.Node, err *yaml.TypeError) []Problem {
+	problems := make([]Problem, 0, len(err.Errors))
+	for _, message := range err.Errors {
+		problem := Problem{Message: message}
+		if match := typeErrorLine.FindStringSubmatch(message); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+		}
+		if match := unknownField.FindStringSubmatch(problem.Message); match != nil {
+			problem.Message = fmt.Sprintf("unknown field %q", match[1])
+			problem.Path = keyPath(root, problem.Line, match[1])
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// nodeLine returns the line of the value at path, or of its closest mapping
+// ancestor when a key is missing. Sequence entries that are not in the file
+// (e.g. clients added from the environment) have no line.
+func nodeLine(root *yaml.Node, path string) int {
+	if root == nil {
+		return 0
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, segment := range splitPath(path) {
+		switch {
+		case segment.index >= 0:
+			if node.Kind != yaml.SequenceNode || segment.index >= len(node.Content) {
+				return 0
+			}
+			node = node.Content[segment.index]
+		default:
+			child := mappingValue(node, segment.key)
+			if child == nil {
+				return line
+			}
+			node = child
+		}
+		line = node.Line
+	}
+	return line
+}
+
+// mappingValue returns the value of key in a mapping node
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// pathSegment is a mapping key or, when index >= 0, a sequence index
+type pathSegment struct {
+	key   string
+	index int
+}
+
+// splitPath parses paths like clients[2].grant_types[0]
+func splitPath(path string) []pathSegment {
+	var segments []pathSegment
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		var indexes []int
+		if open := strings.Index(part, "["); open >= 0 {
+			key = part[:open]
+			for _, index := range strings.Split(strings.TrimSuffix(part[open+1:], "]"), "][") {
+				n, err := strconv.Atoi(index)
+				if err != nil {
+					return segments
+				}
+				indexes = append(indexes, n)
+			}
+		}
+		if key != "" {
+			segments = append(segments, pathSegment{key: key, index: -1})
+		}
+		for _, index := range indexes {
+			segments = append(segments, pathSegment{index: index})
+		}
+	}
+	return segments
+}
+
+// keyPath finds the path of the mapping key on the given line
+func keyPath(node *yaml.Node, line int, key string) string {
+	if node == nil {
+		return ""
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if path := keyPath(child, line, key); path != "" {
+				return path
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name, value := node.Content[i], node.Content[i+1]
+			if name.Line == line && name.Value == key {
+				return name.Value
+			}
+			if path := keyPath(value, line, key); path != "" {
+				if strings.HasPrefix(path, "[") {
+					return name.Value + path
+				}
+				return name.Value + "." + path
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if path := keyPath(child, line, key); path != "" {
+				if strings.HasPrefix(path, "[") {
+					return fmt.Sprintf("[%d]%s", i, path)
+				}
+				return fmt.Sprintf("[%d].%s", i, path)
+			}
+		}
+	}
+	return ""
+}
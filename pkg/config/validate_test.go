@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validTestConfig = `server:
+  port: 8080
+  host: localhost
+  base_url: http://localhost:8080
+security:
+  jwt_signing_key: test-secret
+clients:
+  - id: app
+    secret: app-secret
+    grant_types: [client_credentials]
+`
+
+// loadTestConfig loads yaml from a temporary config file
+func loadTestConfig(t *testing.T, yaml string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{}
+	if err := LoadFromFile(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestValidateReportsLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace [2]string
+		want    Problem
+	}{
+		{
+			name:    "unknown key",
+			replace: [2]string{"    secret: app-secret\n", "    secret: app-secret\n    colour: red\n"},
+			want:    Problem{Line: 10, Path: "clients[0].colour", Message: `unknown field "colour"`},
+		},
+		{
+			name:    "wrongly typed field",
+			replace: [2]string{"port: 8080", "port: eighty"},
+			want:    Problem{Line: 2, Message: "cannot unmarshal !!str `eighty` into int"},
+		},
+		{
+			name:    "invalid value",
+			replace: [2]string{"[client_credentials]", "[client_credentials, magic]"},
+			want:    Problem{Line: 10, Path: "clients[0].grant_types[1]"},
+		},
+		{
+			name:    "wildcard origin",
+			replace: [2]string{"    secret: app-secret\n", "    secret: app-secret\n    allowed_origins: [\"*\"]\n"},
+			want:    Problem{Line: 10, Path: "clients[0].allowed_origins[0]", Message: "must be an origin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, strings.Replace(validTestConfig, tt.replace[0], tt.replace[1], 1))
+
+			var validationErr *ValidationError
+			if err := cfg.Validate(); !errors.As(err, &validationErr) {
+				t.Fatalf("Validate = %v, want a validation error", err)
+			}
+			var found bool
+			for _, problem := range validationErr.Problems {
+				if problem.Line == tt.want.Line && problem.Path == tt.want.Path && strings.Contains(problem.Message, tt.want.Message) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("problems = %+v, want %+v", validationErr.Problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+	if err := loadTestConfig(t, validTestConfig).Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var document struct {
+		ID                   string                     `json:"$id"`
+		AdditionalProperties bool                       `json:"additionalProperties"`
+		Properties           map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(schema, &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.ID != SchemaID || document.AdditionalProperties {
+		t.Errorf("schema $id = %q, additionalProperties = %v, want %s and closed", document.ID, document.AdditionalProperties, SchemaID)
+	}
+
+	var clients struct {
+		Items struct {
+			AdditionalProperties bool `json:"additionalProperties"`
+			Properties           struct {
+				GrantTypes struct {
+					Items struct {
+						Enum []string `json:"enum"`
+					} `json:"items"`
+				} `json:"grant_types"`
+			} `json:"properties"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(document.Properties["clients"], &clients); err != nil {
+		t.Fatal(err)
+	}
+	if clients.Items.AdditionalProperties || len(clients.Items.Properties.GrantTypes.Items.Enum) != len(validGrantTypes) {
+		t.Errorf("client schema = %+v, want closed objects with the valid grant types", clients.Items)
+	}
+
+	// The published schema is generated with `config-schema`
+	published, err := os.ReadFile(filepath.Join("..", "..", "config.schema.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(published), bytes.TrimSpace(schema)) {
+		t.Error("config.schema.json is out of date, regenerate it with `go run ./cmd/server config-schema`")
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// WebAuthnConfig enables passkeys (WebAuthn) on the login page, as a
+// passwordless login and as a second factor after the password
+type WebAuthnConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RPID is the relying party ID passkeys are bound to, a registrable domain
+	// suffix of the login page host; defaults to the host of the base URL.
+	// Changing it invalidates every registered passkey.
+	RPID string `yaml:"rp_id"`
+	// RPName is shown by authenticators when registering; defaults to the mfa
+	// issuer or the relying party ID
+	RPName string `yaml:"rp_name"`
+	// Origins the login page is served from; defaults to the origin of the
+	// base URL
+	Origins []string `yaml:"origins"`
+}
+
+func validateWebAuthn(v *validator, prefix string, webauthn WebAuthnConfig) {
+	if webauthn.RPID != "" && (strings.ContainsAny(webauthn.RPID, ":/ ") || strings.HasPrefix(webauthn.RPID, ".")) {
+		v.add(prefix+".rp_id", "must be a domain name without scheme, port or path, got %q", webauthn.RPID)
+	}
+	for i, origin := range webauthn.Origins {
+		path := fmt.Sprintf("%s.origins[%d]", prefix, i)
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			v.add(path, "must be an http or https origin, got %q", origin)
+			continue
+		}
+		if strings.TrimSuffix(parsed.Path, "/") != "" || parsed.RawQuery != "" {
+			v.add(path, "must not have a path or query, got %q", origin)
+		}
+		if webauthn.RPID != "" && parsed.Hostname() != webauthn.RPID && !strings.HasSuffix(parsed.Hostname(), "."+webauthn.RPID) {
+			v.add(path, "host must be %s or one of its subdomains", webauthn.RPID)
+		}
+	}
+}